@@ -0,0 +1,76 @@
+package appybg
+
+import (
+	"fmt"
+	"github.com/robfig/cron/v3"
+	"time"
+	"ybg/internal/pkg/rest"
+)
+
+// missedScheduleSlot возвращает первый запуск по расписанию schedule, прошедший после lastRun.
+// missed = false, если такого запуска не было или время последнего запуска неизвестно.
+func missedScheduleSlot(schedule string, location *time.Location, lastRun time.Time, now time.Time) (time.Time, bool, error) {
+	// Расписание разбирается так же, как в gocron
+	cronSchedule, err := cron.ParseStandard(fmt.Sprintf("CRON_TZ=%s %s", location.String(), schedule))
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("error when parse schedule %s: %w", schedule, err)
+	}
+	if lastRun.IsZero() {
+		return time.Time{}, false, nil
+	}
+
+	slot := cronSchedule.Next(lastRun)
+	if slot.After(now) {
+		return slot, false, nil
+	}
+	return slot, true, nil
+}
+
+// catchUpMissedUpload после старта (и задержки на загрузку HA) запускает задачу загрузки,
+// если запуск по расписанию был пропущен, пока аддон не работал
+func (app *YbgApp) catchUpMissedUpload() {
+	options := app.currentOptions()
+	if !options.CatchUpMissedUpload {
+		app.logger.DebugLog.Printf("Catch-up of missed upload disabled")
+		return
+	}
+	if app.haApi == nil {
+		app.logger.ErrorLog.Printf("Catch-up of missed upload skipped. HaApiClient not created")
+		return
+	}
+
+	delay := time.Duration(options.CatchUpDelayMin) * time.Minute
+	app.logger.InfoLog.Printf("Check missed scheduled upload in %v", delay)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-app.workCtx.Done():
+		return
+	case <-timer.C:
+	}
+
+	rest.CatchUpUploadTask(app.restObj, func() bool {
+		lastRun, err := app.haApi.GetLastUploadTime()
+		if err != nil {
+			app.logger.ErrorLog.Printf("Catch-up of missed upload skipped. %v", err)
+			return false
+		}
+		slot, missed, err := missedScheduleSlot(app.currentOptions().Schedule, schedulerLocation, lastRun, time.Now())
+		if err != nil {
+			app.logger.ErrorLog.Printf("Catch-up of missed upload skipped. %v", err)
+			return false
+		}
+		if lastRun.IsZero() {
+			app.logger.InfoLog.Printf("Last upload time is unknown. Catch-up of missed upload skipped")
+			return false
+		}
+		if !missed {
+			app.logger.InfoLog.Printf("No missed scheduled upload. Last upload %s, next %s",
+				lastRun.Format(time.DateTime), slot.Format(time.DateTime))
+			return false
+		}
+		app.logger.InfoLog.Printf("Scheduled upload at %s was missed (last upload %s). Run catch-up upload",
+			slot.Format(time.DateTime), lastRun.Format(time.DateTime))
+		return true
+	})
+}
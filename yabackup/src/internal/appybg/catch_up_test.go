@@ -0,0 +1,37 @@
+package appybg
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func Test_missedScheduleSlot(t *testing.T) {
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2026, time.October, day, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name     string
+		lastRun  time.Time
+		now      time.Time
+		want     time.Time
+		wantMiss bool
+	}{
+		{"ran today", at(19, 2, 5), at(19, 10, 0), at(20, 2, 1), false},
+		{"offline at 02:01", at(18, 2, 5), at(19, 10, 0), at(19, 2, 1), true},
+		{"offline for days", at(10, 2, 5), at(19, 1, 0), at(11, 2, 1), true},
+		{"before first slot", at(19, 1, 0), at(19, 2, 0), at(19, 2, 1), false},
+		{"never ran", time.Time{}, at(19, 10, 0), time.Time{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			slot, missed, err := missedScheduleSlot("1 2 * * *", time.UTC, tt.lastRun, tt.now)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantMiss, missed)
+			assert.True(t, tt.want.Equal(slot), "slot %v, want %v", slot, tt.want)
+		})
+	}
+
+	_, _, err := missedScheduleSlot("61 2 * * *", time.UTC, at(19, 2, 5), at(19, 10, 0))
+	assert.Error(t, err)
+}
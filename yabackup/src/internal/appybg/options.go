@@ -0,0 +1,369 @@
+package appybg
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/robfig/cron/v3"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"ybg/internal/pkg/bkoperate"
+	"ybg/internal/pkg/haoperate"
+	"ybg/internal/pkg/throttle"
+	"ybg/internal/pkg/yadiskoperate"
+)
+
+// OptionProblem ошибка в настройках аддона. Некорректное значение заменяется значением по умолчанию
+// (или соответствующая функция отключается), аддон продолжает работать
+type OptionProblem struct {
+	Option  string
+	Message string
+}
+
+func (p OptionProblem) String() string {
+	if p.Option == "" {
+		return p.Message
+	}
+	return p.Option + ": " + p.Message
+}
+
+// readOptions читает настройки аддона. Ошибки чтения и разбора не прерывают запуск:
+// отсутствующие и некорректные значения заменяются значениями по умолчанию
+func readOptions(filePath string) (ApplOptions, []OptionProblem) {
+	data := defaultConfig()
+	plan, err := os.ReadFile(filePath)
+	if err != nil {
+		return data, []OptionProblem{{Message: fmt.Sprintf("cannot read options, defaults are used: %v", err)}}
+	}
+	return parseOptions(plan)
+}
+
+func parseOptions(plan []byte) (ApplOptions, []OptionProblem) {
+	data := defaultConfig()
+	problems := make([]OptionProblem, 0)
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(plan, &fields); err != nil {
+		return data, append(problems, OptionProblem{Message: fmt.Sprintf("cannot parse options, defaults are used: %v", err)})
+	}
+
+	known := optionNames()
+	unknown := make([]string, 0)
+	for name, value := range fields {
+		if !known[name] {
+			unknown = append(unknown, name)
+			continue
+		}
+		// Поля разбираются по одному, чтобы ошибка в одном значении не сбрасывала остальные
+		if err := json.Unmarshal([]byte(fmt.Sprintf("{%q:%s}", name, value)), &data); err != nil {
+			problems = append(problems, OptionProblem{Option: name, Message: fmt.Sprintf("wrong value %s, default is used", value)})
+			restoreDefault(&data, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		problems = append(problems, OptionProblem{Option: name, Message: "unknown option is ignored"})
+	}
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].Option < problems[j].Option })
+
+	return data, append(problems, validateOptions(&data)...)
+}
+
+// optionNames имена настроек (теги json полей ApplOptions)
+func optionNames() map[string]bool {
+	result := make(map[string]bool)
+	optionsType := reflect.TypeOf(ApplOptions{})
+	for i := 0; i < optionsType.NumField(); i++ {
+		name, _, _ := strings.Cut(optionsType.Field(i).Tag.Get("json"), ",")
+		result[name] = true
+	}
+	return result
+}
+
+// restoreDefault возвращает настройке с именем name значение по умолчанию
+func restoreDefault(options *ApplOptions, name string) {
+	defaults := reflect.ValueOf(defaultConfig())
+	value := reflect.ValueOf(options).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		tag, _, _ := strings.Cut(value.Type().Field(i).Tag.Get("json"), ",")
+		if tag == name {
+			value.Field(i).Set(defaults.Field(i))
+			return
+		}
+	}
+}
+
+// intOption проверка диапазона целочисленной настройки (max 0 - без ограничения сверху)
+type intOption struct {
+	name         string
+	value        *int
+	defaultValue int
+	min          int
+	max          int
+}
+
+// choiceOption проверка настройки со списком допустимых значений
+type choiceOption struct {
+	name         string
+	value        *string
+	defaultValue string
+	allowed      []string
+}
+
+// validateOptions проверяет значения настроек. Некорректные значения заменяются значениями по умолчанию
+func validateOptions(options *ApplOptions) []OptionProblem {
+	problems := make([]OptionProblem, 0)
+	defaults := defaultConfig()
+	report := func(name string, format string, args ...any) {
+		problems = append(problems, OptionProblem{Option: name, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if strings.TrimSpace(options.ClientId) == "" || strings.TrimSpace(options.ClientSecret) == "" {
+		report("client_id", "client_id and client_secret are required to get Yandex Disk token")
+	}
+
+	switch {
+	case strings.TrimSpace(options.RemotePath) == "":
+		report("remote_path", "remote path is required, for example /backups")
+	case strings.Contains(options.RemotePath, `\`):
+		report("remote_path", "use / as path separator in %q", options.RemotePath)
+	case !strings.HasPrefix(options.RemotePath, "/"):
+		report("remote_path", "path %q must start with /, /%s is used", options.RemotePath, options.RemotePath)
+		options.RemotePath = "/" + options.RemotePath
+	}
+	for _, part := range strings.Split(options.RemotePath, "/") {
+		if part == ".." || part == "." {
+			report("remote_path", "relative path elements are not allowed in %q", options.RemotePath)
+			break
+		}
+	}
+
+	if err := checkSubfolderLayout(options.RemoteSubfolderLayout); err != nil {
+		report("remote_subfolder_layout", "%v. Files are uploaded without sub folders", err)
+		options.RemoteSubfolderLayout = ""
+	}
+
+	if err := checkCron(options.Schedule); err != nil {
+		report("schedule", "%v. Scheduled upload is disabled", err)
+	}
+	if options.VerificationSchedule != "" {
+		if err := checkCron(options.VerificationSchedule); err != nil {
+			report("verification_schedule", "%v. Scheduled verification is disabled", err)
+			options.VerificationSchedule = ""
+		}
+	}
+	if _, err := throttle.ParseWindow(options.UploadWindow); err != nil {
+		report("upload_window", "%v. Upload is allowed at any time", err)
+		options.UploadWindow = ""
+	}
+	if options.RemoteFileNameTemplate != "" {
+		if _, err := bkoperate.ParseFileNameTemplate(options.RemoteFileNameTemplate, ""); err != nil {
+			report("remote_file_name_template", "%v. Default template %s is used", err, defaults.RemoteFileNameTemplate)
+			options.RemoteFileNameTemplate = defaults.RemoteFileNameTemplate
+		}
+	}
+	patterns := []struct {
+		name  string
+		value *string
+	}{
+		{"upload_filter_name_include", &options.UploadFilterNameInclude},
+		{"upload_filter_name_exclude", &options.UploadFilterNameExclude},
+	}
+	for _, pattern := range patterns {
+		if _, err := regexp.Compile(*pattern.value); err != nil {
+			report(pattern.name, "incorrect regular expression %q: %v. The filter is not used", *pattern.value, err)
+			*pattern.value = ""
+		}
+	}
+	if options.UploadFilterCreatedAfter != "" {
+		if _, err := time.Parse(bkoperate.UploadFilterDateLayout, options.UploadFilterCreatedAfter); err != nil {
+			report("upload_filter_created_after", "incorrect date %q, expected format YYYY-MM-DD. The filter is not used",
+				options.UploadFilterCreatedAfter)
+			options.UploadFilterCreatedAfter = ""
+		}
+	}
+
+	ranges := []intOption{
+		{"remote_maximum_files_quantity", &options.RemoteMaximumFilesQuantity, defaults.RemoteMaximumFilesQuantity, 0, 0},
+		{"local_maximum_files_quantity", &options.LocalMaximumFilesQuantity, defaults.LocalMaximumFilesQuantity, 0, 0},
+		{"local_minimum_amount_free_disk_space_mb", &options.LocalMinimumAmountFreeDiskSpaceMb,
+			defaults.LocalMinimumAmountFreeDiskSpaceMb, 0, 0},
+		{"upload_speed_limit_kb", &options.UploadSpeedLimitKb, defaults.UploadSpeedLimitKb, 0, 0},
+		{"download_speed_limit_kb", &options.DownloadSpeedLimitKb, defaults.DownloadSpeedLimitKb, 0, 0},
+		{"upload_concurrency", &options.UploadConcurrency, defaults.UploadConcurrency, 1, 8},
+		{"local_keep_newest_per_type", &options.LocalKeepNewestPerType, defaults.LocalKeepNewestPerType, 0, 0},
+		{"catch_up_delay_min", &options.CatchUpDelayMin, defaults.CatchUpDelayMin, 0, 60},
+		{"remote_backup_max_age_hours", &options.RemoteBackupMaxAgeHours, defaults.RemoteBackupMaxAgeHours, 0, 0},
+		{"local_backup_max_age_hours", &options.LocalBackupMaxAgeHours, defaults.LocalBackupMaxAgeHours, 0, 0},
+		{"remote_minimum_files_quantity", &options.RemoteMinimumFilesQuantity, defaults.RemoteMinimumFilesQuantity, 0, 0},
+		{"log_buffer_size", &options.LogBufferSize, defaults.LogBufferSize, 0, 10000},
+		{"upload_filter_min_size_mb", &options.UploadFilterMinSizeMb, defaults.UploadFilterMinSizeMb, 0, 0},
+		{"upload_filter_max_size_mb", &options.UploadFilterMaxSizeMb, defaults.UploadFilterMaxSizeMb, 0, 0},
+	}
+	for _, option := range ranges {
+		if *option.value >= option.min && (option.max == 0 || *option.value <= option.max) {
+			continue
+		}
+		report(option.name, "value %d is out of range %s, %d is used", *option.value, rangeString(option), option.defaultValue)
+		*option.value = option.defaultValue
+	}
+	if options.UploadFilterMaxSizeMb > 0 && options.UploadFilterMinSizeMb > options.UploadFilterMaxSizeMb {
+		report("upload_filter_min_size_mb", "value %d is greater than upload_filter_max_size_mb %d. The size filter is not used",
+			options.UploadFilterMinSizeMb, options.UploadFilterMaxSizeMb)
+		options.UploadFilterMinSizeMb = 0
+		options.UploadFilterMaxSizeMb = 0
+	}
+
+	choices := []choiceOption{
+		{"log_level", &options.LogLevel, defaults.LogLevel, []string{"DEBUG", "INFO", "WARNING", "ERROR"}},
+		{"theme", &options.Theme, defaults.Theme, []string{"Light", "Dark"}},
+		{"log_format", &options.LogFormat, defaults.LogFormat, []string{logFormatText, logFormatJson}},
+		{"verification_sample", &options.VerificationSample, defaults.VerificationSample,
+			[]string{bkoperate.VerificationSampleNewest, bkoperate.VerificationSampleRandom}},
+		{"upload_filter_type", &options.UploadFilterType, defaults.UploadFilterType,
+			[]string{bkoperate.UploadFilterTypeAll, bkoperate.UploadFilterTypeFull, bkoperate.UploadFilterTypePartial}},
+	}
+	for _, choice := range choices {
+		if contains(choice.allowed, *choice.value) {
+			continue
+		}
+		report(choice.name, "value %q is not one of %s, %q is used",
+			*choice.value, strings.Join(choice.allowed, "|"), choice.defaultValue)
+		*choice.value = choice.defaultValue
+	}
+
+	locations := make([]BackupLocation, 0, len(options.BackupLocations))
+	for _, location := range options.BackupLocations {
+		switch {
+		case strings.TrimSpace(location.Name) == "":
+			report("backup_locations", "backup location name is empty, the location is ignored")
+			continue
+		case location.MaximumFilesQuantity < 0:
+			report("backup_locations", "maximum_files_quantity %d of %q is out of range 0.., 0 is used",
+				location.MaximumFilesQuantity, location.Name)
+			location.MaximumFilesQuantity = 0
+		}
+		locations = append(locations, location)
+	}
+	options.BackupLocations = locations
+
+	return problems
+}
+
+// validateNetworkStorages проверяет, что хранилища enabled_network_storages подключены в supervisor
+func validateNetworkStorages(options ApplOptions, mounts *haoperate.Mounts) []OptionProblem {
+	problems := make([]OptionProblem, 0)
+	if mounts == nil {
+		return problems
+	}
+	names := make(map[string]string, len(mounts.Mounts))
+	for _, mount := range mounts.Mounts {
+		names[mount.Name] = mount.Usage
+	}
+	for _, storage := range options.EnabledNetworkStorages {
+		usage, ok := names[storage.Name]
+		switch {
+		case !ok:
+			problems = append(problems, OptionProblem{Option: "enabled_network_storages",
+				Message: fmt.Sprintf("network storage %q not found in supervisor mounts", storage.Name)})
+		case usage != haoperate.MountUsageBackup:
+			problems = append(problems, OptionProblem{Option: "enabled_network_storages",
+				Message: fmt.Sprintf("network storage %q is used for %s, not for backups", storage.Name, usage)})
+		}
+	}
+	return problems
+}
+
+// validateBackupLocations проверяет, что хранилища backup_locations подключены в supervisor и используются для бэкапов.
+// Неподходящие хранилища исключаются из настроек
+func validateBackupLocations(options *ApplOptions, mounts *haoperate.Mounts) []OptionProblem {
+	problems := make([]OptionProblem, 0)
+	if mounts == nil {
+		return problems
+	}
+	names := make(map[string]string, len(mounts.Mounts))
+	for _, mount := range mounts.Mounts {
+		names[mount.Name] = mount.Usage
+	}
+	locations := make([]BackupLocation, 0, len(options.BackupLocations))
+	for _, location := range options.BackupLocations {
+		usage, ok := names[location.Name]
+		switch {
+		case !ok:
+			problems = append(problems, OptionProblem{Option: "backup_locations",
+				Message: fmt.Sprintf("backup location %q not found in supervisor mounts and is ignored", location.Name)})
+		case usage != haoperate.MountUsageBackup:
+			problems = append(problems, OptionProblem{Option: "backup_locations",
+				Message: fmt.Sprintf("backup location %q is used for %s, not for backups, and is ignored", location.Name, usage)})
+		default:
+			locations = append(locations, location)
+		}
+	}
+	options.BackupLocations = locations
+	return problems
+}
+
+func problemMessages(problems []OptionProblem) []string {
+	result := make([]string, len(problems))
+	for i, problem := range problems {
+		result[i] = problem.String()
+	}
+	return result
+}
+
+// checkSubfolderLayout проверяет шаблон подкаталогов: подкаталоги должны оставаться внутри remote_path,
+// зависеть от времени создания бэкапа и не быть глубже каталогов, которые обходятся при получении списка файлов
+func checkSubfolderLayout(layout string) error {
+	layout = strings.Trim(strings.TrimSpace(layout), "/")
+	if layout == "" {
+		return nil
+	}
+	for _, part := range strings.Split(layout, "/") {
+		if part == ".." || part == "." {
+			return fmt.Errorf("relative path elements are not allowed in %q", layout)
+		}
+	}
+
+	// Даты отличаются во всех элементах, поэтому шаблон без элементов времени даёт одинаковый каталог
+	first := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC).Format(layout)
+	second := time.Date(2012, 11, 22, 16, 45, 56, 0, time.UTC).Format(layout)
+	if first == second {
+		return fmt.Errorf("layout %q has no time elements, all files are uploaded to one folder", layout)
+	}
+
+	if depth := len(strings.Split(path.Clean(first), "/")); depth > yadiskoperate.RemoteListMaxDepth {
+		return fmt.Errorf("layout %q has %d folder levels, maximum is %d", layout, depth, yadiskoperate.RemoteListMaxDepth)
+	}
+	return nil
+}
+
+func checkCron(schedule string) error {
+	if strings.TrimSpace(schedule) == "" {
+		return fmt.Errorf("schedule is empty")
+	}
+	// Расписание разбирается так же, как в gocron
+	if _, err := cron.ParseStandard(schedule); err != nil {
+		return fmt.Errorf("wrong cron expression %q: %v", schedule, err)
+	}
+	return nil
+}
+
+func rangeString(option intOption) string {
+	if option.max == 0 {
+		return fmt.Sprintf("%d..", option.min)
+	}
+	return fmt.Sprintf("%d..%d", option.min, option.max)
+}
+
+func contains(values []string, value string) bool {
+	for _, element := range values {
+		if element == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,174 @@
+package appybg
+
+import (
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"sort"
+	"testing"
+	"ybg/internal/pkg/haoperate"
+)
+
+const validOptions = `{
+  "client_id": "id",
+  "client_secret": "secret",
+  "remote_path": "/backups",
+  "remote_maximum_files_quantity": 5,
+  "schedule": "0 3 * * *",
+  "log_level": "INFO",
+  "theme": "Dark",
+  "enabled_network_storages": [{"name": "nas"}],
+  "upload_from_network_storage": true,
+  "upload_concurrency": 2
+}`
+
+func Test_parseOptions(t *testing.T) {
+	options, problems := parseOptions([]byte(validOptions))
+	assert.Empty(t, problems)
+	assert.Equal(t, "/backups", options.RemotePath)
+	assert.Equal(t, "Dark", options.Theme)
+	assert.Equal(t, 2, options.UploadConcurrency)
+	assert.Equal(t, 1024, options.LocalMinimumAmountFreeDiskSpaceMb)
+
+	options, problems = parseOptions([]byte(`{
+  "client_id": "id",
+  "client_secret": "secret",
+  "remote_path": "backups",
+  "remote_maximum_files_quantity": -1,
+  "schedule": "0 3 * *",
+  "log_level": "TRACE",
+  "upload_concurrency": "two",
+  "catch_up_delay_min": 100,
+  "verification_schedule": "bad",
+  "upload_window": "25:00-07:00",
+  "unknown_option": true
+}`))
+	assert.Equal(t, []string{
+		"catch_up_delay_min: value 100 is out of range 0..60, 5 is used",
+		"log_level: value \"TRACE\" is not one of DEBUG|INFO|WARNING|ERROR, \"INFO\" is used",
+		"remote_maximum_files_quantity: value -1 is out of range 0.., 0 is used",
+		"remote_path: path \"backups\" must start with /, /backups is used",
+		"schedule: wrong cron expression \"0 3 * *\": expected exactly 5 fields, found 4: [0 3 * *]. Scheduled upload is disabled",
+		"unknown_option: unknown option is ignored",
+		"upload_concurrency: wrong value \"two\", default is used",
+		"upload_window: incorrect time window \"25:00-07:00\": incorrect time \"25:00\". Upload is allowed at any time",
+		"verification_schedule: wrong cron expression \"bad\": expected exactly 5 fields, found 1: [bad]. Scheduled verification is disabled",
+	}, sortedMessages(problems))
+	assert.Equal(t, "/backups", options.RemotePath)
+	assert.Equal(t, 1, options.UploadConcurrency)
+	assert.Equal(t, 5, options.CatchUpDelayMin)
+	assert.Equal(t, "INFO", options.LogLevel)
+	assert.Equal(t, "", options.VerificationSchedule)
+	assert.Equal(t, "", options.UploadWindow)
+
+	options, problems = parseOptions([]byte(`not json`))
+	assert.Len(t, problems, 1)
+	assert.Equal(t, defaultConfig(), options)
+}
+
+func Test_readOptions(t *testing.T) {
+	options, problems := readOptions(filepath.Join(t.TempDir(), "options.json"))
+	assert.Len(t, problems, 1)
+	assert.Contains(t, problems[0].String(), "cannot read options")
+	assert.Equal(t, defaultConfig(), options)
+}
+
+func Test_validateNetworkStorages(t *testing.T) {
+	options, _ := parseOptions([]byte(validOptions))
+	options.EnabledNetworkStorages = append(options.EnabledNetworkStorages, EnabledNetworkStorage{Name: "media"})
+
+	problems := validateNetworkStorages(options, &haoperate.Mounts{Mounts: []haoperate.Mount{
+		{Name: "nas", Usage: haoperate.MountUsageBackup},
+		{Name: "media", Usage: haoperate.MountUsageMedia},
+	}})
+	assert.Equal(t, []string{`enabled_network_storages: network storage "media" is used for media, not for backups`},
+		problemMessages(problems))
+
+	problems = validateNetworkStorages(options, &haoperate.Mounts{})
+	assert.Len(t, problems, 2)
+
+	assert.Empty(t, validateNetworkStorages(options, nil))
+}
+
+func sortedMessages(problems []OptionProblem) []string {
+	messages := problemMessages(problems)
+	sort.Strings(messages)
+	return messages
+}
+
+func Test_keepRestartOptions(t *testing.T) {
+	old, _ := parseOptions([]byte(validOptions))
+	options := old
+	options.ClientSecret = "other"
+	options.UploadSpeedLimitKb = 100
+	options.Schedule = "0 4 * * *"
+	options.EnabledNetworkStorages = nil
+
+	problems := keepRestartOptions(old, &options)
+	assert.Equal(t, []string{
+		"client_secret: changed, restart the addon to apply",
+		"upload_speed_limit_kb: changed, restart the addon to apply",
+	}, problemMessages(problems))
+	assert.Equal(t, "secret", options.ClientSecret)
+	assert.Equal(t, 0, options.UploadSpeedLimitKb)
+	assert.Equal(t, "0 4 * * *", options.Schedule)
+	assert.Nil(t, options.EnabledNetworkStorages)
+}
+
+func Test_validateBackupLocations(t *testing.T) {
+	options, problems := parseOptions([]byte(`{"client_id": "id", "client_secret": "secret", "remote_path": "/b",
+"schedule": "0 3 * * *", "backup_locations": [{"name": "nas", "maximum_files_quantity": -1}, {"name": "media"},
+{"name": " "}, {"name": "absent", "maximum_files_quantity": 2}]}`))
+	assert.Equal(t, []string{
+		`backup_locations: maximum_files_quantity -1 of "nas" is out of range 0.., 0 is used`,
+		"backup_locations: backup location name is empty, the location is ignored",
+	}, problemMessages(problems))
+	assert.Len(t, options.BackupLocations, 3)
+
+	problems = validateBackupLocations(&options, &haoperate.Mounts{Mounts: []haoperate.Mount{
+		{Name: "nas", Usage: haoperate.MountUsageBackup},
+		{Name: "media", Usage: haoperate.MountUsageMedia},
+	}})
+	assert.Len(t, problems, 2)
+	assert.Equal(t, []BackupLocation{{Name: "nas"}}, options.BackupLocations)
+}
+
+func Test_validateUploadFilter(t *testing.T) {
+	_, problems := parseOptions([]byte(`{"client_id": "id", "client_secret": "secret", "remote_path": "/b",
+"schedule": "0 3 * * *", "upload_filter_name_include": "(", "upload_filter_type": "any",
+"upload_filter_created_after": "01.10.2026", "upload_filter_min_size_mb": 100, "upload_filter_max_size_mb": 10}`))
+	assert.Equal(t, []string{
+		`upload_filter_created_after: incorrect date "01.10.2026", expected format YYYY-MM-DD. The filter is not used`,
+		"upload_filter_min_size_mb: value 100 is greater than upload_filter_max_size_mb 10. The size filter is not used",
+		"upload_filter_name_include: incorrect regular expression \"(\": error parsing regexp: missing closing ): `(`. The filter is not used",
+		`upload_filter_type: value "any" is not one of all|full|partial, "all" is used`,
+	}, sortedMessages(problems))
+}
+
+func Test_validateSubfolderLayout(t *testing.T) {
+	tests := []struct {
+		name    string
+		layout  string
+		wantErr string
+	}{
+		{"empty", "", ""},
+		{"year and month", "/2006/01/", ""},
+		{"three levels", "2006/01/02", ""},
+		{"too deep", "2006/01/02/15", `layout "2006/01/02/15" has 4 folder levels, maximum is 3`},
+		{"parent folder", "../2006", `relative path elements are not allowed in "../2006"`},
+		{"no time elements", "archive/daily", `layout "archive/daily" has no time elements, all files are uploaded to one folder`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options, problems := parseOptions([]byte(`{"client_id": "id", "client_secret": "secret", "remote_path": "/b",
+"schedule": "0 3 * * *", "remote_subfolder_layout": "` + tt.layout + `"}`))
+			if tt.wantErr == "" {
+				assert.Empty(t, problems)
+				assert.Equal(t, tt.layout, options.RemoteSubfolderLayout)
+				return
+			}
+			assert.Equal(t, []string{"remote_subfolder_layout: " + tt.wantErr + ". Files are uploaded without sub folders"},
+				problemMessages(problems))
+			assert.Equal(t, "", options.RemoteSubfolderLayout)
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package appybg
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"time"
+	"ybg/internal/pkg/haoperate"
+	"ybg/internal/pkg/mylogger"
+)
+
+// optionsWatchInterval период проверки изменения файла настроек
+const optionsWatchInterval = 30 * time.Second
+
+// restartOptions настройки, которые применяются только при запуске аддона
+var restartOptions = []string{
+	"client_id",
+	"client_secret",
+	"remote_path",
+	"entity_id",
+	"log_format",
+	"log_buffer_size",
+	"upload_speed_limit_kb",
+	"download_speed_limit_kb",
+	"upload_window",
+}
+
+// optionsStamp время изменения и размер файла настроек
+type optionsStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func statOptions(filePath string) optionsStamp {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return optionsStamp{}
+	}
+	return optionsStamp{modTime: info.ModTime(), size: info.Size()}
+}
+
+// currentOptions действующие настройки аддона
+func (app *YbgApp) currentOptions() ApplOptions {
+	app.optionsMu.RLock()
+	defer app.optionsMu.RUnlock()
+	return app.options
+}
+
+// watchOptions перечитывает настройки при изменении файла (supervisor перезаписывает его при сохранении настроек)
+func (app *YbgApp) watchOptions(filePath string) {
+	ticker := time.NewTicker(optionsWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-app.workCtx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		stamp := statOptions(filePath)
+		app.reloadMu.Lock()
+		changed := stamp != optionsStamp{} && stamp != app.optionsStamp
+		app.reloadMu.Unlock()
+		if changed {
+			app.logger.InfoLog.Printf("Options file %s changed", filePath)
+			app.ReloadOptions()
+		}
+	}
+}
+
+// ReloadOptions перечитывает настройки аддона и применяет их без перезапуска.
+// Выполняющиеся загрузка и проверка не прерываются, новые значения действуют для следующих шагов и запусков.
+// Возвращает список проблем в настройках
+func (app *YbgApp) ReloadOptions() []string {
+	app.reloadMu.Lock()
+	defer app.reloadMu.Unlock()
+
+	app.optionsStamp = statOptions(FILE_PATH_OPTIONS)
+	options, optionProblems := readOptions(FILE_PATH_OPTIONS)
+	optionProblems = append(optionProblems, checkMounts(&options, app.haApi, app.logger)...)
+
+	old := app.currentOptions()
+	optionProblems = append(optionProblems, keepRestartOptions(old, &options)...)
+	for _, problem := range optionProblems {
+		app.logger.ErrorLog.Printf("Incorrect option %s", problem)
+	}
+
+	app.logger.SetLevel(mylogger.ParseLevel(options.LogLevel))
+	app.logger.AddSecret(options.BackupPassword)
+	app.bkProcessor.UpdateSettings(bkSettings(options,
+		createFileNameTemplate(options.RemoteFileNameTemplate, app.haApi, app.logger),
+		createUploadFilter(options, app.logger)))
+	app.restObj.UpdateSettings(options.Theme, options.EnableCreateBackupBeforeUpload,
+		options.LocalMinimumAmountFreeDiskSpaceMb)
+	messages := problemMessages(optionProblems)
+	app.restObj.SetOptionProblems(messages)
+
+	app.optionsMu.Lock()
+	app.options = options
+	app.optionsMu.Unlock()
+
+	if options.Schedule != old.Schedule {
+		app.scheduleUpload(options.Schedule)
+	}
+	if options.VerificationSchedule != old.VerificationSchedule {
+		app.scheduleVerification(options.VerificationSchedule)
+	}
+	app.logger.InfoLog.Printf("Options reloaded. Log level %s", mylogger.LevelName(mylogger.ParseLevel(options.LogLevel)))
+	return messages
+}
+
+// keepRestartOptions оставляет прежние значения настроек, которые применяются только при запуске
+func keepRestartOptions(old ApplOptions, options *ApplOptions) []OptionProblem {
+	problems := make([]OptionProblem, 0)
+	oldValue := reflect.ValueOf(old)
+	value := reflect.ValueOf(options).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		name, _, _ := strings.Cut(value.Type().Field(i).Tag.Get("json"), ",")
+		if !contains(restartOptions, name) || reflect.DeepEqual(value.Field(i).Interface(), oldValue.Field(i).Interface()) {
+			continue
+		}
+		value.Field(i).Set(oldValue.Field(i))
+		problems = append(problems, OptionProblem{Option: name, Message: "changed, restart the addon to apply"})
+	}
+	return problems
+}
+
+// checkMounts проверяет enabled_network_storages и backup_locations по списку хранилищ supervisor
+func checkMounts(options *ApplOptions, haApi *haoperate.HaApiClient, logger *mylogger.Logger) []OptionProblem {
+	if haApi == nil || (len(options.EnabledNetworkStorages) == 0 && len(options.BackupLocations) == 0) {
+		return nil
+	}
+	mounts, err := haApi.GetMounts()
+	if err != nil {
+		logger.ErrorLog.Printf("Network storages are not checked. %v", err)
+	}
+	return append(validateNetworkStorages(*options, mounts), validateBackupLocations(options, mounts)...)
+}
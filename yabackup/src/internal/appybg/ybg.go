@@ -2,19 +2,25 @@ package appybg
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/go-co-op/gocron/v2"
+	"github.com/google/uuid"
 	"log"
-	"net/http"
 	"os"
+	"sync"
 	"time"
 	"ybg/internal/pkg/bkoperate"
 	"ybg/internal/pkg/haoperate"
+	"ybg/internal/pkg/metrics"
 	"ybg/internal/pkg/mylogger"
 	om "ybg/internal/pkg/operationmanager"
 	"ybg/internal/pkg/rest"
+	"ybg/internal/pkg/retry"
+	"ybg/internal/pkg/runcoordinator"
+	"ybg/internal/pkg/throttle"
 	"ybg/internal/pkg/yadiskoperate"
+	"ybg/internal/types"
 )
 
 const FILE_PATH_OPTIONS = "/data/options.json"
@@ -22,20 +28,51 @@ const restoreStateEntityInterval time.Duration = 1800
 const restoreStateEntitySchedule = "*/30 * * * * *"
 const clearTaskSchedule = "0 0 */6 * * *"
 const updateStatisticSchedule = "0 0 */6 * * *"
+const freshnessWatchdogSchedule = "0 15 * * * *"
 const operationHourDelta = 6
+
+// Формат лога (log_format)
+const (
+	logFormatText = "text"
+	logFormatJson = "json"
+)
+
+// metricsPort порт сервера метрик Prometheus (пробрасывается наружу в настройках сети аддона)
+const metricsPort = "9099"
+
+var schedulerLocation = time.UTC
+
 const oldTemporaryFileDayDelta = 6
 
+// Остановка аддона. Supervisor ждёт остановки не дольше timeout из config.yaml
+const (
+	httpShutdownTimeout  = 5 * time.Second
+	shutdownGracePeriod  = 60 * time.Second
+	shutdownAbortTimeout = 20 * time.Second
+)
+
+// Контексты приложения: ctx используется клиентами API supervisor и ЯндексДиска и отменяется последним,
+// workCtx (производный от ctx) - операциями загрузки, скачивания и ожидания и отменяется,
+// если операции не успели завершиться за shutdownGracePeriod.
 type YbgApp struct {
-	ctx              context.Context
-	cancel           context.CancelFunc
-	options          ApplOptions
-	restObj          *rest.Rest
-	haApi            *haoperate.HaApiClient
-	operationManager *om.OperationManager
-	bkProcessor      *bkoperate.BkProcessor
-	logger           *mylogger.Logger
-	scheduleLogLevel gocron.LogLevel
-	scheduler        gocron.Scheduler
+	ctx               context.Context
+	cancel            context.CancelFunc
+	workCtx           context.Context
+	cancelWork        context.CancelFunc
+	coordinator       *runcoordinator.Coordinator
+	options           ApplOptions
+	restObj           *rest.Rest
+	haApi             *haoperate.HaApiClient
+	operationManager  *om.OperationManager
+	bkProcessor       *bkoperate.BkProcessor
+	metricsExporter   *metrics.Exporter
+	logger            *mylogger.Logger
+	scheduler         gocron.Scheduler
+	uploadJobId       uuid.UUID
+	verificationJobId uuid.UUID
+	optionsMu         sync.RWMutex
+	reloadMu          sync.Mutex
+	optionsStamp      optionsStamp
 }
 
 type ApplOptions struct {
@@ -52,122 +89,132 @@ type ApplOptions struct {
 	LocalMaximumFilesQuantity         int                     `json:"local_maximum_files_quantity"`
 	EnableCreateBackupBeforeUpload    bool                    `json:"enable_create_backup_before_upload"`
 	LocalMinimumAmountFreeDiskSpaceMb int                     `json:"local_minimum_amount_free_disk_space_mb" default:"1024"`
+	RemoteSubfolderLayout             string                  `json:"remote_subfolder_layout"`
+	RemoteFileNameTemplate            string                  `json:"remote_file_name_template" default:"{name}_{slug}{ext}"`
+	UploadSpeedLimitKb                int                     `json:"upload_speed_limit_kb"`
+	DownloadSpeedLimitKb              int                     `json:"download_speed_limit_kb"`
+	UploadWindow                      string                  `json:"upload_window"`
+	UploadConcurrency                 int                     `json:"upload_concurrency" default:"1"`
+	LocalRotationIncludeAllBackups    bool                    `json:"local_rotation_include_all_backups"`
+	LocalKeepNewestPerType            int                     `json:"local_keep_newest_per_type"`
+	CatchUpMissedUpload               bool                    `json:"catch_up_missed_upload" default:"true"`
+	CatchUpDelayMin                   int                     `json:"catch_up_delay_min" default:"5"`
+	RemoteBackupMaxAgeHours           int                     `json:"remote_backup_max_age_hours" default:"48"`
+	LocalBackupMaxAgeHours            int                     `json:"local_backup_max_age_hours"`
+	RemoteFreeSpaceCheck              bool                    `json:"remote_free_space_check" default:"true"`
+	RemoteFreeSpaceRotate             bool                    `json:"remote_free_space_rotate"`
+	RemoteMinimumFilesQuantity        int                     `json:"remote_minimum_files_quantity" default:"1"`
+	LogFormat                         string                  `json:"log_format" default:"text"`
+	LogBufferSize                     int                     `json:"log_buffer_size" default:"1000"`
+	VerificationSchedule              string                  `json:"verification_schedule"`
+	VerificationSample                string                  `json:"verification_sample" default:"newest"`
+	BackupPassword                    string                  `json:"backup_password"`
+	BackupLocations                   []BackupLocation        `json:"backup_locations"`
+	UploadFilterNameInclude           string                  `json:"upload_filter_name_include"`
+	UploadFilterNameExclude           string                  `json:"upload_filter_name_exclude"`
+	UploadFilterType                  string                  `json:"upload_filter_type" default:"all"`
+	UploadFilterCreatedAfter          string                  `json:"upload_filter_created_after"`
+	UploadFilterMinSizeMb             int                     `json:"upload_filter_min_size_mb"`
+	UploadFilterMaxSizeMb             int                     `json:"upload_filter_max_size_mb"`
+	UploadFilterProtectedOnly         bool                    `json:"upload_filter_protected_only"`
 }
 
 type EnabledNetworkStorage struct {
 	Name string `json:"name"`
 }
 
+// BackupLocation сетевое хранилище supervisor, в которое копируются локальные бэкапы
+type BackupLocation struct {
+	Name                 string `json:"name"`
+	MaximumFilesQuantity int    `json:"maximum_files_quantity"`
+}
+
 func NewYbg(port string) *YbgApp {
 	ctx, cancel := context.WithCancel(context.Background())
+	workCtx, cancelWork := context.WithCancel(ctx)
 
-	logFormat := log.Ldate | log.Ltime | log.Lshortfile
+	options, optionProblems := readOptions(FILE_PATH_OPTIONS)
 
-	debugLog := log.New(mylogger.NewNullWriter(), "DEBUG\t", logFormat)
-	infoLog := log.New(mylogger.NewNullWriter(), "INFO\t", logFormat)
-	errorLog := log.New(os.Stderr, "ERROR\t", logFormat)
-	isDebudDisable := true
-
-	scheduleLogLevel := gocron.LogLevelWarn
-
-	// Test log messages
-
-	options, err := readOptions()
+	// Инициализируем новую структуру с зависимостями приложения.
+	logger := mylogger.NewStructured(mylogger.Options{
+		Level:      mylogger.ParseLevel(options.LogLevel),
+		JSON:       options.LogFormat == logFormatJson,
+		Output:     os.Stdout,
+		BufferSize: options.LogBufferSize,
+	})
+	logger.AddSecret(options.ClientSecret, options.BackupPassword)
+	logger.InfoLog.Printf("Log level %s", mylogger.LevelName(mylogger.ParseLevel(options.LogLevel)))
+
+	operationManager := om.New(workCtx, logger)
+
+	haApi, err := createHaApiClient(ctx, logger, options.EntityId)
 	if err != nil {
-		panic(fmt.Sprintf("Can not read Options: %v", err))
-	}
-
-	if options.LogLevel == "DEBUG" {
-		debugLog = log.New(os.Stdout, "DEBUG\t", logFormat)
-		infoLog = log.New(os.Stdout, "INFO\t", logFormat)
-		scheduleLogLevel = gocron.LogLevelDebug
-		isDebudDisable = false
-
-	}
-	if options.LogLevel == "INFO" {
-		infoLog = log.New(os.Stdout, "INFO\t", logFormat)
-		scheduleLogLevel = gocron.LogLevelInfo
+		logger.ErrorLog.Printf("Error create HaApiClient %v", err)
+		//panic(fmt.Sprintf("error create HaApiClient %v", err))
 	}
 
-	debugLog.Println("hello")
-	infoLog.Println("hello")
-	errorLog.Println("hello")
-
-	// Инициализируем новую структуру с зависимостями приложения.
-	logger := mylogger.New(errorLog, infoLog, debugLog)
-	if isDebudDisable {
-		logger.DisableDebug()
+	optionProblems = append(optionProblems, checkMounts(&options, haApi, logger)...)
+	for _, problem := range optionProblems {
+		logger.ErrorLog.Printf("Incorrect option %s", problem)
 	}
 
-	operationManager := om.New(ctx, logger)
-
-	haApi, err := createHaApiClient(logger, options.EntityId)
+	uploadWindow, err := throttle.ParseWindow(options.UploadWindow)
 	if err != nil {
-		logger.ErrorLog.Printf("Error create HaApiClient %v", err)
-		//panic(fmt.Sprintf("error create HaApiClient %v", err))
+		logger.ErrorLog.Printf("Incorrect upload_window. Upload is allowed at any time. %v", err)
 	}
 
-	yaDP := yadiskoperate.NewYaDProcessor(options.ClientId, options.ClientSecret, options.RemotePath, operationManager, logger)
-
-	enabledNetworkStorages := make([]string, len(options.EnabledNetworkStorages))
+	yaDP := yadiskoperate.NewYaDProcessor(ctx, options.ClientId, options.ClientSecret, options.RemotePath,
+		throttle.NewLimiter(int64(options.UploadSpeedLimitKb)*1024),
+		throttle.NewLimiter(int64(options.DownloadSpeedLimitKb)*1024),
+		uploadWindow,
+		operationManager, logger)
 
-	for i, element := range options.EnabledNetworkStorages {
-		enabledNetworkStorages[i] = element.Name
-	}
+	fileNameTemplate := createFileNameTemplate(options.RemoteFileNameTemplate, haApi, logger)
 
-	bkP := bkoperate.NewBkProcessor(ctx, yaDP, haApi, operationManager, options.RemoteMaximumFilesQuantity,
-		options.EnableUploadFromNetworkStorage, enabledNetworkStorages, options.LocalMaximumFilesQuantity,
-		logger)
+	bkP := bkoperate.NewBkProcessor(workCtx, yaDP, haApi, operationManager,
+		bkSettings(options, fileNameTemplate, createUploadFilter(options, logger)), logger)
 
 	yaDP.EnsureTokenInfo()
 	yaDP.RefreshTokenIsNeed()
 	yaDP.EnsureYandexDisk()
 
 	// Создаем рест
-	restObj, err := rest.NewRest(port, yaDP, bkP, haApi, options.Theme, operationManager,
-		options.EnableCreateBackupBeforeUpload, options.LocalMinimumAmountFreeDiskSpaceMb, logger)
+	coordinator := runcoordinator.New(logger)
+	metricsExporter := metrics.NewExporter(operationManager, bkP, yaDP, logger)
+	restObj, err := rest.NewRest(workCtx, port, yaDP, bkP, haApi, options.Theme, operationManager, coordinator,
+		options.EnableCreateBackupBeforeUpload, options.LocalMinimumAmountFreeDiskSpaceMb,
+		metricsExporter, metricsPort, logger)
 	if err != nil {
 		logger.ErrorLog.Printf("Error create Rest %v", err)
 		panic(fmt.Sprintf("error create Rest %v", err))
 	}
+	restObj.SetOptionProblems(problemMessages(optionProblems))
 
 	return &YbgApp{
 		ctx:              ctx,
 		cancel:           cancel,
+		workCtx:          workCtx,
+		cancelWork:       cancelWork,
+		coordinator:      coordinator,
 		options:          options,
-		scheduleLogLevel: scheduleLogLevel,
+		optionsStamp:     statOptions(FILE_PATH_OPTIONS),
 		logger:           logger,
 		restObj:          restObj,
 		haApi:            haApi,
 		bkProcessor:      bkP,
+		metricsExporter:  metricsExporter,
 		operationManager: operationManager}
 }
 
 func (app *YbgApp) Start() {
 
-	scheduler, err := gocron.NewScheduler(gocron.WithLocation(time.UTC),
-		gocron.WithLogger(
-			gocron.NewLogger(app.scheduleLogLevel),
-		))
+	scheduler, err := gocron.NewScheduler(gocron.WithLocation(schedulerLocation),
+		gocron.WithLogger(app.logger.Slog()))
 	app.scheduler = scheduler
+	app.restObj.SetOptionsReloader(app.ReloadOptions)
 
 	// Upload backup task
-
-	_, err = app.scheduler.NewJob(
-		gocron.CronJob(
-			// standard cron tab parsing
-			app.options.Schedule,
-			false,
-		),
-		gocron.NewTask(
-			func() { rest.UploadTask(app.restObj) },
-		),
-	)
-
-	if err != nil {
-		app.logger.ErrorLog.Printf("Error when create upload task job. %v", err)
-	}
-	app.logger.InfoLog.Printf("Add upload job for to %s schedule", app.options.Schedule)
+	app.scheduleUpload(app.currentOptions().Schedule)
 
 	// Restore HA entitystate task
 	_, err = app.scheduler.NewJob(
@@ -177,13 +224,16 @@ func (app *YbgApp) Start() {
 			true,
 		),
 		gocron.NewTask(
-			func() {
+			func() error {
 				_, err := app.haApi.EnsureEntityState()
 				if err != nil {
 					app.logger.ErrorLog.Printf("Error when restore entity state. %v", err)
 				}
+				return err
 			},
 		),
+		gocron.WithName("restore_entity_state"),
+		app.jobListeners(),
 	)
 
 	if err != nil {
@@ -199,17 +249,21 @@ func (app *YbgApp) Start() {
 			true,
 		),
 		gocron.NewTask(
-			func() {
+			func() error {
 				err := app.operationManager.ClearOperations(operationHourDelta)
 				if err != nil {
 					app.logger.ErrorLog.Printf("Error when clear operation. %v", err)
 				}
-				err = app.haApi.DeleteOldTemporaryFiles(oldTemporaryFileDayDelta)
-				if err != nil {
-					app.logger.ErrorLog.Printf("Error when delete old temporary files %s", err)
+				app.metricsExporter.ClearFinished(operationHourDelta)
+				errFiles := app.haApi.DeleteOldTemporaryFiles(oldTemporaryFileDayDelta)
+				if errFiles != nil {
+					app.logger.ErrorLog.Printf("Error when delete old temporary files %s", errFiles)
 				}
+				return errors.Join(err, errFiles)
 			},
 		),
+		gocron.WithName("clear_temporary_data"),
+		app.jobListeners(),
 	)
 
 	if err != nil {
@@ -225,13 +279,16 @@ func (app *YbgApp) Start() {
 			true,
 		),
 		gocron.NewTask(
-			func() {
+			func() error {
 				err := app.bkProcessor.EnsureStatistic()
 				if err != nil {
 					app.logger.ErrorLog.Printf("Error when ensure statistic. %v", err)
 				}
+				return err
 			},
 		),
+		gocron.WithName("update_statistic"),
+		app.jobListeners(),
 	)
 
 	if err != nil {
@@ -239,11 +296,40 @@ func (app *YbgApp) Start() {
 	}
 	app.logger.InfoLog.Printf("Add ensure statistic job for to %s schedule (cron with seconds!!!)", updateStatisticSchedule)
 
+	// Freshness watchdog task
+	_, err = app.scheduler.NewJob(
+		gocron.CronJob(
+			// standard cron tab parsing
+			freshnessWatchdogSchedule,
+			true,
+		),
+		gocron.NewTask(
+			func() { app.bkProcessor.RunFreshnessWatchdog() },
+		),
+		gocron.WithSingletonMode(gocron.LimitModeReschedule),
+		gocron.WithName("freshness_watchdog"),
+		app.jobListeners(),
+	)
+
+	if err != nil {
+		app.logger.ErrorLog.Printf("Error when create freshness watchdog job. %v", err)
+	}
+	app.logger.InfoLog.Printf("Add freshness watchdog job for to %s schedule (cron with seconds!!!)", freshnessWatchdogSchedule)
+
+	// Backup verification task
+	app.scheduleVerification(app.currentOptions().VerificationSchedule)
+
+	go app.metricsExporter.Run(app.workCtx)
+
 	// Запуск планировщика в отдельной горутине
 	go func() {
 		app.scheduler.Start()
 	}()
 
+	go app.catchUpMissedUpload()
+
+	go app.watchOptions(FILE_PATH_OPTIONS)
+
 	// Запуск восстановления EntityState
 	restoreEntityTask := func() bool {
 		_, err := app.haApi.EnsureEntityState()
@@ -257,6 +343,7 @@ func (app *YbgApp) Start() {
 	await(restoreEntityTask, app.logger, restoreStateEntityInterval)
 
 	go app.updateStatistic()
+	go app.bkProcessor.RunFreshnessWatchdog()
 
 	list, err := app.haApi.GetAddonList()
 	if err != nil {
@@ -266,11 +353,40 @@ func (app *YbgApp) Start() {
 	}
 
 	err = app.restObj.Start()
-	log.Fatal(err)
+	if err != nil {
+		log.Fatal(err)
+	}
 }
 
+// Stop останавливает аддон: WEB-сервер, новые запуски и планировщик.
+// Выполняющейся загрузке даётся shutdownGracePeriod на завершение, после чего она прерывается
+// (недозагруженные файлы удаляются, состояние сохраняется в сущности).
 func (app *YbgApp) Stop() {
-	app.cancel()
+	app.logger.InfoLog.Printf("Stopping addon")
+
+	httpCtx, httpCancel := context.WithTimeout(app.ctx, httpShutdownTimeout)
+	if err := app.restObj.Shutdown(httpCtx); err != nil {
+		app.logger.ErrorLog.Printf("Error when stop WEB-server: %v", err)
+	}
+	httpCancel()
+
+	graceCtx, graceCancel := context.WithTimeout(app.ctx, shutdownGracePeriod)
+	err := app.coordinator.Shutdown(graceCtx)
+	graceCancel()
+	if err != nil {
+		if current, ok := app.coordinator.Current(); ok {
+			app.logger.ErrorLog.Printf("Run %s not finished in %v. Abort it", current, shutdownGracePeriod)
+		}
+		app.cancelWork()
+
+		abortCtx, abortCancel := context.WithTimeout(app.ctx, shutdownAbortTimeout)
+		err = app.coordinator.Shutdown(abortCtx)
+		abortCancel()
+		if err != nil {
+			app.logger.ErrorLog.Printf("Run not stopped in %v after abort", shutdownAbortTimeout)
+		}
+	}
+	app.cancelWork()
 
 	if app.scheduler != nil {
 		// Shutdown вернет ошибку, если что-то пошло не так — лучше её залогировать
@@ -279,6 +395,87 @@ func (app *YbgApp) Stop() {
 		}
 	}
 
+	app.cancel()
+	app.logger.InfoLog.Printf("Addon stopped")
+}
+
+// scheduleUpload (пере)создаёт задание загрузки по расписанию schedule.
+// Выполняющаяся загрузка при этом не прерывается
+func (app *YbgApp) scheduleUpload(schedule string) {
+	app.removeJob(&app.uploadJobId)
+
+	job, err := app.scheduler.NewJob(
+		gocron.CronJob(
+			// standard cron tab parsing
+			schedule,
+			false,
+		),
+		gocron.NewTask(
+			func() { rest.ScheduledUploadTask(app.restObj) },
+		),
+		// Следующий запуск по расписанию не ставится в очередь, пока не завершился предыдущий
+		gocron.WithSingletonMode(gocron.LimitModeReschedule),
+		gocron.WithName("upload"),
+		app.jobListeners(),
+	)
+
+	if err != nil {
+		app.logger.ErrorLog.Printf("Error when create upload task job. %v", err)
+		return
+	}
+	app.uploadJobId = job.ID()
+	app.logger.InfoLog.Printf("Add upload job for to %s schedule", schedule)
+}
+
+// scheduleVerification (пере)создаёт задание проверки архивов. Пустое расписание - проверка по расписанию отключена
+func (app *YbgApp) scheduleVerification(schedule string) {
+	app.removeJob(&app.verificationJobId)
+	if schedule == "" {
+		return
+	}
+
+	job, err := app.scheduler.NewJob(
+		gocron.CronJob(
+			// standard cron tab parsing
+			schedule,
+			false,
+		),
+		gocron.NewTask(
+			func() error { return rest.ScheduledVerificationTask(app.restObj) },
+		),
+		gocron.WithSingletonMode(gocron.LimitModeReschedule),
+		gocron.WithName("verify_backup"),
+		app.jobListeners(),
+	)
+
+	if err != nil {
+		app.logger.ErrorLog.Printf("Error when create verification job. %v", err)
+		return
+	}
+	app.verificationJobId = job.ID()
+	app.logger.InfoLog.Printf("Add verification job for to %s schedule", schedule)
+}
+
+func (app *YbgApp) removeJob(jobId *uuid.UUID) {
+	if *jobId == uuid.Nil {
+		return
+	}
+	if err := app.scheduler.RemoveJob(*jobId); err != nil {
+		app.logger.ErrorLog.Printf("Error when remove job %s. %v", *jobId, err)
+	}
+	*jobId = uuid.Nil
+}
+
+// jobListeners учитывает результаты заданий планировщика в метриках
+func (app *YbgApp) jobListeners() gocron.JobOption {
+	return gocron.WithEventListeners(
+		gocron.AfterJobRuns(func(_ uuid.UUID, jobName string) {
+			app.metricsExporter.ObserveJob(jobName, nil)
+		}),
+		gocron.AfterJobRunsWithError(func(_ uuid.UUID, jobName string, err error) {
+			app.metricsExporter.ObserveJob(jobName, err)
+		}),
+	)
 }
 
 func (app *YbgApp) updateStatistic() {
@@ -311,32 +508,116 @@ func await(task func() bool,
 	}()
 }
 
-func readOptions() (ApplOptions, error) {
-	plan, _ := os.ReadFile(FILE_PATH_OPTIONS)
-	data := defaultConfig()
-	err := json.Unmarshal(plan, &data)
-	return data, err
-}
-
 func defaultConfig() ApplOptions {
 	return ApplOptions{
+		LogLevel:                          "INFO",
 		EntityId:                          "yandex_backup_state",
 		Theme:                             "Light",
 		EnableCreateBackupBeforeUpload:    false,
 		LocalMaximumFilesQuantity:         5,
 		LocalMinimumAmountFreeDiskSpaceMb: 1024,
+		RemoteFileNameTemplate:            bkoperate.DefaultFileNameTemplate,
+		UploadConcurrency:                 1,
+		CatchUpMissedUpload:               true,
+		CatchUpDelayMin:                   5,
+		RemoteBackupMaxAgeHours:           48,
+		RemoteFreeSpaceCheck:              true,
+		RemoteMinimumFilesQuantity:        1,
+		LogFormat:                         logFormatText,
+		LogBufferSize:                     1000,
+		VerificationSample:                bkoperate.VerificationSampleNewest,
+		UploadFilterType:                  bkoperate.UploadFilterTypeAll,
+	}
+}
+
+// bkSettings настройки BkProcessor из настроек аддона
+func bkSettings(options ApplOptions, fileNameTemplate *bkoperate.FileNameTemplate,
+	uploadFilter *bkoperate.UploadFilter) bkoperate.Settings {
+	enabledNetworkStorages := make([]string, len(options.EnabledNetworkStorages))
+	for i, element := range options.EnabledNetworkStorages {
+		enabledNetworkStorages[i] = element.Name
+	}
+	backupLocations := make([]bkoperate.BackupLocation, len(options.BackupLocations))
+	for i, element := range options.BackupLocations {
+		backupLocations[i] = bkoperate.BackupLocation{Name: element.Name, MaxFiles: element.MaximumFilesQuantity}
+	}
+
+	return bkoperate.Settings{
+		RemoteMaximumFilesQuantity:     options.RemoteMaximumFilesQuantity,
+		EnableUploadFromNetworkStorage: options.EnableUploadFromNetworkStorage,
+		EnabledNetworkStorages:         enabledNetworkStorages,
+		LocalRetention: bkoperate.LocalRetention{
+			MaxFiles:          options.LocalMaximumFilesQuantity,
+			IncludeAllBackups: options.LocalRotationIncludeAllBackups,
+			MinimumFreeSpace:  types.MiBToFileSize(float64(options.LocalMinimumAmountFreeDiskSpaceMb)),
+			KeepPerType:       options.LocalKeepNewestPerType,
+		},
+		RemoteSubfolderLayout: options.RemoteSubfolderLayout,
+		FileNameTemplate:      fileNameTemplate,
+		UploadConcurrency:     options.UploadConcurrency,
+		FreshnessPolicy: bkoperate.FreshnessPolicy{
+			RemoteMaxAge: time.Duration(options.RemoteBackupMaxAgeHours) * time.Hour,
+			LocalMaxAge:  time.Duration(options.LocalBackupMaxAgeHours) * time.Hour,
+		},
+		RemoteSpacePolicy: bkoperate.RemoteSpacePolicy{
+			Check:                options.RemoteFreeSpaceCheck,
+			RotateToFit:          options.RemoteFreeSpaceRotate,
+			MinimumFilesQuantity: options.RemoteMinimumFilesQuantity,
+		},
+		VerificationSample: options.VerificationSample,
+		BackupPassword:     options.BackupPassword,
+		BackupLocations:    backupLocations,
+		UploadFilter:       uploadFilter,
+	}
+}
+
+// createUploadFilter фильтр загрузки из настроек. При ошибке (настройки уже проверены) бэкапы не фильтруются
+func createUploadFilter(options ApplOptions, logger *mylogger.Logger) *bkoperate.UploadFilter {
+	uploadFilter, err := bkoperate.NewUploadFilter(options.UploadFilterNameInclude, options.UploadFilterNameExclude,
+		options.UploadFilterType, options.UploadFilterCreatedAfter,
+		options.UploadFilterMinSizeMb, options.UploadFilterMaxSizeMb, options.UploadFilterProtectedOnly)
+	if err != nil {
+		logger.ErrorLog.Printf("Incorrect upload filter. All backups are uploaded. %v", err)
+		return nil
+	}
+	logger.InfoLog.Printf("Upload filter: %s", uploadFilter)
+	return uploadFilter
+}
+
+func createFileNameTemplate(template string, haApi *haoperate.HaApiClient, logger *mylogger.Logger) *bkoperate.FileNameTemplate {
+	host := ""
+	if haApi != nil {
+		hostInfo, err := haApi.GetHostInformation()
+		if err != nil {
+			logger.ErrorLog.Printf("Error get host name for file name template %v", err)
+		} else if hostInfo != nil {
+			host = hostInfo.Hostname
+		}
+	}
+
+	if template == "" {
+		template = bkoperate.DefaultFileNameTemplate
+	}
+
+	fileNameTemplate, err := bkoperate.ParseFileNameTemplate(template, host)
+	if err != nil {
+		logger.ErrorLog.Printf("Incorrect remote_file_name_template. Default template %s is used. %v", bkoperate.DefaultFileNameTemplate, err)
+		fileNameTemplate, _ = bkoperate.ParseFileNameTemplate(bkoperate.DefaultFileNameTemplate, host)
 	}
+	logger.InfoLog.Printf("Remote file name template: %s", fileNameTemplate)
+	return fileNameTemplate
 }
 
-func createHaApiClient(logger *mylogger.Logger, entity_id string) (*haoperate.HaApiClient, error) {
+func createHaApiClient(ctx context.Context, logger *mylogger.Logger, entity_id string) (*haoperate.HaApiClient, error) {
 
 	supervisorToken := os.Getenv("SUPERVISOR_TOKEN")
 	if supervisorToken == "" {
 		logger.ErrorLog.Println("Supervisor token not found")
 		return nil, fmt.Errorf("supervisor token not found")
 	}
+	logger.AddSecret(supervisorToken)
 
-	api, err := haoperate.NewHaApi(entity_id, context.Background(), http.DefaultClient, supervisorToken, logger)
+	api, err := haoperate.NewHaApi(entity_id, ctx, retry.NewHTTPClient(), supervisorToken, logger)
 	if err != nil {
 		logger.ErrorLog.Printf("Error when create ha_api client: %v", err)
 		return nil, fmt.Errorf("error when create ha_api client: %v", err)
@@ -0,0 +1,376 @@
+package backuparchive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Пакет читает архивы бэкапов HA потоком: внешний tar, в нём backup.json и вложенные архивы
+// дополнений и каталогов (*.tar.gz или *.tar, у защищённых паролем бэкапов - зашифрованные SecureTar).
+// На диск ничего не распаковывается.
+
+// Format формат архива с извлечёнными файлами
+type Format string
+
+const (
+	FormatZip Format = "zip"
+	FormatTar Format = "tar"
+)
+
+var ErrEncrypted = errors.New("archive is encrypted, backup password is not set")
+var ErrNotFound = errors.New("nothing found in backup for selection")
+
+// Entry элемент бэкапа. Archive - имя вложенного архива (homeassistant.tar.gz и т.п.), пусто - внешний архив
+type Entry struct {
+	Archive  string    `json:"archive,omitempty"`
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	IsDir    bool      `json:"is_dir,omitempty"`
+	Modified time.Time `json:"modified"`
+}
+
+// Listing содержимое бэкапа. Skipped - вложенные архивы, которые не удалось прочитать, с причиной
+type Listing struct {
+	Entries []Entry           `json:"entries"`
+	Skipped map[string]string `json:"skipped,omitempty"`
+}
+
+// Selection что извлечь: файл или каталог Path во вложенном архиве Archive
+// (Archive пусто - элемент внешнего архива, Path пусто - весь вложенный архив)
+type Selection struct {
+	Archive string
+	Path    string
+}
+
+func (s Selection) matches(entryPath string) bool {
+	selected := cleanPath(s.Path)
+	return selected == "" || entryPath == selected || strings.HasPrefix(entryPath, selected+"/")
+}
+
+// List перечисляет элементы бэкапа и всех вложенных архивов
+func List(source io.Reader, password string) (Listing, error) {
+	result := Listing{Entries: make([]Entry, 0), Skipped: make(map[string]string)}
+
+	err := walk(source, func(header *tar.Header, content io.Reader) (bool, error) {
+		name := cleanPath(header.Name)
+		result.Entries = append(result.Entries, newEntry("", name, header))
+		if !isInnerArchive(name) {
+			return true, nil
+		}
+
+		err := walkInner(content, password, func(innerHeader *tar.Header, _ io.Reader) error {
+			result.Entries = append(result.Entries, newEntry(name, cleanPath(innerHeader.Name), innerHeader))
+			return nil
+		})
+		if err != nil {
+			result.Skipped[name] = err.Error()
+		}
+		return true, nil
+	})
+	if len(result.Skipped) == 0 {
+		result.Skipped = nil
+	}
+	return result, err
+}
+
+// Extract записывает в out архив (zip или tar) с выбранными файлами. Возвращает количество файлов.
+// Чтение источника прекращается сразу после обработки нужного вложенного архива
+func Extract(source io.Reader, password string, selection Selection, format Format, out io.Writer) (int, error) {
+	writer, err := newArchiveWriter(format, out)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	selectedArchive := cleanPath(selection.Archive)
+	err = walk(source, func(header *tar.Header, content io.Reader) (bool, error) {
+		name := cleanPath(header.Name)
+		if selectedArchive == "" {
+			if !selection.matches(name) {
+				return true, nil
+			}
+			count++
+			return true, writer.add(name, header, content)
+		}
+
+		if name != selectedArchive {
+			return true, nil
+		}
+		err := walkInner(content, password, func(innerHeader *tar.Header, innerContent io.Reader) error {
+			innerName := cleanPath(innerHeader.Name)
+			if innerName == "" || !selection.matches(innerName) {
+				return nil
+			}
+			if innerHeader.Typeflag == tar.TypeReg {
+				count++
+			}
+			return writer.add(innerName, innerHeader, innerContent)
+		})
+		return false, err
+	})
+	if err != nil {
+		return count, err
+	}
+	if count == 0 {
+		return 0, ErrNotFound
+	}
+	return count, writer.Close()
+}
+
+// walk обходит внешний tar. visit возвращает false, чтобы прекратить чтение
+func walk(source io.Reader, visit func(header *tar.Header, content io.Reader) (bool, error)) error {
+	tarReader := tar.NewReader(source)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("cannot read backup archive: %w", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		next, err := visit(header, tarReader)
+		if err != nil || !next {
+			return err
+		}
+	}
+}
+
+// walkInner обходит вложенный архив, при необходимости расшифровывая и распаковывая его
+func walkInner(source io.Reader, password string, visit func(header *tar.Header, content io.Reader) error) error {
+	data, encrypted, err := openInner(source, password)
+	if err != nil {
+		return err
+	}
+
+	tarReader := tar.NewReader(data)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if encrypted {
+				return fmt.Errorf("%w: %v", ErrPassword, err)
+			}
+			return err
+		}
+		if cleanPath(header.Name) == "" {
+			continue
+		}
+		if err := visit(header, tarReader); err != nil {
+			return err
+		}
+	}
+}
+
+// CheckInnerArchive читает вложенный архив до конца, при необходимости расшифровывая его.
+// gzip при этом проверяет контрольную сумму сжатых данных
+func CheckInnerArchive(source io.Reader, password string) error {
+	data, _, err := openInner(source, password)
+	if err != nil {
+		return err
+	}
+
+	tarReader := tar.NewReader(data)
+	for {
+		_, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(io.Discard, tarReader); err != nil {
+			return err
+		}
+	}
+	_, err = io.Copy(io.Discard, data)
+	return err
+}
+
+// openInner определяет формат вложенного архива по первым байтам: gzip, tar или зашифрованный SecureTar
+func openInner(source io.Reader, password string) (io.Reader, bool, error) {
+	buffered := bufio.NewReaderSize(source, 512)
+	if isPlain(buffered) {
+		data, err := decompress(buffered)
+		return data, false, err
+	}
+	if password == "" {
+		return nil, true, ErrEncrypted
+	}
+
+	decrypted, err := newSecureTarReader(buffered, password)
+	if err != nil {
+		return nil, true, err
+	}
+	bufferedDecrypted := bufio.NewReaderSize(decrypted, 512)
+	if !isPlain(bufferedDecrypted) {
+		return nil, true, ErrPassword
+	}
+	data, err := decompress(bufferedDecrypted)
+	return data, true, err
+}
+
+func isPlain(reader *bufio.Reader) bool {
+	magic, _ := reader.Peek(2)
+	if isGzip(magic) {
+		return true
+	}
+	header, _ := reader.Peek(512)
+	return isTarHeader(header)
+}
+
+func decompress(reader *bufio.Reader) (io.Reader, error) {
+	magic, _ := reader.Peek(2)
+	if !isGzip(magic) {
+		return reader, nil
+	}
+	return gzip.NewReader(reader)
+}
+
+func isGzip(magic []byte) bool {
+	return len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b
+}
+
+// isTarHeader проверяет контрольную сумму заголовка tar
+func isTarHeader(block []byte) bool {
+	if len(block) < 512 {
+		return false
+	}
+	stored, err := strconv.ParseInt(strings.Trim(string(block[148:156]), " \x00"), 8, 64)
+	if err != nil {
+		return false
+	}
+	var sum int64
+	for i, b := range block[:512] {
+		if i >= 148 && i < 156 {
+			b = ' '
+		}
+		sum += int64(b)
+	}
+	return sum == stored
+}
+
+func isInnerArchive(name string) bool {
+	return strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tar")
+}
+
+func cleanPath(name string) string {
+	name = path.Clean("/" + strings.TrimSpace(name))
+	return strings.TrimPrefix(name, "/")
+}
+
+func newEntry(archive string, name string, header *tar.Header) Entry {
+	return Entry{
+		Archive:  archive,
+		Path:     name,
+		Size:     header.Size,
+		IsDir:    header.Typeflag == tar.TypeDir,
+		Modified: header.ModTime,
+	}
+}
+
+// archiveWriter пишет извлечённые файлы в zip или tar
+type archiveWriter interface {
+	add(name string, header *tar.Header, content io.Reader) error
+	Close() error
+}
+
+func newArchiveWriter(format Format, out io.Writer) (archiveWriter, error) {
+	switch format {
+	case FormatZip, "":
+		return &zipWriter{writer: zip.NewWriter(out)}, nil
+	case FormatTar:
+		return &tarWriter{writer: tar.NewWriter(out)}, nil
+	}
+	return nil, fmt.Errorf("unknown archive format %q", format)
+}
+
+type zipWriter struct {
+	writer *zip.Writer
+}
+
+func (w *zipWriter) add(name string, header *tar.Header, content io.Reader) error {
+	switch header.Typeflag {
+	case tar.TypeDir:
+		_, err := w.writer.CreateHeader(&zip.FileHeader{Name: name + "/", Modified: header.ModTime})
+		return err
+	case tar.TypeReg:
+		fileHeader := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: header.ModTime}
+		fileHeader.SetMode(header.FileInfo().Mode())
+		file, err := w.writer.CreateHeader(fileHeader)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(file, content)
+		return err
+	}
+	// Ссылки и специальные файлы в zip не переносятся
+	return nil
+}
+
+func (w *zipWriter) Close() error {
+	return w.writer.Close()
+}
+
+type tarWriter struct {
+	writer *tar.Writer
+}
+
+func (w *tarWriter) add(name string, header *tar.Header, content io.Reader) error {
+	copied := *header
+	copied.Name = name
+	if header.Typeflag == tar.TypeDir {
+		copied.Name += "/"
+	}
+	if err := w.writer.WriteHeader(&copied); err != nil {
+		return err
+	}
+	if header.Typeflag == tar.TypeReg {
+		_, err := io.Copy(w.writer, content)
+		return err
+	}
+	return nil
+}
+
+func (w *tarWriter) Close() error {
+	return w.writer.Close()
+}
+
+// ArchiveName имя файла для скачивания: backup_homeassistant_data.zip
+func ArchiveName(backupName string, selection Selection, format Format) string {
+	if format == "" {
+		format = FormatZip
+	}
+	parts := []string{strings.TrimSuffix(path.Base(backupName), ".tar")}
+	for _, part := range []string{selection.Archive, selection.Path} {
+		part = strings.TrimSuffix(strings.TrimSuffix(cleanPath(part), ".gz"), ".tar")
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	name := strings.Join(parts, "_")
+	var builder bytes.Buffer
+	for _, r := range name {
+		switch {
+		case r == '/' || r == '\\' || r == '"' || r < ' ':
+			builder.WriteRune('_')
+		default:
+			builder.WriteRune(r)
+		}
+	}
+	return builder.String() + "." + string(format)
+}
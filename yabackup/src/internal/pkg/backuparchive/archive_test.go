@@ -0,0 +1,187 @@
+package backuparchive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+)
+
+const testPassword = "secret-password"
+
+func writeEntry(t *testing.T, writer *tar.Writer, name string, data []byte) {
+	assert.NoError(t, writer.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg}))
+	_, err := writer.Write(data)
+	assert.NoError(t, err)
+}
+
+func innerArchive(t *testing.T) []byte {
+	var buffer bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buffer)
+	writer := tar.NewWriter(gzipWriter)
+	assert.NoError(t, writer.WriteHeader(&tar.Header{Name: "./", Mode: 0755, Typeflag: tar.TypeDir}))
+	assert.NoError(t, writer.WriteHeader(&tar.Header{Name: "data/", Mode: 0755, Typeflag: tar.TypeDir}))
+	writeEntry(t, writer, "data/configuration.yaml", []byte("homeassistant:\n"))
+	writeEntry(t, writer, "data/.storage/core.config", []byte(`{"data":{}}`))
+	writeEntry(t, writer, "data/secrets.yaml", []byte("key: value\n"))
+	assert.NoError(t, writer.Close())
+	assert.NoError(t, gzipWriter.Close())
+	return buffer.Bytes()
+}
+
+// encryptSecureTar шифрует данные так же, как supervisor (SecureTar с заголовком)
+func encryptSecureTar(t *testing.T, data []byte, password string) []byte {
+	salt := []byte("0123456789abcdef")
+	key := passwordToKey(password)
+	block, err := aes.NewCipher(key)
+	assert.NoError(t, err)
+
+	padding := aes.BlockSize - len(data)%aes.BlockSize
+	plain := append(append([]byte{}, data...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	encrypted := make([]byte, len(plain))
+	cipher.NewCBCEncrypter(block, generateIv(key, salt)).CryptBlocks(encrypted, plain)
+
+	result := append([]byte{}, secureTarMagic...)
+	result = append(result, make([]byte, secureTarHeaderSize)...)
+	result = append(result, salt...)
+	return append(result, encrypted...)
+}
+
+func backupArchive(t *testing.T, inner []byte) []byte {
+	var buffer bytes.Buffer
+	writer := tar.NewWriter(&buffer)
+	writeEntry(t, writer, "./homeassistant.tar.gz", inner)
+	writeEntry(t, writer, "./backup.json", []byte(`{"slug":"abc123","name":"Full"}`))
+	assert.NoError(t, writer.Close())
+	return buffer.Bytes()
+}
+
+func entryPaths(listing Listing, archive string) []string {
+	result := make([]string, 0)
+	for _, entry := range listing.Entries {
+		if entry.Archive == archive {
+			result = append(result, entry.Path)
+		}
+	}
+	return result
+}
+
+func Test_List(t *testing.T) {
+	inner := innerArchive(t)
+	innerPaths := []string{"data", "data/configuration.yaml", "data/.storage/core.config", "data/secrets.yaml"}
+
+	listing, err := List(bytes.NewReader(backupArchive(t, inner)), "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"homeassistant.tar.gz", "backup.json"}, entryPaths(listing, ""))
+	assert.Equal(t, innerPaths, entryPaths(listing, "homeassistant.tar.gz"))
+	assert.Nil(t, listing.Skipped)
+
+	encrypted := backupArchive(t, encryptSecureTar(t, inner, testPassword))
+
+	listing, err = List(bytes.NewReader(encrypted), testPassword)
+	assert.NoError(t, err)
+	assert.Equal(t, innerPaths, entryPaths(listing, "homeassistant.tar.gz"))
+
+	listing, err = List(bytes.NewReader(encrypted), "")
+	assert.NoError(t, err)
+	assert.Empty(t, entryPaths(listing, "homeassistant.tar.gz"))
+	assert.Equal(t, ErrEncrypted.Error(), listing.Skipped["homeassistant.tar.gz"])
+
+	listing, err = List(bytes.NewReader(encrypted), "wrong-password")
+	assert.NoError(t, err)
+	assert.Contains(t, listing.Skipped["homeassistant.tar.gz"], ErrPassword.Error())
+}
+
+func Test_CheckInnerArchive(t *testing.T) {
+	inner := innerArchive(t)
+	assert.NoError(t, CheckInnerArchive(bytes.NewReader(inner), ""))
+
+	damaged := append([]byte{}, inner...)
+	damaged[len(damaged)-6] ^= 0xff // контрольная сумма gzip
+	assert.Error(t, CheckInnerArchive(bytes.NewReader(damaged), ""))
+
+	encrypted := encryptSecureTar(t, inner, testPassword)
+	assert.NoError(t, CheckInnerArchive(bytes.NewReader(encrypted), testPassword))
+	assert.ErrorIs(t, CheckInnerArchive(bytes.NewReader(encrypted), ""), ErrEncrypted)
+	assert.ErrorIs(t, CheckInnerArchive(bytes.NewReader(encrypted), "wrong-password"), ErrPassword)
+}
+
+func Test_ExtractZip(t *testing.T) {
+	archive := backupArchive(t, encryptSecureTar(t, innerArchive(t), testPassword))
+
+	var out bytes.Buffer
+	count, err := Extract(bytes.NewReader(archive), testPassword,
+		Selection{Archive: "homeassistant.tar.gz", Path: "data/.storage"}, FormatZip, &out)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	reader, err := zip.NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	assert.NoError(t, err)
+	assert.Len(t, reader.File, 1)
+	assert.Equal(t, "data/.storage/core.config", reader.File[0].Name)
+	file, err := reader.File[0].Open()
+	assert.NoError(t, err)
+	content, _ := io.ReadAll(file)
+	assert.Equal(t, `{"data":{}}`, string(content))
+}
+
+func Test_ExtractTar(t *testing.T) {
+	archive := backupArchive(t, innerArchive(t))
+
+	var out bytes.Buffer
+	count, err := Extract(bytes.NewReader(archive), "",
+		Selection{Archive: "./homeassistant.tar.gz", Path: "data/configuration.yaml"}, FormatTar, &out)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	reader := tar.NewReader(&out)
+	header, err := reader.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, "data/configuration.yaml", header.Name)
+
+	out.Reset()
+	count, err = Extract(bytes.NewReader(archive), "", Selection{Path: "backup.json"}, FormatTar, &out)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	_, err = Extract(bytes.NewReader(archive), "", Selection{Archive: "homeassistant.tar.gz", Path: "missing"}, FormatZip, io.Discard)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	_, err = Extract(bytes.NewReader(archive), "", Selection{Path: "backup.json"}, "rar", io.Discard)
+	assert.Error(t, err)
+}
+
+func Test_ArchiveName(t *testing.T) {
+	assert.Equal(t, "Full_abc.zip",
+		ArchiveName("Full_abc.tar", Selection{}, ""))
+	assert.Equal(t, "Full_abc_homeassistant_data_configuration.yaml.tar",
+		ArchiveName("dir/Full_abc.tar", Selection{Archive: "homeassistant.tar.gz", Path: "data/configuration.yaml"}, FormatTar))
+}
+
+func Test_Summarize(t *testing.T) {
+	inner := innerArchive(t)
+	archive := backupArchive(t, encryptSecureTar(t, inner, testPassword))
+
+	summary, err := Summarize(bytes.NewReader(archive), testPassword, "homeassistant.tar.gz")
+	assert.NoError(t, err)
+	assert.Equal(t, `{"slug":"abc123","name":"Full"}`, string(summary.BackupInfo))
+	assert.Equal(t, map[string]int64{"homeassistant.tar.gz": int64(len(encryptSecureTar(t, inner, testPassword)))}, summary.Archives)
+	assert.Len(t, summary.Files, 3)
+	assert.Equal(t, int64(len("key: value\n")), summary.Files["data/secrets.yaml"].Size)
+	assert.Nil(t, summary.Skipped)
+
+	summary, err = Summarize(bytes.NewReader(archive), "", "homeassistant.tar.gz")
+	assert.NoError(t, err)
+	assert.Nil(t, summary.Files)
+	assert.Equal(t, ErrEncrypted.Error(), summary.Skipped["homeassistant.tar.gz"])
+
+	summary, err = Summarize(bytes.NewReader(archive), "", "")
+	assert.NoError(t, err)
+	assert.Nil(t, summary.Files)
+	assert.Nil(t, summary.Skipped)
+}
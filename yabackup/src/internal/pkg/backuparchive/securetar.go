@@ -0,0 +1,141 @@
+package backuparchive
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Формат SecureTar (шифрование вложенных архивов защищённых паролем бэкапов HA):
+// [заголовок: магическая строка 16 байт + размер 16 байт] + соль 16 байт + данные AES-128-CBC с дополнением PKCS7.
+// Ключ и вектор инициализации получаются многократным хэшированием пароля (как в supervisor).
+const (
+	secureTarBlockSize  = aes.BlockSize
+	secureTarHeaderSize = 16
+	secureTarRounds     = 100
+)
+
+var secureTarMagic = []byte("SecureTar\x02\x00\x00\x00\x00\x00\x00")
+
+var ErrPassword = errors.New("wrong backup password or damaged encrypted archive")
+
+// passwordToKey ключ AES из пароля бэкапа
+func passwordToKey(password string) []byte {
+	key := []byte(password)
+	for i := 0; i < secureTarRounds; i++ {
+		sum := sha256.Sum256(key)
+		key = sum[:]
+	}
+	return key[:secureTarBlockSize]
+}
+
+func generateIv(key []byte, salt []byte) []byte {
+	iv := append(append([]byte{}, key...), salt...)
+	for i := 0; i < secureTarRounds; i++ {
+		sum := sha256.Sum256(iv)
+		iv = sum[:]
+	}
+	return iv[:secureTarBlockSize]
+}
+
+// secureTarReader расшифровывает поток SecureTar. Последний блок придерживается до конца потока,
+// чтобы снять дополнение PKCS7
+type secureTarReader struct {
+	source  io.Reader
+	mode    cipher.BlockMode
+	pending []byte // расшифрованные данные, готовые к выдаче
+	last    []byte // последний расшифрованный блок
+	buffer  []byte
+	eof     bool
+}
+
+// newSecureTarReader читает заголовок SecureTar и возвращает поток расшифрованных данных
+func newSecureTarReader(source io.Reader, password string) (io.Reader, error) {
+	salt := make([]byte, secureTarBlockSize)
+	if _, err := io.ReadFull(source, salt); err != nil {
+		return nil, fmt.Errorf("cannot read SecureTar header: %w", err)
+	}
+	if bytes.Equal(salt, secureTarMagic) {
+		// Заголовок с размером данных, соль идёт после него
+		if _, err := io.ReadFull(source, make([]byte, secureTarHeaderSize)); err != nil {
+			return nil, fmt.Errorf("cannot read SecureTar header: %w", err)
+		}
+		if _, err := io.ReadFull(source, salt); err != nil {
+			return nil, fmt.Errorf("cannot read SecureTar header: %w", err)
+		}
+	}
+
+	key := passwordToKey(password)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &secureTarReader{
+		source: source,
+		mode:   cipher.NewCBCDecrypter(block, generateIv(key, salt)),
+		buffer: make([]byte, 64*secureTarBlockSize),
+	}, nil
+}
+
+func (r *secureTarReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+		if err := r.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func (r *secureTarReader) fill() error {
+	n, err := io.ReadFull(r.source, r.buffer)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		r.eof = true
+	} else if err != nil {
+		return err
+	}
+	if n%secureTarBlockSize != 0 {
+		return fmt.Errorf("encrypted data size is not a multiple of block size: %w", ErrPassword)
+	}
+
+	decrypted := make([]byte, 0, len(r.last)+n)
+	decrypted = append(decrypted, r.last...)
+	if n > 0 {
+		chunk := make([]byte, n)
+		r.mode.CryptBlocks(chunk, r.buffer[:n])
+		decrypted = append(decrypted, chunk...)
+	}
+
+	if !r.eof {
+		if len(decrypted) < secureTarBlockSize {
+			r.last = decrypted
+			return nil
+		}
+		split := len(decrypted) - secureTarBlockSize
+		r.pending, r.last = decrypted[:split], decrypted[split:]
+		return nil
+	}
+
+	if len(decrypted) == 0 {
+		return fmt.Errorf("empty encrypted data: %w", ErrPassword)
+	}
+	padding := int(decrypted[len(decrypted)-1])
+	if padding == 0 || padding > secureTarBlockSize || padding > len(decrypted) {
+		return ErrPassword
+	}
+	for _, b := range decrypted[len(decrypted)-padding:] {
+		if int(b) != padding {
+			return ErrPassword
+		}
+	}
+	r.pending, r.last = decrypted[:len(decrypted)-padding], nil
+	return nil
+}
@@ -0,0 +1,78 @@
+package backuparchive
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+)
+
+// BackupInfoFileName описание бэкапа во внешнем архиве
+const BackupInfoFileName = "backup.json"
+
+// FileDigest размер и контрольная сумма файла вложенного архива
+type FileDigest struct {
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+// Summary сводка бэкапа для сравнения: backup.json, размеры вложенных архивов
+// и (если запрошено) контрольные суммы файлов одного вложенного архива
+type Summary struct {
+	BackupInfo []byte
+	Archives   map[string]int64
+	Files      map[string]FileDigest
+	Skipped    map[string]string
+}
+
+// Summarize читает бэкап целиком. filesOf - вложенный архив, для файлов которого считаются контрольные суммы
+// (пусто - не считать). Если вложенный архив прочитать не удалось, причина сохраняется в Skipped
+func Summarize(source io.Reader, password string, filesOf string) (Summary, error) {
+	result := Summary{Archives: make(map[string]int64), Skipped: make(map[string]string)}
+	filesOf = cleanPath(filesOf)
+
+	err := walk(source, func(header *tar.Header, content io.Reader) (bool, error) {
+		name := cleanPath(header.Name)
+		switch {
+		case name == BackupInfoFileName:
+			data, err := io.ReadAll(content)
+			if err != nil {
+				return false, err
+			}
+			result.BackupInfo = data
+		case isInnerArchive(name):
+			result.Archives[name] = header.Size
+			if filesOf == "" || name != filesOf {
+				return true, nil
+			}
+			files, err := digestFiles(content, password)
+			if err != nil {
+				result.Skipped[name] = err.Error()
+				return true, nil
+			}
+			result.Files = files
+		}
+		return true, nil
+	})
+	if len(result.Skipped) == 0 {
+		result.Skipped = nil
+	}
+	return result, err
+}
+
+func digestFiles(content io.Reader, password string) (map[string]FileDigest, error) {
+	files := make(map[string]FileDigest)
+	err := walkInner(content, password, func(header *tar.Header, fileContent io.Reader) error {
+		if header.Typeflag != tar.TypeReg {
+			return nil
+		}
+		hash := sha256.New()
+		size, err := io.Copy(hash, fileContent)
+		if err != nil {
+			return err
+		}
+		files[cleanPath(header.Name)] = FileDigest{Size: size, Sha256: hex.EncodeToString(hash.Sum(nil))}
+		return nil
+	})
+	return files, err
+}
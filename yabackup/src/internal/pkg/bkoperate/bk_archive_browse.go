@@ -0,0 +1,70 @@
+package bkoperate
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"ybg/internal/pkg/backuparchive"
+)
+
+// BackupSource бэкап для просмотра: файл на ЯндексДиске или бэкап HA (локальный или в сетевом хранилище) по slug
+type BackupSource struct {
+	RemoteFileName string
+	Slug           string
+}
+
+func (s BackupSource) String() string {
+	if s.Slug != "" {
+		return "HA backup " + s.Slug
+	}
+	return "remote file " + s.RemoteFileName
+}
+
+// openBackup открывает бэкап для чтения потоком. Бэкапы HA читаются через supervisor
+func (bkp *BkProcessor) openBackup(ctx context.Context, source BackupSource) (io.ReadCloser, error) {
+	switch {
+	case source.Slug != "":
+		_, body, err := bkp.haApi.GetDownloadBackupBody(ctx, source.Slug)
+		return body, err
+	case source.RemoteFileName != "":
+		return bkp.YaDProcessor.OpenRemoteFile(ctx, source.RemoteFileName)
+	}
+	return nil, fmt.Errorf("backup source is not set")
+}
+
+// ListBackup содержимое бэкапа, включая вложенные архивы дополнений и каталогов.
+// Бэкап читается целиком, но на диск не сохраняется
+func (bkp *BkProcessor) ListBackup(ctx context.Context, source BackupSource) (backuparchive.Listing, error) {
+	reader, err := bkp.openBackup(ctx, source)
+	if err != nil {
+		return backuparchive.Listing{}, err
+	}
+	defer reader.Close()
+
+	listing, err := backuparchive.List(reader, bkp.currentSettings().BackupPassword)
+	if err != nil {
+		return listing, err
+	}
+	bkp.logger.DebugLog.Printf("Listed %d entries of %s", len(listing.Entries), source)
+	for archive, reason := range listing.Skipped {
+		bkp.logger.WarnLog.Printf("Inner archive %s of %s is not readable: %s", archive, source, reason)
+	}
+	return listing, nil
+}
+
+// ExtractFromBackup записывает в out архив с выбранным файлом или каталогом бэкапа
+func (bkp *BkProcessor) ExtractFromBackup(ctx context.Context, source BackupSource, selection backuparchive.Selection,
+	format backuparchive.Format, out io.Writer) (int, error) {
+	reader, err := bkp.openBackup(ctx, source)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	count, err := backuparchive.Extract(reader, bkp.currentSettings().BackupPassword, selection, format, out)
+	if err != nil {
+		return count, err
+	}
+	bkp.logger.InfoLog.Printf("Extracted %d files (%s %s) from %s", count, selection.Archive, selection.Path, source)
+	return count, nil
+}
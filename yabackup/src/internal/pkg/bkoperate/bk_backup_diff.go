@@ -0,0 +1,272 @@
+package bkoperate
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+	"ybg/internal/pkg/backuparchive"
+	"ybg/internal/types"
+)
+
+// homeAssistantArchive вложенный архив с конфигурацией HA, файлы которого сравниваются поштучно
+const homeAssistantArchive = "homeassistant.tar.gz"
+
+// Виды изменений при сравнении бэкапов
+const (
+	ChangeAdded   = "added"
+	ChangeRemoved = "removed"
+	ChangeUpdated = "updated"
+	ChangeChanged = "changed"
+)
+
+// DiffSide описание одного из сравниваемых бэкапов
+type DiffSide struct {
+	Source        string    `json:"source"`
+	Slug          string    `json:"slug"`
+	Name          string    `json:"name"`
+	BackupType    string    `json:"type"`
+	BackupCreated time.Time `json:"created"`
+	HaVersion     string    `json:"ha_version"`
+}
+
+// AddonChange дополнение, которое есть только в одном из бэкапов или с другой версией
+type AddonChange struct {
+	Slug        string `json:"slug"`
+	Name        string `json:"name"`
+	Change      string `json:"change"`
+	FromVersion string `json:"from_version,omitempty"`
+	ToVersion   string `json:"to_version,omitempty"`
+}
+
+// ArchiveDelta размеры вложенного архива в обоих бэкапах (-1 - архива нет)
+type ArchiveDelta struct {
+	Archive  string `json:"archive"`
+	FromSize int64  `json:"from_size"`
+	ToSize   int64  `json:"to_size"`
+	Delta    int64  `json:"delta"`
+}
+
+// FileChange изменённый файл homeassistant.tar.gz
+type FileChange struct {
+	Path     string `json:"path"`
+	Change   string `json:"change"`
+	FromSize int64  `json:"from_size"`
+	ToSize   int64  `json:"to_size"`
+}
+
+// BackupDiff различия двух бэкапов. Files заполняется, только если запрошено сравнение файлов
+// и homeassistant.tar.gz удалось прочитать в обоих бэкапах
+type BackupDiff struct {
+	From           DiffSide       `json:"from"`
+	To             DiffSide       `json:"to"`
+	HaVersion      *AddonChange   `json:"ha_version,omitempty"`
+	Addons         []AddonChange  `json:"addons"`
+	FoldersAdded   []string       `json:"folders_added"`
+	FoldersRemoved []string       `json:"folders_removed"`
+	Archives       []ArchiveDelta `json:"archives"`
+	FilesCompared  bool           `json:"files_compared"`
+	Files          []FileChange   `json:"files,omitempty"`
+	Warnings       []string       `json:"warnings,omitempty"`
+}
+
+// backupSnapshot прочитанный бэкап: описание из backup.json и сводка архива
+type backupSnapshot struct {
+	source  BackupSource
+	info    types.HaBackupInfo
+	summary backuparchive.Summary
+}
+
+// DiffBackups сравнивает два бэкапа. Оба бэкапа читаются целиком по очереди, на диск не сохраняются.
+// withFiles - сравнивать файлы homeassistant.tar.gz по контрольным суммам
+func (bkp *BkProcessor) DiffBackups(ctx context.Context, from BackupSource, to BackupSource, withFiles bool) (BackupDiff, error) {
+	fromSnapshot, err := bkp.readSnapshot(ctx, from, withFiles)
+	if err != nil {
+		return BackupDiff{}, err
+	}
+	toSnapshot, err := bkp.readSnapshot(ctx, to, withFiles)
+	if err != nil {
+		return BackupDiff{}, err
+	}
+
+	diff := diffBackups(fromSnapshot, toSnapshot, withFiles)
+	bkp.logger.InfoLog.Printf("Compared %s and %s: %d addon changes, %d file changes",
+		from, to, len(diff.Addons), len(diff.Files))
+	return diff, nil
+}
+
+func (bkp *BkProcessor) readSnapshot(ctx context.Context, source BackupSource, withFiles bool) (backupSnapshot, error) {
+	reader, err := bkp.openBackup(ctx, source)
+	if err != nil {
+		return backupSnapshot{}, err
+	}
+	defer reader.Close()
+
+	filesOf := ""
+	if withFiles {
+		filesOf = homeAssistantArchive
+	}
+	summary, err := backuparchive.Summarize(reader, bkp.currentSettings().BackupPassword, filesOf)
+	if err != nil {
+		return backupSnapshot{}, fmt.Errorf("cannot read %s: %w", source, err)
+	}
+	if summary.BackupInfo == nil {
+		return backupSnapshot{}, fmt.Errorf("cannot read %s: backup info not found", source)
+	}
+	info, err := parseBackupInfo(summary.BackupInfo)
+	if err != nil {
+		return backupSnapshot{}, fmt.Errorf("cannot read %s: %w", source, err)
+	}
+	return backupSnapshot{source: source, info: info, summary: summary}, nil
+}
+
+func diffSide(snapshot backupSnapshot) DiffSide {
+	return DiffSide{
+		Source:        snapshot.source.String(),
+		Slug:          snapshot.info.Slug,
+		Name:          snapshot.info.Name,
+		BackupType:    snapshot.info.BackupType,
+		BackupCreated: snapshot.info.BackupCreated.Time,
+		HaVersion:     snapshot.info.HaCoreInfo.Version,
+	}
+}
+
+func diffBackups(from backupSnapshot, to backupSnapshot, withFiles bool) BackupDiff {
+	diff := BackupDiff{
+		From:           diffSide(from),
+		To:             diffSide(to),
+		Addons:         diffAddons(from.info.Addons, to.info.Addons),
+		FoldersAdded:   subtract(to.info.Folders, from.info.Folders),
+		FoldersRemoved: subtract(from.info.Folders, to.info.Folders),
+		Archives:       diffArchives(from.summary.Archives, to.summary.Archives),
+	}
+	if diff.From.HaVersion != diff.To.HaVersion {
+		diff.HaVersion = &AddonChange{
+			Slug:        "homeassistant",
+			Name:        "Home Assistant",
+			Change:      versionChange(diff.From.HaVersion, diff.To.HaVersion),
+			FromVersion: diff.From.HaVersion,
+			ToVersion:   diff.To.HaVersion,
+		}
+	}
+
+	if !withFiles {
+		return diff
+	}
+	for _, snapshot := range []backupSnapshot{from, to} {
+		if reason, ok := snapshot.summary.Skipped[homeAssistantArchive]; ok {
+			diff.Warnings = append(diff.Warnings,
+				fmt.Sprintf("Files are not compared, %s of %s is not readable: %s", homeAssistantArchive, snapshot.source, reason))
+		} else if snapshot.summary.Files == nil {
+			diff.Warnings = append(diff.Warnings,
+				fmt.Sprintf("Files are not compared, %s has no %s", snapshot.source, homeAssistantArchive))
+		}
+	}
+	if len(diff.Warnings) == 0 {
+		diff.FilesCompared = true
+		diff.Files = diffFiles(from.summary.Files, to.summary.Files)
+	}
+	return diff
+}
+
+func versionChange(fromVersion string, toVersion string) string {
+	switch {
+	case fromVersion == "":
+		return ChangeAdded
+	case toVersion == "":
+		return ChangeRemoved
+	}
+	return ChangeUpdated
+}
+
+func diffAddons(from []types.HaAddonInfo, to []types.HaAddonInfo) []AddonChange {
+	fromAddons := make(map[string]types.HaAddonInfo, len(from))
+	for _, addon := range from {
+		fromAddons[addon.Slug] = addon
+	}
+	toAddons := make(map[string]types.HaAddonInfo, len(to))
+	for _, addon := range to {
+		toAddons[addon.Slug] = addon
+	}
+
+	result := make([]AddonChange, 0)
+	for slug, addon := range toAddons {
+		fromAddon, ok := fromAddons[slug]
+		switch {
+		case !ok:
+			result = append(result, AddonChange{Slug: slug, Name: addon.Name, Change: ChangeAdded, ToVersion: addon.Version})
+		case fromAddon.Version != addon.Version:
+			result = append(result, AddonChange{Slug: slug, Name: addon.Name, Change: ChangeUpdated,
+				FromVersion: fromAddon.Version, ToVersion: addon.Version})
+		}
+	}
+	for slug, addon := range fromAddons {
+		if _, ok := toAddons[slug]; !ok {
+			result = append(result, AddonChange{Slug: slug, Name: addon.Name, Change: ChangeRemoved, FromVersion: addon.Version})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Slug < result[j].Slug })
+	return result
+}
+
+// subtract элементы values, которых нет в exclude
+func subtract(values []string, exclude []string) []string {
+	excluded := make(map[string]bool, len(exclude))
+	for _, value := range exclude {
+		excluded[value] = true
+	}
+	result := make([]string, 0)
+	for _, value := range values {
+		if !excluded[value] {
+			result = append(result, value)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func diffArchives(from map[string]int64, to map[string]int64) []ArchiveDelta {
+	names := make(map[string]bool)
+	for name := range from {
+		names[name] = true
+	}
+	for name := range to {
+		names[name] = true
+	}
+
+	result := make([]ArchiveDelta, 0, len(names))
+	for name := range names {
+		fromSize, ok := from[name]
+		if !ok {
+			fromSize = -1
+		}
+		toSize, ok := to[name]
+		if !ok {
+			toSize = -1
+		}
+		result = append(result, ArchiveDelta{Archive: name, FromSize: fromSize, ToSize: toSize,
+			Delta: max(toSize, 0) - max(fromSize, 0)})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Archive < result[j].Archive })
+	return result
+}
+
+func diffFiles(from map[string]backuparchive.FileDigest, to map[string]backuparchive.FileDigest) []FileChange {
+	result := make([]FileChange, 0)
+	for path, digest := range to {
+		fromDigest, ok := from[path]
+		switch {
+		case !ok:
+			result = append(result, FileChange{Path: path, Change: ChangeAdded, FromSize: -1, ToSize: digest.Size})
+		case fromDigest.Sha256 != digest.Sha256:
+			result = append(result, FileChange{Path: path, Change: ChangeChanged, FromSize: fromDigest.Size, ToSize: digest.Size})
+		}
+	}
+	for path, digest := range from {
+		if _, ok := to[path]; !ok {
+			result = append(result, FileChange{Path: path, Change: ChangeRemoved, FromSize: digest.Size, ToSize: -1})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Path < result[j].Path })
+	return result
+}
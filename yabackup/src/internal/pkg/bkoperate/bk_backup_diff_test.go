@@ -0,0 +1,87 @@
+package bkoperate
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"ybg/internal/pkg/backuparchive"
+	"ybg/internal/types"
+)
+
+func Test_diffBackups(t *testing.T) {
+	from := backupSnapshot{
+		source: BackupSource{Slug: "old"},
+		info: types.HaBackupInfo{
+			Slug:       "old",
+			HaCoreInfo: types.HaCoreInfo{Version: "2024.5.1"},
+			Folders:    []string{"share", "ssl"},
+			Addons: []types.HaAddonInfo{
+				{Slug: "mqtt", Name: "Mosquitto", Version: "6.4.0"},
+				{Slug: "samba", Name: "Samba", Version: "12.3.1"},
+			},
+		},
+		summary: backuparchive.Summary{
+			Archives: map[string]int64{"homeassistant.tar.gz": 1000, "mqtt.tar.gz": 50, "samba.tar.gz": 20},
+			Files: map[string]backuparchive.FileDigest{
+				"data/configuration.yaml": {Size: 10, Sha256: "a"},
+				"data/automations.yaml":   {Size: 20, Sha256: "b"},
+				"data/scripts.yaml":       {Size: 5, Sha256: "c"},
+			},
+		},
+	}
+	to := backupSnapshot{
+		source: BackupSource{RemoteFileName: "new.tar"},
+		info: types.HaBackupInfo{
+			Slug:       "new",
+			HaCoreInfo: types.HaCoreInfo{Version: "2024.6.0"},
+			Folders:    []string{"share", "media"},
+			Addons: []types.HaAddonInfo{
+				{Slug: "mqtt", Name: "Mosquitto", Version: "6.4.1"},
+				{Slug: "zigbee2mqtt", Name: "Zigbee2MQTT", Version: "1.38.0"},
+			},
+		},
+		summary: backuparchive.Summary{
+			Archives: map[string]int64{"homeassistant.tar.gz": 1200, "mqtt.tar.gz": 50, "zigbee2mqtt.tar.gz": 70},
+			Files: map[string]backuparchive.FileDigest{
+				"data/configuration.yaml": {Size: 10, Sha256: "a"},
+				"data/automations.yaml":   {Size: 25, Sha256: "b2"},
+				"data/blueprints/x.yaml":  {Size: 7, Sha256: "d"},
+			},
+		},
+	}
+
+	diff := diffBackups(from, to, true)
+	assert.Equal(t, "HA backup old", diff.From.Source)
+	assert.Equal(t, &AddonChange{Slug: "homeassistant", Name: "Home Assistant", Change: ChangeUpdated,
+		FromVersion: "2024.5.1", ToVersion: "2024.6.0"}, diff.HaVersion)
+	assert.Equal(t, []AddonChange{
+		{Slug: "mqtt", Name: "Mosquitto", Change: ChangeUpdated, FromVersion: "6.4.0", ToVersion: "6.4.1"},
+		{Slug: "samba", Name: "Samba", Change: ChangeRemoved, FromVersion: "12.3.1"},
+		{Slug: "zigbee2mqtt", Name: "Zigbee2MQTT", Change: ChangeAdded, ToVersion: "1.38.0"},
+	}, diff.Addons)
+	assert.Equal(t, []string{"media"}, diff.FoldersAdded)
+	assert.Equal(t, []string{"ssl"}, diff.FoldersRemoved)
+	assert.Equal(t, []ArchiveDelta{
+		{Archive: "homeassistant.tar.gz", FromSize: 1000, ToSize: 1200, Delta: 200},
+		{Archive: "mqtt.tar.gz", FromSize: 50, ToSize: 50, Delta: 0},
+		{Archive: "samba.tar.gz", FromSize: 20, ToSize: -1, Delta: -20},
+		{Archive: "zigbee2mqtt.tar.gz", FromSize: -1, ToSize: 70, Delta: 70},
+	}, diff.Archives)
+	assert.True(t, diff.FilesCompared)
+	assert.Equal(t, []FileChange{
+		{Path: "data/automations.yaml", Change: ChangeChanged, FromSize: 20, ToSize: 25},
+		{Path: "data/blueprints/x.yaml", Change: ChangeAdded, FromSize: -1, ToSize: 7},
+		{Path: "data/scripts.yaml", Change: ChangeRemoved, FromSize: 5, ToSize: -1},
+	}, diff.Files)
+
+	to.summary.Files = nil
+	to.summary.Skipped = map[string]string{"homeassistant.tar.gz": "encrypted"}
+	diff = diffBackups(from, to, true)
+	assert.False(t, diff.FilesCompared)
+	assert.Nil(t, diff.Files)
+	assert.Len(t, diff.Warnings, 1)
+
+	diff = diffBackups(from, from, false)
+	assert.Nil(t, diff.HaVersion)
+	assert.Empty(t, diff.Addons)
+	assert.Empty(t, diff.Warnings)
+}
@@ -0,0 +1,240 @@
+package bkoperate
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"ybg/internal/pkg/haoperate"
+	"ybg/internal/types"
+)
+
+// BackupLocation хранилище бэкапов supervisor (сетевое хранилище), в которое копируются локальные бэкапы
+type BackupLocation struct {
+	Name     string
+	MaxFiles int // Максимальное количество бэкапов в хранилище. 0 - не ограничено
+}
+
+// LocationFile бэкап, выбранный для копирования в хранилище или удаления из него (или оставленный), и причина решения
+type LocationFile struct {
+	File     types.LocalBackupFileInfo
+	Location string
+	Reason   string
+}
+
+// LocationPlan план копирования локальных бэкапов в хранилища и удаления старых копий
+type LocationPlan struct {
+	ToCopy   []LocationFile
+	ToDelete []LocationFile
+	Kept     []LocationFile
+}
+
+// backupLocations хранилища, в которых есть копии бэкапа (кроме локального)
+func backupLocations(file types.LocalBackupFileInfo) []string {
+	result := make([]string, 0)
+	for _, location := range strings.Split(file.Location, ",") {
+		if location != "" && location != haoperate.LocalLocation {
+			result = append(result, location)
+		}
+	}
+	return result
+}
+
+// planLocation выбирает бэкапы для копирования в хранилище location и для удаления из него.
+// В хранилище остаются MaxFiles новейших бэкапов: недостающие локальные бэкапы копируются, лишние копии удаляются.
+// Копия не удаляется, если она единственная и бэкап не загружен на ЯндексДиск
+func planLocation(location BackupLocation, files []types.LocalBackupFileInfo, remoteSlugs map[string]bool) LocationPlan {
+	plan := LocationPlan{
+		ToCopy:   make([]LocationFile, 0),
+		ToDelete: make([]LocationFile, 0),
+		Kept:     make([]LocationFile, 0),
+	}
+
+	sorted := make([]types.LocalBackupFileInfo, len(files))
+	copy(sorted, files)
+	// Новые бэкапы идут первыми
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].GeneralInfo.Created.After(sorted[j].GeneralInfo.Created)
+	})
+
+	count := 0
+	for _, file := range sorted {
+		locations := backupLocations(file)
+		inLocation := slices.Contains(locations, location.Name)
+		if !inLocation && !file.IsLocal {
+			continue
+		}
+
+		if location.MaxFiles == 0 || count < location.MaxFiles {
+			count++
+			if !inLocation {
+				plan.ToCopy = append(plan.ToCopy, LocationFile{File: file, Location: location.Name,
+					Reason: fmt.Sprintf("not found in %s", location.Name)})
+			}
+			continue
+		}
+
+		if !inLocation {
+			continue
+		}
+		if !file.IsLocal && len(locations) == 1 && !remoteSlugs[file.BackupSlug] {
+			plan.Kept = append(plan.Kept, LocationFile{File: file, Location: location.Name,
+				Reason: "kept: the only copy, not uploaded to Yandex Disk"})
+			continue
+		}
+		plan.ToDelete = append(plan.ToDelete, LocationFile{File: file, Location: location.Name,
+			Reason: fmt.Sprintf("more than %d backups in %s", location.MaxFiles, location.Name)})
+	}
+	return plan
+}
+
+// PlanBackupLocations план копирования бэкапов во все хранилища из настроек
+func (bkp *BkProcessor) PlanBackupLocations() (LocationPlan, error) {
+	plan := LocationPlan{
+		ToCopy:   make([]LocationFile, 0),
+		ToDelete: make([]LocationFile, 0),
+		Kept:     make([]LocationFile, 0),
+	}
+	locations := bkp.currentSettings().BackupLocations
+	if len(locations) == 0 {
+		return plan, nil
+	}
+
+	localFiles, err := getLocalBackupFiles(bkp.haApi, bkp.logger)
+	if err != nil {
+		return plan, err
+	}
+	files := make([]types.LocalBackupFileInfo, 0, len(localFiles))
+	for _, file := range localFiles {
+		files = append(files, file)
+	}
+
+	remoteSlugs := make(map[string]bool)
+	filesInfo, err := bkp.GetFilesInfo()
+	if err != nil {
+		// Без списка файлов на ЯндексДиске ни один бэкап не считается загруженным
+		bkp.logger.ErrorLog.Printf("Remote files unknown. Only copies of local backups will be deleted from locations. %v", err)
+	}
+	for _, file := range filesInfo {
+		if file.IsRemote && file.BackupSlug != "" {
+			remoteSlugs[file.BackupSlug] = true
+		}
+	}
+
+	for _, location := range locations {
+		locationPlan := planLocation(location, files, remoteSlugs)
+		plan.ToCopy = append(plan.ToCopy, locationPlan.ToCopy...)
+		plan.ToDelete = append(plan.ToDelete, locationPlan.ToDelete...)
+		plan.Kept = append(plan.Kept, locationPlan.Kept...)
+	}
+
+	bkp.logger.InfoLog.Printf("Backup locations: %d backups to copy, %d to delete, %d kept",
+		len(plan.ToCopy), len(plan.ToDelete), len(plan.Kept))
+	return plan, nil
+}
+
+// CopyToBackupLocations копирует локальные бэкапы в хранилища из настроек и удаляет из них старые копии.
+// operationId - операция, в которой показывается ход копирования. Возвращает результаты копирования и удаления
+func (bkp *BkProcessor) CopyToBackupLocations(operationId string) (ProcessedFilesResult, ProcessedFilesResult, error) {
+	result := ProcessedFilesResult{Files: make([]ProcessedFileResult, 0)}
+	deleted := ProcessedFilesResult{}
+	plan, err := bkp.PlanBackupLocations()
+	if err != nil {
+		return result, deleted, err
+	}
+
+	for i, file := range plan.ToCopy {
+		if bkp.applCtx.Err() != nil {
+			bkp.logger.InfoLog.Printf("Copy to backup locations interrupted")
+			break
+		}
+		bkp.operationManager.ChangeStatusAndProgress(operationId,
+			fmt.Sprintf("copying %s to %s", file.File.BackupName, file.Location), 100*i/len(plan.ToCopy))
+
+		err := bkp.copyToLocation(file)
+		result.Files = append(result.Files, ProcessedFileResult{Slug: file.File.BackupSlug,
+			RemoteFileName: file.Location + "/" + file.File.BackupName, Size: file.File.GeneralInfo.Size, Err: err})
+		if err != nil {
+			bkp.logger.ErrorLog.Printf("Error when copy backup [slug: %s, name: %s] to %s. %v",
+				file.File.BackupSlug, file.File.BackupName, file.Location, err)
+			result.Error++
+			continue
+		}
+		bkp.logger.InfoLog.Printf("Backup [slug: %s, name: %s] copied to %s", file.File.BackupSlug, file.File.BackupName, file.Location)
+		result.Ok++
+		result.ProcessedSize += file.File.GeneralInfo.Size
+	}
+
+	for _, file := range plan.ToDelete {
+		if bkp.applCtx.Err() != nil {
+			break
+		}
+		err := bkp.haApi.DeleteBackupFromLocation(file.File.BackupSlug, file.Location)
+		if err != nil {
+			bkp.logger.ErrorLog.Printf("Error when delete backup [slug: %s, name: %s] from %s. %v",
+				file.File.BackupSlug, file.File.BackupName, file.Location, err)
+			deleted.Error++
+			continue
+		}
+		deleted.Ok++
+		deleted.ProcessedSize += file.File.GeneralInfo.Size
+		bkp.logger.InfoLog.Printf("Deleted backup [slug: %s, name: %s] from %s: %s",
+			file.File.BackupSlug, file.File.BackupName, file.Location, file.Reason)
+	}
+
+	bkp.InvalidateStatistic()
+	if result.Error > 0 || deleted.Error > 0 {
+		return result, deleted, fmt.Errorf("error when copy backups to locations")
+	}
+	return result, deleted, nil
+}
+
+// copyToLocation копирует бэкап в хранилище. Локальный файл загружается напрямую,
+// иначе бэкап сначала скачивается из HA во временный файл
+func (bkp *BkProcessor) copyToLocation(file LocationFile) error {
+	source := file.File.Path
+	if source == "" {
+		source = haoperate.GetTemporaryFilePath(file.File.BackupSlug + ".tar")
+		defer bkp.haApi.RemoveTemporaryFile(source)
+		if err := bkp.downloadFromHa(file.File.BackupSlug, source); err != nil {
+			return err
+		}
+	}
+	return bkp.haApi.UploadBackupToLocation(bkp.applCtx, source, file.Location)
+}
+
+func (bkp *BkProcessor) downloadFromHa(slug string, destination string) error {
+	_, body, err := bkp.haApi.GetDownloadBackupBody(bkp.applCtx, slug)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	output, err := os.Create(destination)
+	if err != nil {
+		return fmt.Errorf("error when create file %s: %w", destination, err)
+	}
+	defer output.Close()
+
+	if _, err := output.ReadFrom(body); err != nil {
+		return fmt.Errorf("error when download backup %s: %w", slug, err)
+	}
+	return nil
+}
+
+// isInBackupLocation бэкап есть в одном из хранилищ из настроек
+func isInBackupLocation(file types.LocalBackupFileInfo, locations []BackupLocation) bool {
+	fileLocations := backupLocations(file)
+	for _, location := range locations {
+		if slices.Contains(fileLocations, location.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasBackupLocations в настройках заданы хранилища для копирования бэкапов
+func (bkp *BkProcessor) HasBackupLocations() bool {
+	return len(bkp.currentSettings().BackupLocations) > 0
+}
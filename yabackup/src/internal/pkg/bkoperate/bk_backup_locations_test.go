@@ -0,0 +1,49 @@
+package bkoperate
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+	"ybg/internal/types"
+)
+
+func Test_planLocation(t *testing.T) {
+	backup := func(slug string, d int, isLocal bool, location string) types.LocalBackupFileInfo {
+		return types.LocalBackupFileInfo{
+			BackupSlug:  slug,
+			GeneralInfo: types.GeneralFileInfo{Created: types.FileModified(time.Date(2026, 10, d, 0, 0, 0, 0, time.UTC))},
+			IsLocal:     isLocal,
+			Location:    location,
+		}
+	}
+	files := []types.LocalBackupFileInfo{
+		backup("d1", 1, false, "nas"),
+		backup("d2", 2, false, "nas"),
+		backup("d3", 3, true, "nas"),
+		backup("d4", 4, true, ""),
+		backup("d5", 5, true, "media,other"),
+		backup("d6", 6, false, "other"),
+	}
+	slugs := func(files []LocationFile) []string {
+		result := make([]string, 0)
+		for _, file := range files {
+			result = append(result, file.File.BackupSlug)
+		}
+		return result
+	}
+
+	plan := planLocation(BackupLocation{Name: "nas", MaxFiles: 3}, files, map[string]bool{"d1": true})
+	assert.Equal(t, []string{"d5", "d4"}, slugs(plan.ToCopy))
+	assert.Equal(t, []string{"d1"}, slugs(plan.ToDelete))
+	assert.Equal(t, []string{"d2"}, slugs(plan.Kept))
+	assert.Equal(t, "nas", plan.ToCopy[0].Location)
+
+	plan = planLocation(BackupLocation{Name: "nas"}, files, map[string]bool{})
+	assert.Equal(t, []string{"d5", "d4"}, slugs(plan.ToCopy))
+	assert.Empty(t, plan.ToDelete)
+
+	plan = planLocation(BackupLocation{Name: "nas", MaxFiles: 1}, files, map[string]bool{})
+	assert.Equal(t, []string{"d5"}, slugs(plan.ToCopy))
+	assert.Equal(t, []string{"d3"}, slugs(plan.ToDelete))
+	assert.Equal(t, []string{"d2", "d1"}, slugs(plan.Kept))
+}
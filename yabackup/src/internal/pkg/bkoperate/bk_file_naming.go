@@ -0,0 +1,148 @@
+package bkoperate
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"ybg/internal/types"
+)
+
+const DefaultFileNameTemplate = "{name}_{slug}{ext}"
+const remoteFileExtension = ".tar"
+const defaultTemplateDateLayout = "2006-01-02"
+
+const (
+	placeholderName      = "name"
+	placeholderSlug      = "slug"
+	placeholderDate      = "date"
+	placeholderType      = "type"
+	placeholderHaVersion = "ha_version"
+	placeholderHost      = "host"
+	placeholderExt       = "ext"
+)
+
+var knownPlaceholders = map[string]bool{
+	placeholderName:      true,
+	placeholderSlug:      true,
+	placeholderDate:      true,
+	placeholderType:      true,
+	placeholderHaVersion: true,
+	placeholderHost:      true,
+	placeholderExt:       true,
+}
+
+var fileNameReplacer = strings.NewReplacer(" ", "-", ":", "_", "/", "_", "\\", "_")
+
+// FileNameTemplate шаблон имени файла на ЯндексДиске.
+// Пример: "{name}_{slug}{ext}", "{date:2006-01-02}_{type}_{slug}{ext}"
+type FileNameTemplate struct {
+	template string
+	host     string
+	parts    []templatePart
+}
+
+type templatePart struct {
+	literal     string
+	placeholder string
+	arg         string
+}
+
+// ParseFileNameTemplate разбирает и проверяет шаблон. Шаблон обязан содержать {slug},
+// иначе невозможно сопоставить файл на ЯндексДиске с бэкапом.
+func ParseFileNameTemplate(template string, host string) (*FileNameTemplate, error) {
+	result := &FileNameTemplate{template: template, host: host, parts: make([]templatePart, 0)}
+	hasSlug := false
+
+	rest := template
+	for rest != "" {
+		start := strings.IndexAny(rest, "{}")
+		if start < 0 {
+			result.parts = append(result.parts, templatePart{literal: rest})
+			break
+		}
+		if rest[start] == '}' {
+			return nil, fmt.Errorf("unexpected '}' in file name template %q", template)
+		}
+		if start > 0 {
+			result.parts = append(result.parts, templatePart{literal: rest[:start]})
+		}
+
+		end := strings.IndexAny(rest[start+1:], "{}")
+		if end < 0 || rest[start+1+end] != '}' {
+			return nil, fmt.Errorf("unclosed placeholder in file name template %q", template)
+		}
+		body := rest[start+1 : start+1+end]
+		rest = rest[start+1+end+1:]
+
+		name, arg, _ := strings.Cut(body, ":")
+		if !knownPlaceholders[name] {
+			return nil, fmt.Errorf("unknown placeholder {%s} in file name template %q", body, template)
+		}
+		if arg != "" && name != placeholderDate {
+			return nil, fmt.Errorf("placeholder {%s} does not support format in file name template %q", name, template)
+		}
+		if name == placeholderDate && arg == "" {
+			arg = defaultTemplateDateLayout
+		}
+		if name == placeholderSlug {
+			hasSlug = true
+		}
+		result.parts = append(result.parts, templatePart{placeholder: name, arg: arg})
+	}
+
+	if !hasSlug {
+		return nil, fmt.Errorf("file name template %q must contain {%s}", template, placeholderSlug)
+	}
+
+	return result, nil
+}
+
+func (t *FileNameTemplate) String() string {
+	return t.template
+}
+
+// Execute формирует имя файла на ЯндексДиске для локального бэкапа
+func (t *FileNameTemplate) Execute(localFile types.LocalBackupFileInfo) string {
+	var builder strings.Builder
+	for _, part := range t.parts {
+		if part.placeholder == "" {
+			builder.WriteString(part.literal)
+			continue
+		}
+		builder.WriteString(t.placeholderValue(part, localFile))
+	}
+	return fileNameReplacer.Replace(builder.String())
+}
+
+func (t *FileNameTemplate) placeholderValue(part templatePart, localFile types.LocalBackupFileInfo) string {
+	switch part.placeholder {
+	case placeholderName:
+		return localFile.BackupName
+	case placeholderSlug:
+		return localFile.BackupSlug
+	case placeholderDate:
+		created := time.Time(localFile.GeneralInfo.Created)
+		if localFile.BackupArchInfo != nil && !localFile.BackupArchInfo.BackupCreated.IsZero() {
+			created = time.Time(localFile.BackupArchInfo.BackupCreated)
+		}
+		return created.Format(part.arg)
+	case placeholderType:
+		if localFile.BackupArchInfo != nil {
+			return localFile.BackupArchInfo.BackupType
+		}
+	case placeholderHaVersion:
+		if localFile.BackupArchInfo != nil {
+			return localFile.BackupArchInfo.CoreInfo.Version
+		}
+	case placeholderHost:
+		return t.host
+	case placeholderExt:
+		return remoteFileExtension
+	}
+	return ""
+}
+
+// legacyRemoteFileName имя файла, которое использовалось до появления шаблонов
+func legacyRemoteFileName(localFile types.LocalBackupFileInfo) string {
+	return strings.ReplaceAll(strings.ReplaceAll(localFile.BackupName+"_"+localFile.BackupSlug, " ", "-"), ":", "_")
+}
@@ -0,0 +1,96 @@
+package bkoperate
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+	"ybg/internal/types"
+)
+
+func Test_ParseFileNameTemplate(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		wantErr  string
+	}{
+		{name: "default", template: DefaultFileNameTemplate},
+		{name: "all placeholders", template: "{host}_{date:2006-01-02}_{type}_{ha_version}_{name}_{slug}{ext}"},
+		{name: "without slug", template: "{name}{ext}", wantErr: "must contain {slug}"},
+		{name: "unknown placeholder", template: "{name}_{slug}_{unknown}", wantErr: "unknown placeholder"},
+		{name: "unclosed placeholder", template: "{name_{slug}", wantErr: "unclosed placeholder"},
+		{name: "unexpected brace", template: "name}_{slug}", wantErr: "unexpected '}'"},
+		{name: "format for not date", template: "{name:abc}_{slug}", wantErr: "does not support format"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseFileNameTemplate(tt.template, "host")
+			if tt.wantErr == "" {
+				assert.Nil(t, err, "Error must be nil")
+				return
+			}
+			assert.NotNil(t, err, "Error expected")
+			assert.True(t, strings.Contains(err.Error(), tt.wantErr), "Error mast contain text %s. Real error message: %s", tt.wantErr, err.Error())
+		})
+	}
+}
+
+func Test_FileNameTemplateExecute(t *testing.T) {
+	created := time.Date(2026, time.October, 5, 2, 1, 0, 0, time.UTC)
+	localFile := types.LocalBackupFileInfo{
+		GeneralInfo: types.GeneralFileInfo{Created: types.FileModified(created)},
+		BackupArchInfo: &types.BackupArchInfo{BackupType: "full",
+			CoreInfo:      types.HaCoreInfo{Version: "2026.10.1"},
+			BackupCreated: types.FileModified(created)},
+		BackupSlug: "5508d5ad",
+		BackupName: "Full_Y_Backup_2026-10-05 02:01:00",
+	}
+
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{"default", DefaultFileNameTemplate, "Full_Y_Backup_2026-10-05-02_01_00_5508d5ad.tar"},
+		{"legacy", "{name}_{slug}", legacyRemoteFileName(localFile)},
+		{"date", "{date}_{slug}", "2026-10-05_5508d5ad"},
+		{"date with layout", "{date:2006/01}_{slug}", "2026_10_5508d5ad"},
+		{"type and version", "{type}_{ha_version}_{host}_{slug}{ext}", "full_2026.10.1_homeassistant_5508d5ad.tar"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nameTemplate, err := ParseFileNameTemplate(tt.template, "homeassistant")
+			assert.Nil(t, err, "Error must be nil")
+			assert.Equalf(t, tt.want, nameTemplate.Execute(localFile), "Execute(%v)", tt.template)
+		})
+	}
+}
+
+func Test_intersectFilesWithOldTemplates(t *testing.T) {
+	localFiles := map[string]types.LocalBackupFileInfo{
+		"5508d5ad": {BackupSlug: "5508d5ad", BackupName: "Full backup", IsLocal: true},
+		"6608d5ad": {BackupSlug: "6608d5ad", BackupName: "Partial", IsLocal: true},
+		"7708d5ad": {BackupSlug: "7708d5ad", BackupName: "New", IsLocal: true},
+	}
+	remoteFiles := []types.RemoteFileInfo{
+		{Name: "Full-backup_5508d5ad"},
+		{Name: "2026-10-01_6608d5ad.tar"},
+	}
+
+	nameTemplate, _ := ParseFileNameTemplate(DefaultFileNameTemplate, "")
+	result, err := intersectFiles(localFiles, remoteFiles, nameTemplate)
+	assert.Nil(t, err, "Error must be nil")
+	assert.Equal(t, 3, len(result), "Result length not equal")
+
+	byName := make(map[string]types.BackupFileInfo)
+	for _, file := range result {
+		byName[file.BackupName] = file
+	}
+
+	assert.Equal(t, "Full-backup_5508d5ad", byName["Full backup"].RemoteFileName, "Legacy name must be recognised")
+	assert.True(t, byName["Full backup"].IsRemote)
+	assert.Equal(t, "2026-10-01_6608d5ad.tar", byName["Partial"].RemoteFileName, "Other template must be recognised by slug")
+	assert.True(t, byName["Partial"].IsRemote)
+	assert.Equal(t, "New_7708d5ad.tar", byName["New"].RemoteFileName, "Current template must be used for new files")
+	assert.False(t, byName["New"].IsRemote)
+}
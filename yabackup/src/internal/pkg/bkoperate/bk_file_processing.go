@@ -2,87 +2,178 @@ package bkoperate
 
 import (
 	"archive/tar"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 	"ybg/internal/pkg/haoperate"
 	"ybg/internal/pkg/mylogger"
+	om "ybg/internal/pkg/operationmanager"
 	"ybg/internal/types"
 )
 
+// backupInfoFileName описание бэкапа внутри архива
+const backupInfoFileName = "backup.json"
+
 type ProcessedFilesResult struct {
 	Ok            int
 	Error         int
 	ProcessedSize types.FileSize
+	Files         []ProcessedFileResult
+}
+
+// ProcessedFileResult результат обработки одного файла. Порядок Files совпадает с порядком обработки файлов
+type ProcessedFileResult struct {
+	Slug           string
+	RemoteFileName string
+	Size           types.FileSize
+	Err            error
 }
 
-func UploadFiles(app *BkProcessor, files []types.ForUploadFileInfo) (ProcessedFilesResult, error) {
+// ErrorFiles имена файлов, обработанных с ошибкой
+func (r ProcessedFilesResult) ErrorFiles() []string {
+	result := make([]string, 0)
+	for _, file := range r.Files {
+		if file.Err != nil {
+			result = append(result, file.RemoteFileName)
+		}
+	}
+	return result
+}
+
+func UploadFiles(app *BkProcessor, files []types.ForUploadFileInfo, parentOperationId string) (ProcessedFilesResult, error) {
 	sort.Slice(files, func(i, j int) bool {
 		return time.Time(files[i].LocalFileInfo.Modified).Before(time.Time(files[j].LocalFileInfo.Modified))
 	})
 
-	isError := false
-	uploaded := 0
-	errorUploaded := 0
-	processedSize := types.FileSize(0)
-
+	// TODO ОТказ от прямой загрузки файла. Пока непонятно как поставить файл в соответвие slug
+	// Загружаются только файлы из локального и сетевых хранилищ (по slug)
+	uploadFiles := make([]types.ForUploadFileInfo, 0, len(files))
 	for _, file := range files {
+		if file.IsLocal || file.IsNetwork {
+			uploadFiles = append(uploadFiles, file)
+		}
+	}
 
-		// TODO ОТказ от прямой загрузки файла. Пока непонятно как поставить файл в соответвие slug
-		//if file.IsLocal && file.LocalFileInfo.Name != "" {
-		//	sourceName := BACKUP_PATH + "/" + file.LocalFileInfo.Name
-		//	app.logger.DebugLog.Printf("Try upload %s ", sourceName)
-		//	err := app.YaDProcessor.UploadFile(sourceName, file.RemoteFileName)
-		//	if err != nil {
-		//		app.logger.ErrorLog.Printf("Error when upload file %s. Err: %s", sourceName, err)
-		//		isError = true
-		//		errorUploaded++
-		//	} else {
-		//		uploaded++
-		//		processedSize += file.LocalFileInfo.Size
-		//	}
-		//} else
-
-		if file.IsLocal {
-			app.logger.DebugLog.Printf("Try upload local file %s ", file.Slug)
-			err := app.YaDProcessor.UploadDataFromSlug(app.haApi, file.Slug, file.RemoteFileName)
-			if err != nil {
-				app.logger.ErrorLog.Printf("Error when upload local file %s. Err: %s", file.Slug, err)
-				isError = true
-				errorUploaded++
-			} else {
-				uploaded++
-				processedSize += file.LocalFileInfo.Size
-			}
-		} else if file.IsNetwork {
-			app.logger.DebugLog.Printf("Try upload network file %s ", file.Slug)
-			err := app.YaDProcessor.UploadDataFromSlug(app.haApi, file.Slug, file.RemoteFileName)
-			if err != nil {
-				app.logger.ErrorLog.Printf("Error when upload network file %s. Err: %s", file.Slug, err)
-				isError = true
-				errorUploaded++
-			} else {
-				uploaded++
-				processedSize += file.LocalFileInfo.Size
+	workers := app.currentSettings().UploadConcurrency
+	results := processConcurrently(app.applCtx, app.logger, uploadFiles, workers, func(file types.ForUploadFileInfo) error {
+		return uploadFile(app, file, parentOperationId)
+	})
+
+	result := ProcessedFilesResult{Files: results}
+	for _, file := range results {
+		if file.Err != nil {
+			result.Error++
+		} else {
+			result.Ok++
+			result.ProcessedSize += file.Size
+		}
+	}
+
+	if result.Error > 0 {
+		return result, fmt.Errorf("error when upload files")
+	}
+	return result, nil
+}
+
+// processConcurrently обрабатывает файлы не более чем workers параллельными вызовами process.
+// После отмены ctx необработанные файлы не обрабатываются и получают ошибку ctx.Err().
+// Порядок результатов совпадает с порядком files
+func processConcurrently(ctx context.Context, logger *mylogger.Logger, files []types.ForUploadFileInfo, workers int,
+	process func(file types.ForUploadFileInfo) error) []ProcessedFileResult {
+	results := make([]ProcessedFileResult, len(files))
+	for i, file := range files {
+		results[i] = ProcessedFileResult{Slug: file.Slug, RemoteFileName: file.RemoteFileName, Size: file.LocalFileInfo.Size}
+	}
+
+	if workers > len(files) {
+		workers = len(files)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	logger.DebugLog.Printf("Upload %d files by %d workers", len(files), workers)
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				// select в цикле ниже может отдать файл и после отмены ctx
+				if ctx.Err() != nil {
+					results[i].Err = ctx.Err()
+					continue
+				}
+				results[i].Err = process(files[i])
 			}
+		}()
+	}
+
+	canceled := false
+	for i := range files {
+		if canceled {
+			results[i].Err = ctx.Err()
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			logger.ErrorLog.Printf("Upload canceled. %d files not uploaded", len(files)-i)
+			canceled = true
+			results[i].Err = ctx.Err()
+		case jobs <- i:
 		}
 	}
+	close(jobs)
+	wg.Wait()
+	return results
+}
 
-	err := fmt.Errorf("plug")
-	err = nil
-	if isError {
-		err = fmt.Errorf("error when upload files")
+func uploadFile(app *BkProcessor, file types.ForUploadFileInfo, parentOperationId string) error {
+	storage := "local"
+	if !file.IsLocal {
+		storage = "network"
 	}
-	return ProcessedFilesResult{Ok: uploaded,
-			Error:         errorUploaded,
-			ProcessedSize: processedSize},
-		err
+
+	// Идентификатор операции совпадает с именем файла в карточке UI
+	operationId := path.Base(file.RemoteFileName)
+	ctx := app.operationManager.StartCancelableOperation(app.applCtx, operationId, "waiting for upload")
+	app.operationManager.SetOperationType(operationId, om.OperationTypeUpload, parentOperationId)
+	logger := app.logger.With("operation_id", operationId, "slug", file.Slug)
+
+	err := app.YaDProcessor.WaitUploadWindow(ctx, int64(file.LocalFileInfo.Size), operationId)
+	if err != nil {
+		logger.ErrorLog.Printf("Upload %s file %s canceled. Err: %s", storage, file.Slug, err)
+		app.operationManager.ErrorDone(operationId, "Upload canceled")
+		return err
+	}
+
+	logger.DebugLog.Printf("Try upload %s file %s ", storage, file.Slug)
+	sha256sum, err := app.YaDProcessor.UploadDataFromSlug(ctx, app.haApi, file.Slug, file.RemoteFileName, operationId)
+	if err != nil {
+		logger.ErrorLog.Printf("Error when upload %s file %s. Err: %s", storage, file.Slug, err)
+		if ctx.Err() != nil {
+			app.operationManager.ErrorDone(operationId, "Upload canceled")
+		} else {
+			app.operationManager.ErrorDone(operationId, "Error upload to YD")
+		}
+		return err
+	}
+
+	// Контрольная сумма загруженных данных - эталон для проверки архива на ЯндексДиске
+	app.uploadHashes.record(file.RemoteFileName, UploadedHash{Sha256: sha256sum, Size: file.LocalFileInfo.Size, Uploaded: time.Now()})
+	logger.InfoLog.Printf("Upload %s file %s done", storage, file.Slug)
+	app.operationManager.SuccessDone(operationId)
+	return nil
 }
 
 type stringSet map[string]bool
@@ -90,21 +181,26 @@ type remoteFilesMap map[string]types.RemoteFileInfo
 
 func intersectFiles(
 	localFiles map[string]types.LocalBackupFileInfo,
-	remoteFiles []types.RemoteFileInfo) ([]types.BackupFileInfo, error) {
+	remoteFiles []types.RemoteFileInfo,
+	nameTemplate *FileNameTemplate) ([]types.BackupFileInfo, error) {
 
 	remoteFileNames := make(remoteFilesMap)
 	processedRemoteFile := make(stringSet)
 
+	// Файлы могут лежать в датированных подкаталогах, поэтому сопоставление идёт по имени файла без пути
 	for _, remoteFile := range remoteFiles {
-		remoteFileNames[remoteFile.Name] = remoteFile
+		remoteFileNames[path.Base(remoteFile.Name)] = remoteFile
 	}
 
 	result := make([]types.BackupFileInfo, 0, len(localFiles))
 
 	// Обработаем локальные файлы
 	for _, localFile := range localFiles {
-		remoteFileName := generateRemoteFileName(localFile)
-		remoteFileInfo, isRemote := remoteFileNames[remoteFileName]
+		remoteFileName := nameTemplate.Execute(localFile)
+		remoteFileInfo, isRemote := findRemoteFile(localFile, remoteFileName, remoteFileNames, remoteFiles, processedRemoteFile)
+		if isRemote {
+			remoteFileName = remoteFileInfo.Name
+		}
 
 		backupFileInfo := types.BackupFileInfo{
 			GeneralInfo:    localFile.GeneralInfo,
@@ -134,7 +230,7 @@ func intersectFiles(
 			result = append(result,
 				types.BackupFileInfo{
 					GeneralInfo: types.GeneralFileInfo{
-						Name:     remoteFile.Name,
+						Name:     path.Base(remoteFile.Name),
 						Size:     remoteFile.Size,
 						Modified: remoteFile.Modified,
 						Created:  remoteFile.Created,
@@ -143,7 +239,7 @@ func intersectFiles(
 						Folders: make([]string, 0),
 						Addons:  make([]types.HaAddonInfo, 0),
 					},
-					BackupName:     remoteFile.Name,
+					BackupName:     path.Base(remoteFile.Name),
 					RemoteFileName: remoteFile.Name,
 					Downloaded:     remoteFile.Created,
 					IsLocal:        false,
@@ -166,8 +262,32 @@ func getSortedTime(backupFileInfo *types.BackupFileInfo) types.FileModified {
 	return backupFileInfo.GeneralInfo.Modified
 }
 
-func generateRemoteFileName(localFile types.LocalBackupFileInfo) string {
-	return strings.ReplaceAll(strings.ReplaceAll(localFile.BackupName+"_"+localFile.BackupSlug, " ", "-"), ":", "_")
+// findRemoteFile ищет файл бэкапа на ЯндексДиске. Сначала по имени из текущего шаблона,
+// затем по имени старого формата, и в последнюю очередь по вхождению slug в имя файла
+// (файлы, загруженные по другим шаблонам).
+func findRemoteFile(localFile types.LocalBackupFileInfo,
+	remoteFileName string,
+	remoteFileNames remoteFilesMap,
+	remoteFiles []types.RemoteFileInfo,
+	processedRemoteFile stringSet) (types.RemoteFileInfo, bool) {
+
+	legacyName := legacyRemoteFileName(localFile)
+	for _, name := range []string{remoteFileName, legacyName, legacyName + remoteFileExtension} {
+		if remoteFileInfo, ok := remoteFileNames[name]; ok && !processedRemoteFile[remoteFileInfo.Name] {
+			return remoteFileInfo, true
+		}
+	}
+
+	if localFile.BackupSlug == "" {
+		return types.RemoteFileInfo{}, false
+	}
+
+	for _, remoteFile := range remoteFiles {
+		if !processedRemoteFile[remoteFile.Name] && strings.Contains(path.Base(remoteFile.Name), localFile.BackupSlug) {
+			return remoteFile, true
+		}
+	}
+	return types.RemoteFileInfo{}, false
 }
 
 func getLocalBackupFiles(haApi *haoperate.HaApiClient, logger *mylogger.Logger) (map[string]types.LocalBackupFileInfo, error) {
@@ -336,6 +456,11 @@ func extractArchInfo(logger *mylogger.Logger, tarfile string) (*types.BackupArch
 		}
 	}(reader)
 
+	return readArchInfo(logger, reader)
+}
+
+// readArchInfo читает backup.json из потока архива бэкапа. Чтение прекращается, как только backup.json найден
+func readArchInfo(logger *mylogger.Logger, reader io.Reader) (*types.BackupArchInfo, error) {
 	tarReader := tar.NewReader(reader)
 	for {
 		header, err := tarReader.Next()
@@ -351,10 +476,9 @@ func extractArchInfo(logger *mylogger.Logger, tarfile string) (*types.BackupArch
 		}
 
 		info := header.FileInfo()
-		if info.IsDir() || info.Name() != "backup.json" {
+		if info.IsDir() || info.Name() != backupInfoFileName {
 			continue
 		} else {
-			var data types.HaBackupInfo
 			plan, err := io.ReadAll(tarReader)
 
 			if err != nil {
@@ -362,30 +486,39 @@ func extractArchInfo(logger *mylogger.Logger, tarfile string) (*types.BackupArch
 
 			}
 
-			err = json.Unmarshal(plan, &data)
+			data, err := parseBackupInfo(plan)
 			logger.DebugLog.Printf("data= %+v\n", data)
 			if err != nil {
-				return nil, fmt.Errorf("cannot parse backup info, error=[%v]", err)
+				return nil, err
 			}
-			if data.Slug == "" || data.Name == "" {
-				return nil, fmt.Errorf("cannot parse backup info. Necessary field not found")
-			}
-
-			result := types.BackupArchInfo{
-				Slug:       data.Slug,
-				Name:       data.Name,
-				BackupType: data.BackupType,
-				HaVersion:  data.HaVersion,
-				CoreInfo:   data.HaCoreInfo,
-				Folders:    data.Folders,
-				Addons:     data.Addons,
-			}
-
-			if &data.BackupCreated != nil {
-				result.BackupCreated = types.FileModified(data.BackupCreated.Time)
-			}
-			return &result, nil
+			return convertBackupInfoToArchInfo(data), nil
 		}
 	}
 	return nil, fmt.Errorf("backup info not found")
 }
+
+// parseBackupInfo разбирает backup.json из архива бэкапа
+func parseBackupInfo(plan []byte) (types.HaBackupInfo, error) {
+	var data types.HaBackupInfo
+	err := json.Unmarshal(plan, &data)
+	if err != nil {
+		return data, fmt.Errorf("cannot parse backup info, error=[%v]", err)
+	}
+	if data.Slug == "" || data.Name == "" {
+		return data, fmt.Errorf("cannot parse backup info. Necessary field not found")
+	}
+	return data, nil
+}
+
+func convertBackupInfoToArchInfo(data types.HaBackupInfo) *types.BackupArchInfo {
+	return &types.BackupArchInfo{
+		Slug:          data.Slug,
+		Name:          data.Name,
+		BackupType:    data.BackupType,
+		HaVersion:     data.HaVersion,
+		CoreInfo:      data.HaCoreInfo,
+		BackupCreated: types.FileModified(data.BackupCreated.Time),
+		Folders:       data.Folders,
+		Addons:        data.Addons,
+	}
+}
@@ -1,13 +1,20 @@
 package bkoperate
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 	"ybg/internal/pkg/mylogger"
+	"ybg/internal/types"
 )
 
 func Test_extractArchInfo(t *testing.T) {
@@ -48,9 +55,131 @@ func Test_extractBadArchInfo(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			_, err := extractArchInfo(logger, filepath.Join("testresources", tt.args.fileName))
+			_, err := extractArchInfo(logger, filepath.Join("../../../testresources", tt.args.fileName))
 			assert.NotNilf(t, err, "Error expected. Test %s", tt.name)
 			assert.True(t, strings.Contains(err.Error(), tt.want), "Error mast contain text %s. Real error message: %s. Test %s", tt.want, err.Error(), tt.name)
 		})
 	}
 }
+
+func Test_intersectFilesInSubfolders(t *testing.T) {
+	localFiles := map[string]types.LocalBackupFileInfo{
+		"5508d5ad": {BackupSlug: "5508d5ad", BackupName: "Full backup", IsLocal: true},
+		"6608d5ad": {BackupSlug: "6608d5ad", BackupName: "Partial", IsLocal: true},
+	}
+	remoteFiles := []types.RemoteFileInfo{
+		{Name: "2026/10/Full-backup_5508d5ad"},
+		{Name: "2026/09/Old-backup_1111"},
+	}
+
+	nameTemplate, _ := ParseFileNameTemplate(DefaultFileNameTemplate, "")
+	result, err := intersectFiles(localFiles, remoteFiles, nameTemplate)
+	assert.Nil(t, err, "Error must be nil")
+	assert.Equal(t, 3, len(result), "Result length not equal")
+
+	byName := make(map[string]types.BackupFileInfo)
+	for _, file := range result {
+		byName[file.BackupName] = file
+	}
+
+	assert.True(t, byName["Full backup"].IsRemote, "File in sub folder must be found")
+	assert.Equal(t, "2026/10/Full-backup_5508d5ad", byName["Full backup"].RemoteFileName)
+	assert.False(t, byName["Partial"].IsRemote, "File must be not remote")
+	assert.Equal(t, "2026/09/Old-backup_1111", byName["Old-backup_1111"].RemoteFileName)
+}
+
+func TestProcessedFilesResult_ErrorFiles(t *testing.T) {
+	result := ProcessedFilesResult{Files: []ProcessedFileResult{
+		{RemoteFileName: "a.tar", Err: errors.New("error")},
+		{RemoteFileName: "b.tar"},
+		{RemoteFileName: "c.tar", Err: context.Canceled},
+	}}
+	assert.Equal(t, []string{"a.tar", "c.tar"}, result.ErrorFiles())
+	assert.Equal(t, []string{}, ProcessedFilesResult{}.ErrorFiles())
+}
+
+func uploadTestFiles(amount int) []types.ForUploadFileInfo {
+	files := make([]types.ForUploadFileInfo, amount)
+	for i := range files {
+		files[i] = types.ForUploadFileInfo{Slug: fmt.Sprintf("slug%d", i), RemoteFileName: fmt.Sprintf("file%d.tar", i), IsLocal: true}
+	}
+	return files
+}
+
+func discardLogger() *mylogger.Logger {
+	discardLog := log.New(io.Discard, "", 0)
+	return mylogger.New(discardLog, discardLog, discardLog)
+}
+
+func Test_processConcurrentlyBoundsWorkers(t *testing.T) {
+	files := uploadTestFiles(10)
+	var active, maxActive, calls int32
+
+	results := processConcurrently(context.Background(), discardLogger(), files, 3, func(file types.ForUploadFileInfo) error {
+		current := atomic.AddInt32(&active, 1)
+		for {
+			seen := atomic.LoadInt32(&maxActive)
+			if current <= seen || atomic.CompareAndSwapInt32(&maxActive, seen, current) {
+				break
+			}
+		}
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(5 * time.Millisecond)
+		atomic.AddInt32(&active, -1)
+		return nil
+	})
+
+	assert.Equal(t, int32(10), calls)
+	assert.LessOrEqual(t, maxActive, int32(3))
+	assert.Len(t, results, 10)
+}
+
+func Test_processConcurrentlyKeepsOrder(t *testing.T) {
+	files := uploadTestFiles(8)
+
+	// Первые файлы обрабатываются дольше, чтобы завершиться позже последних
+	results := processConcurrently(context.Background(), discardLogger(), files, 4, func(file types.ForUploadFileInfo) error {
+		var index int
+		fmt.Sscanf(file.Slug, "slug%d", &index)
+		time.Sleep(time.Duration(len(files)-index) * time.Millisecond)
+		if index%2 == 1 {
+			return errors.New("upload error " + file.Slug)
+		}
+		return nil
+	})
+
+	for i, result := range results {
+		assert.Equal(t, files[i].RemoteFileName, result.RemoteFileName)
+		if i%2 == 1 {
+			assert.EqualError(t, result.Err, "upload error "+files[i].Slug)
+		} else {
+			assert.NoError(t, result.Err)
+		}
+	}
+}
+
+func Test_processConcurrentlyCanceled(t *testing.T) {
+	files := uploadTestFiles(5)
+	ctx, cancel := context.WithCancel(context.Background())
+	var calls int32
+
+	results := processConcurrently(ctx, discardLogger(), files, 1, func(file types.ForUploadFileInfo) error {
+		atomic.AddInt32(&calls, 1)
+		cancel()
+		return nil
+	})
+
+	assert.Equal(t, int32(1), calls)
+	assert.NoError(t, results[0].Err)
+	for _, result := range results[1:] {
+		assert.ErrorIs(t, result.Err, context.Canceled)
+	}
+
+	results = processConcurrently(ctx, discardLogger(), files, 2, func(file types.ForUploadFileInfo) error {
+		t.Errorf("file %s must not be processed after cancel", file.Slug)
+		return nil
+	})
+	for _, result := range results {
+		assert.ErrorIs(t, result.Err, context.Canceled)
+	}
+}
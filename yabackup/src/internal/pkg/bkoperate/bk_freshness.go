@@ -0,0 +1,225 @@
+package bkoperate
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+	"ybg/internal/pkg/haoperate"
+	"ybg/internal/types"
+)
+
+const freshnessNotificationId = "yandex_backup_freshness"
+
+// FreshnessPolicy максимально допустимый возраст новейшего бэкапа. 0 - проверка отключена
+type FreshnessPolicy struct {
+	RemoteMaxAge time.Duration
+	LocalMaxAge  time.Duration
+}
+
+func (p FreshnessPolicy) IsEnabled() bool {
+	return p.RemoteMaxAge > 0 || p.LocalMaxAge > 0
+}
+
+// BackupFreshness возраст новейших бэкапов на ЯндексДиске и в локальном хранилище.
+// Возраст -1 - бэкапов нет.
+type BackupFreshness struct {
+	NewestRemote      *time.Time `json:"newest_remote,omitempty"`
+	RemoteAgeHours    float64    `json:"remote_age_hours"`
+	RemoteMaxAgeHours int        `json:"remote_max_age_hours"`
+	NewestLocal       *time.Time `json:"newest_local,omitempty"`
+	LocalAgeHours     float64    `json:"local_age_hours"`
+	LocalMaxAgeHours  int        `json:"local_max_age_hours"`
+	Problems          []string   `json:"problems"`
+	Checked           *time.Time `json:"checked,omitempty"`
+}
+
+func (f BackupFreshness) IsProblem() bool {
+	return len(f.Problems) > 0
+}
+
+// evaluateFreshness оценивает возраст новейших бэкапов. Время бэкапа на ЯндексДиске - время загрузки
+func evaluateFreshness(files []types.BackupFileInfo, policy FreshnessPolicy, now time.Time) BackupFreshness {
+	var newestRemote, newestLocal time.Time
+	for _, file := range files {
+		if file.IsRemote && time.Time(file.Downloaded).After(newestRemote) {
+			newestRemote = time.Time(file.Downloaded)
+		}
+		if file.IsLocal && time.Time(file.GeneralInfo.Modified).After(newestLocal) {
+			newestLocal = time.Time(file.GeneralInfo.Modified)
+		}
+	}
+
+	result := BackupFreshness{
+		RemoteMaxAgeHours: int(policy.RemoteMaxAge.Hours()),
+		LocalMaxAgeHours:  int(policy.LocalMaxAge.Hours()),
+		Problems:          make([]string, 0),
+		Checked:           &now,
+	}
+	result.NewestRemote, result.RemoteAgeHours = backupAge(newestRemote, now)
+	result.NewestLocal, result.LocalAgeHours = backupAge(newestLocal, now)
+
+	if problem := ageProblem("Yandex Disk", newestRemote, result.RemoteAgeHours, policy.RemoteMaxAge); problem != "" {
+		result.Problems = append(result.Problems, problem)
+	}
+	if problem := ageProblem("local storage", newestLocal, result.LocalAgeHours, policy.LocalMaxAge); problem != "" {
+		result.Problems = append(result.Problems, problem)
+	}
+	return result
+}
+
+func backupAge(newest time.Time, now time.Time) (*time.Time, float64) {
+	if newest.IsZero() {
+		return nil, -1
+	}
+	return &newest, math.Round(now.Sub(newest).Hours()*10) / 10
+}
+
+func ageProblem(storage string, newest time.Time, ageHours float64, maxAge time.Duration) string {
+	if maxAge <= 0 {
+		return ""
+	}
+	if newest.IsZero() {
+		return fmt.Sprintf("No backups in %s", storage)
+	}
+	if ageHours > maxAge.Hours() {
+		return fmt.Sprintf("Newest backup in %s is %.1f hours old (maximum %d)", storage, ageHours, int(maxAge.Hours()))
+	}
+	return ""
+}
+
+// failedFreshness результат проверки, в которой не удалось получить список бэкапов. Ошибка проверки - проблема.
+// Если список локальных бэкапов получен (localKnown), оценивается возраст локальных бэкапов
+func failedFreshness(checkErr error, localFiles []types.BackupFileInfo, localKnown bool, policy FreshnessPolicy, now time.Time) BackupFreshness {
+	localPolicy := FreshnessPolicy{}
+	if localKnown {
+		localPolicy.LocalMaxAge = policy.LocalMaxAge
+	}
+	result := evaluateFreshness(localFiles, localPolicy, now)
+	result.RemoteMaxAgeHours = int(policy.RemoteMaxAge.Hours())
+	result.LocalMaxAgeHours = int(policy.LocalMaxAge.Hours())
+	result.Problems = append([]string{fmt.Sprintf("Backup freshness check failed: %v", checkErr)}, result.Problems...)
+	return result
+}
+
+// CheckFreshness проверяет возраст новейших бэкапов и сохраняет результат в статистике.
+// Если проверка не удалась, результат содержит ошибку как проблему и возвращается вместе с ошибкой
+func (bkp *BkProcessor) CheckFreshness() (BackupFreshness, error) {
+	policy := bkp.currentSettings().FreshnessPolicy
+	files, err := bkp.GetFilesInfo()
+
+	var freshness BackupFreshness
+	if err != nil {
+		localFiles := make([]types.BackupFileInfo, 0)
+		local, localErr := getLocalBackupFiles(bkp.haApi, bkp.logger)
+		if localErr != nil {
+			bkp.logger.ErrorLog.Printf("Local backups unknown. Local backup age is not checked. %v", localErr)
+		}
+		for _, file := range local {
+			if file.IsLocal {
+				localFiles = append(localFiles, types.BackupFileInfo{GeneralInfo: file.GeneralInfo, IsLocal: true})
+			}
+		}
+		freshness = failedFreshness(err, localFiles, localErr == nil, policy, time.Now())
+	} else {
+		freshness = evaluateFreshness(files, policy, time.Now())
+	}
+
+	bkp.statisticMu.Lock()
+	bkp.freshness = freshness
+	bkp.statistic.Freshness = freshness
+	bkp.statisticMu.Unlock()
+	return freshness, err
+}
+
+// RunFreshnessWatchdog проверяет возраст бэкапов, обновляет сенсор проблем и
+// создаёт уведомление HA при появлении проблемы (убирает, когда проблема исчезла).
+// Если проверка отключена, сенсор и уведомление один раз сбрасываются
+func (bkp *BkProcessor) RunFreshnessWatchdog() {
+	bkp.freshnessMu.Lock()
+	defer bkp.freshnessMu.Unlock()
+
+	if !bkp.currentSettings().FreshnessPolicy.IsEnabled() {
+		bkp.clearFreshnessProblem()
+		return
+	}
+
+	// Ошибка проверки (например, недействительный токен) тоже считается проблемой
+	freshness, err := bkp.CheckFreshness()
+	if err != nil {
+		bkp.logger.ErrorLog.Printf("Error check backup freshness %v", err)
+	}
+
+	isProblem := freshness.IsProblem()
+	if isProblem {
+		bkp.logger.WarnLog.Printf("Backups are stale: %s", strings.Join(freshness.Problems, "; "))
+	} else {
+		bkp.logger.DebugLog.Printf("Backups are fresh. Remote age %.1f h, local age %.1f h", freshness.RemoteAgeHours, freshness.LocalAgeHours)
+	}
+
+	err = bkp.haApi.SetProblemState(isProblem, problemAttributes(freshness))
+	if err != nil {
+		bkp.logger.ErrorLog.Printf("Error set problem entity %v", err)
+	}
+
+	if bkp.freshnessProblemReported != nil && *bkp.freshnessProblemReported == isProblem {
+		return
+	}
+	if isProblem {
+		err = bkp.haApi.CreateNotification(freshnessNotificationId, "Yandex backup: backups are stale",
+			strings.Join(freshness.Problems, "\n"))
+	} else {
+		err = bkp.haApi.DismissNotification(freshnessNotificationId)
+	}
+	if err != nil {
+		bkp.logger.ErrorLog.Printf("Error update freshness notification %v", err)
+		return
+	}
+	bkp.freshnessProblemReported = &isProblem
+}
+
+// clearFreshnessProblem сбрасывает проблему, оставшуюся от включённой проверки
+// (настройки изменены без перезапуска или аддон перезапущен с отключённой проверкой)
+func (bkp *BkProcessor) clearFreshnessProblem() {
+	if bkp.freshnessProblemReported != nil && !*bkp.freshnessProblemReported {
+		return
+	}
+
+	bkp.statisticMu.Lock()
+	bkp.freshness = BackupFreshness{}
+	bkp.statistic.Freshness = BackupFreshness{}
+	bkp.statisticMu.Unlock()
+
+	err := bkp.haApi.SetProblemState(false, problemAttributes(BackupFreshness{}))
+	if err != nil {
+		bkp.logger.ErrorLog.Printf("Error set problem entity %v", err)
+		return
+	}
+	err = bkp.haApi.DismissNotification(freshnessNotificationId)
+	if err != nil {
+		bkp.logger.ErrorLog.Printf("Error update freshness notification %v", err)
+		return
+	}
+	bkp.logger.InfoLog.Printf("Backup freshness check is disabled, problem state is cleared")
+	isProblem := false
+	bkp.freshnessProblemReported = &isProblem
+}
+
+func problemAttributes(freshness BackupFreshness) haoperate.ProblemAttributes {
+	attributes := haoperate.ProblemAttributes{
+		FriendlyName:      "Yandex backup problem",
+		Problems:          freshness.Problems,
+		RemoteMaxAgeHours: freshness.RemoteMaxAgeHours,
+		LocalMaxAgeHours:  freshness.LocalMaxAgeHours,
+	}
+	if freshness.NewestRemote != nil {
+		attributes.RemoteAgeHours = &freshness.RemoteAgeHours
+	}
+	if freshness.NewestLocal != nil {
+		attributes.LocalAgeHours = &freshness.LocalAgeHours
+	}
+	if freshness.Checked != nil {
+		attributes.Checked = freshness.Checked.Format(time.RFC3339)
+	}
+	return attributes
+}
@@ -0,0 +1,109 @@
+package bkoperate
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"ybg/internal/pkg/haoperate"
+	"ybg/internal/types"
+)
+
+func Test_evaluateFreshness(t *testing.T) {
+	now := time.Date(2026, time.October, 19, 12, 0, 0, 0, time.UTC)
+	hoursAgo := func(hours int) types.FileModified {
+		return types.FileModified(now.Add(-time.Duration(hours) * time.Hour))
+	}
+	files := []types.BackupFileInfo{
+		{IsLocal: true, IsRemote: true, GeneralInfo: types.GeneralFileInfo{Modified: hoursAgo(80)}, Downloaded: hoursAgo(72)},
+		{IsLocal: true, GeneralInfo: types.GeneralFileInfo{Modified: hoursAgo(10)}},
+		{IsRemote: true, Downloaded: hoursAgo(100)},
+	}
+	policy := FreshnessPolicy{RemoteMaxAge: 48 * time.Hour, LocalMaxAge: 24 * time.Hour}
+
+	freshness := evaluateFreshness(files, policy, now)
+	assert.Equal(t, 72.0, freshness.RemoteAgeHours)
+	assert.Equal(t, 10.0, freshness.LocalAgeHours)
+	assert.Equal(t, []string{"Newest backup in Yandex Disk is 72.0 hours old (maximum 48)"}, freshness.Problems)
+	assert.True(t, freshness.IsProblem())
+
+	freshness = evaluateFreshness(files, FreshnessPolicy{RemoteMaxAge: 96 * time.Hour}, now)
+	assert.False(t, freshness.IsProblem())
+
+	freshness = evaluateFreshness(nil, policy, now)
+	assert.Equal(t, -1.0, freshness.RemoteAgeHours)
+	assert.Nil(t, freshness.NewestLocal)
+	assert.Equal(t, []string{"No backups in Yandex Disk", "No backups in local storage"}, freshness.Problems)
+}
+
+func Test_failedFreshness(t *testing.T) {
+	now := time.Date(2026, time.October, 19, 12, 0, 0, 0, time.UTC)
+	policy := FreshnessPolicy{RemoteMaxAge: 48 * time.Hour, LocalMaxAge: 24 * time.Hour}
+	localFiles := []types.BackupFileInfo{
+		{IsLocal: true, GeneralInfo: types.GeneralFileInfo{Modified: types.FileModified(now.Add(-30 * time.Hour))}},
+	}
+	checkErr := errors.New("unauthorized")
+
+	freshness := failedFreshness(checkErr, localFiles, true, policy, now)
+	assert.Equal(t, []string{"Backup freshness check failed: unauthorized",
+		"Newest backup in local storage is 30.0 hours old (maximum 24)"}, freshness.Problems)
+	assert.Equal(t, 30.0, freshness.LocalAgeHours)
+	assert.Nil(t, freshness.NewestRemote)
+	assert.Equal(t, 48, freshness.RemoteMaxAgeHours)
+
+	freshness = failedFreshness(checkErr, nil, false, policy, now)
+	assert.Equal(t, []string{"Backup freshness check failed: unauthorized"}, freshness.Problems)
+	assert.True(t, freshness.IsProblem())
+}
+
+// haRecorder запоминает пути запросов к HA и отвечает status
+type haRecorder struct {
+	mu     sync.Mutex
+	paths  []string
+	status int
+}
+
+func (r *haRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.paths = append(r.paths, req.URL.Path)
+	return &http.Response{StatusCode: r.status, Body: io.NopCloser(strings.NewReader("[]")), Request: req}, nil
+}
+
+func (r *haRecorder) take() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	paths := r.paths
+	r.paths = nil
+	return paths
+}
+
+func Test_RunFreshnessWatchdogClearsProblemWhenDisabled(t *testing.T) {
+	recorder := &haRecorder{status: http.StatusInternalServerError}
+	haApi, err := haoperate.NewHaApi("", context.Background(), &http.Client{Transport: recorder}, "token", discardLogger())
+	assert.NoError(t, err)
+
+	reported := true
+	bkp := &BkProcessor{haApi: haApi, logger: discardLogger(), freshnessProblemReported: &reported,
+		freshness: BackupFreshness{Problems: []string{"stale"}}}
+	clearRequests := []string{"/core/api/states/" + haApi.ProblemEntityId(), "/core/api/services/persistent_notification/dismiss"}
+
+	// HA недоступен: сброс повторяется при следующем запуске
+	bkp.RunFreshnessWatchdog()
+	assert.Equal(t, clearRequests[:1], recorder.take())
+	assert.True(t, *bkp.freshnessProblemReported)
+
+	recorder.status = http.StatusOK
+	bkp.RunFreshnessWatchdog()
+	assert.Equal(t, clearRequests, recorder.take())
+	assert.False(t, *bkp.freshnessProblemReported)
+	assert.Empty(t, bkp.freshness.Problems)
+
+	bkp.RunFreshnessWatchdog()
+	assert.Empty(t, recorder.take())
+}
@@ -0,0 +1,105 @@
+package bkoperate
+
+import (
+	"fmt"
+	"sort"
+	"ybg/internal/types"
+)
+
+const unknownBackupType = "unknown"
+
+// LocalRetention настройки удаления старых локальных бэкапов
+type LocalRetention struct {
+	MaxFiles          int            // Максимальное количество локальных бэкапов
+	IncludeAllBackups bool           // Удалять не только бэкапы, созданные аддоном
+	MinimumFreeSpace  types.FileSize // Целевой объём свободного места. 0 - не учитывается
+	KeepPerType       int            // Количество новейших бэкапов каждого типа, которые не удаляются никогда. 0 - не учитывается
+}
+
+// LocalFileToDelete локальный бэкап, выбранный для удаления (или оставленный), и причина решения
+type LocalFileToDelete struct {
+	File   types.LocalBackupFileInfo
+	Reason string
+}
+
+// localRetentionState исходные данные для выбора локальных бэкапов на удаление
+type localRetentionState struct {
+	files          []types.LocalBackupFileInfo
+	remoteSlugs    map[string]bool // Бэкапы, наличие которых на ЯндексДиске подтверждено
+	pendingBackups int             // Бэкапы, которые будут созданы до удаления
+	freeSpace      types.FileSize
+	freeSpaceKnown bool
+}
+
+// selectLocalFilesToDelete выбирает локальные бэкапы на удаление.
+// Кандидаты: бэкапы сверх MaxFiles (самые старые) и, пока свободного места меньше MinimumFreeSpace, следующие по возрасту.
+// Кандидат не удаляется, если он не загружен на ЯндексДиск или входит в KeepPerType новейших бэкапов своего типа.
+// Возвращает бэкапы на удаление и кандидатов, которые оставлены (с причиной)
+func selectLocalFilesToDelete(policy LocalRetention, state localRetentionState) ([]LocalFileToDelete, []LocalFileToDelete) {
+	toDelete := make([]LocalFileToDelete, 0)
+	kept := make([]LocalFileToDelete, 0)
+
+	files := make([]types.LocalBackupFileInfo, len(state.files))
+	copy(files, state.files)
+	// Новые бэкапы идут первыми
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].GeneralInfo.Created.After(files[j].GeneralInfo.Created)
+	})
+
+	protected := make(map[string]bool)
+	if policy.KeepPerType > 0 {
+		perType := make(map[string]int)
+		for _, file := range files {
+			backupType := localBackupType(file)
+			if perType[backupType] < policy.KeepPerType {
+				perType[backupType]++
+				protected[file.BackupSlug] = true
+			}
+		}
+	}
+
+	keep := policy.MaxFiles - state.pendingBackups
+	if keep < 0 {
+		keep = 0
+	}
+
+	needFreeSpace := types.FileSize(0)
+	if policy.MinimumFreeSpace > 0 && state.freeSpaceKnown && state.freeSpace < policy.MinimumFreeSpace {
+		needFreeSpace = policy.MinimumFreeSpace - state.freeSpace
+	}
+
+	// Старые бэкапы рассматриваются первыми
+	for i := len(files) - 1; i >= 0; i-- {
+		file := files[i]
+
+		reason := ""
+		if i >= keep {
+			reason = fmt.Sprintf("more than %d local backups", policy.MaxFiles)
+		} else if needFreeSpace > 0 {
+			reason = fmt.Sprintf("free space below %s MB", policy.MinimumFreeSpace.Convert2MbString())
+		} else {
+			continue
+		}
+
+		switch {
+		case protected[file.BackupSlug]:
+			kept = append(kept, LocalFileToDelete{File: file,
+				Reason: fmt.Sprintf("kept: one of %d newest %s backups", policy.KeepPerType, localBackupType(file))})
+		case !state.remoteSlugs[file.BackupSlug]:
+			kept = append(kept, LocalFileToDelete{File: file,
+				Reason: "kept: not uploaded to Yandex Disk"})
+		default:
+			toDelete = append(toDelete, LocalFileToDelete{File: file, Reason: reason})
+			needFreeSpace -= file.GeneralInfo.Size
+		}
+	}
+
+	return toDelete, kept
+}
+
+func localBackupType(file types.LocalBackupFileInfo) string {
+	if file.BackupArchInfo == nil || file.BackupArchInfo.BackupType == "" {
+		return unknownBackupType
+	}
+	return file.BackupArchInfo.BackupType
+}
@@ -0,0 +1,97 @@
+package bkoperate
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+	"ybg/internal/types"
+)
+
+func Test_selectLocalFilesToDelete(t *testing.T) {
+	day := func(d int) types.FileModified {
+		return types.FileModified(time.Date(2026, 10, d, 0, 0, 0, 0, time.UTC))
+	}
+	backup := func(slug string, d int, backupType string) types.LocalBackupFileInfo {
+		return types.LocalBackupFileInfo{
+			BackupSlug:     slug,
+			GeneralInfo:    types.GeneralFileInfo{Created: day(d), Size: types.MiBToFileSize(100)},
+			BackupArchInfo: &types.BackupArchInfo{BackupType: backupType},
+			IsLocal:        true,
+		}
+	}
+	files := []types.LocalBackupFileInfo{
+		backup("d1", 1, "full"),
+		backup("d2", 2, "partial"),
+		backup("d3", 3, "full"),
+		backup("d4", 4, "full"),
+		backup("d5", 5, "full"),
+	}
+	allRemote := map[string]bool{"d1": true, "d2": true, "d3": true, "d4": true, "d5": true}
+
+	slugs := func(files []LocalFileToDelete) []string {
+		result := make([]string, 0)
+		for _, file := range files {
+			result = append(result, file.File.BackupSlug)
+		}
+		return result
+	}
+
+	tests := []struct {
+		name       string
+		policy     LocalRetention
+		state      localRetentionState
+		wantDelete []string
+		wantKept   []string
+	}{
+		{
+			name:       "by count",
+			policy:     LocalRetention{MaxFiles: 3},
+			state:      localRetentionState{files: files, remoteSlugs: allRemote},
+			wantDelete: []string{"d1", "d2"},
+			wantKept:   []string{},
+		},
+		{
+			name:       "pending backup takes a slot",
+			policy:     LocalRetention{MaxFiles: 3},
+			state:      localRetentionState{files: files, remoteSlugs: allRemote, pendingBackups: 1},
+			wantDelete: []string{"d1", "d2", "d3"},
+			wantKept:   []string{},
+		},
+		{
+			name:       "not uploaded is kept",
+			policy:     LocalRetention{MaxFiles: 3},
+			state:      localRetentionState{files: files, remoteSlugs: map[string]bool{"d2": true}},
+			wantDelete: []string{"d2"},
+			wantKept:   []string{"d1"},
+		},
+		{
+			name:       "newest per type is kept",
+			policy:     LocalRetention{MaxFiles: 3, KeepPerType: 1},
+			state:      localRetentionState{files: files, remoteSlugs: allRemote},
+			wantDelete: []string{"d1"},
+			wantKept:   []string{"d2"},
+		},
+		{
+			name:   "free space target",
+			policy: LocalRetention{MaxFiles: 10, MinimumFreeSpace: types.MiBToFileSize(1000)},
+			state: localRetentionState{files: files, remoteSlugs: allRemote,
+				freeSpace: types.MiBToFileSize(850), freeSpaceKnown: true},
+			wantDelete: []string{"d1", "d2"},
+			wantKept:   []string{},
+		},
+		{
+			name:       "unknown free space ignored",
+			policy:     LocalRetention{MaxFiles: 10, MinimumFreeSpace: types.MiBToFileSize(1000)},
+			state:      localRetentionState{files: files, remoteSlugs: allRemote},
+			wantDelete: []string{},
+			wantKept:   []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			toDelete, kept := selectLocalFilesToDelete(tt.policy, tt.state)
+			assert.Equal(t, tt.wantDelete, slugs(toDelete))
+			assert.Equal(t, tt.wantKept, slugs(kept))
+		})
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"path"
 	"regexp"
+	"slices"
 	"sort"
 	"strings"
 	"sync"
@@ -20,9 +22,10 @@ import (
 const BACKUP_PATH = "/backup"
 
 type Statistic struct {
-	YaDisk         types.StorageStatistic
-	LocalStorage   types.StorageStatistic
-	NetworkStorage map[string]types.StorageStatistic
+	YaDisk         types.StorageStatistic            `json:"yandex_disk"`
+	LocalStorage   types.StorageStatistic            `json:"local_storage"`
+	NetworkStorage map[string]types.StorageStatistic `json:"network_storage"`
+	Freshness      BackupFreshness                   `json:"freshness"`
 }
 
 type HaStatistic struct {
@@ -31,57 +34,55 @@ type HaStatistic struct {
 }
 
 type BkProcessor struct {
-	YaDProcessor                   *yadiskoperate.YaDProcessor
-	haApi                          *haoperate.HaApiClient
-	operationManager               *om.OperationManager
-	remoteMaximumFilesQuantity     int
-	enabledNetworkStorages         map[string]struct{}
-	enableUploadFromNetworkStorage bool
-	statisticMu                    sync.RWMutex
-	statistic                      Statistic
-	isStatisticValid               bool
-	logger                         *mylogger.Logger
-	pollInterval                   time.Duration
-	checkJobTimeout                time.Duration
-	waitCreateBackupInterval       time.Duration
-	waitCreateBackupTimeout        time.Duration
-	deleteFilePattern              string
-	maxLocalFileAmount             int
-	applCtx                        context.Context
+	YaDProcessor             *yadiskoperate.YaDProcessor
+	haApi                    *haoperate.HaApiClient
+	operationManager         *om.OperationManager
+	settingsMu               sync.RWMutex
+	settings                 Settings
+	statisticMu              sync.RWMutex
+	statistic                Statistic
+	isStatisticValid         bool
+	logger                   *mylogger.Logger
+	pollInterval             time.Duration
+	checkJobTimeout          time.Duration
+	waitCreateBackupInterval time.Duration
+	waitCreateBackupTimeout  time.Duration
+	deleteFilePattern        string
+	freshness                BackupFreshness
+	freshnessMu              sync.Mutex
+	freshnessProblemReported *bool
+	countersMu               sync.Mutex
+	counters                 TransferCounters
+	verificationHistory      *VerificationHistory
+	uploadHashes             *UploadHashes
+	applCtx                  context.Context
 }
 
 func NewBkProcessor(applCtx context.Context,
 	yaDP *yadiskoperate.YaDProcessor, haApi *haoperate.HaApiClient, operationManager *om.OperationManager,
-	remoteMaximumFilesQuantity int, enableUploadFromNetworkStorage bool,
-	enabledNetworkStorages []string,
-	maxLocalFileAmount int,
+	settings Settings,
 	logger *mylogger.Logger) *BkProcessor {
 
-	m := make(map[string]struct{})
-	for _, element := range enabledNetworkStorages {
-		m[strings.TrimSpace(element)] = struct{}{}
-	}
 	return &BkProcessor{
-		YaDProcessor:                      yaDP,
-		haApi:                             haApi,
-		operationManager:                  operationManager,
-		remoteMaximumFilesQuantity:        remoteMaximumFilesQuantity,
-		enableUploadFromNetworkStorage:    enableUploadFromNetworkStorage,
-		enabledNetworkStorages:            m,
-		logger:                            logger,
-		isStatisticValid:                  false,
-		pollInterval:                      time.Minute,
-		checkJobTimeout:                   30 * time.Minute,
-		waitCreateBackupInterval:          time.Minute,
-		waitCreateBackupTimeout:           30 * time.Minute,
-		deleteFilePattern:                 "Y_Backup",
-		maxLocalFileAmount:                maxLocalFileAmount,
-		applCtx:                           applCtx,
+		YaDProcessor:             yaDP,
+		haApi:                    haApi,
+		operationManager:         operationManager,
+		settings:                 normalizeSettings(settings),
+		logger:                   logger,
+		isStatisticValid:         false,
+		pollInterval:             time.Minute,
+		checkJobTimeout:          30 * time.Minute,
+		waitCreateBackupInterval: time.Minute,
+		waitCreateBackupTimeout:  30 * time.Minute,
+		deleteFilePattern:        "Y_Backup",
+		verificationHistory:      loadVerificationHistory(verificationHistoryPath, logger),
+		uploadHashes:             loadUploadHashes(uploadHashesPath, logger),
+		applCtx:                  applCtx,
 	}
 }
 
 func (bkp *BkProcessor) DeleteOldLocalFiles() error {
-	files, err := bkp.GetOldLocalFiles(bkp.deleteFilePattern, bkp.maxLocalFileAmount)
+	files, _, err := bkp.ChooseLocalFilesToDelete(0)
 	if err != nil {
 		return err
 	}
@@ -92,11 +93,17 @@ func (bkp *BkProcessor) DeleteOldLocalFiles() error {
 		return nil
 	}
 
+	locations := bkp.currentSettings().BackupLocations
 	for _, file := range files {
-		slug := file.BackupSlug
-		fileName := file.BackupName
-		bkp.logger.DebugLog.Printf("Deleting old file [slug: %s, name: %s]", slug, fileName)
-		err = bkp.haApi.DeleteBackup(slug)
+		slug := file.File.BackupSlug
+		fileName := file.File.BackupName
+		bkp.logger.DebugLog.Printf("Deleting old file [slug: %s, name: %s, reason: %s]", slug, fileName, file.Reason)
+		if isInBackupLocation(file.File, locations) {
+			// Копии в хранилищах бэкапов удаляются по их собственному ограничению количества
+			err = bkp.haApi.DeleteBackupFromLocation(slug, haoperate.LocalLocation)
+		} else {
+			err = bkp.haApi.DeleteBackup(slug)
+		}
 
 		if err != nil {
 			bkp.logger.ErrorLog.Printf("Error when delete file [slug: %s, name: %s] %v", slug, fileName, err)
@@ -108,6 +115,62 @@ func (bkp *BkProcessor) DeleteOldLocalFiles() error {
 	return nil
 }
 
+// ChooseLocalFilesToDelete выбирает старые локальные бэкапы для удаления.
+// Удаляются только бэкапы, загруженные на ЯндексДиск. Вторым значением возвращаются бэкапы,
+// которые подходили для удаления, но оставлены (с причиной).
+// pendingBackups - количество бэкапов, которые будут созданы до удаления (используется в плане загрузки)
+func (bkp *BkProcessor) ChooseLocalFilesToDelete(pendingBackups int) ([]LocalFileToDelete, []LocalFileToDelete, error) {
+	retention := bkp.currentSettings().LocalRetention
+	pattern := bkp.deleteFilePattern
+	if retention.IncludeAllBackups {
+		pattern = ""
+	}
+
+	files, err := bkp.GetLocalFiles(pattern)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	state := localRetentionState{
+		files:          files,
+		remoteSlugs:    make(map[string]bool),
+		pendingBackups: pendingBackups,
+	}
+
+	filesInfo, err := bkp.GetFilesInfo()
+	if err != nil {
+		// Без списка файлов на ЯндексДиске ни один бэкап не считается загруженным
+		bkp.logger.ErrorLog.Printf("Remote files unknown. Local files will not be deleted. %v", err)
+	}
+	for _, file := range filesInfo {
+		if file.IsRemote && file.BackupSlug != "" {
+			state.remoteSlugs[file.BackupSlug] = true
+		}
+	}
+
+	if retention.MinimumFreeSpace > 0 {
+		haStatistic, err := bkp.GetHaStatistic()
+		if err != nil {
+			bkp.logger.ErrorLog.Printf("Local free space unknown. Free space target is ignored. %v", err)
+		} else {
+			state.freeSpace = haStatistic.LocalStorage.FreeSpace
+			state.freeSpaceKnown = true
+		}
+	}
+
+	toDelete, kept := selectLocalFilesToDelete(retention, state)
+
+	bkp.logger.InfoLog.Printf("Local rotation: %d backups, %d to delete, %d kept [policy %+v]",
+		len(files), len(toDelete), len(kept), retention)
+	for _, file := range toDelete {
+		bkp.logger.InfoLog.Printf("Local backup will be deleted [slug: %s, name: %s]: %s", file.File.BackupSlug, file.File.BackupName, file.Reason)
+	}
+	for _, file := range kept {
+		bkp.logger.InfoLog.Printf("Local backup is not deleted [slug: %s, name: %s]: %s", file.File.BackupSlug, file.File.BackupName, file.Reason)
+	}
+	return toDelete, kept, nil
+}
+
 func (bkp *BkProcessor) GetOldLocalFiles(nameMaskPattern string, maxFileAmount int) ([]types.LocalBackupFileInfo, error) {
 	result := make([]types.LocalBackupFileInfo, 0)
 
@@ -171,48 +234,80 @@ func (bkp *BkProcessor) GetFilesInfo() ([]types.BackupFileInfo, error) {
 		return make([]types.BackupFileInfo, 0), err
 	}
 
-	return intersectFiles(localFiles, remoteFiles)
+	return intersectFiles(localFiles, remoteFiles, bkp.currentSettings().FileNameTemplate)
 }
 
 func (bkp *BkProcessor) ChooseFilesToUpload(files []types.BackupFileInfo) []types.ForUploadFileInfo {
+	result, _ := bkp.ChooseFilesToUploadFiltered(files)
+	return result
+}
+
+// ChooseFilesToUploadFiltered выбирает файлы для загрузки. Вторым значением возвращаются файлы,
+// не прошедшие фильтр загрузки (с причиной)
+func (bkp *BkProcessor) ChooseFilesToUploadFiltered(files []types.BackupFileInfo) ([]types.ForUploadFileInfo, []SkippedUploadFile) {
+	settings := bkp.currentSettings()
 	result := make([]types.ForUploadFileInfo, 0)
+	excluded := make([]SkippedUploadFile, 0)
 	for _, file := range files {
 
 		if !file.IsRemote {
 			// Файл ещё не загружен
+			var uploadFile types.ForUploadFileInfo
 			if file.IsLocal {
 				// Файл локальный. Грузится всегда
-				result = append(result, types.ForUploadFileInfo{
+				uploadFile = types.ForUploadFileInfo{
 					LocalFileInfo:  file.GeneralInfo,
-					RemoteFileName: file.RemoteFileName,
+					RemoteFileName: remoteUploadName(file, settings.RemoteSubfolderLayout),
 					Slug:           file.BackupSlug,
 					IsLocal:        true,
 					IsNetwork:      false,
-				})
-			} else if file.IsNetwork && bkp.enableUploadFromNetworkStorage && bkp.isNetworkStorageEnabled(file.Location) {
+				}
+			} else if file.IsNetwork && settings.EnableUploadFromNetworkStorage && bkp.isNetworkStorageEnabled(settings, file.Location) {
 				// Файл из сетевого хранилища. Разрешён к загрузке
-				result = append(result, types.ForUploadFileInfo{
+				uploadFile = types.ForUploadFileInfo{
 					LocalFileInfo:  file.GeneralInfo,
-					RemoteFileName: file.RemoteFileName,
+					RemoteFileName: remoteUploadName(file, settings.RemoteSubfolderLayout),
 					NetworkFileInfo: types.NetworkFileInfo{
 						Location: file.Location,
 					},
 					Slug:      file.BackupSlug,
 					IsLocal:   false,
 					IsNetwork: true,
-				})
+				}
+			} else {
+				continue
+			}
+
+			if reason := settings.UploadFilter.Exclusion(file); reason != "" {
+				bkp.logger.DebugLog.Printf("File %s excluded by upload filter: %s", file.BackupName, reason)
+				excluded = append(excluded, SkippedUploadFile{File: uploadFile, Reason: "excluded by upload filter: " + reason})
+				continue
 			}
+			result = append(result, uploadFile)
 		}
 	}
-	return result
+	return result, excluded
+}
+
+// remoteUploadName возвращает путь файла относительно remote_path с учётом датированных подкаталогов
+func remoteUploadName(file types.BackupFileInfo, subfolderLayout string) string {
+	if subfolderLayout == "" {
+		return file.RemoteFileName
+	}
+
+	created := time.Time(file.GeneralInfo.Created)
+	if created.IsZero() {
+		created = time.Now()
+	}
+	return path.Join(created.Format(subfolderLayout), file.RemoteFileName)
 }
 
-func (bkp *BkProcessor) isNetworkStorageEnabled(storage string) bool {
-	if len(bkp.enabledNetworkStorages) == 0 {
+func (bkp *BkProcessor) isNetworkStorageEnabled(settings Settings, storage string) bool {
+	if len(settings.EnabledNetworkStorages) == 0 {
 		bkp.logger.DebugLog.Println("Enabled upload from any network storage")
 		return true
 	}
-	_, ok := bkp.enabledNetworkStorages[strings.TrimSpace(storage)]
+	ok := slices.Contains(settings.EnabledNetworkStorages, strings.TrimSpace(storage))
 	if ok {
 		bkp.logger.DebugLog.Printf("Enabled upload from '%s' network storage", storage)
 	} else {
@@ -221,8 +316,11 @@ func (bkp *BkProcessor) isNetworkStorageEnabled(storage string) bool {
 	return ok
 }
 
-func (bkp *BkProcessor) UploadFiles(files []types.ForUploadFileInfo) (ProcessedFilesResult, error) {
-	return UploadFiles(bkp, files)
+// UploadFiles загружает файлы на ЯндексДиск. parentOperationId - операция, шагом которой является загрузка (может быть пустым)
+func (bkp *BkProcessor) UploadFiles(files []types.ForUploadFileInfo, parentOperationId string) (ProcessedFilesResult, error) {
+	result, err := UploadFiles(bkp, files, parentOperationId)
+	bkp.addUploadResult(result)
+	return result, err
 }
 
 func (bkp *BkProcessor) ChooseFilesToDelete(files []types.BackupFileInfo, uploadFileCount int) []types.ForDeleteFileInfo {
@@ -236,8 +334,9 @@ func (bkp *BkProcessor) ChooseFilesToDelete(files []types.BackupFileInfo, upload
 	}
 
 	fileAmount := uploadFileCount + len(remoteFiles)
+	maximumFilesQuantity := bkp.currentSettings().RemoteMaximumFilesQuantity
 
-	if bkp.remoteMaximumFilesQuantity >= fileAmount {
+	if maximumFilesQuantity >= fileAmount {
 		bkp.logger.InfoLog.Printf("Not need delete files")
 		return result
 	}
@@ -252,7 +351,7 @@ func (bkp *BkProcessor) ChooseFilesToDelete(files []types.BackupFileInfo, upload
 			MD5:      "",
 			FileInfo: file.GeneralInfo})
 		fileAmount--
-		if bkp.remoteMaximumFilesQuantity >= fileAmount {
+		if maximumFilesQuantity >= fileAmount {
 			break
 		}
 	}
@@ -277,6 +376,7 @@ func (bkp *BkProcessor) DeleteFiles(files []types.ForDeleteFileInfo) (ProcessedF
 		} else {
 			deleted++
 			processedSize += file.FileInfo.Size
+			bkp.uploadHashes.remove(file.RemoteFileName)
 		}
 	}
 	err := fmt.Errorf("plug")
@@ -284,10 +384,11 @@ func (bkp *BkProcessor) DeleteFiles(files []types.ForDeleteFileInfo) (ProcessedF
 	if isError {
 		err = fmt.Errorf("error when delete files")
 	}
-	return ProcessedFilesResult{Ok: deleted,
-			Error:         errorDeleted,
-			ProcessedSize: processedSize},
-		err
+	result := ProcessedFilesResult{Ok: deleted,
+		Error:         errorDeleted,
+		ProcessedSize: processedSize}
+	bkp.addDeleteResult(result)
+	return result, err
 }
 
 func (bkp *BkProcessor) GetStatistic() (Statistic, error) {
@@ -348,6 +449,7 @@ func (bkp *BkProcessor) UpdateAndGetStatistic() (Statistic, error) {
 
 	result.NetworkStorage = haStatistic.NetworkStorage
 	result.LocalStorage = haStatistic.LocalStorage
+	result.Freshness = bkp.freshness
 	bkp.statistic = result
 	bkp.isStatisticValid = !isError
 	return result, nil
@@ -374,8 +476,8 @@ func (bkp *BkProcessor) GetHaStatistic() (HaStatistic, error) {
 
 }
 
-func (bkp *BkProcessor) CreateFullBackupSync() (bool, error) {
-	operationId, err := bkp.CreateFullBackupAsync()
+func (bkp *BkProcessor) CreateFullBackupSync(parentOperationId string) (bool, error) {
+	operationId, err := bkp.CreateFullBackupAsync(parentOperationId)
 	if err != nil {
 		return true, err
 	}
@@ -390,16 +492,18 @@ func (bkp *BkProcessor) CreateFullBackupSync() (bool, error) {
 	return response.IsError, nil
 }
 
-func (bkp *BkProcessor) CreateFullBackupAsync() (string, error) {
+func (bkp *BkProcessor) CreateFullBackupAsync(parentOperationId string) (string, error) {
 	backupName := "Full_Y_Backup_" + time.Now().Format(time.DateTime)
 	createBackupResult, err := bkp.haApi.CreateFullBackup(backupName)
 	if err != nil {
 		bkp.logger.ErrorLog.Printf("Error create full backup %s", err)
 		return "", err
 	}
-	const operationId = "create_backup"
-	bkp.operationManager.StartOperation(operationId, "backup creating")
-	go bkp.backgroundPolling(bkp.applCtx, createBackupResult.Job, operationId,
+	// Идентификатор уникален, чтобы состояние предыдущего создания бэкапа не перетиралось
+	operationId := "create_backup_" + time.Now().Format("20060102150405")
+	ctx := bkp.operationManager.StartCancelableOperation(bkp.applCtx, operationId, "backup creating")
+	bkp.operationManager.SetOperationType(operationId, om.OperationTypeCreateBackup, parentOperationId)
+	go bkp.backgroundPolling(ctx, createBackupResult.Job, operationId,
 		func(withError bool, errorMessage string) bool {
 			bkp.registerBackupResult(withError, errorMessage)
 			return true
@@ -444,6 +548,10 @@ func (bkp *BkProcessor) backgroundPolling(parentCtx context.Context, jobID strin
 			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
 				bkp.logger.DebugLog.Printf("Stop periodical job checker by timeout (%v) [JobId %s]", bkp.checkJobTimeout, jobID)
 
+			} else if bkp.applCtx.Err() == nil {
+				// Отмена пользователем. Задание supervisor при этом не прерывается
+				bkp.logger.InfoLog.Printf("Stop periodical job checker by cancel [JobId %s]", jobID)
+				bkp.operationManager.ErrorDone(operationId, "Waiting for backup canceled")
 			} else {
 				bkp.logger.DebugLog.Printf("Stop periodical job checker by shutdown [JobId %s]", jobID)
 			}
@@ -479,6 +587,6 @@ func (bkp *BkProcessor) checkStatus(ctx context.Context, jobId string, operation
 		return true, false, ""
 	}
 
-	bkp.logger.DebugLog.Printf("Job steel work. [JobId %s]: %s", jobId)
+	bkp.logger.DebugLog.Printf("Job steel work. [JobId %s]", jobId)
 	return false, false, ""
 }
@@ -0,0 +1,179 @@
+package bkoperate
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"ybg/internal/types"
+)
+
+// RemoteSpacePolicy проверка свободного места на ЯндексДиске перед загрузкой.
+// RotateToFit - удалять старые файлы на ЯндексДиске, чтобы освободить место, оставляя не менее MinimumFilesQuantity файлов.
+type RemoteSpacePolicy struct {
+	Check                bool
+	RotateToFit          bool
+	MinimumFilesQuantity int
+}
+
+// SkippedUploadFile файл, который не будет загружен
+type SkippedUploadFile struct {
+	File   types.ForUploadFileInfo
+	Reason string
+}
+
+// RemoteSpacePlan результат проверки места: что загружать, что удалить перед загрузкой и что пропустить
+type RemoteSpacePlan struct {
+	FreeSpace types.FileSize
+	ToUpload  []types.ForUploadFileInfo
+	ToDelete  []types.ForDeleteFileInfo
+	Skipped   []SkippedUploadFile
+}
+
+// planRemoteSpace распределяет свободное место между файлами, начиная с самых новых бэкапов.
+// Файл, для которого места не хватает, пропускается. При RotateToFit для него удаляются самые старые файлы на ЯндексДиске,
+// если их удаление освобождает достаточно места.
+func planRemoteSpace(files []types.BackupFileInfo, toUpload []types.ForUploadFileInfo, freeSpace types.FileSize, policy RemoteSpacePolicy) RemoteSpacePlan {
+	newestFirst := make([]types.ForUploadFileInfo, len(toUpload))
+	copy(newestFirst, toUpload)
+	sort.SliceStable(newestFirst, func(i, j int) bool {
+		return time.Time(newestFirst[i].LocalFileInfo.Modified).After(time.Time(newestFirst[j].LocalFileInfo.Modified))
+	})
+
+	plan := RemoteSpacePlan{
+		FreeSpace: freeSpace,
+		ToUpload:  make([]types.ForUploadFileInfo, 0, len(toUpload)),
+		ToDelete:  make([]types.ForDeleteFileInfo, 0),
+		Skipped:   make([]SkippedUploadFile, 0),
+	}
+
+	// Кандидаты на удаление. Старые файлы идут первыми
+	remoteFiles := make([]types.BackupFileInfo, 0)
+	for _, file := range files {
+		if file.IsRemote {
+			remoteFiles = append(remoteFiles, file)
+		}
+	}
+	sort.Slice(remoteFiles, func(i, j int) bool {
+		return time.Time(remoteFiles[i].GeneralInfo.Modified).Before(time.Time(remoteFiles[j].GeneralInfo.Modified))
+	})
+
+	available := freeSpace
+	for _, file := range newestFirst {
+		size := file.LocalFileInfo.Size
+		if policy.RotateToFit && available < size {
+			// Файлы удаляются, только если их удаление действительно освобождает место для загрузки
+			rotate, freed := filesToFree(remoteFiles, size-available, policy.MinimumFilesQuantity)
+			if available+freed >= size {
+				for _, oldest := range remoteFiles[:rotate] {
+					plan.ToDelete = append(plan.ToDelete, types.ForDeleteFileInfo{RemoteFileName: oldest.RemoteFileName,
+						FileInfo: oldest.GeneralInfo})
+				}
+				remoteFiles = remoteFiles[rotate:]
+				available += freed
+			}
+		}
+
+		if available < size {
+			plan.Skipped = append(plan.Skipped, SkippedUploadFile{File: file,
+				Reason: fmt.Sprintf("not enough free space on Yandex Disk for %s: need %s MB, free %s MB",
+					file.RemoteFileName, size.Convert2MbString(), available.Convert2MbString())})
+			continue
+		}
+		available -= size
+		plan.ToUpload = append(plan.ToUpload, file)
+	}
+	return plan
+}
+
+// filesToFree количество самых старых файлов (и их размер), удаление которых освобождает need,
+// оставляя на ЯндексДиске не менее minimum файлов. Если места не хватает, возвращает все разрешённые к удалению файлы
+func filesToFree(oldestFirst []types.BackupFileInfo, need types.FileSize, minimum int) (int, types.FileSize) {
+	count := 0
+	freed := types.FileSize(0)
+	for count < len(oldestFirst)-minimum && freed < need {
+		freed += oldestFirst[count].GeneralInfo.Size
+		count++
+	}
+	return count, freed
+}
+
+// PlanRemoteSpace проверяет, хватит ли места на ЯндексДиске для загрузки toUpload.
+// Если проверка отключена или свободное место неизвестно, загружаются все файлы.
+func (bkp *BkProcessor) PlanRemoteSpace(filesInfo []types.BackupFileInfo, toUpload []types.ForUploadFileInfo) RemoteSpacePlan {
+	policy := bkp.currentSettings().RemoteSpacePolicy
+	plan := RemoteSpacePlan{FreeSpace: -1, ToUpload: toUpload}
+	if !policy.Check || len(toUpload) == 0 {
+		return plan
+	}
+
+	diskInfo, err := bkp.YaDProcessor.GetDiskInfo()
+	if err != nil {
+		bkp.logger.ErrorLog.Printf("Yandex Disk free space is unknown. Check skipped. %v", err)
+		return plan
+	}
+
+	plan = planRemoteSpace(filesInfo, toUpload, diskInfo.TotalSpace-diskInfo.UsedSpace, policy)
+	bkp.logger.InfoLog.Printf("Yandex Disk free space %s MB. Upload %d files, delete %d old files to free space, skip %d files",
+		plan.FreeSpace.Convert2MbString(), len(plan.ToUpload), len(plan.ToDelete), len(plan.Skipped))
+	for _, skipped := range plan.Skipped {
+		bkp.logger.ErrorLog.Printf("Skip upload: %s", skipped.Reason)
+	}
+	return plan
+}
+
+// AddSkipped учитывает пропущенные файлы как загруженные с ошибкой
+func (r *ProcessedFilesResult) AddSkipped(skipped []SkippedUploadFile) {
+	for _, file := range skipped {
+		r.Error++
+		r.Files = append(r.Files, ProcessedFileResult{
+			Slug:           file.File.Slug,
+			RemoteFileName: file.File.RemoteFileName,
+			Size:           file.File.LocalFileInfo.Size,
+			Err:            fmt.Errorf("%s", file.Reason),
+		})
+	}
+}
+
+// SkippedReason причины пропуска файлов одной строкой
+func (p RemoteSpacePlan) SkippedReason() string {
+	reasons := make([]string, 0, len(p.Skipped))
+	for _, file := range p.Skipped {
+		reasons = append(reasons, file.Reason)
+	}
+	return strings.Join(reasons, "; ")
+}
+
+// FreeRemoteSpace удаляет с ЯндексДиска файлы, выбранные для освобождения места,
+// и возвращает список файлов без них
+func (bkp *BkProcessor) FreeRemoteSpace(filesInfo []types.BackupFileInfo, plan RemoteSpacePlan) ([]types.BackupFileInfo, ProcessedFilesResult, error) {
+	if len(plan.ToDelete) == 0 {
+		return filesInfo, ProcessedFilesResult{}, nil
+	}
+	bkp.logger.InfoLog.Printf("Delete %d old files on Yandex Disk to free space", len(plan.ToDelete))
+	result, err := bkp.DeleteFiles(plan.ToDelete)
+	return withoutRemoteFiles(filesInfo, plan.ToDelete), result, err
+}
+
+// withoutRemoteFiles убирает из списка файлы, удалённые с ЯндексДиска
+func withoutRemoteFiles(files []types.BackupFileInfo, deleted []types.ForDeleteFileInfo) []types.BackupFileInfo {
+	if len(deleted) == 0 {
+		return files
+	}
+	deletedNames := make(map[string]bool, len(deleted))
+	for _, file := range deleted {
+		deletedNames[file.RemoteFileName] = true
+	}
+
+	result := make([]types.BackupFileInfo, 0, len(files))
+	for _, file := range files {
+		if file.IsRemote && deletedNames[file.RemoteFileName] {
+			if !file.IsLocal && !file.IsNetwork {
+				continue
+			}
+			file.IsRemote = false
+		}
+		result = append(result, file)
+	}
+	return result
+}
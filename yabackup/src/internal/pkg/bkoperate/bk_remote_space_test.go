@@ -0,0 +1,88 @@
+package bkoperate
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+	"ybg/internal/types"
+)
+
+func remoteBackup(name string, size types.FileSize, daysAgo int) types.BackupFileInfo {
+	return types.BackupFileInfo{RemoteFileName: name, IsRemote: true,
+		GeneralInfo: types.GeneralFileInfo{Name: name, Size: size,
+			Modified: types.FileModified(time.Now().AddDate(0, 0, -daysAgo))}}
+}
+
+func pendingUpload(name string, size types.FileSize, daysAgo int) types.ForUploadFileInfo {
+	return types.ForUploadFileInfo{RemoteFileName: name, IsLocal: true,
+		LocalFileInfo: types.GeneralFileInfo{Name: name, Size: size,
+			Modified: types.FileModified(time.Now().AddDate(0, 0, -daysAgo))}}
+}
+
+func uploadNames(files []types.ForUploadFileInfo) []string {
+	result := make([]string, 0)
+	for _, file := range files {
+		result = append(result, file.RemoteFileName)
+	}
+	return result
+}
+
+func Test_planRemoteSpace(t *testing.T) {
+	files := []types.BackupFileInfo{
+		remoteBackup("r_new", 300, 1),
+		remoteBackup("r_old", 200, 10),
+		remoteBackup("r_mid", 100, 5),
+	}
+	toUpload := []types.ForUploadFileInfo{pendingUpload("u_old", 400, 2), pendingUpload("u_new", 500, 0)}
+
+	tests := []struct {
+		name       string
+		freeSpace  types.FileSize
+		policy     RemoteSpacePolicy
+		wantUpload []string
+		wantDelete []string
+		wantSkip   []string
+	}{
+		{"enough space", 1000, RemoteSpacePolicy{Check: true}, []string{"u_new", "u_old"}, []string{}, []string{}},
+		{"newest first", 600, RemoteSpacePolicy{Check: true}, []string{"u_new"}, []string{}, []string{"u_old"}},
+		{"rotate oldest", 600, RemoteSpacePolicy{Check: true, RotateToFit: true, MinimumFilesQuantity: 1},
+			[]string{"u_new", "u_old"}, []string{"r_old", "r_mid"}, []string{}},
+		{"respect minimum", 600, RemoteSpacePolicy{Check: true, RotateToFit: true, MinimumFilesQuantity: 2},
+			[]string{"u_new"}, []string{}, []string{"u_old"}},
+		{"rotate only for file that fits", 100, RemoteSpacePolicy{Check: true, RotateToFit: true, MinimumFilesQuantity: 1},
+			[]string{"u_old"}, []string{"r_old", "r_mid"}, []string{"u_new"}},
+		{"nothing fits", 100, RemoteSpacePolicy{Check: true}, []string{}, []string{}, []string{"u_new", "u_old"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan := planRemoteSpace(files, toUpload, tt.freeSpace, tt.policy)
+
+			deleted := make([]string, 0)
+			for _, file := range plan.ToDelete {
+				deleted = append(deleted, file.RemoteFileName)
+			}
+			skipped := make([]string, 0)
+			for _, file := range plan.Skipped {
+				skipped = append(skipped, file.File.RemoteFileName)
+				assert.Contains(t, file.Reason, "not enough free space on Yandex Disk")
+			}
+			assert.Equal(t, tt.wantUpload, uploadNames(plan.ToUpload))
+			assert.Equal(t, tt.wantDelete, deleted)
+			assert.Equal(t, tt.wantSkip, skipped)
+		})
+	}
+}
+
+func Test_withoutRemoteFiles(t *testing.T) {
+	files := []types.BackupFileInfo{
+		{RemoteFileName: "remote_only", IsRemote: true},
+		{RemoteFileName: "remote_and_local", IsRemote: true, IsLocal: true},
+		{RemoteFileName: "kept", IsRemote: true},
+	}
+	deleted := []types.ForDeleteFileInfo{{RemoteFileName: "remote_only"}, {RemoteFileName: "remote_and_local"}}
+
+	assert.Equal(t, []types.BackupFileInfo{
+		{RemoteFileName: "remote_and_local", IsLocal: true},
+		{RemoteFileName: "kept", IsRemote: true},
+	}, withoutRemoteFiles(files, deleted))
+}
@@ -0,0 +1,61 @@
+package bkoperate
+
+import "strings"
+
+// Settings настройки BkProcessor из настроек аддона. Могут меняться без перезапуска (UpdateSettings):
+// новые значения действуют для следующих шагов и запусков, выполняющаяся загрузка не прерывается
+type Settings struct {
+	RemoteMaximumFilesQuantity     int
+	EnableUploadFromNetworkStorage bool
+	EnabledNetworkStorages         []string
+	LocalRetention                 LocalRetention
+	RemoteSubfolderLayout          string
+	FileNameTemplate               *FileNameTemplate
+	UploadConcurrency              int
+	FreshnessPolicy                FreshnessPolicy
+	RemoteSpacePolicy              RemoteSpacePolicy
+	VerificationSample             string
+	BackupPassword                 string
+	BackupLocations                []BackupLocation
+	UploadFilter                   *UploadFilter
+}
+
+func normalizeSettings(settings Settings) Settings {
+	if settings.FileNameTemplate == nil {
+		settings.FileNameTemplate, _ = ParseFileNameTemplate(DefaultFileNameTemplate, "")
+	}
+	settings.RemoteSubfolderLayout = strings.Trim(strings.TrimSpace(settings.RemoteSubfolderLayout), "/")
+
+	storages := make([]string, 0, len(settings.EnabledNetworkStorages))
+	for _, storage := range settings.EnabledNetworkStorages {
+		storages = append(storages, strings.TrimSpace(storage))
+	}
+	settings.EnabledNetworkStorages = storages
+
+	locations := make([]BackupLocation, 0, len(settings.BackupLocations))
+	for _, location := range settings.BackupLocations {
+		location.Name = strings.TrimSpace(location.Name)
+		locations = append(locations, location)
+	}
+	settings.BackupLocations = locations
+	return settings
+}
+
+// UpdateSettings применяет новые настройки
+func (bkp *BkProcessor) UpdateSettings(settings Settings) {
+	settings = normalizeSettings(settings)
+	bkp.settingsMu.Lock()
+	bkp.settings = settings
+	bkp.settingsMu.Unlock()
+
+	bkp.InvalidateStatistic()
+	bkp.logger.InfoLog.Printf("Backup settings updated: remote maximum files %d, local retention %+v, network storages %v, backup locations %+v",
+		settings.RemoteMaximumFilesQuantity, settings.LocalRetention, settings.EnabledNetworkStorages, settings.BackupLocations)
+}
+
+// currentSettings копия действующих настроек
+func (bkp *BkProcessor) currentSettings() Settings {
+	bkp.settingsMu.RLock()
+	defer bkp.settingsMu.RUnlock()
+	return bkp.settings
+}
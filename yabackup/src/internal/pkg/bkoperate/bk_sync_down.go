@@ -0,0 +1,82 @@
+package bkoperate
+
+import (
+	"context"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"ybg/internal/types"
+)
+
+// ChooseFilesToSyncDown выбирает бэкапы ЯндексДиска, которых нет в HA, для загрузки в HA.
+// Если selected не пуст, выбираются указанные файлы (RemoteFileName), иначе count новейших
+func ChooseFilesToSyncDown(files []types.BackupFileInfo, count int, selected []string) []types.BackupFileInfo {
+	result := make([]types.BackupFileInfo, 0)
+	for _, file := range files {
+		// Бэкап, сопоставленный с бэкапом HA (локальным или в сетевом хранилище), уже есть в HA
+		if !file.IsRemote || file.IsLocal || file.IsNetwork {
+			continue
+		}
+		if len(selected) > 0 && !slices.Contains(selected, file.RemoteFileName) {
+			continue
+		}
+		result = append(result, file)
+	}
+
+	// Новые бэкапы идут первыми
+	sort.SliceStable(result, func(i, j int) bool {
+		return time.Time(getSortedTime(&result[i])).After(time.Time(getSortedTime(&result[j])))
+	})
+	if len(selected) == 0 && count < len(result) {
+		result = result[:count]
+	}
+	return result
+}
+
+// HaBackupSlugs slug всех бэкапов HA (во всех хранилищах)
+func (bkp *BkProcessor) HaBackupSlugs() (map[string]bool, error) {
+	list, err := bkp.haApi.GetBackupSlugsList()
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]bool, len(list.Backups))
+	for _, backup := range list.Backups {
+		result[backup.Slug] = true
+	}
+	return result, nil
+}
+
+// slugInFileName slug бэкапа HA, содержащийся в имени файла (шаблон имени всегда содержит {slug}).
+// Пустая строка - ни один slug не найден
+func slugInFileName(remoteFileName string, haSlugs map[string]bool) string {
+	name := path.Base(remoteFileName)
+	for slug := range haSlugs {
+		if slug != "" && strings.Contains(name, slug) {
+			return slug
+		}
+	}
+	return ""
+}
+
+// RemoteBackupInHa проверяет, есть ли бэкап с ЯндексДиска в HA, не скачивая архив целиком:
+// сначала по имени файла, затем по backup.json, который читается из начала архива потоком.
+// Возвращает slug найденного бэкапа
+func (bkp *BkProcessor) RemoteBackupInHa(ctx context.Context, remoteFileName string, haSlugs map[string]bool) (bool, string, error) {
+	if slug := slugInFileName(remoteFileName, haSlugs); slug != "" {
+		return true, slug, nil
+	}
+
+	reader, err := bkp.YaDProcessor.OpenRemoteFile(ctx, remoteFileName)
+	if err != nil {
+		return false, "", err
+	}
+	defer reader.Close()
+
+	info, err := readArchInfo(bkp.logger, reader)
+	if err != nil {
+		return false, "", err
+	}
+	return haSlugs[info.Slug], info.Slug, nil
+}
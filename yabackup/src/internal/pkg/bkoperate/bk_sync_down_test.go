@@ -0,0 +1,44 @@
+package bkoperate
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+	"ybg/internal/types"
+)
+
+func Test_ChooseFilesToSyncDown(t *testing.T) {
+	remote := func(name string, d int) types.BackupFileInfo {
+		return types.BackupFileInfo{
+			RemoteFileName: name,
+			Downloaded:     types.FileModified(time.Date(2026, 10, d, 0, 0, 0, 0, time.UTC)),
+			IsRemote:       true,
+		}
+	}
+	inHa := remote("d4.tar", 4)
+	inHa.IsLocal = true
+	onNas := remote("d5.tar", 5)
+	onNas.IsNetwork = true
+	files := []types.BackupFileInfo{remote("d1.tar", 1), remote("d3.tar", 3), remote("d2.tar", 2), inHa, onNas,
+		{RemoteFileName: "local.tar", IsLocal: true}}
+
+	names := func(files []types.BackupFileInfo) []string {
+		result := make([]string, 0)
+		for _, file := range files {
+			result = append(result, file.RemoteFileName)
+		}
+		return result
+	}
+
+	assert.Equal(t, []string{"d3.tar", "d2.tar"}, names(ChooseFilesToSyncDown(files, 2, nil)))
+	assert.Equal(t, []string{"d3.tar", "d2.tar", "d1.tar"}, names(ChooseFilesToSyncDown(files, 10, nil)))
+	assert.Equal(t, []string{"d1.tar"}, names(ChooseFilesToSyncDown(files, 2, []string{"d1.tar", "d4.tar"})))
+}
+
+func Test_slugInFileName(t *testing.T) {
+	haSlugs := map[string]bool{"a1b2c3d4": true, "e5f6a7b8": true}
+
+	assert.Equal(t, "a1b2c3d4", slugInFileName("2026_10/Full backup_a1b2c3d4.tar", haSlugs))
+	assert.Equal(t, "", slugInFileName("Full backup_00000000.tar", haSlugs))
+	assert.Equal(t, "", slugInFileName("Full backup_a1b2c3d4.tar", nil))
+}
@@ -0,0 +1,43 @@
+package bkoperate
+
+import "ybg/internal/types"
+
+// TransferCounters счётчики загрузок на ЯндексДиск и удалений с него с момента старта аддона
+type TransferCounters struct {
+	UploadOk      int
+	UploadError   int
+	UploadedBytes types.FileSize
+	DeleteOk      int
+	DeleteError   int
+	DeletedBytes  types.FileSize
+}
+
+func (bkp *BkProcessor) addUploadResult(result ProcessedFilesResult) {
+	bkp.countersMu.Lock()
+	defer bkp.countersMu.Unlock()
+	bkp.counters.UploadOk += result.Ok
+	bkp.counters.UploadError += result.Error
+	bkp.counters.UploadedBytes += result.ProcessedSize
+}
+
+func (bkp *BkProcessor) addDeleteResult(result ProcessedFilesResult) {
+	bkp.countersMu.Lock()
+	defer bkp.countersMu.Unlock()
+	bkp.counters.DeleteOk += result.Ok
+	bkp.counters.DeleteError += result.Error
+	bkp.counters.DeletedBytes += result.ProcessedSize
+}
+
+// TransferCounters текущие значения счётчиков
+func (bkp *BkProcessor) TransferCounters() TransferCounters {
+	bkp.countersMu.Lock()
+	defer bkp.countersMu.Unlock()
+	return bkp.counters
+}
+
+// LastStatistic последняя собранная статистика хранилищ (без обращения к HA и ЯндексДиску)
+func (bkp *BkProcessor) LastStatistic() Statistic {
+	bkp.statisticMu.RLock()
+	defer bkp.statisticMu.RUnlock()
+	return bkp.statistic
+}
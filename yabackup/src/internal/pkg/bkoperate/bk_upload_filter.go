@@ -0,0 +1,113 @@
+package bkoperate
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+	"ybg/internal/types"
+)
+
+// UploadFilterDateLayout формат даты upload_filter_created_after
+const UploadFilterDateLayout = "2006-01-02"
+
+// Типы бэкапов для фильтра загрузки
+const (
+	UploadFilterTypeAll     = "all"
+	UploadFilterTypeFull    = "full"
+	UploadFilterTypePartial = "partial"
+)
+
+// UploadFilter отбор бэкапов для загрузки на ЯндексДиск. Пустые условия не проверяются
+type UploadFilter struct {
+	nameInclude   *regexp.Regexp
+	nameExclude   *regexp.Regexp
+	backupType    string
+	createdAfter  time.Time
+	minSize       types.FileSize
+	maxSize       types.FileSize
+	protectedOnly bool
+}
+
+// NewUploadFilter создаёт фильтр загрузки. nameInclude и nameExclude - регулярные выражения для имени бэкапа,
+// createdAfter - дата в формате UploadFilterDateLayout, minSizeMb и maxSizeMb - 0 не ограничивает размер
+func NewUploadFilter(nameInclude string, nameExclude string, backupType string, createdAfter string,
+	minSizeMb int, maxSizeMb int, protectedOnly bool) (*UploadFilter, error) {
+
+	filter := &UploadFilter{
+		backupType:    backupType,
+		minSize:       types.MiBToFileSize(float64(minSizeMb)),
+		maxSize:       types.MiBToFileSize(float64(maxSizeMb)),
+		protectedOnly: protectedOnly,
+	}
+	if filter.backupType == UploadFilterTypeAll {
+		filter.backupType = ""
+	}
+
+	var err error
+	if nameInclude != "" {
+		if filter.nameInclude, err = regexp.Compile(nameInclude); err != nil {
+			return nil, fmt.Errorf("incorrect name regular expression %q: %v", nameInclude, err)
+		}
+	}
+	if nameExclude != "" {
+		if filter.nameExclude, err = regexp.Compile(nameExclude); err != nil {
+			return nil, fmt.Errorf("incorrect name regular expression %q: %v", nameExclude, err)
+		}
+	}
+	if createdAfter != "" {
+		if filter.createdAfter, err = time.ParseInLocation(UploadFilterDateLayout, createdAfter, time.Local); err != nil {
+			return nil, fmt.Errorf("incorrect date %q, expected format YYYY-MM-DD", createdAfter)
+		}
+	}
+	if filter.maxSize > 0 && filter.minSize > filter.maxSize {
+		return nil, fmt.Errorf("minimum size %d MB is greater than maximum size %d MB", minSizeMb, maxSizeMb)
+	}
+	return filter, nil
+}
+
+// IsEmpty фильтр пропускает все бэкапы
+func (f *UploadFilter) IsEmpty() bool {
+	return f == nil || (f.nameInclude == nil && f.nameExclude == nil && f.backupType == "" && f.createdAfter.IsZero() &&
+		f.minSize == 0 && f.maxSize == 0 && !f.protectedOnly)
+}
+
+// Exclusion причина, по которой бэкап не загружается. Пустая строка - бэкап проходит фильтр
+func (f *UploadFilter) Exclusion(file types.BackupFileInfo) string {
+	if f.IsEmpty() {
+		return ""
+	}
+
+	switch {
+	case f.nameInclude != nil && !f.nameInclude.MatchString(file.BackupName):
+		return fmt.Sprintf("name does not match %q", f.nameInclude)
+	case f.nameExclude != nil && f.nameExclude.MatchString(file.BackupName):
+		return fmt.Sprintf("name matches %q", f.nameExclude)
+	case f.backupType != "" && localBackupType(types.LocalBackupFileInfo{BackupArchInfo: file.BackupArchInfo}) != f.backupType:
+		return fmt.Sprintf("backup type is not %s", f.backupType)
+	case !f.createdAfter.IsZero() && time.Time(file.GeneralInfo.Created).Before(f.createdAfter):
+		return fmt.Sprintf("created before %s", f.createdAfter.Format(UploadFilterDateLayout))
+	case f.minSize > 0 && file.GeneralInfo.Size < f.minSize:
+		return fmt.Sprintf("size less than %s MB", f.minSize.Convert2MbString())
+	case f.maxSize > 0 && file.GeneralInfo.Size > f.maxSize:
+		return fmt.Sprintf("size greater than %s MB", f.maxSize.Convert2MbString())
+	case f.protectedOnly && !file.IsProtected:
+		return "backup is not protected"
+	}
+	return ""
+}
+
+func (f *UploadFilter) String() string {
+	if f.IsEmpty() {
+		return "none"
+	}
+	return fmt.Sprintf("include %q, exclude %q, type %q, created after %s, size %s..%s MB, protected only %v",
+		regexpString(f.nameInclude), regexpString(f.nameExclude), f.backupType, f.createdAfter.Format(UploadFilterDateLayout),
+		f.minSize.Convert2MbString(), f.maxSize.Convert2MbString(), f.protectedOnly)
+}
+
+func regexpString(re *regexp.Regexp) string {
+	if re == nil {
+		return ""
+	}
+	return re.String()
+}
@@ -0,0 +1,48 @@
+package bkoperate
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+	"ybg/internal/types"
+)
+
+func Test_UploadFilter(t *testing.T) {
+	backup := func(name string, backupType string, d int, sizeMb float64, protected bool) types.BackupFileInfo {
+		return types.BackupFileInfo{
+			BackupName: name,
+			GeneralInfo: types.GeneralFileInfo{
+				Created: types.FileModified(time.Date(2026, 10, d, 12, 0, 0, 0, time.Local)),
+				Size:    types.MiBToFileSize(sizeMb),
+			},
+			BackupArchInfo: &types.BackupArchInfo{BackupType: backupType},
+			IsProtected:    protected,
+		}
+	}
+
+	var empty *UploadFilter
+	assert.True(t, empty.IsEmpty())
+	assert.Equal(t, "", empty.Exclusion(backup("any", "partial", 1, 1, false)))
+
+	filter, err := NewUploadFilter("^Full", "update", UploadFilterTypeFull, "2026-10-05", 10, 1000, true)
+	assert.NoError(t, err)
+	assert.False(t, filter.IsEmpty())
+	assert.Equal(t, "", filter.Exclusion(backup("Full 1", "full", 5, 100, true)))
+	assert.Equal(t, `name does not match "^Full"`, filter.Exclusion(backup("Core 2026.10", "full", 5, 100, true)))
+	assert.Equal(t, `name matches "update"`, filter.Exclusion(backup("Full before update", "full", 5, 100, true)))
+	assert.Equal(t, "backup type is not full", filter.Exclusion(backup("Full 1", "partial", 5, 100, true)))
+	assert.Equal(t, "created before 2026-10-05", filter.Exclusion(backup("Full 1", "full", 4, 100, true)))
+	assert.Equal(t, "size less than 10.00 MB", filter.Exclusion(backup("Full 1", "full", 5, 1, true)))
+	assert.Equal(t, "backup is not protected", filter.Exclusion(backup("Full 1", "full", 5, 100, false)))
+
+	filter, err = NewUploadFilter("", "", UploadFilterTypeAll, "", 0, 0, false)
+	assert.NoError(t, err)
+	assert.True(t, filter.IsEmpty())
+
+	_, err = NewUploadFilter("(", "", "", "", 0, 0, false)
+	assert.Error(t, err)
+	_, err = NewUploadFilter("", "", "", "2026/10/05", 0, 0, false)
+	assert.Error(t, err)
+	_, err = NewUploadFilter("", "", "", "", 10, 5, false)
+	assert.Error(t, err)
+}
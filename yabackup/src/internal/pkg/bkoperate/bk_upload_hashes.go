@@ -0,0 +1,88 @@
+package bkoperate
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+	"ybg/internal/pkg/mylogger"
+	"ybg/internal/types"
+)
+
+const uploadHashesPath = "/data/upload-hashes.json"
+
+// UploadedHash контрольная сумма данных, посчитанная при загрузке файла на ЯндексДиск
+type UploadedHash struct {
+	Sha256   string         `json:"sha256"`
+	Size     types.FileSize `json:"size"`
+	Uploaded time.Time      `json:"uploaded"`
+}
+
+// UploadHashes контрольные суммы загруженных файлов по имени файла на ЯндексДиске.
+// Сохраняются в файл, чтобы проверка архива после перезапуска аддона сравнивала скачанный файл с загруженным
+type UploadHashes struct {
+	mu       sync.RWMutex
+	filePath string
+	hashes   map[string]UploadedHash
+	logger   *mylogger.Logger
+}
+
+func loadUploadHashes(filePath string, logger *mylogger.Logger) *UploadHashes {
+	store := &UploadHashes{filePath: filePath, hashes: make(map[string]UploadedHash), logger: logger}
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logger.ErrorLog.Printf("Error when read upload hashes %s: %v", filePath, err)
+		}
+		return store
+	}
+	err = json.Unmarshal(data, &store.hashes)
+	if err != nil || store.hashes == nil {
+		logger.ErrorLog.Printf("Error when parse upload hashes %s: %v", filePath, err)
+		store.hashes = make(map[string]UploadedHash)
+	}
+	return store
+}
+
+// Get контрольная сумма файла, записанная при загрузке. false - не записана
+func (h *UploadHashes) Get(remoteFileName string) (UploadedHash, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	hash, ok := h.hashes[remoteFileName]
+	return hash, ok
+}
+
+func (h *UploadHashes) record(remoteFileName string, hash UploadedHash) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.hashes[remoteFileName] = hash
+	h.save()
+}
+
+// remove забывает контрольные суммы удалённых с ЯндексДиска файлов
+func (h *UploadHashes) remove(remoteFileNames ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	changed := false
+	for _, name := range remoteFileNames {
+		if _, ok := h.hashes[name]; ok {
+			delete(h.hashes, name)
+			changed = true
+		}
+	}
+	if changed {
+		h.save()
+	}
+}
+
+func (h *UploadHashes) save() {
+	data, err := json.Marshal(h.hashes)
+	if err == nil {
+		err = os.WriteFile(h.filePath, data, 0644)
+	}
+	if err != nil {
+		h.logger.ErrorLog.Printf("Error when save upload hashes %s: %v", h.filePath, err)
+	}
+}
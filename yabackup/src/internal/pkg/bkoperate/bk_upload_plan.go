@@ -0,0 +1,225 @@
+package bkoperate
+
+import (
+	"fmt"
+	"time"
+	"ybg/internal/types"
+)
+
+// PlanFile файл в плане задачи загрузки
+type PlanFile struct {
+	Name           string         `json:"name"`
+	Slug           string         `json:"slug,omitempty"`
+	RemoteFileName string         `json:"remote_file_name,omitempty"`
+	Location       string         `json:"location,omitempty"`
+	Size           types.FileSize `json:"size"`
+	Created        time.Time      `json:"created"`
+	Reason         string         `json:"reason,omitempty"`
+}
+
+// UploadPlan план задачи загрузки (dry-run): что будет загружено и удалено и как изменится свободное место
+type UploadPlan struct {
+	CreateBackup          bool           `json:"create_backup"`
+	CreateBackupReason    string         `json:"create_backup_reason,omitempty"`
+	FilesToUpload         []PlanFile     `json:"files_to_upload"`
+	FilesExcluded         []PlanFile     `json:"files_excluded"`
+	RemoteFilesToDelete   []PlanFile     `json:"remote_files_to_delete"`
+	LocalFilesToDelete    []PlanFile     `json:"local_files_to_delete"`
+	LocalFilesKept        []PlanFile     `json:"local_files_kept"`
+	LocationFilesToCopy   []PlanFile     `json:"location_files_to_copy"`
+	LocationFilesToDelete []PlanFile     `json:"location_files_to_delete"`
+	LocationFilesKept     []PlanFile     `json:"location_files_kept"`
+	UploadSize            types.FileSize `json:"upload_size"`
+	RemoteDeleteSize      types.FileSize `json:"remote_delete_size"`
+	LocalDeleteSize       types.FileSize `json:"local_delete_size"`
+	RemoteFreeSpace       types.FileSize `json:"remote_free_space"`
+	RemoteFreeSpaceAfter  types.FileSize `json:"remote_free_space_after"`
+	LocalFreeSpace        types.FileSize `json:"local_free_space"`
+	LocalFreeSpaceAfter   types.FileSize `json:"local_free_space_after"`
+	Warnings              []string       `json:"warnings,omitempty"`
+}
+
+// PlanUpload строит план задачи загрузки, ничего не меняя в HA и на ЯндексДиске.
+// createBackup - перед загрузкой будет создан новый бэкап, rotateLocal - будут удалены старые локальные бэкапы.
+func (bkp *BkProcessor) PlanUpload(createBackup bool, rotateLocal bool) (UploadPlan, error) {
+	plan := UploadPlan{
+		CreateBackup:          createBackup,
+		FilesToUpload:         make([]PlanFile, 0),
+		FilesExcluded:         make([]PlanFile, 0),
+		RemoteFilesToDelete:   make([]PlanFile, 0),
+		LocalFilesToDelete:    make([]PlanFile, 0),
+		LocalFilesKept:        make([]PlanFile, 0),
+		LocationFilesToCopy:   make([]PlanFile, 0),
+		LocationFilesToDelete: make([]PlanFile, 0),
+		LocationFilesKept:     make([]PlanFile, 0),
+		Warnings:              make([]string, 0),
+	}
+
+	pendingBackups := 0
+	if createBackup {
+		pendingBackups = 1
+		plan.Warnings = append(plan.Warnings, "The size of the new backup is unknown and is not included in the space impact")
+	}
+
+	// Копирование в хранилища бэкапов выполняется до удаления старых локальных бэкапов
+	locationPlan, err := bkp.PlanBackupLocations()
+	if err != nil {
+		plan.Warnings = append(plan.Warnings, fmt.Sprintf("Copy to backup locations is unknown: %v", err))
+	}
+	for _, file := range locationPlan.ToCopy {
+		plan.LocationFilesToCopy = append(plan.LocationFilesToCopy, locationPlanFile(file))
+	}
+	for _, file := range locationPlan.ToDelete {
+		plan.LocationFilesToDelete = append(plan.LocationFilesToDelete, locationPlanFile(file))
+	}
+	for _, file := range locationPlan.Kept {
+		plan.LocationFilesKept = append(plan.LocationFilesKept, locationPlanFile(file))
+	}
+
+	deletedSlugs := make(map[string]bool)
+	if rotateLocal {
+		localFiles, keptFiles, err := bkp.ChooseLocalFilesToDelete(pendingBackups)
+		if err != nil {
+			return plan, err
+		}
+		for _, file := range localFiles {
+			deletedSlugs[file.File.BackupSlug] = true
+			plan.LocalDeleteSize += file.File.GeneralInfo.Size
+			plan.LocalFilesToDelete = append(plan.LocalFilesToDelete, localPlanFile(file))
+		}
+		for _, file := range keptFiles {
+			plan.LocalFilesKept = append(plan.LocalFilesKept, localPlanFile(file))
+		}
+	}
+
+	filesInfo, err := bkp.GetFilesInfo()
+	if err != nil {
+		return plan, err
+	}
+	filesInfo = withoutDeletedBackups(filesInfo, deletedSlugs)
+
+	filesToUpload, excluded := bkp.ChooseFilesToUploadFiltered(filesInfo)
+	for _, file := range excluded {
+		plan.FilesExcluded = append(plan.FilesExcluded, uploadPlanFile(file.File, file.Reason))
+	}
+
+	diskInfo, diskErr := bkp.YaDProcessor.GetDiskInfo()
+	if diskErr != nil {
+		plan.Warnings = append(plan.Warnings, fmt.Sprintf("Yandex Disk free space is unknown: %v", diskErr))
+	} else {
+		plan.RemoteFreeSpace = diskInfo.TotalSpace - diskInfo.UsedSpace
+	}
+
+	settings := bkp.currentSettings()
+	if settings.RemoteSpacePolicy.Check && diskErr == nil {
+		spacePlan := planRemoteSpace(filesInfo, filesToUpload, plan.RemoteFreeSpace, settings.RemoteSpacePolicy)
+		for _, file := range spacePlan.ToDelete {
+			plan.RemoteDeleteSize += file.FileInfo.Size
+			plan.RemoteFilesToDelete = append(plan.RemoteFilesToDelete,
+				remotePlanFile(file, "free space on Yandex Disk for new backups"))
+		}
+		for _, file := range spacePlan.Skipped {
+			plan.Warnings = append(plan.Warnings, "Upload skipped: "+file.Reason)
+		}
+		filesInfo = withoutRemoteFiles(filesInfo, spacePlan.ToDelete)
+		filesToUpload = spacePlan.ToUpload
+	}
+
+	for _, file := range filesToUpload {
+		plan.UploadSize += file.LocalFileInfo.Size
+		plan.FilesToUpload = append(plan.FilesToUpload, uploadPlanFile(file, "not found on Yandex Disk"))
+	}
+
+	filesToDelete := bkp.ChooseFilesToDelete(filesInfo, len(filesToUpload)+pendingBackups)
+	for _, file := range filesToDelete {
+		plan.RemoteDeleteSize += file.FileInfo.Size
+		plan.RemoteFilesToDelete = append(plan.RemoteFilesToDelete,
+			remotePlanFile(file, fmt.Sprintf("more than %d files on Yandex Disk", settings.RemoteMaximumFilesQuantity)))
+	}
+
+	if diskErr == nil {
+		plan.RemoteFreeSpaceAfter = plan.RemoteFreeSpace - plan.UploadSize + plan.RemoteDeleteSize
+		if plan.RemoteFreeSpaceAfter < 0 {
+			plan.Warnings = append(plan.Warnings, "Not enough free space on Yandex Disk")
+		}
+	}
+
+	haStatistic, err := bkp.GetHaStatistic()
+	if err != nil {
+		plan.Warnings = append(plan.Warnings, fmt.Sprintf("Local free space is unknown: %v", err))
+	} else {
+		plan.LocalFreeSpace = haStatistic.LocalStorage.FreeSpace
+		plan.LocalFreeSpaceAfter = plan.LocalFreeSpace + plan.LocalDeleteSize
+	}
+
+	bkp.logger.InfoLog.Printf("Upload plan: create backup %v, upload %d files, delete %d remote and %d local files, "+
+		"copy %d files to backup locations",
+		plan.CreateBackup, len(plan.FilesToUpload), len(plan.RemoteFilesToDelete), len(plan.LocalFilesToDelete),
+		len(plan.LocationFilesToCopy))
+	return plan, nil
+}
+
+func uploadPlanFile(file types.ForUploadFileInfo, reason string) PlanFile {
+	return PlanFile{
+		Name:           file.LocalFileInfo.Name,
+		Slug:           file.Slug,
+		RemoteFileName: file.RemoteFileName,
+		Location:       file.NetworkFileInfo.Location,
+		Size:           file.LocalFileInfo.Size,
+		Created:        time.Time(file.LocalFileInfo.Created),
+		Reason:         reason,
+	}
+}
+
+func remotePlanFile(file types.ForDeleteFileInfo, reason string) PlanFile {
+	return PlanFile{
+		Name:           file.FileInfo.Name,
+		RemoteFileName: file.RemoteFileName,
+		Size:           file.FileInfo.Size,
+		Created:        time.Time(file.FileInfo.Modified),
+		Reason:         reason,
+	}
+}
+
+func localPlanFile(file LocalFileToDelete) PlanFile {
+	return PlanFile{
+		Name:     file.File.BackupName,
+		Slug:     file.File.BackupSlug,
+		Location: file.File.Location,
+		Size:     file.File.GeneralInfo.Size,
+		Created:  time.Time(file.File.GeneralInfo.Created),
+		Reason:   file.Reason,
+	}
+}
+
+func locationPlanFile(file LocationFile) PlanFile {
+	return PlanFile{
+		Name:     file.File.BackupName,
+		Slug:     file.File.BackupSlug,
+		Location: file.Location,
+		Size:     file.File.GeneralInfo.Size,
+		Created:  time.Time(file.File.GeneralInfo.Created),
+		Reason:   file.Reason,
+	}
+}
+
+// withoutDeletedBackups убирает удалённые из HA бэкапы. Бэкап удаляется из всех хранилищ HA,
+// поэтому остаётся только его копия на ЯндексДиске
+func withoutDeletedBackups(files []types.BackupFileInfo, deletedSlugs map[string]bool) []types.BackupFileInfo {
+	if len(deletedSlugs) == 0 {
+		return files
+	}
+
+	result := make([]types.BackupFileInfo, 0, len(files))
+	for _, file := range files {
+		if deletedSlugs[file.BackupSlug] {
+			if !file.IsRemote {
+				continue
+			}
+			file.IsLocal = false
+			file.IsNetwork = false
+		}
+		result = append(result, file)
+	}
+	return result
+}
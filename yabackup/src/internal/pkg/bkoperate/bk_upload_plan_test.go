@@ -0,0 +1,24 @@
+package bkoperate
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"ybg/internal/types"
+)
+
+func Test_withoutDeletedBackups(t *testing.T) {
+	files := []types.BackupFileInfo{
+		{BackupSlug: "local_only", IsLocal: true},
+		{BackupSlug: "local_and_remote", IsLocal: true, IsNetwork: true, IsRemote: true},
+		{BackupSlug: "kept", IsLocal: true},
+	}
+	deleted := map[string]bool{"local_only": true, "local_and_remote": true}
+
+	result := withoutDeletedBackups(files, deleted)
+
+	assert.Equal(t, []types.BackupFileInfo{
+		{BackupSlug: "local_and_remote", IsRemote: true},
+		{BackupSlug: "kept", IsLocal: true},
+	}, result)
+	assert.Equal(t, files, withoutDeletedBackups(files, nil))
+}
@@ -0,0 +1,365 @@
+package bkoperate
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"ybg/internal/pkg/backuparchive"
+	"ybg/internal/pkg/haoperate"
+	"ybg/internal/pkg/mylogger"
+	om "ybg/internal/pkg/operationmanager"
+	"ybg/internal/types"
+)
+
+const verificationHistoryPath = "/data/verification-history.json"
+
+// verificationHistorySize количество хранимых результатов проверок
+const verificationHistorySize = 100
+
+// Способ выбора бэкапа для проверки по расписанию
+const (
+	VerificationSampleNewest = "newest"
+	VerificationSampleRandom = "random"
+)
+
+// innerArchiveSuffix архивы дополнений и каталогов внутри бэкапа
+const innerArchiveSuffix = ".tar.gz"
+
+var ErrNothingToVerify = errors.New("no backups on Yandex Disk")
+
+// VerificationResult результат проверки архива бэкапа на ЯндексДиске
+type VerificationResult struct {
+	RemoteFileName string         `json:"remote_file_name"`
+	Slug           string         `json:"slug,omitempty"`
+	Checked        time.Time      `json:"checked"`
+	DurationSec    float64        `json:"duration_sec"`
+	Size           types.FileSize `json:"size"`
+	Sha256         string         `json:"sha256,omitempty"`
+	HashChecked    bool           `json:"hash_checked"`
+	InnerArchives  int            `json:"inner_archives"`
+	InnerSkipped   int            `json:"inner_skipped,omitempty"`
+	Encrypted      bool           `json:"encrypted,omitempty"`
+	Ok             bool           `json:"ok"`
+	Error          string         `json:"error,omitempty"`
+}
+
+// VerificationHistory последние результаты проверок. Сохраняется в файл, чтобы переживать перезапуск аддона
+type VerificationHistory struct {
+	mu       sync.RWMutex
+	filePath string
+	results  []VerificationResult
+	logger   *mylogger.Logger
+}
+
+func loadVerificationHistory(filePath string, logger *mylogger.Logger) *VerificationHistory {
+	history := &VerificationHistory{filePath: filePath, results: make([]VerificationResult, 0), logger: logger}
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logger.ErrorLog.Printf("Error when read verification history %s: %v", filePath, err)
+		}
+		return history
+	}
+	err = json.Unmarshal(data, &history.results)
+	if err != nil {
+		logger.ErrorLog.Printf("Error when parse verification history %s: %v", filePath, err)
+		history.results = make([]VerificationResult, 0)
+	}
+	return history
+}
+
+func (h *VerificationHistory) add(result VerificationResult) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.results = append(h.results, result)
+	if len(h.results) > verificationHistorySize {
+		h.results = h.results[len(h.results)-verificationHistorySize:]
+	}
+
+	data, err := json.Marshal(h.results)
+	if err == nil {
+		err = os.WriteFile(h.filePath, data, 0644)
+	}
+	if err != nil {
+		h.logger.ErrorLog.Printf("Error when save verification history %s: %v", h.filePath, err)
+	}
+}
+
+// Results результаты проверок, от новых к старым
+func (h *VerificationHistory) Results() []VerificationResult {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	result := make([]VerificationResult, len(h.results))
+	for i, item := range h.results {
+		result[len(h.results)-1-i] = item
+	}
+	return result
+}
+
+// LastResults последний результат проверки каждого файла (по имени файла на ЯндексДиске)
+func (h *VerificationHistory) LastResults() map[string]VerificationResult {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	result := make(map[string]VerificationResult)
+	for _, item := range h.results {
+		result[item.RemoteFileName] = item
+	}
+	return result
+}
+
+// archiveCheck результат проверки содержимого архива
+type archiveCheck struct {
+	backupInfo    types.HaBackupInfo
+	innerArchives int
+	innerSkipped  int
+	size          int64
+	md5           string
+	sha256        string
+}
+
+func (c archiveCheck) isEncrypted() bool {
+	return c.backupInfo.Crypto != ""
+}
+
+// verifyArchive читает архив бэкапа целиком: внешний tar, backup.json и все вложенные tar.gz,
+// попутно считая контрольные суммы. Зашифрованные вложенные архивы расшифровываются паролем бэкапов,
+// без пароля они пропускаются и учитываются в innerSkipped.
+func verifyArchive(source io.Reader, password string) (archiveCheck, error) {
+	result := archiveCheck{}
+	md5Hash := md5.New()
+	sha256Hash := sha256.New()
+	counter := &countingWriter{}
+	reader := io.TeeReader(source, io.MultiWriter(md5Hash, sha256Hash, counter))
+
+	backupInfoFound := false
+	innerErrors := make([]string, 0)
+
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return result, fmt.Errorf("archive is not readable: %w", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name := path.Base(header.Name)
+		switch {
+		case name == backupInfoFileName:
+			plan, err := io.ReadAll(tarReader)
+			if err != nil {
+				return result, fmt.Errorf("cannot read backup info: %w", err)
+			}
+			result.backupInfo, err = parseBackupInfo(plan)
+			if err != nil {
+				return result, err
+			}
+			backupInfoFound = true
+		case strings.HasSuffix(name, innerArchiveSuffix):
+			result.innerArchives++
+			err := backuparchive.CheckInnerArchive(tarReader, password)
+			if errors.Is(err, backuparchive.ErrEncrypted) {
+				result.innerSkipped++
+			} else if err != nil {
+				innerErrors = append(innerErrors, fmt.Sprintf("%s: %v", name, err))
+			}
+		}
+	}
+
+	// Дочитываем окончание архива, чтобы контрольные суммы были посчитаны по всему файлу
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		return result, fmt.Errorf("archive is not readable: %w", err)
+	}
+	result.size = counter.size
+	result.md5 = hashString(md5Hash)
+	result.sha256 = hashString(sha256Hash)
+
+	if !backupInfoFound {
+		return result, fmt.Errorf("backup info not found")
+	}
+	if len(innerErrors) > 0 {
+		return result, fmt.Errorf("inner archives are damaged: %s", strings.Join(innerErrors, "; "))
+	}
+	return result, nil
+}
+
+// checkRemoteHash сравнивает размер и контрольные суммы архива с посчитанными ЯндексДиском.
+// Возвращает false, если ЯндексДиск не вернул контрольных сумм
+func checkRemoteHash(check archiveCheck, remote types.RemoteFileHash) (bool, error) {
+	if remote.Size > 0 && int64(remote.Size) != check.size {
+		return false, fmt.Errorf("size mismatch: downloaded %d bytes, on Yandex Disk %d bytes", check.size, remote.Size)
+	}
+	if remote.Sha256 != "" {
+		if !strings.EqualFold(remote.Sha256, check.sha256) {
+			return false, fmt.Errorf("sha256 mismatch: downloaded %s, on Yandex Disk %s", check.sha256, remote.Sha256)
+		}
+		return true, nil
+	}
+	if remote.Md5 != "" {
+		if !strings.EqualFold(remote.Md5, check.md5) {
+			return false, fmt.Errorf("md5 mismatch: downloaded %s, on Yandex Disk %s", check.md5, remote.Md5)
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// checkUploadedHash сравнивает размер и sha256 архива с посчитанными при загрузке на ЯндексДиск.
+// Возвращает false, если контрольная сумма при загрузке не записана (файл загружен старой версией аддона)
+func checkUploadedHash(check archiveCheck, uploaded UploadedHash, recorded bool) (bool, error) {
+	if !recorded || uploaded.Sha256 == "" {
+		return false, nil
+	}
+	if uploaded.Size > 0 && int64(uploaded.Size) != check.size {
+		return false, fmt.Errorf("size mismatch: downloaded %d bytes, uploaded %d bytes", check.size, uploaded.Size)
+	}
+	if !strings.EqualFold(uploaded.Sha256, check.sha256) {
+		return false, fmt.Errorf("sha256 mismatch: downloaded %s, uploaded %s", check.sha256, uploaded.Sha256)
+	}
+	return true, nil
+}
+
+// chooseFileToVerify бэкап на ЯндексДиске для проверки по расписанию: новейший или случайный
+func chooseFileToVerify(files []types.BackupFileInfo, sample string, random func(n int) int) (types.BackupFileInfo, error) {
+	remoteFiles := make([]types.BackupFileInfo, 0, len(files))
+	for _, file := range files {
+		if file.IsRemote {
+			remoteFiles = append(remoteFiles, file)
+		}
+	}
+	if len(remoteFiles) == 0 {
+		return types.BackupFileInfo{}, ErrNothingToVerify
+	}
+
+	if sample == VerificationSampleRandom {
+		return remoteFiles[random(len(remoteFiles))], nil
+	}
+	sort.SliceStable(remoteFiles, func(i, j int) bool {
+		return remoteFiles[i].Downloaded.After(remoteFiles[j].Downloaded)
+	})
+	return remoteFiles[0], nil
+}
+
+// ChooseFileToVerify бэкап на ЯндексДиске для проверки по расписанию (verification_sample)
+func (bkp *BkProcessor) ChooseFileToVerify() (types.BackupFileInfo, error) {
+	files, err := bkp.GetFilesInfo()
+	if err != nil {
+		return types.BackupFileInfo{}, err
+	}
+	return chooseFileToVerify(files, bkp.currentSettings().VerificationSample, rand.Intn)
+}
+
+// VerificationHistory результаты проверок архивов
+func (bkp *BkProcessor) VerificationHistory() *VerificationHistory {
+	return bkp.verificationHistory
+}
+
+// VerifyBackup скачивает бэкап с ЯндексДиска во временный файл и проверяет, что его можно восстановить.
+// Результат сохраняется в истории проверок
+func (bkp *BkProcessor) VerifyBackup(remoteFileName string, operationId string) VerificationResult {
+	logger := bkp.logger.With("operation_id", operationId, "file", remoteFileName)
+	ctx := bkp.operationManager.StartCancelableOperation(bkp.applCtx, operationId, "verifying")
+	bkp.operationManager.SetOperationType(operationId, om.OperationTypeVerify, "")
+
+	start := time.Now()
+	result := VerificationResult{RemoteFileName: remoteFileName, Checked: start}
+	err := bkp.verifyRemoteFile(ctx, remoteFileName, operationId, &result)
+	result.DurationSec = math.Round(time.Since(start).Seconds()*10) / 10
+
+	if err != nil {
+		result.Error = err.Error()
+		logger.ErrorLog.Printf("Verification of %s failed. %v", remoteFileName, err)
+		if ctx.Err() != nil {
+			bkp.operationManager.ErrorDone(operationId, "Verification canceled")
+		} else {
+			bkp.operationManager.ErrorDone(operationId, "Verification failed")
+		}
+	} else {
+		result.Ok = true
+		logger.InfoLog.Printf("Verification of %s done. Inner archives %d (skipped encrypted %d), upload hash checked %v",
+			remoteFileName, result.InnerArchives, result.InnerSkipped, result.HashChecked)
+		bkp.operationManager.SetResult(operationId, "verified")
+		bkp.operationManager.SuccessDone(operationId)
+	}
+
+	bkp.verificationHistory.add(result)
+	return result
+}
+
+func (bkp *BkProcessor) verifyRemoteFile(ctx context.Context, remoteFileName string, operationId string, result *VerificationResult) error {
+	remoteHash, err := bkp.YaDProcessor.GetRemoteFileHash(remoteFileName)
+	if err != nil {
+		return err
+	}
+
+	dst := haoperate.GetTemporaryFilePath(path.Base(remoteFileName) + ".verify")
+	defer bkp.haApi.RemoveTemporaryFile(dst)
+
+	err = bkp.YaDProcessor.DownloadFile(ctx, remoteFileName, dst, operationId)
+	if err != nil {
+		return err
+	}
+
+	bkp.operationManager.ChangeStatusAndProgress(operationId, "checking archive", 90)
+	file, err := os.Open(dst)
+	if err != nil {
+		return fmt.Errorf("error when open downloaded file: %w", err)
+	}
+	defer file.Close()
+
+	check, err := verifyArchive(file, bkp.currentSettings().BackupPassword)
+	result.Slug = check.backupInfo.Slug
+	result.Size = types.FileSize(check.size)
+	result.Sha256 = check.sha256
+	result.InnerArchives = check.innerArchives
+	result.InnerSkipped = check.innerSkipped
+	result.Encrypted = check.isEncrypted()
+	if err != nil {
+		return err
+	}
+
+	// Сумма ЯндексДиска считается по уже сохранённому файлу и подтверждает только скачивание,
+	// эталон - сумма данных, посчитанная аддоном при загрузке
+	if _, err := checkRemoteHash(check, remoteHash); err != nil {
+		return err
+	}
+	uploaded, recorded := bkp.uploadHashes.Get(remoteFileName)
+	result.HashChecked, err = checkUploadedHash(check, uploaded, recorded)
+	return err
+}
+
+type countingWriter struct {
+	size int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.size += int64(len(p))
+	return len(p), nil
+}
+
+func hashString(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))
+}
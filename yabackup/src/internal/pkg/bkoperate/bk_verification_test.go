@@ -0,0 +1,192 @@
+package bkoperate
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"log"
+	"path/filepath"
+	"testing"
+	"time"
+	"ybg/internal/pkg/mylogger"
+	"ybg/internal/types"
+)
+
+const testBackupInfo = `{"slug":"abc123","name":"Full backup","type":"full","date":"2024-05-01T10:00:00.000000+00:00"}`
+
+func tarEntry(t *testing.T, writer *tar.Writer, name string, data []byte) {
+	assert.NoError(t, writer.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg}))
+	_, err := writer.Write(data)
+	assert.NoError(t, err)
+}
+
+func innerArchive(t *testing.T) []byte {
+	var buffer bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buffer)
+	tarWriter := tar.NewWriter(gzipWriter)
+	tarEntry(t, tarWriter, "data/options.json", []byte(`{"a":1}`))
+	assert.NoError(t, tarWriter.Close())
+	assert.NoError(t, gzipWriter.Close())
+	return buffer.Bytes()
+}
+
+func backupArchive(t *testing.T, backupInfo string, inner []byte) []byte {
+	var buffer bytes.Buffer
+	writer := tar.NewWriter(&buffer)
+	tarEntry(t, writer, "./homeassistant.tar.gz", inner)
+	if backupInfo != "" {
+		tarEntry(t, writer, "./backup.json", []byte(backupInfo))
+	}
+	assert.NoError(t, writer.Close())
+	return buffer.Bytes()
+}
+
+func Test_verifyArchive(t *testing.T) {
+	inner := innerArchive(t)
+	damaged := append([]byte{}, inner...)
+	damaged[len(damaged)-6] ^= 0xff // контрольная сумма gzip
+
+	encryptedInfo := `{"slug":"abc123","name":"Full backup","type":"full","crypto":"aes128","date":"2024-05-01T10:00:00.000000+00:00"}`
+
+	tests := []struct {
+		name        string
+		archive     []byte
+		password    string
+		wantSkipped int
+		wantErr     string
+	}{
+		{"valid", backupArchive(t, testBackupInfo, inner), "", 0, ""},
+		{"valid with password", backupArchive(t, testBackupInfo, inner), "secret", 0, ""},
+		{"damaged inner archive", backupArchive(t, testBackupInfo, damaged), "", 0, "inner archives are damaged"},
+		{"encrypted inner archive without password is skipped", backupArchive(t, encryptedInfo, []byte("encrypted")), "", 1, ""},
+		{"encrypted inner archive is decrypted with password", backupArchive(t, encryptedInfo, []byte("encrypted")), "secret", 0, "inner archives are damaged"},
+		{"no backup info", backupArchive(t, "", inner), "", 0, "backup info not found"},
+		{"invalid backup info", backupArchive(t, `{"slug":""}`, inner), "", 0, "Necessary field not found"},
+		{"truncated", backupArchive(t, testBackupInfo, inner)[:512+len(inner)/2], "", 0, "archive is not readable"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			check, err := verifyArchive(bytes.NewReader(tt.archive), tt.password)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, "abc123", check.backupInfo.Slug)
+			assert.Equal(t, 1, check.innerArchives)
+			assert.Equal(t, tt.wantSkipped, check.innerSkipped)
+			assert.Equal(t, int64(len(tt.archive)), check.size)
+
+			sum := sha256.Sum256(tt.archive)
+			assert.Equal(t, hex.EncodeToString(sum[:]), check.sha256)
+		})
+	}
+}
+
+func Test_checkRemoteHash(t *testing.T) {
+	check := archiveCheck{size: 10, md5: "aa", sha256: "bb"}
+
+	checked, err := checkRemoteHash(check, types.RemoteFileHash{Size: 10, Md5: "AA", Sha256: "BB"})
+	assert.NoError(t, err)
+	assert.True(t, checked)
+
+	_, err = checkRemoteHash(check, types.RemoteFileHash{Size: 10, Sha256: "cc"})
+	assert.ErrorContains(t, err, "sha256 mismatch")
+
+	_, err = checkRemoteHash(check, types.RemoteFileHash{Size: 10, Md5: "cc"})
+	assert.ErrorContains(t, err, "md5 mismatch")
+
+	_, err = checkRemoteHash(check, types.RemoteFileHash{Size: 11})
+	assert.ErrorContains(t, err, "size mismatch")
+
+	checked, err = checkRemoteHash(check, types.RemoteFileHash{})
+	assert.NoError(t, err)
+	assert.False(t, checked)
+}
+
+func Test_checkUploadedHash(t *testing.T) {
+	check := archiveCheck{size: 10, md5: "aa", sha256: "bb"}
+
+	checked, err := checkUploadedHash(check, UploadedHash{Sha256: "BB", Size: 10}, true)
+	assert.NoError(t, err)
+	assert.True(t, checked)
+
+	_, err = checkUploadedHash(check, UploadedHash{Sha256: "cc", Size: 10}, true)
+	assert.ErrorContains(t, err, "sha256 mismatch")
+
+	_, err = checkUploadedHash(check, UploadedHash{Sha256: "bb", Size: 11}, true)
+	assert.ErrorContains(t, err, "size mismatch")
+
+	checked, err = checkUploadedHash(check, UploadedHash{}, false)
+	assert.NoError(t, err)
+	assert.False(t, checked)
+}
+
+func Test_UploadHashes(t *testing.T) {
+	discardLog := log.New(io.Discard, "", 0)
+	logger := mylogger.New(discardLog, discardLog, discardLog)
+	filePath := filepath.Join(t.TempDir(), "hashes.json")
+
+	hashes := loadUploadHashes(filePath, logger)
+	hashes.record("a.tar", UploadedHash{Sha256: "aa", Size: 10})
+	hashes.record("b.tar", UploadedHash{Sha256: "bb", Size: 20})
+	hashes.remove("a.tar", "missing.tar")
+
+	reloaded := loadUploadHashes(filePath, logger)
+	_, ok := reloaded.Get("a.tar")
+	assert.False(t, ok)
+	hash, ok := reloaded.Get("b.tar")
+	assert.True(t, ok)
+	assert.Equal(t, "bb", hash.Sha256)
+	assert.Equal(t, types.FileSize(20), hash.Size)
+}
+
+func Test_chooseFileToVerify(t *testing.T) {
+	uploaded := func(name string, daysAgo int) types.BackupFileInfo {
+		file := remoteBackup(name, 100, daysAgo)
+		file.Downloaded = types.FileModified(time.Now().AddDate(0, 0, -daysAgo))
+		return file
+	}
+	files := []types.BackupFileInfo{
+		uploaded("r_old", 10),
+		{RemoteFileName: "local_only", IsLocal: true},
+		uploaded("r_new", 1),
+		uploaded("r_mid", 5),
+	}
+
+	file, err := chooseFileToVerify(files, VerificationSampleNewest, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "r_new", file.RemoteFileName)
+
+	file, err = chooseFileToVerify(files, VerificationSampleRandom, func(n int) int { return n - 1 })
+	assert.NoError(t, err)
+	assert.Equal(t, "r_mid", file.RemoteFileName)
+
+	_, err = chooseFileToVerify(files[1:2], VerificationSampleNewest, nil)
+	assert.ErrorIs(t, err, ErrNothingToVerify)
+}
+
+func Test_VerificationHistory(t *testing.T) {
+	discardLog := log.New(io.Discard, "", 0)
+	logger := mylogger.New(discardLog, discardLog, discardLog)
+	filePath := filepath.Join(t.TempDir(), "history.json")
+
+	history := loadVerificationHistory(filePath, logger)
+	history.add(VerificationResult{RemoteFileName: "a", Ok: false, Error: "damaged"})
+	history.add(VerificationResult{RemoteFileName: "b", Ok: true})
+	history.add(VerificationResult{RemoteFileName: "a", Ok: true})
+
+	loaded := loadVerificationHistory(filePath, logger)
+	results := loaded.Results()
+	assert.Len(t, results, 3)
+	assert.Equal(t, "a", results[0].RemoteFileName)
+	assert.Equal(t, "damaged", results[2].Error)
+
+	last := loaded.LastResults()
+	assert.Len(t, last, 2)
+	assert.True(t, last["a"].Ok)
+}
@@ -2,28 +2,33 @@ package downloader
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	grab "github.com/cavaliergopher/grab/v3"
-	"math"
+	"os"
 	"sync"
 	"time"
 	"ybg/internal/pkg/mylogger"
 	om "ybg/internal/pkg/operationmanager"
+	"ybg/internal/pkg/throttle"
 )
 
 type Downloader struct {
 	operationManager *om.OperationManager
+	limiter          *throttle.Limiter
 	logger           *mylogger.Logger
 }
 
-func New(operationManager *om.OperationManager, logger *mylogger.Logger) *Downloader {
+func New(operationManager *om.OperationManager, limiter *throttle.Limiter, logger *mylogger.Logger) *Downloader {
 	return &Downloader{
 		operationManager: operationManager,
+		limiter:          limiter,
 		logger:           logger,
 	}
 }
 
-func (dwn *Downloader) Download(fileURL string,
+func (dwn *Downloader) Download(ctx context.Context,
+	fileURL string,
 	fileName string,
 	id string,
 	statusSuffix string) error {
@@ -34,7 +39,7 @@ func (dwn *Downloader) Download(fileURL string,
 
 	go func(url, name, id string) {
 		defer wg.Done()
-		err := dwn.downloadInner(url, name, id, statusSuffix)
+		err := dwn.downloadInner(ctx, url, name, id, statusSuffix)
 		if err != nil {
 			errChan <- err
 		}
@@ -53,7 +58,8 @@ func (dwn *Downloader) Download(fileURL string,
 	return nil
 }
 
-func (dwn *Downloader) downloadInner(fileURL string,
+func (dwn *Downloader) downloadInner(parentCtx context.Context,
+	fileURL string,
 	fileName string,
 	id string,
 	statusSuffix string) error {
@@ -70,9 +76,12 @@ func (dwn *Downloader) downloadInner(fileURL string,
 	}
 
 	// Создаем контекст с таймаутом
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	ctx, cancel := context.WithTimeout(parentCtx, 10*time.Minute)
 	defer cancel()
 	req = req.WithContext(ctx)
+	if dwn.limiter != nil {
+		req.RateLimiter = dwn.limiter
+	}
 
 	// Выполняем запрос
 
@@ -86,12 +95,16 @@ func (dwn *Downloader) downloadInner(fileURL string,
 	for {
 		select {
 		case <-ticker.C:
-			progress := resp.Progress()
-			dwn.logger.DebugLog.Printf("Download progress: %v", progress)
-			dwn.operationManager.ChangeProgress(id, int(math.Floor(progress*100)))
+			dwn.logger.DebugLog.Printf("Download progress: %v", resp.Progress())
+			dwn.operationManager.ChangeTransferred(id, "downloading "+statusSuffix, resp.BytesComplete(), resp.Size())
 
 		case <-resp.Done:
 			if err := resp.Err(); err != nil {
+				dwn.removePartialFile(resp.Filename)
+				if errors.Is(parentCtx.Err(), context.Canceled) {
+					dwn.operationManager.ErrorDone(id, "Download canceled")
+					return fmt.Errorf("download canceled: %w", err)
+				}
 				dwn.operationManager.ErrorDone(id, fmt.Sprintf("Error when download file: %v", err))
 				return fmt.Errorf("error when download file: %v", err)
 			} else {
@@ -103,3 +116,16 @@ func (dwn *Downloader) downloadInner(fileURL string,
 	}
 
 }
+
+// removePartialFile удаляет не до конца скачанный файл
+func (dwn *Downloader) removePartialFile(fileName string) {
+	if fileName == "" {
+		return
+	}
+	err := os.Remove(fileName)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		dwn.logger.ErrorLog.Printf("Error when remove partial file %s: %v", fileName, err)
+		return
+	}
+	dwn.logger.DebugLog.Printf("Partial file %s removed", fileName)
+}
@@ -9,21 +9,26 @@ import (
 	"io"
 	"mime/multipart"
 	"net/http"
+	neturl "net/url"
 	"os"
 	"path/filepath"
 	"strconv"
 	"time"
 	"ybg/internal/pkg/mylogger"
+	"ybg/internal/pkg/retry"
 	"ybg/internal/types"
 )
 
 const UPLOAD_TEMP_DIR = "bfiles"
 const (
-	CoreBaseURL         string = "http://supervisor/core/api"
-	AddonsBaseURL       string = "http://supervisor/addons"
-	BackupBaseURL       string = "http://supervisor/backups"
-	JobBaseURL          string = "http://supervisor/jobs"
-	HostBaseURL         string = "http://supervisor/host"
+	CoreBaseURL   string = "http://supervisor/core/api"
+	AddonsBaseURL string = "http://supervisor/addons"
+	BackupBaseURL string = "http://supervisor/backups"
+	JobBaseURL    string = "http://supervisor/jobs"
+	HostBaseURL   string = "http://supervisor/host"
+	MountsBaseURL string = "http://supervisor/mounts"
+	// LocalLocation имя локального хранилища бэкапов в запросах к supervisor
+	LocalLocation       string = ".local"
 	EntityIdPrefix      string = "sensor."
 	DefaultEntityId     string = "yandex_backup_state"
 	localEntityCopyPath string = "/data/entity-copy.json"
@@ -31,12 +36,15 @@ const (
 	uploadBackup        string = "/new/upload"
 )
 
+const setEntityStateTimeout = 30 * time.Second
+
 type HaApiClient struct {
-	entity_id  string
-	ctx        context.Context
-	httpClient *http.Client
-	token      string
-	logger     *mylogger.Logger
+	entity_id     string
+	ctx           context.Context
+	httpClient    *http.Client
+	requestPolicy retry.Policy
+	token         string
+	logger        *mylogger.Logger
 }
 
 // Status Определяем Enum для статуса
@@ -80,6 +88,8 @@ type EntityState struct {
 	State                       Status
 	OkUpload                    int
 	ErrorUpload                 int
+	ErrorUploadFiles            []string
+	UploadErrorMessage          string
 	OkDelete                    int
 	ErrorDelete                 int
 	LocalFiles                  int
@@ -123,11 +133,36 @@ type getHostInfoResult struct {
 	Data   *HostInfo `json:"data,omitempty"`
 }
 type HostInfo struct {
+	Hostname  string  `json:"hostname"`
 	DiskTotal float64 `json:"disk_total"`
 	DiskUsed  float64 `json:"disk_used"`
 	DiskFree  float64 `json:"disk_free"`
 }
 
+// Назначение сетевого хранилища (usage)
+const (
+	MountUsageBackup = "backup"
+	MountUsageMedia  = "media"
+	MountUsageShare  = "share"
+)
+
+type getMountsResult struct {
+	Result string  `json:"result"`
+	Data   *Mounts `json:"data,omitempty"`
+}
+type Mounts struct {
+	DefaultBackupMount string  `json:"default_backup_mount"`
+	Mounts             []Mount `json:"mounts"`
+}
+
+// Mount сетевое хранилище, подключённое в supervisor
+type Mount struct {
+	Name  string `json:"name"`
+	Usage string `json:"usage"`
+	Type  string `json:"type"`
+	State string `json:"state"`
+}
+
 type FileStatistic struct {
 	FilesSize  types.FileSize
 	FileAmount int
@@ -141,6 +176,10 @@ type createFullBacupRequest struct {
 	Background      bool   `json:"background"`
 }
 
+type deleteBackupRequest struct {
+	Location []string `json:"location"`
+}
+
 type CreateBackupResult struct {
 	Slug string `json:"slug"`
 	Job  string `json:"job_id"`
@@ -194,6 +233,8 @@ func (c *CustomTime) UnmarshalJSON(data []byte) error {
 type EntityAttributes struct {
 	OkUploadAmount              int        `json:"success_upload_files"`
 	ErrorUploadAmount           int        `json:"error_upload_files"`
+	ErrorUploadFileNames        []string   `json:"error_upload_file_names,omitempty"`
+	UploadErrorMessage          string     `json:"upload_error_message,omitempty"`
 	OkDeleteAmount              int        `json:"success_delete_files"`
 	ErrorDeleteAmount           int        `json:"error_delete_files"`
 	RemoteFiles                 int        `json:"remote_files"`
@@ -266,7 +307,7 @@ func NewHaApi(entity_id string, ctx context.Context, client *http.Client, token
 		entity_id = DefaultEntityId
 	}
 	entity_id = EntityIdPrefix + entity_id
-	return &HaApiClient{entity_id: entity_id, ctx: ctx, httpClient: client, token: token, logger: logger}, nil
+	return &HaApiClient{entity_id: entity_id, ctx: ctx, httpClient: client, requestPolicy: retry.DefaultPolicy(), token: token, logger: logger}, nil
 }
 
 func (haApi *HaApiClient) SetLastBackupState(withError bool, errorText string) error {
@@ -306,6 +347,32 @@ func (haApi *HaApiClient) GetEntityState() (*EntityState, error) {
 	return entityState, nil
 }
 
+// GetLastUploadTime время завершения последней задачи загрузки по сущности в HA и её локальной копии (берётся более позднее).
+// Если задача загрузки ещё не выполнялась, возвращается нулевое время.
+func (haApi *HaApiClient) GetLastUploadTime() (time.Time, error) {
+	state, stateErr := haApi.GetEntityState()
+	if stateErr != nil {
+		haApi.logger.InfoLog.Printf("Can not read state entity, use local copy. %v", stateErr)
+	}
+	entityCopy, copyErr := readLocalEntityCopy()
+	if copyErr != nil {
+		haApi.logger.DebugLog.Printf("Can not read state entity local copy. %v", copyErr)
+	}
+
+	if stateErr != nil && copyErr != nil {
+		return time.Time{}, fmt.Errorf("error when get last upload time: %v; local copy: %v", stateErr, copyErr)
+	}
+
+	lastUpload := time.Time{}
+	if stateErr == nil {
+		lastUpload = state.LastUploadedTime.Time
+	}
+	if copyErr == nil && entityCopy.Attributes.LastUploadTime.After(lastUpload) {
+		lastUpload = entityCopy.Attributes.LastUploadTime.Time
+	}
+	return lastUpload, nil
+}
+
 func (haApi *HaApiClient) EnsureEntityState() (*EntityState, error) {
 	haApi.logger.DebugLog.Printf("Check state entity existence")
 	state, err := haApi.GetEntityState()
@@ -397,6 +464,24 @@ func (haApi *HaApiClient) GetHostInformation() (*HostInfo, error) {
 	return result.Data, nil
 }
 
+// GetMounts сетевые хранилища supervisor
+func (haApi *HaApiClient) GetMounts() (*Mounts, error) {
+	haApi.logger.DebugLog.Println("Get mounts request")
+	var result getMountsResult
+
+	err := haApi.getRequest(MountsBaseURL, &result)
+
+	if err != nil {
+		resultError := fmt.Errorf("error when get mounts: %v", err)
+		return nil, resultError
+	}
+	if result.Data == nil {
+		return &Mounts{}, nil
+	}
+
+	return result.Data, nil
+}
+
 func (haApi *HaApiClient) GetStorageStatistic() (map[string]types.StorageStatistic, error) {
 	info, err := haApi.GetHostInformation()
 	if err != nil {
@@ -462,7 +547,7 @@ func (haApi *HaApiClient) GetFileStatistic() (map[string]*FileStatistic, error)
 }
 
 func (haApi *HaApiClient) GetJobInfo(jobId string) (*JobInfo, error) {
-	haApi.logger.DebugLog.Println("Get job info request %s", jobId)
+	haApi.logger.DebugLog.Printf("Get job info request %s", jobId)
 	url := fmt.Sprintf("%s/%s", JobBaseURL, jobId)
 	var result JobInfoResponse
 
@@ -493,6 +578,23 @@ func (haApi *HaApiClient) DeleteBackup(slug string) error {
 	return nil
 }
 
+// DeleteBackupFromLocation удаляет копию бэкапа из одного хранилища (LocalLocation - локальная копия).
+// Копии в других хранилищах остаются
+func (haApi *HaApiClient) DeleteBackupFromLocation(slug string, location string) error {
+	haApi.logger.DebugLog.Printf("Delete backup %s from location %s request", slug, location)
+	url := fmt.Sprintf("%s/%s", BackupBaseURL, slug)
+	var result StubResponse
+
+	err := haApi.innerRequest("DELETE", url, http.StatusOK, deleteBackupRequest{Location: []string{location}}, &result)
+
+	if err != nil {
+		resultError := fmt.Errorf("error when delete backup from location %s: %v", location, err)
+		return resultError
+	}
+
+	return nil
+}
+
 func (haApi *HaApiClient) CreateFullBackup(backupName string) (*CreateBackupResult, error) {
 	haApi.logger.DebugLog.Println("Create full backup request")
 	url := fmt.Sprintf("%s/new/full", BackupBaseURL)
@@ -583,32 +685,54 @@ func (haApi *HaApiClient) getRequest(url string, result interface{}) error {
 	return haApi.innerRequest("GET", url, http.StatusOK, nil, result)
 }
 
+// innerRequest выполняет запрос к supervisor. GET запросы при временных ошибках повторяются согласно haApi.requestPolicy,
+// остальные выполняются один раз. Время каждой попытки ограничено.
 func (haApi *HaApiClient) innerRequest(method string, url string, expectedStatus int, body any, result interface{}) error {
 	haApi.logger.DebugLog.Printf("Execute %s request %s", method, url)
 
 	// Преобразуем структуру в JSON
-
-	var bodyReader io.Reader
+	var jsonData []byte
 	if body != nil {
-		jsonData, err := json.Marshal(body)
+		var err error
+		jsonData, err = json.Marshal(body)
 		if err != nil {
 			resultError := fmt.Errorf("error when data marshalling: %v", err)
 			haApi.logger.ErrorLog.Println(resultError)
 			return resultError
 		}
+	}
+
+	policy := haApi.requestPolicy
+	if method != http.MethodGet {
+		policy.MaxAttempts = 1
+	}
+
+	err := policy.Do(haApi.ctx, method+" "+url, haApi.logger, func(ctx context.Context) error {
+		return haApi.doRequest(ctx, method, url, expectedStatus, jsonData, result)
+	})
+	if err != nil {
+		haApi.logger.ErrorLog.Println(err)
+		return err
+	}
+
+	haApi.logger.DebugLog.Printf("Get result %v", result)
+	return nil
+}
+
+func (haApi *HaApiClient) doRequest(ctx context.Context, method string, url string, expectedStatus int, jsonData []byte, result interface{}) error {
+	var bodyReader io.Reader
+	if jsonData != nil {
 		bodyReader = bytes.NewReader(jsonData) // эффективнее для чтения
 	}
 
 	// Создаём запрос
-	req, err := http.NewRequest(method, url, bodyReader)
+	req, err := http.NewRequestWithContext(ctx, method, url, bodyReader)
 	if err != nil {
-		resultError := fmt.Errorf("error when create request: %w", err)
-		haApi.logger.ErrorLog.Println(resultError)
-		return resultError
+		return fmt.Errorf("error when create request: %w", err)
 	}
 
 	// Устанавливаем заголовок для JSON, если тело было
-	if body != nil {
+	if jsonData != nil {
 		req.Header.Set("Content-Type", "application/json")
 	}
 
@@ -619,46 +743,35 @@ func (haApi *HaApiClient) innerRequest(method string, url string, expectedStatus
 	// Выполняем запрос
 	resp, err := haApi.httpClient.Do(req)
 	if err != nil {
-		resultError := fmt.Errorf("error when execute request: %v", err)
-		haApi.logger.ErrorLog.Println(resultError)
-		return resultError
+		return fmt.Errorf("error when execute request: %w", err)
 	}
 
 	defer resp.Body.Close()
 
 	// Проверяем статус код
 	if resp.StatusCode != expectedStatus {
-		resultError := fmt.Errorf("failed to fetch data: %s", resp.Status)
-		haApi.logger.ErrorLog.Println(resultError)
-		return resultError
+		return fmt.Errorf("failed to fetch data: %w", retry.NewStatusError(resp))
 	}
 
 	// Читаем тело ответа
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		resultError := fmt.Errorf("error when read body: %v", err)
-		haApi.logger.ErrorLog.Println(resultError)
-		return resultError
+		return fmt.Errorf("error when read body: %w", err)
 	}
 
-	//haApi.logger.ErrorLog.Printf("*** Result body: %s", string(respBody))
-
 	// Декодируем JSON-ответ
 	if err := json.Unmarshal(respBody, result); err != nil {
-		resultError := fmt.Errorf("error when parse body: %v", err)
-		haApi.logger.ErrorLog.Println(resultError)
-		return resultError
+		return fmt.Errorf("error when parse body: %v", err)
 	}
-	haApi.logger.DebugLog.Printf("Get result %v", result)
 	return nil
 }
 
-func (haApi *HaApiClient) GetDownloadBackupBody(slug string) (int64, io.ReadCloser, error) {
+func (haApi *HaApiClient) GetDownloadBackupBody(ctx context.Context, slug string) (int64, io.ReadCloser, error) {
 	haApi.logger.DebugLog.Println("Get addons request")
 	url := fmt.Sprintf("%s/%s/download", BackupBaseURL, slug)
 
 	// Создаем новый HTTP-запрос
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		resultError := fmt.Errorf("error when create request: %v", err)
 		haApi.logger.ErrorLog.Println(resultError)
@@ -701,7 +814,7 @@ func (haApi *HaApiClient) SaveAddonIcon(slug string) (string, error) {
 	outputFile := addonIconPath + "/" + outputFileName
 
 	// Создаем новый HTTP-запрос
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(haApi.ctx, "GET", url, nil)
 	if err != nil {
 		resultError := fmt.Errorf("error when create request: %v", err)
 		haApi.logger.ErrorLog.Println(resultError)
@@ -750,6 +863,8 @@ func (haApi *HaApiClient) innerSetEntityState(entityState EntityState, saveLocal
 		Attributes: EntityAttributes{
 			OkUploadAmount:              entityState.OkUpload,
 			ErrorUploadAmount:           entityState.ErrorUpload,
+			ErrorUploadFileNames:        entityState.ErrorUploadFiles,
+			UploadErrorMessage:          entityState.UploadErrorMessage,
 			OkDeleteAmount:              entityState.OkDelete,
 			ErrorDeleteAmount:           entityState.ErrorDelete,
 			RemoteFiles:                 entityState.RemoteFiles,
@@ -774,6 +889,11 @@ func (haApi *HaApiClient) innerSetEntityState(entityState EntityState, saveLocal
 		}
 	}
 
+	return haApi.postState(url, data)
+}
+
+// postState записывает состояние сущности через /states. HA отвечает 201 при создании сущности и 200 при изменении
+func (haApi *HaApiClient) postState(url string, data any) error {
 	// Преобразуем структуру в JSON
 	jsonData, err := json.Marshal(data)
 	if err != nil {
@@ -784,7 +904,9 @@ func (haApi *HaApiClient) innerSetEntityState(entityState EntityState, saveLocal
 
 	// Выполняем POST запрос
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	ctx, cancel := context.WithTimeout(haApi.ctx, setEntityStateTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
 		resultError := fmt.Errorf("error when create request: %v", err)
 		haApi.logger.ErrorLog.Println(resultError)
@@ -808,7 +930,7 @@ func (haApi *HaApiClient) innerSetEntityState(entityState EntityState, saveLocal
 	// Проверяем статус ответа
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		haApi.logger.ErrorLog.Println("Ошибка при чтении ответа: %v", err)
+		haApi.logger.ErrorLog.Printf("Ошибка при чтении ответа: %v", err)
 	}
 
 	haApi.logger.DebugLog.Printf("Request result %d: %s", resp.StatusCode, body)
@@ -827,6 +949,8 @@ func NewEntityState(state Status, attributes EntityAttributes) *EntityState {
 		State:                       state,
 		OkUpload:                    attributes.OkUploadAmount,
 		ErrorUpload:                 attributes.ErrorUploadAmount,
+		ErrorUploadFiles:            attributes.ErrorUploadFileNames,
+		UploadErrorMessage:          attributes.UploadErrorMessage,
 		OkDelete:                    attributes.OkDeleteAmount,
 		ErrorDelete:                 attributes.ErrorDeleteAmount,
 		LocalFiles:                  attributes.LocalFiles,
@@ -863,14 +987,23 @@ func readLocalEntityCopy() (setEntityStateRequest, error) {
 	return data, err
 }
 
-func (app *HaApiClient) UploadBackup(source string, destinationFileName string) error {
+func (app *HaApiClient) UploadBackup(ctx context.Context, source string, destinationFileName string) error {
 	app.logger.DebugLog.Printf("Try upload %s into %s", source, destinationFileName)
 
 	url := fmt.Sprintf("%s/new/upload", BackupBaseURL)
-	return app.uploadFileMultipart(url, source, app.token)
+	return app.uploadFileMultipart(ctx, url, source, app.token)
 }
 
-func (app *HaApiClient) uploadFileMultipart(url, filePath, token string) error {
+// UploadBackupToLocation загружает файл бэкапа в хранилище бэкапов supervisor (сетевое хранилище).
+// Если бэкап уже есть в HA, хранилище добавляется к его копиям
+func (app *HaApiClient) UploadBackupToLocation(ctx context.Context, source string, location string) error {
+	app.logger.DebugLog.Printf("Try upload %s into location %s", source, location)
+
+	url := fmt.Sprintf("%s/new/upload?location=%s", BackupBaseURL, neturl.QueryEscape(location))
+	return app.uploadFileMultipart(ctx, url, source, app.token)
+}
+
+func (app *HaApiClient) uploadFileMultipart(ctx context.Context, url, filePath, token string) error {
 	// Открываем файл для чтения
 	file, err := os.Open(filePath)
 	if err != nil {
@@ -879,46 +1012,22 @@ func (app *HaApiClient) uploadFileMultipart(url, filePath, token string) error {
 	}
 	defer file.Close()
 
-	// Создаем буфер для тела запроса
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
-
-	// Создаем часть для файла
-	part, err := writer.CreateFormFile("file", filePath)
-	if err != nil {
-		app.logger.ErrorLog.Printf("Error when create form: %v", err)
-		return fmt.Errorf("error when create form: %v", err)
-	}
-
-	// Читаем файл по частям и записываем в часть формы
-	buf := make([]byte, 8192) // Буфер размером 8KB
-	for {
-		n, err := file.Read(buf)
-		if n > 0 {
-			_, err := part.Write(buf[:n])
-			if err != nil {
-				app.logger.ErrorLog.Printf("Error when write part to form: %v", err)
-				return fmt.Errorf("error when write part to form: %v", err)
-			}
-		}
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			app.logger.ErrorLog.Printf("Error when read part from file: %v", err)
-			return fmt.Errorf("error when read part from file: %v", err)
-		}
-	}
-
-	// Закрываем писатель, чтобы завершить формирование тела запроса
-	err = writer.Close()
-	if err != nil {
-		app.logger.ErrorLog.Printf("Error when close writer: %v", err)
-		return fmt.Errorf("error when close writer: %v", err)
-	}
+	// Тело запроса формируется потоком: файл бэкапа может быть больше доступной памяти
+	body, bodyWriter := io.Pipe()
+	writer := multipart.NewWriter(bodyWriter)
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		bodyWriter.CloseWithError(writeMultipartFile(writer, file, filePath))
+	}()
+	defer func() {
+		// Если запрос прерван, запись в закрытый поток завершится ошибкой
+		body.Close()
+		<-written
+	}()
 
 	// Создаем новый запрос
-	req, err := http.NewRequest("POST", url, body)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, body)
 	if err != nil {
 		app.logger.ErrorLog.Printf("Error when create request: %v", err)
 		return fmt.Errorf("error when create request: %v", err)
@@ -954,3 +1063,18 @@ func (app *HaApiClient) uploadFileMultipart(url, filePath, token string) error {
 	app.logger.InfoLog.Printf("File uploaded: %s", filePath)
 	return nil
 }
+
+// writeMultipartFile записывает файл в форму multipart и завершает её
+func writeMultipartFile(writer *multipart.Writer, file io.Reader, filePath string) error {
+	part, err := writer.CreateFormFile("file", filePath)
+	if err != nil {
+		return fmt.Errorf("error when create form: %w", err)
+	}
+	if _, err := io.Copy(part, file); err != nil {
+		return fmt.Errorf("error when write file to form: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("error when close writer: %w", err)
+	}
+	return nil
+}
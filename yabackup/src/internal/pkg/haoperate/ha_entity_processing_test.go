@@ -0,0 +1,84 @@
+package haoperate
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+	"ybg/internal/pkg/mylogger"
+	"ybg/internal/pkg/retry"
+)
+
+func newTestHaApi(t *testing.T) *HaApiClient {
+	discardLog := log.New(io.Discard, "", 0)
+	haApi, err := NewHaApi("", context.Background(), retry.NewHTTPClient(), "token", mylogger.New(discardLog, discardLog, discardLog))
+	assert.NoError(t, err)
+	haApi.requestPolicy = retry.Policy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, AttemptTimeout: time.Second}
+	return haApi
+}
+
+// supervisorRestarting первые failures запросов отвечает 502, как supervisor во время перезапуска
+func supervisorRestarting(failures int32) (*httptest.Server, *atomic.Int32) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= failures {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		_, _ = io.WriteString(w, `{"result":"ok","data":{"name":"job","done":true}}`)
+	}))
+	return server, &calls
+}
+
+func Test_GetRequestRetriesTransientErrors(t *testing.T) {
+	haApi := newTestHaApi(t)
+	server, calls := supervisorRestarting(2)
+	defer server.Close()
+
+	var result JobInfoResponse
+	err := haApi.getRequest(server.URL, &result)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(3), calls.Load())
+	assert.True(t, result.Data.Done)
+}
+
+func Test_PostRequestIsNotRetried(t *testing.T) {
+	haApi := newTestHaApi(t)
+	server, calls := supervisorRestarting(2)
+	defer server.Close()
+
+	var result JobInfoResponse
+	err := haApi.postRequest(server.URL, struct{}{}, &result)
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func Test_uploadFileMultipartStreamsFile(t *testing.T) {
+	haApi := newTestHaApi(t)
+	content := []byte("backup archive content")
+	source := filepath.Join(t.TempDir(), "backup.tar")
+	assert.NoError(t, os.WriteFile(source, content, 0o600))
+
+	var received []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file, _, err := r.FormFile("file")
+		if !assert.NoError(t, err) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received, _ = io.ReadAll(file)
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+	}))
+	defer server.Close()
+
+	err := haApi.uploadFileMultipart(context.Background(), server.URL, source, "token")
+	assert.NoError(t, err)
+	assert.Equal(t, content, received)
+}
@@ -0,0 +1,82 @@
+package haoperate
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	binarySensorPrefix  = "binary_sensor."
+	problemEntitySuffix = "_problem"
+	problemStateOn      = "on"
+	problemStateOff     = "off"
+	deviceClassProblem  = "problem"
+)
+
+// ProblemAttributes атрибуты сенсора проблем с бэкапами
+type ProblemAttributes struct {
+	FriendlyName      string   `json:"friendly_name"`
+	DeviceClass       string   `json:"device_class"`
+	Problems          []string `json:"problems"`
+	RemoteAgeHours    *float64 `json:"remote_backup_age_hours,omitempty"`
+	LocalAgeHours     *float64 `json:"local_backup_age_hours,omitempty"`
+	RemoteMaxAgeHours int      `json:"remote_backup_max_age_hours"`
+	LocalMaxAgeHours  int      `json:"local_backup_max_age_hours"`
+	Checked           string   `json:"checked"`
+}
+
+type setProblemStateRequest struct {
+	State      string            `json:"state"`
+	Attributes ProblemAttributes `json:"attributes"`
+}
+
+type notificationRequest struct {
+	NotificationId string `json:"notification_id"`
+	Title          string `json:"title,omitempty"`
+	Message        string `json:"message,omitempty"`
+}
+
+// ProblemEntityId идентификатор сенсора проблем: binary_sensor.<entity_id>_problem
+func (haApi *HaApiClient) ProblemEntityId() string {
+	return binarySensorPrefix + strings.TrimPrefix(haApi.entity_id, EntityIdPrefix) + problemEntitySuffix
+}
+
+// SetProblemState устанавливает состояние сенсора проблем (device_class problem)
+func (haApi *HaApiClient) SetProblemState(isProblem bool, attributes ProblemAttributes) error {
+	haApi.logger.DebugLog.Printf("Set problem entity %v", isProblem)
+	url := fmt.Sprintf("%s/states/%s", CoreBaseURL, haApi.ProblemEntityId())
+
+	attributes.DeviceClass = deviceClassProblem
+	if attributes.Problems == nil {
+		attributes.Problems = make([]string, 0)
+	}
+	data := setProblemStateRequest{State: problemStateOff, Attributes: attributes}
+	if isProblem {
+		data.State = problemStateOn
+	}
+	return haApi.postState(url, data)
+}
+
+// CreateNotification создаёт (или заменяет) постоянное уведомление HA
+func (haApi *HaApiClient) CreateNotification(notificationId string, title string, message string) error {
+	haApi.logger.DebugLog.Printf("Create notification %s", notificationId)
+	url := fmt.Sprintf("%s/services/persistent_notification/create", CoreBaseURL)
+	var result []any
+	err := haApi.postRequest(url, notificationRequest{NotificationId: notificationId, Title: title, Message: message}, &result)
+	if err != nil {
+		return fmt.Errorf("error when create notification: %v", err)
+	}
+	return nil
+}
+
+// DismissNotification убирает постоянное уведомление HA
+func (haApi *HaApiClient) DismissNotification(notificationId string) error {
+	haApi.logger.DebugLog.Printf("Dismiss notification %s", notificationId)
+	url := fmt.Sprintf("%s/services/persistent_notification/dismiss", CoreBaseURL)
+	var result []any
+	err := haApi.postRequest(url, notificationRequest{NotificationId: notificationId}, &result)
+	if err != nil {
+		return fmt.Errorf("error when dismiss notification: %v", err)
+	}
+	return nil
+}
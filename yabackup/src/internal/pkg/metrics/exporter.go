@@ -0,0 +1,225 @@
+package metrics
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"sync"
+	"time"
+	"ybg/internal/pkg/bkoperate"
+	"ybg/internal/pkg/mylogger"
+	om "ybg/internal/pkg/operationmanager"
+	"ybg/internal/pkg/yadiskoperate"
+	"ybg/internal/types"
+)
+
+const namespace = "yabackup"
+
+const (
+	resultOk    = "ok"
+	resultError = "error"
+)
+
+// durationBuckets границы корзин гистограммы длительности загрузки файла (секунды)
+var durationBuckets = []float64{5, 15, 30, 60, 120, 300, 600, 1200, 1800, 3600, 7200}
+
+// Exporter метрики аддона для Prometheus.
+// Счётчики операций заполняются по событиям OperationManager и результатам запусков заданий планировщика,
+// значения хранилищ берутся из статистики BkProcessor в момент запроса метрик.
+type Exporter struct {
+	registry         *prometheus.Registry
+	handler          http.Handler
+	operationManager *om.OperationManager
+	bkProcessor      *bkoperate.BkProcessor
+	yaDProcessor     *yadiskoperate.YaDProcessor
+	logger           *mylogger.Logger
+
+	uploads           *prometheus.CounterVec
+	deletes           *prometheus.CounterVec
+	transferredBytes  *prometheus.CounterVec
+	operations        *prometheus.CounterVec
+	operationDuration *prometheus.HistogramVec
+	lastSuccess       *prometheus.GaugeVec
+	jobRuns           *prometheus.CounterVec
+	jobLastRun        *prometheus.GaugeVec
+	files             *prometheus.GaugeVec
+	filesSize         *prometheus.GaugeVec
+	freeSpace         *prometheus.GaugeVec
+	tokenExpiry       prometheus.Gauge
+
+	mu       sync.Mutex
+	counted  bkoperate.TransferCounters // значения счётчиков BkProcessor, уже перенесённые в метрики
+	finished map[string]time.Time       // время завершения уже учтённой операции
+}
+
+func NewExporter(operationManager *om.OperationManager, bkProcessor *bkoperate.BkProcessor,
+	yaDProcessor *yadiskoperate.YaDProcessor, logger *mylogger.Logger) *Exporter {
+	registry := prometheus.NewRegistry()
+	e := &Exporter{
+		registry:         registry,
+		operationManager: operationManager,
+		bkProcessor:      bkProcessor,
+		yaDProcessor:     yaDProcessor,
+		logger:           logger,
+		finished:         make(map[string]time.Time),
+
+		uploads: prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: namespace, Name: "uploads_total",
+			Help: "Files uploaded to Yandex Disk"}, []string{"result"}),
+		deletes: prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: namespace, Name: "deletes_total",
+			Help: "Files deleted from Yandex Disk"}, []string{"result"}),
+		transferredBytes: prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: namespace, Name: "transferred_bytes_total",
+			Help: "Bytes transferred to (upload) and from (download) Yandex Disk"}, []string{"direction"}),
+		operations: prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: namespace, Name: "operations_total",
+			Help: "Finished operations by type and result"}, []string{"type", "result"}),
+		operationDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{Namespace: namespace, Name: "operation_duration_seconds",
+			Help: "Duration of successful upload, download and upload task operations", Buckets: durationBuckets}, []string{"type"}),
+		lastSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: namespace, Name: "last_success_timestamp_seconds",
+			Help: "Unix time of the last successful operation by type"}, []string{"type"}),
+		jobRuns: prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: namespace, Name: "scheduler_job_runs_total",
+			Help: "Scheduler job runs by job and result"}, []string{"job", "result"}),
+		jobLastRun: prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: namespace, Name: "scheduler_job_last_run_timestamp_seconds",
+			Help: "Unix time of the last scheduler job run"}, []string{"job", "result"}),
+		files: prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: namespace, Name: "files",
+			Help: "Number of backup files in the storage"}, []string{"storage"}),
+		filesSize: prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: namespace, Name: "files_size_bytes",
+			Help: "Total size of backup files in the storage"}, []string{"storage"}),
+		freeSpace: prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: namespace, Name: "free_space_bytes",
+			Help: "Free space in the storage"}, []string{"storage"}),
+		tokenExpiry: prometheus.NewGauge(prometheus.GaugeOpts{Namespace: namespace, Name: "token_expiry_timestamp_seconds",
+			Help: "Unix time when the Yandex OAuth token expires"}),
+	}
+	registry.MustRegister(e.uploads, e.deletes, e.transferredBytes, e.operations, e.operationDuration, e.lastSuccess,
+		e.jobRuns, e.jobLastRun, e.files, e.filesSize, e.freeSpace, e.tokenExpiry)
+	e.handler = promhttp.HandlerFor(registry, promhttp.HandlerOpts{ErrorLog: e.logger.ErrorLog})
+	return e
+}
+
+// Run учитывает события OperationManager до отмены ctx
+func (e *Exporter) Run(ctx context.Context) {
+	subscription := e.operationManager.Subscribe(nil)
+	defer e.operationManager.Unsubscribe(subscription)
+
+	for {
+		for _, operation := range subscription.Changes() {
+			e.observeOperation(operation)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-subscription.Notify():
+		}
+	}
+}
+
+// observeOperation учитывает завершение операции. Идентификаторы операций переиспользуются,
+// поэтому завершение отличается по времени окончания
+func (e *Exporter) observeOperation(operation om.OperationInfoResponse) {
+	if !operation.IsDone || operation.FinishTime == nil {
+		return
+	}
+
+	e.mu.Lock()
+	if e.finished[operation.Id].Equal(*operation.FinishTime) {
+		e.mu.Unlock()
+		return
+	}
+	e.finished[operation.Id] = *operation.FinishTime
+	e.mu.Unlock()
+
+	operationType := string(operation.Type)
+	if operationType == "" {
+		operationType = "unknown"
+	}
+
+	if operation.IsError {
+		e.operations.WithLabelValues(operationType, resultError).Inc()
+		return
+	}
+	e.operations.WithLabelValues(operationType, resultOk).Inc()
+	e.lastSuccess.WithLabelValues(operationType).Set(float64(operation.FinishTime.Unix()))
+
+	switch operation.Type {
+	case om.OperationTypeUpload, om.OperationTypeDownload, om.OperationTypeUploadTask, om.OperationTypeVerify,
+		om.OperationTypeSyncDown:
+		if operation.StartTime != nil {
+			e.operationDuration.WithLabelValues(operationType).Observe(operation.FinishTime.Sub(*operation.StartTime).Seconds())
+		}
+	}
+	if operation.Type == om.OperationTypeDownload || operation.Type == om.OperationTypeVerify {
+		addDelta(e.transferredBytes.WithLabelValues("download"), float64(operation.TotalBytes))
+	}
+}
+
+// ClearFinished забывает операции, завершённые больше hourDelta часов назад.
+// Вызывается вместе с OperationManager.ClearOperations, который удаляет эти операции
+func (e *Exporter) ClearFinished(hourDelta int) {
+	threshold := time.Now().Add(time.Duration(-1*hourDelta) * time.Hour)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for id, finished := range e.finished {
+		if finished.Before(threshold) {
+			delete(e.finished, id)
+		}
+	}
+}
+
+// ObserveJob учитывает выполнение задания планировщика (err == nil - успешно)
+func (e *Exporter) ObserveJob(job string, err error) {
+	result := resultOk
+	if err != nil {
+		result = resultError
+	}
+	e.jobRuns.WithLabelValues(job, result).Inc()
+	e.jobLastRun.WithLabelValues(job, result).Set(float64(time.Now().Unix()))
+}
+
+// collect переносит в метрики счётчики и статистику BkProcessor
+func (e *Exporter) collect() {
+	counters := e.bkProcessor.TransferCounters()
+
+	e.mu.Lock()
+	counted := e.counted
+	e.counted = counters
+	e.mu.Unlock()
+
+	addDelta(e.uploads.WithLabelValues(resultOk), float64(counters.UploadOk-counted.UploadOk))
+	addDelta(e.uploads.WithLabelValues(resultError), float64(counters.UploadError-counted.UploadError))
+	addDelta(e.deletes.WithLabelValues(resultOk), float64(counters.DeleteOk-counted.DeleteOk))
+	addDelta(e.deletes.WithLabelValues(resultError), float64(counters.DeleteError-counted.DeleteError))
+	addDelta(e.transferredBytes.WithLabelValues("upload"), float64(counters.UploadedBytes-counted.UploadedBytes))
+
+	statistic := e.bkProcessor.LastStatistic()
+	e.setStorage("yandex_disk", statistic.YaDisk)
+	e.setStorage("local", statistic.LocalStorage)
+	for name, storage := range statistic.NetworkStorage {
+		e.setStorage(name, storage)
+	}
+
+	if expiry := e.yaDProcessor.TokenInfo.Expiry; !expiry.IsZero() {
+		e.tokenExpiry.Set(float64(expiry.Unix()))
+	}
+}
+
+// setStorage FileAmount -1 - статистика хранилища не получена
+func (e *Exporter) setStorage(storage string, statistic types.StorageStatistic) {
+	if statistic.FileAmount < 0 {
+		return
+	}
+	e.files.WithLabelValues(storage).Set(float64(statistic.FileAmount))
+	e.filesSize.WithLabelValues(storage).Set(float64(statistic.FilesSize))
+	e.freeSpace.WithLabelValues(storage).Set(float64(statistic.FreeSpace))
+}
+
+// addDelta увеличивает счётчик. Counter.Add паникует на отрицательных значениях, поэтому они пропускаются
+func addDelta(counter prometheus.Counter, value float64) {
+	if value >= 0 {
+		counter.Add(value)
+	}
+}
+
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.collect()
+	e.handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"log"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"ybg/internal/pkg/mylogger"
+	om "ybg/internal/pkg/operationmanager"
+)
+
+func testExporter() *Exporter {
+	logger := mylogger.New(log.Default(), log.Default(), log.Default())
+	operationManager := om.New(context.Background(), logger)
+	return NewExporter(operationManager, nil, nil, logger)
+}
+
+func Test_observeOperationCountsEachFinishOnce(t *testing.T) {
+	exporter := testExporter()
+
+	start := time.Now().Add(-time.Minute)
+	finish := time.Now()
+	operation := om.OperationInfoResponse{Id: "upload_task", Type: om.OperationTypeUploadTask,
+		IsDone: true, StartTime: &start, FinishTime: &finish}
+
+	exporter.observeOperation(operation)
+	exporter.observeOperation(operation)
+	nextFinish := finish.Add(time.Hour)
+	operation.FinishTime = &nextFinish
+	operation.IsError = true
+	exporter.observeOperation(operation)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(exporter.operations.WithLabelValues("upload_task", resultOk)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(exporter.operations.WithLabelValues("upload_task", resultError)))
+	assert.Equal(t, float64(finish.Unix()), testutil.ToFloat64(exporter.lastSuccess.WithLabelValues("upload_task")))
+	assert.Equal(t, 1, testutil.CollectAndCount(exporter.operationDuration))
+}
+
+func Test_ClearFinished(t *testing.T) {
+	exporter := testExporter()
+
+	for id, finishedAgo := range map[string]time.Duration{"old.tar": 7 * time.Hour, "new.tar": time.Hour} {
+		start := time.Now().Add(-finishedAgo - time.Minute)
+		finish := time.Now().Add(-finishedAgo)
+		exporter.observeOperation(om.OperationInfoResponse{Id: id, Type: om.OperationTypeUpload,
+			IsDone: true, StartTime: &start, FinishTime: &finish})
+	}
+
+	exporter.ClearFinished(6)
+	assert.Len(t, exporter.finished, 1)
+	assert.Contains(t, exporter.finished, "new.tar")
+	assert.Equal(t, 2.0, testutil.ToFloat64(exporter.operations.WithLabelValues("upload", resultOk)))
+}
+
+func Test_handlerWritesTextFormat(t *testing.T) {
+	exporter := testExporter()
+	exporter.ObserveJob("upload", nil)
+	exporter.ObserveJob("upload", errors.New("failed"))
+	exporter.ObserveJob("upload", errors.New("failed"))
+	addDelta(exporter.uploads.WithLabelValues(resultOk), -1)
+
+	recorder := httptest.NewRecorder()
+	exporter.handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := io.ReadAll(recorder.Body)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 200, recorder.Code)
+	assert.Contains(t, recorder.Header().Get("Content-Type"), "text/plain")
+	assert.Contains(t, string(body), "# TYPE yabackup_scheduler_job_runs_total counter")
+	assert.Contains(t, string(body), `yabackup_scheduler_job_runs_total{job="upload",result="ok"} 1`)
+	assert.Contains(t, string(body), `yabackup_scheduler_job_runs_total{job="upload",result="error"} 2`)
+	assert.Contains(t, string(body), `yabackup_uploads_total{result="ok"} 0`)
+}
@@ -0,0 +1,61 @@
+package mylogger
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Entry запись лога в буфере
+type Entry struct {
+	Time    time.Time         `json:"time"`
+	Level   string            `json:"level"`
+	Message string            `json:"message"`
+	Source  string            `json:"source,omitempty"`
+	Fields  map[string]string `json:"fields,omitempty"`
+	level   slog.Level
+}
+
+// Buffer кольцевой буфер последних записей лога
+type Buffer struct {
+	mu      sync.Mutex
+	entries []Entry
+	next    int
+	full    bool
+}
+
+func NewBuffer(size int) *Buffer {
+	return &Buffer{entries: make([]Entry, size)}
+}
+
+func (b *Buffer) add(entry Entry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.entries[b.next] = entry
+	b.next = (b.next + 1) % len(b.entries)
+	if b.next == 0 {
+		b.full = true
+	}
+}
+
+// Entries записи с уровнем не ниже minLevel, от старых к новым. limit > 0 - только limit последних
+func (b *Buffer) Entries(minLevel slog.Level, limit int) []Entry {
+	b.mu.Lock()
+	ordered := make([]Entry, 0, len(b.entries))
+	if b.full {
+		ordered = append(ordered, b.entries[b.next:]...)
+	}
+	ordered = append(ordered, b.entries[:b.next]...)
+	b.mu.Unlock()
+
+	result := make([]Entry, 0, len(ordered))
+	for _, entry := range ordered {
+		if entry.level >= minLevel {
+			result = append(result, entry)
+		}
+	}
+	if limit > 0 && len(result) > limit {
+		result = result[len(result)-limit:]
+	}
+	return result
+}
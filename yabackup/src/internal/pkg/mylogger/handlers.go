@@ -0,0 +1,213 @@
+package mylogger
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// levelWriter принимает строки от *log.Logger и пишет их в slog.Handler с заданным уровнем
+type levelWriter struct {
+	handler slog.Handler
+	level   slog.Level
+}
+
+func (w *levelWriter) Write(p []byte) (int, error) {
+	ctx := context.Background()
+	if !w.handler.Enabled(ctx, w.level) {
+		return len(p), nil
+	}
+	record := slog.NewRecord(time.Now(), w.level, strings.TrimRight(string(p), "\n"), callerPC())
+	return len(p), w.handler.Handle(ctx, record)
+}
+
+// packageDir каталог исходников пакета mylogger
+var packageDir = func() string {
+	_, file, _, _ := runtime.Caller(0)
+	return filepath.Dir(file)
+}()
+
+// callerPC место вызова ErrorLog.Printf и т.п.: первый кадр стека вне пакета log и исходников mylogger
+func callerPC() uintptr {
+	var pcs [16]uintptr
+	n := runtime.Callers(3, pcs[:])
+	for _, pc := range pcs[:n] {
+		frame, _ := runtime.CallersFrames([]uintptr{pc}).Next()
+		if strings.HasPrefix(frame.Function, "log.") {
+			continue
+		}
+		if filepath.Dir(frame.File) == packageDir && !strings.HasSuffix(frame.File, "_test.go") {
+			continue
+		}
+		return pc
+	}
+	return 0
+}
+
+// teeHandler передаёт запись нескольким обработчикам
+type teeHandler struct {
+	handlers []slog.Handler
+}
+
+func (h *teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, handler := range h.handlers {
+		if handler.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *teeHandler) Handle(ctx context.Context, record slog.Record) error {
+	var result error
+	for _, handler := range h.handlers {
+		if handler.Enabled(ctx, record.Level) {
+			result = errors.Join(result, handler.Handle(ctx, record.Clone()))
+		}
+	}
+	return result
+}
+
+func (h *teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make([]slog.Handler, len(h.handlers))
+	for i, handler := range h.handlers {
+		handlers[i] = handler.WithAttrs(attrs)
+	}
+	return &teeHandler{handlers: handlers}
+}
+
+func (h *teeHandler) WithGroup(name string) slog.Handler {
+	handlers := make([]slog.Handler, len(h.handlers))
+	for i, handler := range h.handlers {
+		handlers[i] = handler.WithGroup(name)
+	}
+	return &teeHandler{handlers: handlers}
+}
+
+// redactHandler удаляет секреты из сообщения и строковых полей записи
+type redactHandler struct {
+	next     slog.Handler
+	redactor *redactor
+}
+
+func (h *redactHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *redactHandler) Handle(ctx context.Context, record slog.Record) error {
+	redacted := slog.NewRecord(record.Time, record.Level, h.redactor.redact(record.Message), record.PC)
+	record.Attrs(func(attr slog.Attr) bool {
+		redacted.AddAttrs(h.redactAttr(attr))
+		return true
+	})
+	return h.next.Handle(ctx, redacted)
+}
+
+func (h *redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, attr := range attrs {
+		redacted[i] = h.redactAttr(attr)
+	}
+	return &redactHandler{next: h.next.WithAttrs(redacted), redactor: h.redactor}
+}
+
+func (h *redactHandler) WithGroup(name string) slog.Handler {
+	return &redactHandler{next: h.next.WithGroup(name), redactor: h.redactor}
+}
+
+func (h *redactHandler) redactAttr(attr slog.Attr) slog.Attr {
+	value := attr.Value.Resolve()
+	switch value.Kind() {
+	case slog.KindString:
+		return slog.String(attr.Key, h.redactor.redact(value.String()))
+	case slog.KindAny:
+		return slog.String(attr.Key, h.redactor.redact(value.String()))
+	case slog.KindGroup:
+		group := value.Group()
+		redacted := make([]any, len(group))
+		for i, item := range group {
+			redacted[i] = h.redactAttr(item)
+		}
+		return slog.Group(attr.Key, redacted...)
+	}
+	return attr
+}
+
+// bufferHandler сохраняет записи в кольцевой буфер для просмотра в WEB-интерфейсе
+type bufferHandler struct {
+	buffer *Buffer
+	level  slog.Leveler
+	attrs  []slog.Attr
+	group  string
+}
+
+func (h *bufferHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *bufferHandler) Handle(_ context.Context, record slog.Record) error {
+	entry := Entry{
+		Time:    record.Time,
+		Level:   LevelName(record.Level),
+		Message: record.Message,
+		level:   record.Level,
+	}
+	if record.PC != 0 {
+		frame, _ := runtime.CallersFrames([]uintptr{record.PC}).Next()
+		entry.Source = formatSource(&slog.Source{File: frame.File, Line: frame.Line})
+	}
+
+	fields := make(map[string]string)
+	for _, attr := range h.attrs {
+		addField(fields, "", attr)
+	}
+	record.Attrs(func(attr slog.Attr) bool {
+		addField(fields, h.group, attr)
+		return true
+	})
+	if len(fields) > 0 {
+		entry.Fields = fields
+	}
+
+	h.buffer.add(entry)
+	return nil
+}
+
+func (h *bufferHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	prefixed := make([]slog.Attr, 0, len(h.attrs)+len(attrs))
+	prefixed = append(prefixed, h.attrs...)
+	for _, attr := range attrs {
+		if h.group != "" {
+			attr.Key = h.group + "." + attr.Key
+		}
+		prefixed = append(prefixed, attr)
+	}
+	return &bufferHandler{buffer: h.buffer, level: h.level, attrs: prefixed, group: h.group}
+}
+
+func (h *bufferHandler) WithGroup(name string) slog.Handler {
+	group := name
+	if h.group != "" {
+		group = h.group + "." + name
+	}
+	return &bufferHandler{buffer: h.buffer, level: h.level, attrs: h.attrs, group: group}
+}
+
+func addField(fields map[string]string, prefix string, attr slog.Attr) {
+	key := attr.Key
+	if prefix != "" {
+		key = prefix + "." + key
+	}
+	value := attr.Value.Resolve()
+	if value.Kind() == slog.KindGroup {
+		for _, item := range value.Group() {
+			addField(fields, key, item)
+		}
+		return
+	}
+	fields[key] = value.String()
+}
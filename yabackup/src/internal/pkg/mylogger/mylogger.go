@@ -2,33 +2,120 @@ package mylogger
 
 import (
 	"encoding/json"
+	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"path/filepath"
+	"strings"
 )
 
+// Logger структурированный логгер (slog). ErrorLog, WarnLog, InfoLog, DebugLog пишут в него с соответствующим уровнем,
+// место вызова (файл:строка) и поля, добавленные через With, попадают в запись.
+// Перед выводом из записей удаляются секреты (токены, пароли).
 type Logger struct {
-	ErrorLog     *log.Logger
-	InfoLog      *log.Logger
-	DebugLog     *log.Logger
-	debugEnabled bool
+	ErrorLog *log.Logger
+	WarnLog  *log.Logger
+	InfoLog  *log.Logger
+	DebugLog *log.Logger
+	slogger  *slog.Logger
+	level    *slog.LevelVar
+	redactor *redactor
+	buffer   *Buffer
 }
 
+// Options настройки структурированного логгера
+type Options struct {
+	Level      slog.Level
+	JSON       bool // вывод в формате JSON, иначе key=value
+	Output     io.Writer
+	BufferSize int // количество последних записей, доступных в WEB-интерфейсе. 0 - не хранить
+}
+
+// New логгер поверх готовых *log.Logger (без уровней и буфера). Используется в тестах
 func New(errorLog *log.Logger,
 	infoLog *log.Logger,
 	debugLog *log.Logger) *Logger {
+	level := &slog.LevelVar{}
+	level.Set(slog.LevelDebug)
 	return &Logger{
-		ErrorLog:     errorLog,
-		InfoLog:      infoLog,
-		DebugLog:     debugLog,
-		debugEnabled: true,
+		ErrorLog: errorLog,
+		WarnLog:  errorLog,
+		InfoLog:  infoLog,
+		DebugLog: debugLog,
+		slogger:  slog.New(slog.NewTextHandler(errorLog.Writer(), &slog.HandlerOptions{Level: level})),
+		level:    level,
+		redactor: newRedactor(),
 	}
 }
 
-func (app *Logger) DisableDebug() {
-	app.debugEnabled = false
+// NewStructured создаёт структурированный логгер
+func NewStructured(options Options) *Logger {
+	level := &slog.LevelVar{}
+	level.Set(options.Level)
+
+	handlerOptions := &slog.HandlerOptions{AddSource: true, Level: level, ReplaceAttr: replaceAttr}
+	var handler slog.Handler
+	if options.JSON {
+		handler = slog.NewJSONHandler(options.Output, handlerOptions)
+	} else {
+		handler = slog.NewTextHandler(options.Output, handlerOptions)
+	}
+
+	var buffer *Buffer
+	if options.BufferSize > 0 {
+		buffer = NewBuffer(options.BufferSize)
+		handler = &teeHandler{handlers: []slog.Handler{handler, &bufferHandler{buffer: buffer, level: level}}}
+	}
+
+	redactor := newRedactor()
+	return newLogger(&redactHandler{next: handler, redactor: redactor}, level, redactor, buffer)
+}
+
+func newLogger(handler slog.Handler, level *slog.LevelVar, redactor *redactor, buffer *Buffer) *Logger {
+	return &Logger{
+		ErrorLog: log.New(&levelWriter{handler: handler, level: slog.LevelError}, "", 0),
+		WarnLog:  log.New(&levelWriter{handler: handler, level: slog.LevelWarn}, "", 0),
+		InfoLog:  log.New(&levelWriter{handler: handler, level: slog.LevelInfo}, "", 0),
+		DebugLog: log.New(&levelWriter{handler: handler, level: slog.LevelDebug}, "", 0),
+		slogger:  slog.New(handler),
+		level:    level,
+		redactor: redactor,
+		buffer:   buffer,
+	}
+}
+
+// With возвращает логгер, добавляющий поля (пары ключ-значение) ко всем записям, например operation_id, slug
+func (app *Logger) With(args ...any) *Logger {
+	if _, ok := app.ErrorLog.Writer().(*levelWriter); !ok {
+		// Логгер поверх готовых *log.Logger (New) полей не поддерживает
+		return app
+	}
+	return newLogger(app.slogger.With(args...).Handler(), app.level, app.redactor, app.buffer)
+}
+
+// Slog логгер slog для библиотек (например, планировщика)
+func (app *Logger) Slog() *slog.Logger {
+	return app.slogger
+}
+
+// AddSecret значения, которые никогда не должны попасть в лог (токены, пароли)
+func (app *Logger) AddSecret(secrets ...string) {
+	app.redactor.addSecrets(secrets...)
+}
+
+// Buffer последние записи лога. nil, если буфер отключён
+func (app *Logger) Buffer() *Buffer {
+	return app.buffer
+}
+
+// SetLevel меняет уровень лога без пересоздания логгера
+func (app *Logger) SetLevel(level slog.Level) {
+	app.level.Set(level)
 }
 
 func (app *Logger) IsDebugEnabled() bool {
-	return app.debugEnabled
+	return app.level.Level() <= slog.LevelDebug
 }
 
 func (app *Logger) LogStruct(format string, s any, logger *log.Logger) {
@@ -39,3 +126,51 @@ func (app *Logger) LogStruct(format string, s any, logger *log.Logger) {
 	}
 	logger.Printf(format, data)
 }
+
+// ParseLevel уровень лога из настроек аддона (DEBUG, INFO, WARNING, ERROR). По умолчанию INFO
+func ParseLevel(level string) slog.Level {
+	switch strings.ToUpper(strings.TrimSpace(level)) {
+	case "DEBUG":
+		return slog.LevelDebug
+	case "WARNING", "WARN":
+		return slog.LevelWarn
+	case "ERROR":
+		return slog.LevelError
+	}
+	return slog.LevelInfo
+}
+
+// LevelName имя уровня как в настройках аддона
+func LevelName(level slog.Level) string {
+	switch {
+	case level >= slog.LevelError:
+		return "ERROR"
+	case level >= slog.LevelWarn:
+		return "WARNING"
+	case level >= slog.LevelInfo:
+		return "INFO"
+	}
+	return "DEBUG"
+}
+
+// replaceAttr выводит уровень как в настройках аддона и место вызова в виде файл:строка
+func replaceAttr(_ []string, attr slog.Attr) slog.Attr {
+	switch attr.Key {
+	case slog.LevelKey:
+		if level, ok := attr.Value.Any().(slog.Level); ok {
+			return slog.String(slog.LevelKey, LevelName(level))
+		}
+	case slog.SourceKey:
+		if source, ok := attr.Value.Any().(*slog.Source); ok {
+			return slog.String(slog.SourceKey, formatSource(source))
+		}
+	}
+	return attr
+}
+
+func formatSource(source *slog.Source) string {
+	if source == nil || source.File == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d", filepath.Base(source.File), source.Line)
+}
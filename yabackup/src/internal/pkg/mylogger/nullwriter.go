@@ -1,12 +0,0 @@
-package mylogger
-
-type NullWriter struct {
-}
-
-func (NullWriter) Write(p []byte) (n int, err error) {
-	return 0, nil
-}
-
-func NewNullWriter() NullWriter {
-	return NullWriter{}
-}
@@ -0,0 +1,64 @@
+package mylogger
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const redacted = "***"
+
+// minSecretLength более короткие значения не маскируются, чтобы не портить лог случайными совпадениями
+const minSecretLength = 6
+
+// secretPatterns токены в заголовках авторизации и значения полей с секретами
+// (AccessToken:..., "access_token":"...", client_secret=...)
+var secretPatterns = []struct {
+	re          *regexp.Regexp
+	replacement string
+}{
+	{regexp.MustCompile(`(?i)\b(bearer|oauth)\s+[A-Za-z0-9._~+/=-]+`), "${1} " + redacted},
+	{regexp.MustCompile(`(?i)((?:access_?token|refresh_?token|client_?secret|password|supervisor_?token)["']?\s*[:=]\s*["']?)[^\s"',&}\]]+`),
+		"${1}" + redacted},
+}
+
+// redactor удаляет секреты из строк лога: известные значения (AddSecret) и значения по шаблонам
+type redactor struct {
+	mu       sync.RWMutex
+	replacer *strings.Replacer
+	secrets  map[string]struct{}
+}
+
+func newRedactor() *redactor {
+	return &redactor{secrets: make(map[string]struct{})}
+}
+
+func (r *redactor) addSecrets(secrets ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, secret := range secrets {
+		if len(secret) >= minSecretLength {
+			r.secrets[secret] = struct{}{}
+		}
+	}
+
+	pairs := make([]string, 0, 2*len(r.secrets))
+	for secret := range r.secrets {
+		pairs = append(pairs, secret, redacted)
+	}
+	r.replacer = strings.NewReplacer(pairs...)
+}
+
+func (r *redactor) redact(s string) string {
+	r.mu.RLock()
+	replacer := r.replacer
+	r.mu.RUnlock()
+
+	if replacer != nil {
+		s = replacer.Replace(s)
+	}
+	for _, pattern := range secretPatterns {
+		s = pattern.re.ReplaceAllString(s, pattern.replacement)
+	}
+	return s
+}
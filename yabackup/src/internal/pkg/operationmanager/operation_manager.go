@@ -4,29 +4,77 @@ import (
 	"context"
 	"errors"
 	"runtime"
+	"sort"
 	"sync"
 	"time"
 	"ybg/internal/pkg/mylogger"
 )
 
+var ErrOperationNotFound = errors.New("operation not found")
+var ErrOperationNotCancelable = errors.New("operation can not be canceled")
+
+// speedSmoothing вес последнего замера при сглаживании скорости передачи
+const speedSmoothing = 0.3
+
+const resultSuccess = "success"
+
+// OperationType тип операции
+type OperationType string
+
+const (
+	OperationTypeUnknown      OperationType = ""
+	OperationTypeUploadTask   OperationType = "upload_task"
+	OperationTypeCreateBackup OperationType = "create_backup"
+	OperationTypeUpload       OperationType = "upload"
+	OperationTypeRotate       OperationType = "rotate"
+	OperationTypeDownload     OperationType = "download"
+	OperationTypeDelete       OperationType = "delete"
+	OperationTypeVerify       OperationType = "verify"
+	OperationTypeCopy         OperationType = "copy"
+	OperationTypeSyncDown     OperationType = "sync_down"
+)
+
 type OperationInfo struct {
-	Progress    int
-	Status      string
-	IsError     bool
-	IsDone      bool
-	LastUpdated time.Time
+	Type             OperationType
+	ParentId         string
+	Progress         int
+	Status           string
+	IsError          bool
+	IsDone           bool
+	Cancelable       bool
+	TransferredBytes int64
+	TotalBytes       int64
+	Speed            float64 // байт в секунду
+	TransferUpdated  time.Time
+	StartTime        time.Time
+	FinishTime       time.Time
+	Result           string
+	LastUpdated      time.Time
 }
 
 type OperationInfoResponse struct {
-	Id       string `json:"id"`
-	Progress int    `json:"progress"`
-	Status   string `json:"status"`
-	IsError  bool   `json:"is_error"`
-	IsDone   bool   `json:"is_done"`
+	Id               string        `json:"id"`
+	Type             OperationType `json:"type,omitempty"`
+	ParentId         string        `json:"parent_id,omitempty"`
+	Children         []string      `json:"children,omitempty"`
+	Progress         int           `json:"progress"`
+	Status           string        `json:"status"`
+	IsError          bool          `json:"is_error"`
+	IsDone           bool          `json:"is_done"`
+	Cancelable       bool          `json:"cancelable"`
+	TransferredBytes int64         `json:"transferred_bytes,omitempty"`
+	TotalBytes       int64         `json:"total_bytes,omitempty"`
+	Speed            int64         `json:"speed,omitempty"`
+	Eta              int64         `json:"eta,omitempty"`
+	StartTime        *time.Time    `json:"start_time,omitempty"`
+	FinishTime       *time.Time    `json:"finish_time,omitempty"`
+	Result           string        `json:"result,omitempty"`
 }
 
 type OperationManager struct {
 	operationsMap *sync.Map
+	cancelMap     *sync.Map
+	subscriptions *sync.Map
 	logger        *mylogger.Logger
 	applCtx       context.Context
 }
@@ -34,11 +82,53 @@ type OperationManager struct {
 func New(applCtx context.Context, logger *mylogger.Logger) *OperationManager {
 	return &OperationManager{
 		operationsMap: &sync.Map{},
+		cancelMap:     &sync.Map{},
+		subscriptions: &sync.Map{},
 		logger:        logger,
 		applCtx:       applCtx,
 	}
 }
 
+// StartCancelableOperation стартует операцию, которую можно отменить через Cancel.
+// Возвращаемый контекст отменяется при вызове Cancel, при отмене parentCtx и при завершении операции (SuccessDone, ErrorDone).
+func (dwn *OperationManager) StartCancelableOperation(parentCtx context.Context, id string, newStatus string) context.Context {
+	ctx, cancel := context.WithCancel(parentCtx)
+	if old, loaded := dwn.cancelMap.Swap(id, cancel); loaded {
+		// Операция с таким идентификатором перезапущена. Предыдущую отменяем
+		old.(context.CancelFunc)()
+	}
+
+	dwn.updateOperationInfo(id, func(info *OperationInfo) {
+		startOperation(info, newStatus, true)
+	})
+	return ctx
+}
+
+// Cancel отменяет выполняющуюся операцию. Завершение операции (ErrorDone) выполняет сам исполнитель операции
+func (dwn *OperationManager) Cancel(id string) error {
+	cancel, ok := dwn.cancelMap.Load(id)
+	if !ok {
+		if found, _ := dwn.GetOperation(id); !found {
+			return ErrOperationNotFound
+		}
+		return ErrOperationNotCancelable
+	}
+
+	dwn.logger.InfoLog.Printf("Cancel operation [operationId %s]", id)
+	dwn.updateOperationInfo(id, func(info *OperationInfo) {
+		info.Status = "canceling"
+		info.Cancelable = false
+	})
+	cancel.(context.CancelFunc)()
+	return nil
+}
+
+func (dwn *OperationManager) releaseCancel(id string) {
+	if cancel, loaded := dwn.cancelMap.LoadAndDelete(id); loaded {
+		cancel.(context.CancelFunc)()
+	}
+}
+
 func (dwn *OperationManager) ChangeProgress(id string, newProgress int) {
 	dwn.updateOperationInfo(id, func(info *OperationInfo) {
 		info.Progress = newProgress
@@ -46,14 +136,78 @@ func (dwn *OperationManager) ChangeProgress(id string, newProgress int) {
 }
 
 func (dwn *OperationManager) StartOperation(id string, newStatus string) {
+	dwn.releaseCancel(id)
+	dwn.updateOperationInfo(id, func(info *OperationInfo) {
+		startOperation(info, newStatus, false)
+	})
+}
+
+// SetOperationType задаёт тип операции и родительскую операцию (шаг которой она является).
+// Вызывается после старта операции
+func (dwn *OperationManager) SetOperationType(id string, operationType OperationType, parentId string) {
+	dwn.updateOperationInfo(id, func(info *OperationInfo) {
+		info.Type = operationType
+		info.ParentId = parentId
+	})
+}
+
+// SetResult задаёт итог операции. Итог отображается после завершения операции
+func (dwn *OperationManager) SetResult(id string, result string) {
+	dwn.updateOperationInfo(id, func(info *OperationInfo) {
+		info.Result = result
+	})
+}
+
+func startOperation(info *OperationInfo, newStatus string, cancelable bool) {
+	info.Type = OperationTypeUnknown
+	info.ParentId = ""
+	info.Status = newStatus
+	info.Progress = 0
+	info.IsDone = false
+	info.IsError = false
+	info.Cancelable = cancelable
+	info.StartTime = time.Now()
+	info.FinishTime = time.Time{}
+	info.Result = ""
+	resetTransfer(info)
+}
+
+// ChangeTransferred обновляет количество переданных байт. Прогресс, скорость и оставшееся время вычисляются по ним
+func (dwn *OperationManager) ChangeTransferred(id string, newStatus string, transferred int64, total int64) {
+	if total < 0 {
+		// Размер неизвестен
+		total = 0
+	}
 	dwn.updateOperationInfo(id, func(info *OperationInfo) {
+		now := time.Now()
+		if info.TransferUpdated.IsZero() || transferred < info.TransferredBytes {
+			info.Speed = 0
+		} else if seconds := now.Sub(info.TransferUpdated).Seconds(); seconds > 0 {
+			speed := float64(transferred-info.TransferredBytes) / seconds
+			if info.Speed == 0 {
+				info.Speed = speed
+			} else {
+				info.Speed = speedSmoothing*speed + (1-speedSmoothing)*info.Speed
+			}
+		}
+
 		info.Status = newStatus
-		info.Progress = 0
-		info.IsDone = false
-		info.IsError = false
+		info.TransferredBytes = transferred
+		info.TotalBytes = total
+		info.TransferUpdated = now
+		if total > 0 {
+			info.Progress = int(transferred * 100 / total)
+		}
 	})
 }
 
+func resetTransfer(info *OperationInfo) {
+	info.TransferredBytes = 0
+	info.TotalBytes = 0
+	info.Speed = 0
+	info.TransferUpdated = time.Time{}
+}
+
 func (dwn *OperationManager) ChangeStatusAndProgress(id string, newStatus string, newProgress int) {
 	dwn.updateOperationInfo(id, func(info *OperationInfo) {
 		info.Status = newStatus
@@ -62,17 +216,27 @@ func (dwn *OperationManager) ChangeStatusAndProgress(id string, newStatus string
 }
 
 func (dwn *OperationManager) SuccessDone(id string) {
+	dwn.releaseCancel(id)
 	dwn.updateOperationInfo(id, func(info *OperationInfo) {
 		info.Progress = 100.
 		info.IsDone = true
+		info.Cancelable = false
+		info.FinishTime = time.Now()
+		if info.Result == "" {
+			info.Result = resultSuccess
+		}
 	})
 }
 
 func (dwn *OperationManager) ErrorDone(id string, errorStatus string) {
+	dwn.releaseCancel(id)
 	dwn.updateOperationInfo(id, func(info *OperationInfo) {
 		info.Status = errorStatus
 		info.IsError = true
 		info.IsDone = true
+		info.Cancelable = false
+		info.FinishTime = time.Now()
+		info.Result = errorStatus
 	})
 }
 
@@ -88,15 +252,12 @@ func (dwn *OperationManager) updateOperationInfo(id string, updateFunc func(*Ope
 		if exists {
 			// Приводим тип и сохраняем в info
 			orig = val.(*OperationInfo)
-			info = &OperationInfo{Progress: orig.Progress,
-				Status:      orig.Status,
-				IsError:     orig.IsError,
-				IsDone:      orig.IsDone,
-				LastUpdated: orig.LastUpdated}
+			copied := *orig
+			info = &copied
 
 		} else {
 			// Если запись не существует, создаем новую
-			info = &OperationInfo{0., "created", false, false, time.Now()}
+			info = &OperationInfo{Status: "created", StartTime: time.Now(), LastUpdated: time.Now()}
 		}
 
 		// Вызываем updateFunc с указателем на info
@@ -115,6 +276,7 @@ func (dwn *OperationManager) updateOperationInfo(id string, updateFunc func(*Ope
 		dwn.logger.DebugLog.Printf("orig %+v, old %+v", orig, old)
 
 		if old == orig {
+			dwn.publish(id, info)
 			return
 		}
 
@@ -150,6 +312,17 @@ func (dwn *OperationManager) GetAllOperations() []OperationInfoResponse {
 		}
 		return true
 	})
+
+	children := make(map[string][]string)
+	for _, item := range targetList {
+		if item.ParentId != "" {
+			children[item.ParentId] = append(children[item.ParentId], item.Id)
+		}
+	}
+	for i := range targetList {
+		targetList[i].Children = children[targetList[i].Id]
+		sort.Strings(targetList[i].Children)
+	}
 	return targetList
 }
 
@@ -205,6 +378,7 @@ func (dwn *OperationManager) GetOperation(id string) (bool, *OperationInfoRespon
 		}
 
 		result := transformItem(id, v)
+		result.Children = dwn.getChildren(id)
 
 		return true, &result
 
@@ -214,12 +388,49 @@ func (dwn *OperationManager) GetOperation(id string) (bool, *OperationInfoRespon
 
 }
 
+func (dwn *OperationManager) getChildren(parentId string) []string {
+	var result []string
+	dwn.operationsMap.Range(func(key, value interface{}) bool {
+		k, ok1 := key.(string)
+		v, ok2 := value.(*OperationInfo)
+		if ok1 && ok2 && v.ParentId == parentId {
+			result = append(result, k)
+		}
+		return true
+	})
+	sort.Strings(result)
+	return result
+}
+
 func transformItem(id string, item *OperationInfo) OperationInfoResponse {
-	return OperationInfoResponse{
-		Id:       id,
-		Progress: item.Progress,
-		Status:   item.Status,
-		IsError:  item.IsError,
-		IsDone:   item.IsDone,
+	result := OperationInfoResponse{
+		Id:               id,
+		Type:             item.Type,
+		ParentId:         item.ParentId,
+		Result:           item.Result,
+		Progress:         item.Progress,
+		Status:           item.Status,
+		IsError:          item.IsError,
+		IsDone:           item.IsDone,
+		Cancelable:       item.Cancelable,
+		TransferredBytes: item.TransferredBytes,
+		TotalBytes:       item.TotalBytes,
+	}
+
+	if !item.StartTime.IsZero() {
+		startTime := item.StartTime
+		result.StartTime = &startTime
+	}
+	if !item.FinishTime.IsZero() {
+		finishTime := item.FinishTime
+		result.FinishTime = &finishTime
+	}
+
+	if !item.IsDone && item.Speed > 0 {
+		result.Speed = int64(item.Speed)
+		if item.TotalBytes > item.TransferredBytes {
+			result.Eta = int64(float64(item.TotalBytes-item.TransferredBytes) / item.Speed)
+		}
 	}
+	return result
 }
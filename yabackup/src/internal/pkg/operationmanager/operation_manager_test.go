@@ -0,0 +1,148 @@
+package operationmanager
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"log"
+	"testing"
+	"time"
+	"ybg/internal/pkg/mylogger"
+)
+
+func newTestManager() *OperationManager {
+	discardLog := log.New(io.Discard, "", 0)
+	logger := &mylogger.Logger{ErrorLog: discardLog, InfoLog: discardLog, DebugLog: discardLog}
+	return New(context.Background(), logger)
+}
+
+func TestOperationManager_Cancel(t *testing.T) {
+	manager := newTestManager()
+
+	assert.ErrorIs(t, manager.Cancel("unknown"), ErrOperationNotFound)
+
+	manager.StartOperation("simple", "delete file")
+	assert.ErrorIs(t, manager.Cancel("simple"), ErrOperationNotCancelable)
+
+	ctx := manager.StartCancelableOperation(context.Background(), "upload", "uploading")
+	_, info := manager.GetOperation("upload")
+	assert.True(t, info.Cancelable)
+
+	assert.NoError(t, manager.Cancel("upload"))
+	assert.ErrorIs(t, ctx.Err(), context.Canceled)
+	_, info = manager.GetOperation("upload")
+	assert.False(t, info.Cancelable)
+	assert.Equal(t, "canceling", info.Status)
+
+	manager.ErrorDone("upload", "Upload canceled")
+	assert.ErrorIs(t, manager.Cancel("upload"), ErrOperationNotCancelable)
+
+	ctx = manager.StartCancelableOperation(context.Background(), "download", "downloading")
+	manager.SuccessDone("download")
+	assert.ErrorIs(t, ctx.Err(), context.Canceled, "context released after operation done")
+	_, info = manager.GetOperation("download")
+	assert.True(t, info.IsDone)
+	assert.False(t, info.IsError)
+}
+
+func TestOperationManager_Subscribe(t *testing.T) {
+	manager := newTestManager()
+	manager.StartOperation("a", "uploading")
+	manager.StartOperation("b", "uploading")
+
+	all := manager.Subscribe(nil)
+	defer manager.Unsubscribe(all)
+	onlyB := manager.Subscribe([]string{"b"})
+
+	// Текущее состояние доступно сразу после подписки
+	<-all.Notify()
+	changes := all.Changes()
+	assert.Len(t, changes, 2)
+	assert.Equal(t, "a", changes[0].Id)
+	assert.Equal(t, "b", changes[1].Id)
+
+	// Изменения одной операции схлопываются до последнего состояния
+	manager.ChangeStatusAndProgress("b", "uploading", 10)
+	manager.ChangeStatusAndProgress("b", "uploading", 20)
+	manager.ChangeStatusAndProgress("a", "uploading", 50)
+	<-onlyB.Notify()
+	changes = onlyB.Changes()
+	assert.Len(t, changes, 1)
+	assert.Equal(t, 20, changes[0].Progress)
+
+	manager.Unsubscribe(onlyB)
+	manager.SuccessDone("b")
+	assert.Empty(t, onlyB.Changes())
+
+	changes = all.Changes()
+	assert.Len(t, changes, 2)
+	assert.Equal(t, 50, changes[0].Progress)
+	assert.True(t, changes[1].IsDone)
+}
+
+func TestOperationManager_ChangeTransferred(t *testing.T) {
+	manager := newTestManager()
+	manager.StartOperation("upload", "waiting")
+	manager.ChangeTransferred("upload", "uploading", 0, 1000)
+
+	manager.updateOperationInfo("upload", func(info *OperationInfo) {
+		info.TransferUpdated = info.TransferUpdated.Add(-2 * time.Second)
+	})
+	manager.ChangeTransferred("upload", "uploading", 200, 1000)
+
+	_, info := manager.GetOperation("upload")
+	assert.Equal(t, "uploading", info.Status)
+	assert.Equal(t, 20, info.Progress)
+	assert.Equal(t, int64(200), info.TransferredBytes)
+	assert.Equal(t, int64(1000), info.TotalBytes)
+	assert.InDelta(t, 100, info.Speed, 5)
+	assert.InDelta(t, 8, info.Eta, 1)
+
+	manager.SuccessDone("upload")
+	_, info = manager.GetOperation("upload")
+	assert.Zero(t, info.Speed)
+	assert.Zero(t, info.Eta)
+}
+
+func TestOperationManager_ParentAndChildren(t *testing.T) {
+	manager := newTestManager()
+	manager.StartOperation("task", "starting")
+	manager.SetOperationType("task", OperationTypeUploadTask, "")
+	manager.StartOperation("b.tar", "uploading")
+	manager.SetOperationType("b.tar", OperationTypeUpload, "task")
+	manager.StartOperation("a.tar", "uploading")
+	manager.SetOperationType("a.tar", OperationTypeUpload, "task")
+
+	manager.ErrorDone("b.tar", "Error upload to YD")
+	manager.SuccessDone("a.tar")
+	manager.SetResult("task", "uploaded 1, upload errors 1")
+	manager.SuccessDone("task")
+
+	operations := manager.GetAllOperations()
+	byId := make(map[string]OperationInfoResponse)
+	for _, operation := range operations {
+		byId[operation.Id] = operation
+	}
+
+	task := byId["task"]
+	assert.Equal(t, OperationTypeUploadTask, task.Type)
+	assert.Equal(t, []string{"a.tar", "b.tar"}, task.Children)
+	assert.Equal(t, "uploaded 1, upload errors 1", task.Result)
+	assert.NotNil(t, task.StartTime)
+	assert.NotNil(t, task.FinishTime)
+
+	assert.Equal(t, "task", byId["a.tar"].ParentId)
+	assert.Equal(t, "success", byId["a.tar"].Result)
+	assert.Equal(t, "Error upload to YD", byId["b.tar"].Result)
+
+	_, info := manager.GetOperation("task")
+	assert.Equal(t, []string{"a.tar", "b.tar"}, info.Children)
+
+	// Перезапуск операции очищает тип, родителя и итог
+	manager.StartOperation("a.tar", "delete file")
+	_, info = manager.GetOperation("a.tar")
+	assert.Equal(t, OperationTypeUnknown, info.Type)
+	assert.Empty(t, info.ParentId)
+	assert.Empty(t, info.Result)
+	assert.Nil(t, info.FinishTime)
+}
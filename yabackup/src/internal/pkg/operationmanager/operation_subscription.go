@@ -0,0 +1,99 @@
+package operationmanager
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Subscription подписка на изменения операций.
+// Изменения одной операции схлопываются: читатель всегда получает последнее состояние операции,
+// даже если не успевает обрабатывать все промежуточные изменения.
+type Subscription struct {
+	ids     map[string]bool
+	mu      sync.Mutex
+	pending map[string]OperationInfoResponse
+	updated map[string]time.Time
+	notify  chan struct{}
+}
+
+// Subscribe создаёт подписку на изменения операций ids (пустой список - все операции).
+// Сразу после подписки в ней доступно текущее состояние операций
+func (dwn *OperationManager) Subscribe(ids []string) *Subscription {
+	subscription := &Subscription{
+		ids:     make(map[string]bool, len(ids)),
+		pending: make(map[string]OperationInfoResponse),
+		updated: make(map[string]time.Time),
+		notify:  make(chan struct{}, 1),
+	}
+	for _, id := range ids {
+		subscription.ids[id] = true
+	}
+
+	dwn.subscriptions.Store(subscription, struct{}{})
+
+	dwn.operationsMap.Range(func(key, value interface{}) bool {
+		k, ok1 := key.(string)
+		v, ok2 := value.(*OperationInfo)
+		if ok1 && ok2 {
+			subscription.publish(k, v)
+		}
+		return true
+	})
+
+	return subscription
+}
+
+func (dwn *OperationManager) Unsubscribe(subscription *Subscription) {
+	dwn.subscriptions.Delete(subscription)
+}
+
+func (dwn *OperationManager) publish(id string, info *OperationInfo) {
+	dwn.subscriptions.Range(func(key, _ interface{}) bool {
+		key.(*Subscription).publish(id, info)
+		return true
+	})
+}
+
+// Notify канал, в который приходит сигнал о наличии изменений
+func (s *Subscription) Notify() <-chan struct{} {
+	return s.notify
+}
+
+// Changes возвращает накопленные изменения (отсортированы по идентификатору операции) и очищает их
+func (s *Subscription) Changes() []OperationInfoResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make([]OperationInfoResponse, 0, len(s.pending))
+	for _, item := range s.pending {
+		result = append(result, item)
+	}
+	s.pending = make(map[string]OperationInfoResponse)
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Id < result[j].Id
+	})
+	return result
+}
+
+func (s *Subscription) publish(id string, info *OperationInfo) {
+	if len(s.ids) > 0 && !s.ids[id] {
+		return
+	}
+
+	s.mu.Lock()
+	// Изменения, опубликованные не по порядку, не должны перетирать более новое состояние
+	if info.LastUpdated.Before(s.updated[id]) {
+		s.mu.Unlock()
+		return
+	}
+	s.updated[id] = info.LastUpdated
+	s.pending[id] = transformItem(id, info)
+	s.mu.Unlock()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
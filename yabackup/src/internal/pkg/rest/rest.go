@@ -1,23 +1,66 @@
 package rest
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
 	"html/template"
+	"net"
 	"net/http"
+	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+	"ybg/internal/pkg/backuparchive"
 	"ybg/internal/pkg/bkoperate"
 	"ybg/internal/pkg/haoperate"
 	"ybg/internal/pkg/mylogger"
 	om "ybg/internal/pkg/operationmanager"
+	"ybg/internal/pkg/runcoordinator"
 	"ybg/internal/pkg/yadiskoperate"
 	"ybg/internal/types"
 )
 
 const headerYbaOperationId = "yba-operation-id"
 
+// Инициаторы запусков
+const (
+	initiatorUser     = "user"
+	initiatorSchedule = "schedule"
+	initiatorCatchUp  = "catch-up"
+)
+
+// Идентификаторы операций задачи загрузки и её шагов
+const (
+	uploadTaskOperationId    = "upload_task"
+	rotateLocalOperationId   = "rotate_local"
+	rotateRemoteOperationId  = "rotate_remote"
+	verifyTaskOperationId    = "verify_task"
+	copyLocationsOperationId = "copy_locations"
+	syncDownTaskOperationId  = "sync_down_task"
+)
+
+// Параметры потока событий операций (SSE)
+const (
+	operationEventsRetry     = 5 * time.Second
+	operationEventsHeartbeat = 15 * time.Second
+)
+
+const readHeaderTimeout = 10 * time.Second
+
+// defaultLogLimit количество записей лога на странице по умолчанию
+const defaultLogLimit = 200
+
+// defaultSyncDownCount количество новейших бэкапов ЯндексДиска, загружаемых в HA по умолчанию
+const defaultSyncDownCount = 3
+
+// errBackupPresent бэкап уже есть в HA
+var errBackupPresent = errors.New("backup already present in HA")
+
 type AlertMessage struct {
 	Message string
 }
@@ -29,7 +72,59 @@ type BackupResponse struct {
 	LocalStatistic   types.StorageStatistic
 	NetworkStatistic map[string]types.StorageStatistic
 	AddonIcons       map[string]string
+	Verification     map[string]bkoperate.VerificationResult
+}
+type UploadPlanResponse struct {
+	IsDarkTheme   bool
+	AlertMessages []AlertMessage
+	Plan          bkoperate.UploadPlan
+}
+type LogsResponse struct {
+	IsDarkTheme   bool
+	AlertMessages []AlertMessage
+	Levels        []string
+	Level         string
+	Limit         int
+	Entries       []mylogger.Entry
 }
+
+type BrowseResponse struct {
+	IsDarkTheme    bool
+	AlertMessages  []AlertMessage
+	RemoteFileName string
+	Slug           string
+	Source         string
+}
+
+// BackupChoice бэкап в списке выбора. Value - slug:<slug> или file:<файл на ЯндексДиске>
+type BackupChoice struct {
+	Value string
+	Label string
+}
+
+type CompareResponse struct {
+	IsDarkTheme   bool
+	AlertMessages []AlertMessage
+	Backups       []BackupChoice
+	From          string
+	To            string
+}
+
+// SyncDownChoice бэкап ЯндексДиска, которого нет в HA
+type SyncDownChoice struct {
+	RemoteFileName string
+	Name           string
+	Created        string
+	Size           types.FileSize
+	Selected       bool
+}
+
+type SyncDownResponse struct {
+	IsDarkTheme   bool
+	AlertMessages []AlertMessage
+	Files         []SyncDownChoice
+}
+
 type GetTokenResponse struct {
 	IsDarkTheme   bool
 	AlertMessages []AlertMessage
@@ -37,34 +132,51 @@ type GetTokenResponse struct {
 }
 
 type Rest struct {
+	applCtx                         context.Context
+	streamsCtx                      context.Context
+	stopStreams                     context.CancelFunc
+	server                          *http.Server
+	metricsServer                   *http.Server
 	logger                          *mylogger.Logger
 	operationManager                *om.OperationManager
+	coordinator                     *runcoordinator.Coordinator
 	TokenInfo                       types.TokenInfo
 	yaDProcessor                    *yadiskoperate.YaDProcessor
 	bKProcessor                     *bkoperate.BkProcessor
 	haApi                           *haoperate.HaApiClient
 	router                          *mux.Router
 	port                            string
+	icons                           map[string]string
+	settingsMu                      sync.RWMutex
 	theme                           string
 	createBackupBeforeUpload        bool
 	localMinimumAmountFreeDiskSpace types.FileSize
-	icons                           map[string]string
+	optionProblems                  []string
+	reloadOptions                   func() []string
 }
 
-func NewRest(port string,
+func NewRest(applCtx context.Context,
+	port string,
 	yaDProcessor *yadiskoperate.YaDProcessor,
 	bKProcessor *bkoperate.BkProcessor,
 	haApi *haoperate.HaApiClient,
 	theme string,
 	operationManager *om.OperationManager,
+	coordinator *runcoordinator.Coordinator,
 	createBackupBeforeUpload bool,
 	localMinimumAmountFreeDiskSpaceMb int,
+	metricsHandler http.Handler,
+	metricsPort string,
 	logger *mylogger.Logger) (*Rest, error) {
 
 	router := mux.NewRouter()
 	fileServer := http.FileServer(http.Dir("./internal/pkg/rest/ui/static/"))
 	router.PathPrefix("/static/").Handler(http.StripPrefix("/static", fileServer))
-	restObj := Rest{port: port,
+	streamsCtx, stopStreams := context.WithCancel(applCtx)
+	restObj := Rest{applCtx: applCtx,
+		streamsCtx:                      streamsCtx,
+		stopStreams:                     stopStreams,
+		port:                            port,
 		yaDProcessor:                    yaDProcessor,
 		bKProcessor:                     bKProcessor,
 		haApi:                           haApi,
@@ -72,6 +184,7 @@ func NewRest(port string,
 		router:                          router,
 		logger:                          logger,
 		operationManager:                operationManager,
+		coordinator:                     coordinator,
 		createBackupBeforeUpload:        createBackupBeforeUpload,
 		localMinimumAmountFreeDiskSpace: types.MiBToFileSize(float64(localMinimumAmountFreeDiskSpaceMb)),
 		icons:                           make(map[string]string)}
@@ -82,30 +195,143 @@ func NewRest(port string,
 	router.HandleFunc("/get_token", restObj.getToken).Methods("POST")
 	router.HandleFunc("/start_upload", restObj.startUpload).Methods("GET")
 	router.HandleFunc("/upload1", restObj.upload1).Methods("GET")
+	router.HandleFunc("/upload-plan", restObj.uploadPlanPage).Methods("GET")
+	router.HandleFunc("/upload/plan", restObj.uploadPlan).Methods("GET")
 	router.HandleFunc("/create-backup-1", restObj.createBackup1).Methods("GET")
 	router.HandleFunc("/download/{fileName}", restObj.downloadFile).Methods("GET")
+	router.HandleFunc("/statistic", restObj.statistic).Methods("GET")
+	router.HandleFunc("/logs", restObj.logsPage).Methods("GET")
+	router.HandleFunc("/logs/data", restObj.logsData).Methods("GET")
 	router.HandleFunc("/operation/status/all", restObj.allOperationStatus).Methods("GET")
-	router.HandleFunc("/load-to-ha/{fileName}", restObj.uploadFileToHa).Methods("POST")
-	router.HandleFunc("/delete-from-yd/{fileName}", restObj.deleteFromYd).Methods("DELETE")
+	router.HandleFunc("/operation/events", restObj.operationEvents).Methods("GET")
+	router.HandleFunc("/operation/cancel/{id:.+}", restObj.cancelOperation).Methods("POST")
+	router.HandleFunc("/load-to-ha/{fileName:.+}", restObj.uploadFileToHa).Methods("POST")
+	router.HandleFunc("/delete-from-yd/{fileName:.+}", restObj.deleteFromYd).Methods("DELETE")
 	router.HandleFunc("/delete-from-ha/{slug}", restObj.deleteFromHa).Methods("DELETE")
+	router.HandleFunc("/verify/{fileName:.+}", restObj.verifyFile).Methods("POST")
+	router.HandleFunc("/verification/history", restObj.verificationHistory).Methods("GET")
+	router.HandleFunc("/browse", restObj.browsePage).Methods("GET")
+	router.HandleFunc("/browse/data", restObj.browseData).Methods("GET")
+	router.HandleFunc("/extract", restObj.extractFromBackup).Methods("GET")
+	router.HandleFunc("/compare", restObj.comparePage).Methods("GET")
+	router.HandleFunc("/compare/data", restObj.compareData).Methods("GET")
+	router.HandleFunc("/sync-down", restObj.syncDownPage).Methods("GET")
+	router.HandleFunc("/sync-down", restObj.syncDown).Methods("POST")
+	router.HandleFunc("/options/reload", restObj.reloadOptionsHandler).Methods("POST")
 	//router.HandleFunc("/backup/create", restObj.createBackup).Methods("GET")
 	router.HandleFunc("/backup-create", restObj.createBackup).Methods("GET")
 	router.HandleFunc("/backup/delete", restObj.deleteBackup).Methods("GET")
+	if metricsHandler != nil {
+		router.Handle("/metrics", metricsHandler).Methods("GET")
+	}
 
 	router.HandleFunc("/{path1}/{path2}/{path3}", restObj.notFoundHandler)
 	router.HandleFunc("/{path1}/{path2}", restObj.notFoundHandler)
 	router.HandleFunc("/{path}", restObj.notFoundHandler)
 
-	logger.ErrorLog.Printf("(It is not error!!!) Run WEB-Server on http://127.0.0.1:%s", port)
+	restObj.server = &http.Server{
+		Addr:              ":" + port,
+		Handler:           router,
+		ReadHeaderTimeout: readHeaderTimeout,
+		// Контексты запросов производны от контекста приложения
+		BaseContext: func(net.Listener) context.Context { return applCtx },
+	}
+
+	logger.InfoLog.Printf("Run WEB-Server on http://127.0.0.1:%s", port)
+
+	// Отдельный порт только с метриками - для Prometheus без доступа к WEB-интерфейсу
+	if metricsHandler != nil && metricsPort != "" {
+		metricsRouter := http.NewServeMux()
+		metricsRouter.Handle("/metrics", metricsHandler)
+		restObj.metricsServer = &http.Server{
+			Addr:              ":" + metricsPort,
+			Handler:           metricsRouter,
+			ReadHeaderTimeout: readHeaderTimeout,
+			BaseContext:       func(net.Listener) context.Context { return applCtx },
+		}
+		logger.InfoLog.Printf("Run metrics server on http://127.0.0.1:%s/metrics", metricsPort)
+	}
 
 	return &restObj, nil
 }
 
+// SetOptionProblems ошибки в настройках аддона, которые показываются в WEB-интерфейсе
+func (app *Rest) SetOptionProblems(problems []string) {
+	app.settingsMu.Lock()
+	defer app.settingsMu.Unlock()
+	app.optionProblems = problems
+}
+
+// SetOptionsReloader функция перечитывания настроек аддона (POST /options/reload). Возвращает ошибки в настройках
+func (app *Rest) SetOptionsReloader(reload func() []string) {
+	app.settingsMu.Lock()
+	defer app.settingsMu.Unlock()
+	app.reloadOptions = reload
+}
+
+// UpdateSettings применяет изменённые настройки аддона без перезапуска
+func (app *Rest) UpdateSettings(theme string, createBackupBeforeUpload bool, localMinimumAmountFreeDiskSpaceMb int) {
+	app.settingsMu.Lock()
+	defer app.settingsMu.Unlock()
+	app.theme = theme
+	app.createBackupBeforeUpload = createBackupBeforeUpload
+	app.localMinimumAmountFreeDiskSpace = types.MiBToFileSize(float64(localMinimumAmountFreeDiskSpaceMb))
+}
+
+func (app *Rest) isCreateBackupBeforeUpload() bool {
+	app.settingsMu.RLock()
+	defer app.settingsMu.RUnlock()
+	return app.createBackupBeforeUpload
+}
+
+func (app *Rest) localMinimumFreeSpace() types.FileSize {
+	app.settingsMu.RLock()
+	defer app.settingsMu.RUnlock()
+	return app.localMinimumAmountFreeDiskSpace
+}
+
+// optionAlerts ошибки в настройках аддона для вывода на странице
+func (app *Rest) optionAlerts() []AlertMessage {
+	app.settingsMu.RLock()
+	defer app.settingsMu.RUnlock()
+	result := make([]AlertMessage, 0, len(app.optionProblems))
+	for _, problem := range app.optionProblems {
+		result = append(result, AlertMessage{Message: "Incorrect option " + problem})
+	}
+	return result
+}
+
+// Start запускает WEB-сервер. После Shutdown возвращает nil
 func (rest *Rest) Start() error {
-	return http.ListenAndServe(":"+rest.port, rest.router)
+	if rest.metricsServer != nil {
+		go func() {
+			err := rest.metricsServer.ListenAndServe()
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				rest.logger.ErrorLog.Printf("Error when start metrics server %v", err)
+			}
+		}()
+	}
+	err := rest.server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Shutdown закрывает потоки событий и останавливает WEB-сервер и сервер метрик, дожидаясь завершения запросов не дольше ctx
+func (rest *Rest) Shutdown(ctx context.Context) error {
+	rest.stopStreams()
+	if rest.metricsServer != nil {
+		if err := rest.metricsServer.Shutdown(ctx); err != nil {
+			rest.logger.ErrorLog.Printf("Error when stop metrics server %v", err)
+		}
+	}
+	return rest.server.Shutdown(ctx)
 }
 
 func (app *Rest) isUseDarkTheme() bool {
+	app.settingsMu.RLock()
+	defer app.settingsMu.RUnlock()
 	return app.theme == "Dark"
 }
 
@@ -179,13 +405,17 @@ func (app *Rest) indexHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	alertMessages := make([]AlertMessage, 0)
+	alertMessages := app.optionAlerts()
 	if app.yaDProcessor.IsTokenEmpty() {
 		alertMessages = append(alertMessages, AlertMessage{Message: "Token does not exists"})
 	} else if !app.yaDProcessor.IsTokenValid() {
 		alertMessages = append(alertMessages, AlertMessage{Message: "Token is not valid or expired"})
 	}
 
+	if current, ok := app.coordinator.Current(); ok {
+		alertMessages = append(alertMessages, AlertMessage{Message: "Running: " + current.String()})
+	}
+
 	app.yaDProcessor.RefreshTokenIsNeed()
 	filesInfo, err := app.bKProcessor.GetFilesInfo()
 	if err != nil {
@@ -251,7 +481,8 @@ func (app *Rest) indexHandler(w http.ResponseWriter, r *http.Request) {
 	data := BackupResponse{BFiles: filesInfo,
 		AlertMessages: alertMessages,
 		IsDarkTheme:   app.isUseDarkTheme(),
-		AddonIcons:    app.icons}
+		AddonIcons:    app.icons,
+		Verification:  app.bKProcessor.VerificationHistory().LastResults()}
 
 	statistic, err := app.bKProcessor.GetStatistic()
 	if err != nil {
@@ -263,6 +494,9 @@ func (app *Rest) indexHandler(w http.ResponseWriter, r *http.Request) {
 		data.YDStatistic = statistic.YaDisk
 		data.LocalStatistic = statistic.LocalStorage
 		data.NetworkStatistic = statistic.NetworkStorage
+		for _, problem := range statistic.Freshness.Problems {
+			data.AlertMessages = append(data.AlertMessages, AlertMessage{Message: problem})
+		}
 	}
 
 	//data.NetworkStatistic["server1"] = types.StorageStatistic{FilesSize: 1, FileAmount: 300, FreeSpace: 222}
@@ -274,6 +508,308 @@ func (app *Rest) indexHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// statistic статистика хранилищ и возраст новейших бэкапов
+func (app *Rest) statistic(w http.ResponseWriter, r *http.Request) {
+	app.logger.DebugLog.Println("statistic")
+	statistic, err := app.bKProcessor.GetStatistic()
+	if err != nil {
+		app.logger.ErrorLog.Printf("Error get statistic %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(statistic)
+	if err != nil {
+		app.logger.ErrorLog.Printf("Error encode statistic %s", err)
+	}
+}
+
+// verificationHistory результаты проверок архивов, от новых к старым
+func (app *Rest) verificationHistory(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(app.bKProcessor.VerificationHistory().Results())
+	if err != nil {
+		app.logger.ErrorLog.Printf("Error encode verification history %s", err)
+	}
+}
+
+// logEntries последние записи лога из параметров запроса level (по умолчанию INFO) и limit
+func (app *Rest) logEntries(r *http.Request) (string, int, []mylogger.Entry) {
+	level := mylogger.LevelName(mylogger.ParseLevel(r.URL.Query().Get("level")))
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = defaultLogLimit
+	}
+
+	buffer := app.logger.Buffer()
+	if buffer == nil {
+		return level, limit, make([]mylogger.Entry, 0)
+	}
+	return level, limit, buffer.Entries(mylogger.ParseLevel(level), limit)
+}
+
+func (app *Rest) logsPage(w http.ResponseWriter, r *http.Request) {
+	app.logger.DebugLog.Println("logsPage")
+	files := []string{
+		"./internal/pkg/rest/ui/html/logs.html",
+		"./internal/pkg/rest/ui/html/base.html",
+	}
+	ts, err := template.ParseFiles(files...)
+	if err != nil {
+		app.logger.ErrorLog.Println(err.Error())
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	alertMessages := make([]AlertMessage, 0)
+	if app.logger.Buffer() == nil {
+		alertMessages = append(alertMessages, AlertMessage{Message: "Log buffer is disabled (log_buffer_size is 0)"})
+	}
+
+	level, limit, entries := app.logEntries(r)
+	// Новые записи сверху
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+
+	data := LogsResponse{
+		IsDarkTheme:   app.isUseDarkTheme(),
+		AlertMessages: alertMessages,
+		Levels:        []string{"DEBUG", "INFO", "WARNING", "ERROR"},
+		Level:         level,
+		Limit:         limit,
+		Entries:       entries,
+	}
+	err = ts.Execute(w, data)
+	if err != nil {
+		app.logger.ErrorLog.Println(err.Error())
+		http.Error(w, "Internal Server Error", 500)
+	}
+}
+
+func (app *Rest) logsData(w http.ResponseWriter, r *http.Request) {
+	_, _, entries := app.logEntries(r)
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(entries)
+	if err != nil {
+		app.logger.ErrorLog.Printf("Error encode log entries %s", err)
+	}
+}
+
+// reloadOptionsHandler перечитывает настройки аддона и возвращает найденные в них ошибки
+func (app *Rest) reloadOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	app.settingsMu.RLock()
+	reload := app.reloadOptions
+	app.settingsMu.RUnlock()
+	if reload == nil {
+		http.Error(w, "options reload is not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	problems := reload()
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(map[string][]string{"problems": problems})
+	if err != nil {
+		app.logger.ErrorLog.Printf("Error encode option problems %s", err)
+	}
+}
+
+// backupSource бэкап из параметров запроса file (файл на ЯндексДиске) или slug (бэкап HA)
+func backupSource(r *http.Request) (bkoperate.BackupSource, error) {
+	source := bkoperate.BackupSource{
+		RemoteFileName: r.URL.Query().Get("file"),
+		Slug:           r.URL.Query().Get("slug"),
+	}
+	if source.RemoteFileName == "" && source.Slug == "" {
+		return source, errors.New("parameter file or slug is required")
+	}
+	return source, nil
+}
+
+func (app *Rest) browsePage(w http.ResponseWriter, r *http.Request) {
+	app.logger.DebugLog.Println("browsePage")
+	files := []string{
+		"./internal/pkg/rest/ui/html/browse.html",
+		"./internal/pkg/rest/ui/html/base.html",
+	}
+	ts, err := template.ParseFiles(files...)
+	if err != nil {
+		app.logger.ErrorLog.Println(err.Error())
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	alertMessages := make([]AlertMessage, 0)
+	source, err := backupSource(r)
+	if err != nil {
+		alertMessages = append(alertMessages, AlertMessage{Message: err.Error()})
+	}
+
+	data := BrowseResponse{
+		IsDarkTheme:    app.isUseDarkTheme(),
+		AlertMessages:  alertMessages,
+		RemoteFileName: source.RemoteFileName,
+		Slug:           source.Slug,
+		Source:         source.String(),
+	}
+	err = ts.Execute(w, data)
+	if err != nil {
+		app.logger.ErrorLog.Println(err.Error())
+		http.Error(w, "Internal Server Error", 500)
+	}
+}
+
+// browseData содержимое бэкапа в JSON
+func (app *Rest) browseData(w http.ResponseWriter, r *http.Request) {
+	source, err := backupSource(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	listing, err := app.bKProcessor.ListBackup(r.Context(), source)
+	if err != nil {
+		app.logger.ErrorLog.Printf("Error list %s: %s", source, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(listing)
+	if err != nil {
+		app.logger.ErrorLog.Printf("Error encode backup listing %s", err)
+	}
+}
+
+// extractFromBackup отдаёт архив с файлом или каталогом бэкапа (параметры archive, path, format=zip|tar)
+func (app *Rest) extractFromBackup(w http.ResponseWriter, r *http.Request) {
+	source, err := backupSource(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	selection := backuparchive.Selection{
+		Archive: r.URL.Query().Get("archive"),
+		Path:    r.URL.Query().Get("path"),
+	}
+	format := backuparchive.Format(r.URL.Query().Get("format"))
+	if format != "" && format != backuparchive.FormatZip && format != backuparchive.FormatTar {
+		http.Error(w, fmt.Sprintf("unknown format %q", format), http.StatusBadRequest)
+		return
+	}
+
+	backupName := source.RemoteFileName
+	if backupName == "" {
+		backupName = source.Slug
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=\"%s\"", backuparchive.ArchiveName(backupName, selection, format)))
+
+	// Архив пишется в ответ по мере чтения бэкапа. Если ничего не найдено, в ответ ещё ничего не записано
+	_, err = app.bKProcessor.ExtractFromBackup(r.Context(), source, selection, format, w)
+	if errors.Is(err, backuparchive.ErrNotFound) {
+		w.Header().Del("Content-Disposition")
+		w.Header().Del("Content-Type")
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		app.logger.ErrorLog.Printf("Error extract from %s: %s", source, err)
+		// Если архив уже начал передаваться, заголовок ответа не изменить, клиент получит обрезанный файл
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// parseBackupChoice бэкап из значения slug:<slug> или file:<файл на ЯндексДиске>
+func parseBackupChoice(value string) (bkoperate.BackupSource, error) {
+	kind, name, found := strings.Cut(value, ":")
+	switch {
+	case found && name != "" && kind == "slug":
+		return bkoperate.BackupSource{Slug: name}, nil
+	case found && name != "" && kind == "file":
+		return bkoperate.BackupSource{RemoteFileName: name}, nil
+	}
+	return bkoperate.BackupSource{}, fmt.Errorf("wrong backup %q, expected slug:<slug> or file:<file name>", value)
+}
+
+// backupChoices бэкапы для сравнения. Бэкапы, которые есть в HA, читаются через supervisor
+func backupChoices(filesInfo []types.BackupFileInfo) []BackupChoice {
+	result := make([]BackupChoice, 0, len(filesInfo))
+	for _, file := range filesInfo {
+		label := file.GeneralInfo.Created.Convert2String() + " " + file.BackupName
+		switch {
+		case (file.IsLocal || file.IsNetwork) && file.BackupSlug != "":
+			result = append(result, BackupChoice{Value: "slug:" + file.BackupSlug, Label: label + " (HA)"})
+		case file.IsRemote:
+			result = append(result, BackupChoice{Value: "file:" + file.RemoteFileName, Label: label + " (Yandex Disk)"})
+		}
+	}
+	return result
+}
+
+func (app *Rest) comparePage(w http.ResponseWriter, r *http.Request) {
+	app.logger.DebugLog.Println("comparePage")
+	files := []string{
+		"./internal/pkg/rest/ui/html/compare.html",
+		"./internal/pkg/rest/ui/html/base.html",
+	}
+	ts, err := template.ParseFiles(files...)
+	if err != nil {
+		app.logger.ErrorLog.Println(err.Error())
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	alertMessages := make([]AlertMessage, 0)
+	filesInfo, err := app.bKProcessor.GetFilesInfo()
+	if err != nil {
+		alertMessages = append(alertMessages, AlertMessage{Message: err.Error()})
+	}
+
+	data := CompareResponse{
+		IsDarkTheme:   app.isUseDarkTheme(),
+		AlertMessages: alertMessages,
+		Backups:       backupChoices(filesInfo),
+		From:          r.URL.Query().Get("from"),
+		To:            r.URL.Query().Get("to"),
+	}
+	err = ts.Execute(w, data)
+	if err != nil {
+		app.logger.ErrorLog.Println(err.Error())
+		http.Error(w, "Internal Server Error", 500)
+	}
+}
+
+// compareData различия двух бэкапов в JSON (параметры from, to и files=true для сравнения файлов)
+func (app *Rest) compareData(w http.ResponseWriter, r *http.Request) {
+	from, err := parseBackupChoice(r.URL.Query().Get("from"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := parseBackupChoice(r.URL.Query().Get("to"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	withFiles, _ := strconv.ParseBool(r.URL.Query().Get("files"))
+
+	diff, err := app.bKProcessor.DiffBackups(r.Context(), from, to, withFiles)
+	if err != nil {
+		app.logger.ErrorLog.Printf("Error compare %s and %s: %s", from, to, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(diff)
+	if err != nil {
+		app.logger.ErrorLog.Printf("Error encode backup diff %s", err)
+	}
+}
+
 func (app *Rest) getTokenForm(w http.ResponseWriter, r *http.Request) {
 	app.logger.InfoLog.Println("getTokenForm")
 	app.renderTokenForm(w, r, "")
@@ -353,7 +889,133 @@ func (app *Rest) startUpload(w http.ResponseWriter, r *http.Request) {
 
 func (app *Rest) upload1(w http.ResponseWriter, r *http.Request) {
 	app.logger.InfoLog.Println("upload1")
+	lease, ok := app.tryStartRun(w, runcoordinator.RunUpload)
+	if !ok {
+		return
+	}
 	UploadTask(app)
+	lease.Release()
+
+	uri := r.Header.Get("X-Ingress-Path")
+	http.Redirect(w, r, uri+"/", http.StatusSeeOther)
+}
+
+func (app *Rest) uploadPlan(w http.ResponseWriter, r *http.Request) {
+	app.logger.InfoLog.Println("uploadPlan")
+	plan, err := PlanUploadTask(app)
+	if err != nil {
+		app.logger.ErrorLog.Printf("Error build upload plan %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(plan); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (app *Rest) uploadPlanPage(w http.ResponseWriter, r *http.Request) {
+	app.logger.InfoLog.Println("uploadPlanPage")
+	files := []string{
+		"./internal/pkg/rest/ui/html/upload_plan.html",
+		"./internal/pkg/rest/ui/html/base.html",
+	}
+	ts, err := template.ParseFiles(files...)
+	if err != nil {
+		app.logger.ErrorLog.Println(err.Error())
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	alertMessages := make([]AlertMessage, 0)
+	plan, err := PlanUploadTask(app)
+	if err != nil {
+		app.logger.ErrorLog.Printf("Error build upload plan %s", err)
+		alertMessages = append(alertMessages, AlertMessage{Message: err.Error()})
+	}
+
+	data := UploadPlanResponse{Plan: plan,
+		AlertMessages: alertMessages,
+		IsDarkTheme:   app.isUseDarkTheme()}
+
+	err = ts.Execute(w, data)
+	if err != nil {
+		app.logger.ErrorLog.Println(err.Error())
+		http.Error(w, "Internal Server Error", 500)
+	}
+}
+
+// syncDownPage бэкапы ЯндексДиска, которых нет в HA. Новейшие defaultSyncDownCount отмечены для загрузки в HA
+func (app *Rest) syncDownPage(w http.ResponseWriter, r *http.Request) {
+	app.logger.DebugLog.Println("syncDownPage")
+	files := []string{
+		"./internal/pkg/rest/ui/html/sync_down.html",
+		"./internal/pkg/rest/ui/html/base.html",
+	}
+	ts, err := template.ParseFiles(files...)
+	if err != nil {
+		app.logger.ErrorLog.Println(err.Error())
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	alertMessages := make([]AlertMessage, 0)
+	filesInfo, err := app.bKProcessor.GetFilesInfo()
+	if err != nil {
+		app.logger.ErrorLog.Printf("Error get backup files %s", err)
+		alertMessages = append(alertMessages, AlertMessage{Message: fmt.Sprintf("Cannot get backup files: %v", err)})
+	}
+
+	choices := make([]SyncDownChoice, 0)
+	for i, file := range bkoperate.ChooseFilesToSyncDown(filesInfo, len(filesInfo), nil) {
+		choices = append(choices, SyncDownChoice{
+			RemoteFileName: file.RemoteFileName,
+			Name:           file.BackupName,
+			Created:        file.Downloaded.Convert2String(),
+			Size:           file.GeneralInfo.Size,
+			Selected:       i < defaultSyncDownCount,
+		})
+	}
+
+	data := SyncDownResponse{
+		IsDarkTheme:   app.isUseDarkTheme(),
+		AlertMessages: alertMessages,
+		Files:         choices,
+	}
+	err = ts.Execute(w, data)
+	if err != nil {
+		app.logger.ErrorLog.Println(err.Error())
+		http.Error(w, "Internal Server Error", 500)
+	}
+}
+
+// syncDown загружает в HA выбранные бэкапы ЯндексДиска (параметры file) или count новейших, которых нет в HA
+func (app *Rest) syncDown(w http.ResponseWriter, r *http.Request) {
+	app.logger.InfoLog.Println("syncDown")
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	selected := r.Form["file"]
+	count := defaultSyncDownCount
+	if value := r.Form.Get("count"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			http.Error(w, fmt.Sprintf("wrong count %q", value), http.StatusBadRequest)
+			return
+		}
+		count = parsed
+	}
+
+	lease, ok := app.tryStartRun(w, runcoordinator.RunRestore)
+	if !ok {
+		return
+	}
+	defer lease.Release()
+
+	SyncDownTask(app, count, selected)
+
 	uri := r.Header.Get("X-Ingress-Path")
 	http.Redirect(w, r, uri+"/", http.StatusSeeOther)
 }
@@ -385,10 +1047,16 @@ func (app *Rest) createBackup(w http.ResponseWriter, r *http.Request) {
 
 func (app *Rest) createBackup1(w http.ResponseWriter, r *http.Request) {
 	app.logger.InfoLog.Println("createBackup1")
-	_, err := app.bKProcessor.CreateFullBackupSync()
+	lease, ok := app.tryStartRun(w, runcoordinator.RunCreate)
+	if !ok {
+		return
+	}
+	_, err := app.bKProcessor.CreateFullBackupSync("")
+	lease.Release()
 	if err != nil {
-		app.logger.ErrorLog.Println("Error create backup %s", err)
+		app.logger.ErrorLog.Printf("Error create backup %s", err)
 	}
+
 	uri := r.Header.Get("X-Ingress-Path")
 	http.Redirect(w, r, uri+"/", http.StatusSeeOther)
 }
@@ -396,10 +1064,17 @@ func (app *Rest) createBackup1(w http.ResponseWriter, r *http.Request) {
 func (app *Rest) deleteBackup(w http.ResponseWriter, r *http.Request) {
 	//TODO Пробное удаление старых бэкапов
 	app.logger.InfoLog.Println("delete backup")
+	lease, ok := app.tryStartRun(w, runcoordinator.RunRotate)
+	if !ok {
+		return
+	}
 	err := app.bKProcessor.DeleteOldLocalFiles()
+	lease.Release()
 	//_, err := app.bKProcessor.CreateFullBackupSync()
 
 	if err != nil {
+		app.logger.ErrorLog.Printf("Error when delete old backup files %v", err)
+		http.Error(w, fmt.Sprintf("error when delete old backup files: %v", err), http.StatusInternalServerError)
 		return
 	}
 	uri := r.Header.Get("X-Ingress-Path")
@@ -422,6 +1097,91 @@ func (app *Rest) allOperationStatus(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// operationEvents поток изменений операций (Server-Sent Events).
+// Параметр id (можно указать несколько раз) ограничивает поток указанными операциями.
+// При подключении (и переподключении) клиент сначала получает текущее состояние операций.
+func (app *Rest) operationEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	ids := r.URL.Query()["id"]
+	app.logger.DebugLog.Printf("operationEvents subscribe %v", ids)
+	subscription := app.operationManager.Subscribe(ids)
+	defer app.operationManager.Unsubscribe(subscription)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// Отключаем буферизацию в прокси ingress
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", operationEventsRetry.Milliseconds())
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(operationEventsHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			app.logger.DebugLog.Printf("operationEvents client disconnected")
+			return
+		case <-app.streamsCtx.Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		case <-subscription.Notify():
+			changes := subscription.Changes()
+			if len(changes) == 0 {
+				continue
+			}
+			data, err := json.Marshal(changes)
+			if err != nil {
+				app.logger.ErrorLog.Printf("Error marshal operations %v", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: operations\ndata: %s\n\n", data)
+			flusher.Flush()
+		}
+	}
+}
+
+// tryStartRun захватывает право на запуск по запросу пользователя. При отказе клиенту возвращается 409 с причиной
+func (app *Rest) tryStartRun(w http.ResponseWriter, runType runcoordinator.RunType) (*runcoordinator.Lease, bool) {
+	lease, err := app.coordinator.TryAcquire(runType, initiatorUser)
+	if errors.Is(err, runcoordinator.ErrClosed) {
+		app.logger.ErrorLog.Printf("Request rejected. %v", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return nil, false
+	}
+	if err != nil {
+		app.logger.ErrorLog.Printf("Request rejected. %v", err)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return nil, false
+	}
+	return lease, true
+}
+
+func (app *Rest) cancelOperation(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	operationId := vars["id"]
+	app.logger.InfoLog.Printf("cancelOperation %s", operationId)
+
+	err := app.operationManager.Cancel(operationId)
+	switch {
+	case errors.Is(err, om.ErrOperationNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
 func (app *Rest) uploadFileToHa(w http.ResponseWriter, r *http.Request) {
 	app.logger.InfoLog.Println("uploadToHa")
 	vars := mux.Vars(r)
@@ -436,8 +1196,18 @@ func (app *Rest) uploadFileToHa(w http.ResponseWriter, r *http.Request) {
 		operationId = "emptyOperationId"
 	}
 
-	innerUploadFile(app, fileName, operationId)
-	w.WriteHeader(http.StatusOK)
+	lease, ok := app.tryStartRun(w, runcoordinator.RunRestore)
+	if !ok {
+		return
+	}
+	defer lease.Release()
+
+	err := innerUploadFile(app, fileName, operationId, "")
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
 
 }
 func (app *Rest) deleteFromHa(w http.ResponseWriter, r *http.Request) {
@@ -454,6 +1224,12 @@ func (app *Rest) deleteFromHa(w http.ResponseWriter, r *http.Request) {
 		operationId = "emptyOperationId"
 	}
 
+	lease, ok := app.tryStartRun(w, runcoordinator.RunDelete)
+	if !ok {
+		return
+	}
+	defer lease.Release()
+
 	err := innerDeleteFileFromHa(app, fileName, operationId)
 	if err != nil {
 		w.WriteHeader(http.StatusUnprocessableEntity)
@@ -476,6 +1252,12 @@ func (app *Rest) deleteFromYd(w http.ResponseWriter, r *http.Request) {
 		operationId = "emptyOperationId"
 	}
 
+	lease, ok := app.tryStartRun(w, runcoordinator.RunDelete)
+	if !ok {
+		return
+	}
+	defer lease.Release()
+
 	err := innerDeleteFileFromYd(app, fileName, operationId)
 	if err != nil {
 		w.WriteHeader(http.StatusUnprocessableEntity)
@@ -485,14 +1267,47 @@ func (app *Rest) deleteFromYd(w http.ResponseWriter, r *http.Request) {
 
 }
 
+func (app *Rest) verifyFile(w http.ResponseWriter, r *http.Request) {
+	app.logger.InfoLog.Println("verifyFile")
+	vars := mux.Vars(r)
+	fileName, ok := vars["fileName"]
+	if !ok {
+		app.logger.ErrorLog.Printf("fileName is missing in parameters")
+	}
+
+	operationId := r.Header.Get(headerYbaOperationId)
+
+	if operationId == "" {
+		operationId = "emptyOperationId"
+	}
+
+	lease, ok := app.tryStartRun(w, runcoordinator.RunVerify)
+	if !ok {
+		return
+	}
+	defer lease.Release()
+
+	result := app.bKProcessor.VerifyBackup(fileName, operationId)
+	w.Header().Set("Content-Type", "application/json")
+	if !result.Ok {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	err := json.NewEncoder(w).Encode(result)
+	if err != nil {
+		app.logger.ErrorLog.Printf("Error encode verification result %s", err)
+	}
+}
+
 func innerDeleteFileFromHa(app *Rest, slug, id string) error {
+	logger := app.logger.With("operation_id", id, "slug", slug)
 
 	app.operationManager.StartOperation(id, "delete file")
+	app.operationManager.SetOperationType(id, om.OperationTypeDelete, "")
 	app.operationManager.ChangeStatusAndProgress(id, "delete file", 10)
 	//app.yaDProcessor.EnsureYandexDisk()
 	err := app.haApi.DeleteBackup(slug)
 	if err != nil {
-		app.logger.ErrorLog.Printf("Error when delete file %v", err)
+		logger.ErrorLog.Printf("Error when delete file %v", err)
 		app.operationManager.ErrorDone(id, fmt.Sprintf("Error when delete file %v", err))
 		return err
 	}
@@ -501,13 +1316,15 @@ func innerDeleteFileFromHa(app *Rest, slug, id string) error {
 	return nil
 }
 func innerDeleteFileFromYd(app *Rest, filename, id string) error {
+	logger := app.logger.With("operation_id", id, "file", filename)
 
 	app.operationManager.StartOperation(id, "delete file")
+	app.operationManager.SetOperationType(id, om.OperationTypeDelete, "")
 	app.operationManager.ChangeStatusAndProgress(id, "delete file", 10)
 	//app.yaDProcessor.EnsureYandexDisk()
 	err := app.yaDProcessor.DeleteFile(filename, "", false)
 	if err != nil {
-		app.logger.ErrorLog.Printf("Error when delete file %v", err)
+		logger.ErrorLog.Printf("Error when delete file %v", err)
 		app.operationManager.ErrorDone(id, fmt.Sprintf("Error when delete file %v", err))
 		return err
 	}
@@ -515,62 +1332,255 @@ func innerDeleteFileFromYd(app *Rest, filename, id string) error {
 	app.updateStatistic()
 	return nil
 }
-func innerUploadFile(app *Rest, filename, id string) {
-	app.operationManager.StartOperation(id, "uploading to HA")
 
-	dst := haoperate.GetTemporaryFilePath(filename + ".tar")
+// innerUploadFile скачивает файл с ЯндексДиска и загружает его в HA. parentId - операция, шагом которой является загрузка
+func innerUploadFile(app *Rest, filename, id string, parentId string) error {
+	logger := app.logger.With("operation_id", id, "file", filename)
+	ctx := app.operationManager.StartCancelableOperation(app.applCtx, id, "uploading to HA")
+	app.operationManager.SetOperationType(id, om.OperationTypeDownload, parentId)
+
+	dst := haoperate.GetTemporaryFilePath(path.Base(filename) + ".tar")
 	app.haApi.RemoveTemporaryFile(dst)
 	err := app.haApi.DeleteOldTemporaryFiles(1)
 	if err != nil {
-		app.logger.ErrorLog.Printf("Error when delete old temporary files %s", err)
+		logger.ErrorLog.Printf("Error when delete old temporary files %s", err)
 	}
 
-	err = app.yaDProcessor.DownloadFile(filename, dst, id)
+	err = app.yaDProcessor.DownloadFile(ctx, filename, dst, id)
 	if err != nil {
-		app.logger.ErrorLog.Printf("Error when download file %s", err)
-		app.operationManager.ErrorDone(id, "Error download file")
-		return
+		logger.ErrorLog.Printf("Error when download file %s", err)
+		app.haApi.RemoveTemporaryFile(dst)
+		if ctx.Err() != nil {
+			app.operationManager.ErrorDone(id, "Download canceled")
+		} else {
+			app.operationManager.ErrorDone(id, "Error download file")
+		}
+		return err
 	}
-	app.logger.InfoLog.Printf("Downloaded file %s to %s", filename, dst)
+	logger.InfoLog.Printf("Downloaded file %s to %s", filename, dst)
 
 	app.operationManager.ChangeStatusAndProgress(id, "uploading to HA", 90)
-	err = app.haApi.UploadBackup(dst, "slug")
+	err = app.haApi.UploadBackup(ctx, dst, "slug")
 	if err != nil {
-		app.logger.ErrorLog.Printf("Error when upload file to HA %s", err)
+		logger.ErrorLog.Printf("Error when upload file to HA %s", err)
+		app.haApi.RemoveTemporaryFile(dst)
 		app.operationManager.ErrorDone(id, "Error upload to HA")
-		return
+		return err
 	}
 	app.haApi.RemoveTemporaryFile(dst)
 
 	app.operationManager.SuccessDone(id)
 	app.updateStatistic()
+	return nil
 }
 
-func UploadTask(app *Rest) {
-	// TODO Подумать а не перенести ли в bkProcessor
+// SyncDownTask загружает в HA бэкапы с ЯндексДиска, которых нет в HA: выбранные файлы (selected) или count новейших.
+// Вызывающий должен владеть правом на запуск (runcoordinator)
+func SyncDownTask(app *Rest, count int, selected []string) bkoperate.ProcessedFilesResult {
+	result := bkoperate.ProcessedFilesResult{Files: make([]bkoperate.ProcessedFileResult, 0)}
+	app.operationManager.StartOperation(syncDownTaskOperationId, "starting")
+	app.operationManager.SetOperationType(syncDownTaskOperationId, om.OperationTypeSyncDown, "")
 
-	if app.createBackupBeforeUpload {
-		createBackupEnabled := true
-		if app.localMinimumAmountFreeDiskSpace > 0 {
-			app.logger.DebugLog.Printf("Start check minimum local space")
-			haStatistic, err := app.bKProcessor.GetHaStatistic()
-			if err != nil {
-				app.logger.ErrorLog.Printf("Error get haStatistic. %s", err)
-				createBackupEnabled = false
-			}
+	filesInfo, err := app.bKProcessor.GetFilesInfo()
+	if err != nil {
+		app.logger.ErrorLog.Printf("Error get backup files %s", err)
+		app.operationManager.ErrorDone(syncDownTaskOperationId, fmt.Sprintf("Error get backup files %v", err))
+		return result
+	}
+	haSlugs, err := app.bKProcessor.HaBackupSlugs()
+	if err != nil {
+		app.logger.ErrorLog.Printf("Error get HA backups %s", err)
+		app.operationManager.ErrorDone(syncDownTaskOperationId, fmt.Sprintf("Error get HA backups %v", err))
+		return result
+	}
+
+	// Кандидаты рассматриваются от новых к старым. Бэкапы, которые уже есть в HA, не скачиваются и не учитываются в count
+	files := bkoperate.ChooseFilesToSyncDown(filesInfo, len(filesInfo), selected)
+	if len(selected) > 0 {
+		count = len(files)
+	}
+	app.logger.InfoLog.Printf("Sync down: %d candidates, up to %d backups to upload into HA", len(files), count)
+	skipped := 0
+	for _, file := range files {
+		if result.Ok+result.Error >= count {
+			break
+		}
+		if app.applCtx.Err() != nil {
+			app.logger.InfoLog.Printf("Sync down interrupted")
+			break
+		}
+		app.operationManager.ChangeStatusAndProgress(syncDownTaskOperationId,
+			fmt.Sprintf("checking %s", file.BackupName), 100*(result.Ok+result.Error)/count)
 
-			createBackupEnabled = haStatistic.LocalStorage.FreeSpace > app.localMinimumAmountFreeDiskSpace
+		present, slug, err := app.bKProcessor.RemoteBackupInHa(app.applCtx, file.RemoteFileName, haSlugs)
+		if err != nil {
+			// Если slug прочитать не удалось, наличие бэкапа в HA неизвестно, и он загружается
+			app.logger.ErrorLog.Printf("Error when read backup slug of %s. %v", file.RemoteFileName, err)
+		} else if present {
+			app.logger.InfoLog.Printf("Backup %s (%s) already present in HA. Upload skipped", slug, file.RemoteFileName)
+			result.Files = append(result.Files, bkoperate.ProcessedFileResult{Slug: slug, RemoteFileName: file.RemoteFileName,
+				Size: file.GeneralInfo.Size, Err: errBackupPresent})
+			skipped++
+			continue
+		}
 
-			if !createBackupEnabled {
-				app.logger.ErrorLog.Printf("It is not allowed to create a backup. Insufficient disk space. [free space %d, minimum free spase: %d]",
-					haStatistic.LocalStorage.FreeSpace, app.localMinimumAmountFreeDiskSpace)
-			}
-		} else {
-			app.logger.InfoLog.Printf("Check minimum local space disabled")
+		app.operationManager.ChangeStatusAndProgress(syncDownTaskOperationId,
+			fmt.Sprintf("uploading %s to HA", file.BackupName), 100*(result.Ok+result.Error)/count)
+		err = innerUploadFile(app, file.RemoteFileName, file.RemoteFileName, syncDownTaskOperationId)
+		result.Files = append(result.Files, bkoperate.ProcessedFileResult{Slug: slug, RemoteFileName: file.RemoteFileName,
+			Size: file.GeneralInfo.Size, Err: err})
+		if err != nil {
+			result.Error++
+			continue
 		}
+		result.Ok++
+		result.ProcessedSize += file.GeneralInfo.Size
+	}
+
+	summary := fmt.Sprintf("uploaded to HA %d, already present %d, errors %d", result.Ok, skipped, result.Error)
+	app.logger.InfoLog.Printf("Sync down completed: %s", summary)
+	if result.Error > 0 {
+		app.operationManager.ErrorDone(syncDownTaskOperationId, summary)
+	} else {
+		app.operationManager.SetResult(syncDownTaskOperationId, summary)
+		app.operationManager.SuccessDone(syncDownTaskOperationId)
+	}
+	return result
+}
+
+// checkCreateBackupAllowed проверяет, можно ли создать бэкап (достаточно ли локального места). Возвращает причину отказа
+func checkCreateBackupAllowed(app *Rest) (bool, string) {
+	minimumFreeSpace := app.localMinimumFreeSpace()
+	if minimumFreeSpace <= 0 {
+		app.logger.InfoLog.Printf("Check minimum local space disabled")
+		return true, ""
+	}
+
+	app.logger.DebugLog.Printf("Start check minimum local space")
+	haStatistic, err := app.bKProcessor.GetHaStatistic()
+	if err != nil {
+		app.logger.ErrorLog.Printf("Error get haStatistic. %s", err)
+		return false, fmt.Sprintf("local free space is unknown: %v", err)
+	}
+
+	if haStatistic.LocalStorage.FreeSpace <= minimumFreeSpace {
+		app.logger.ErrorLog.Printf("It is not allowed to create a backup. Insufficient disk space. [free space %d, minimum free spase: %d]",
+			haStatistic.LocalStorage.FreeSpace, minimumFreeSpace)
+		return false, fmt.Sprintf("insufficient local disk space: free %s MB, minimum %s MB",
+			haStatistic.LocalStorage.FreeSpace.Convert2MbString(), minimumFreeSpace.Convert2MbString())
+	}
+	return true, ""
+}
+
+// PlanUploadTask план задачи загрузки (dry-run). В HA и на ЯндексДиске ничего не меняется
+func PlanUploadTask(app *Rest) (bkoperate.UploadPlan, error) {
+	createBackup := false
+	createBackupBeforeUpload := app.isCreateBackupBeforeUpload()
+	reason := "disabled by enable_create_backup_before_upload"
+	if createBackupBeforeUpload {
+		createBackup, reason = checkCreateBackupAllowed(app)
+	}
+
+	plan, err := app.bKProcessor.PlanUpload(createBackup, createBackupBeforeUpload)
+	if !createBackup {
+		plan.CreateBackupReason = reason
+	}
+	return plan, err
+}
+
+// ScheduledUploadTask запуск задачи загрузки по расписанию.
+// Если выполняется другой запуск, задача ждёт его завершения
+func ScheduledUploadTask(app *Rest) {
+	lease, err := app.coordinator.Acquire(app.applCtx, runcoordinator.RunUpload, initiatorSchedule)
+	if err != nil {
+		app.logger.ErrorLog.Printf("Scheduled upload not started. %v", err)
+		return
+	}
+	defer lease.Release()
+
+	UploadTask(app)
+}
+
+// CatchUpUploadTask запуск пропущенной задачи загрузки (аддон был выключен во время запуска по расписанию).
+// Необходимость запуска (missed) проверяется после получения права на запуск,
+// чтобы не повторять загрузку, которая только что выполнилась по расписанию.
+func CatchUpUploadTask(app *Rest, missed func() bool) {
+	lease, err := app.coordinator.Acquire(app.applCtx, runcoordinator.RunUpload, initiatorCatchUp)
+	if err != nil {
+		app.logger.ErrorLog.Printf("Catch-up upload not started. %v", err)
+		return
+	}
+	defer lease.Release()
+
+	if !missed() {
+		return
+	}
+	UploadTask(app)
+}
+
+// ScheduledVerificationTask проверка по расписанию архива бэкапа на ЯндексДиске (новейшего или случайного).
+// Если выполняется другой запуск, задача ждёт его завершения
+func ScheduledVerificationTask(app *Rest) error {
+	lease, err := app.coordinator.Acquire(app.applCtx, runcoordinator.RunVerify, initiatorSchedule)
+	if err != nil {
+		app.logger.ErrorLog.Printf("Scheduled verification not started. %v", err)
+		return err
+	}
+	defer lease.Release()
+
+	file, err := app.bKProcessor.ChooseFileToVerify()
+	if errors.Is(err, bkoperate.ErrNothingToVerify) {
+		app.logger.InfoLog.Printf("Verification skipped. %v", err)
+		return nil
+	}
+	if err != nil {
+		app.logger.ErrorLog.Printf("Error when choose backup to verify. %v", err)
+		return err
+	}
+
+	result := app.bKProcessor.VerifyBackup(file.RemoteFileName, verifyTaskOperationId)
+	if !result.Ok {
+		return fmt.Errorf("verification of %s failed: %s", result.RemoteFileName, result.Error)
+	}
+	return nil
+}
+
+// copyToBackupLocations шаг задачи загрузки: копирование бэкапов в хранилища backup_locations
+func copyToBackupLocations(app *Rest) bkoperate.ProcessedFilesResult {
+	if !app.bKProcessor.HasBackupLocations() {
+		return bkoperate.ProcessedFilesResult{}
+	}
+
+	app.operationManager.ChangeStatusAndProgress(uploadTaskOperationId, "copying to backup locations", 20)
+	app.operationManager.StartOperation(copyLocationsOperationId, "copying to backup locations")
+	app.operationManager.SetOperationType(copyLocationsOperationId, om.OperationTypeCopy, uploadTaskOperationId)
+	copied, deleted, err := app.bKProcessor.CopyToBackupLocations(copyLocationsOperationId)
+	summary := fmt.Sprintf("copied %d, deleted %d, errors %d", copied.Ok, deleted.Ok, copied.Error+deleted.Error)
+	if err != nil {
+		app.logger.ErrorLog.Printf("Error when copy backups to backup locations %v", err)
+		app.operationManager.ErrorDone(copyLocationsOperationId, summary)
+	} else {
+		app.logger.InfoLog.Printf("Copy to backup locations completed: %s", summary)
+		app.operationManager.SetResult(copyLocationsOperationId, summary)
+		app.operationManager.SuccessDone(copyLocationsOperationId)
+	}
+	copied.Error += deleted.Error
+	return copied
+}
+
+// UploadTask задача загрузки. Вызывающий должен владеть правом на запуск (runcoordinator)
+func UploadTask(app *Rest) {
+	// TODO Подумать а не перенести ли в bkProcessor
+
+	app.operationManager.StartOperation(uploadTaskOperationId, "starting")
+	app.operationManager.SetOperationType(uploadTaskOperationId, om.OperationTypeUploadTask, "")
+
+	if app.isCreateBackupBeforeUpload() {
+		app.operationManager.ChangeStatusAndProgress(uploadTaskOperationId, "creating backup", 0)
+		createBackupEnabled, _ := checkCreateBackupAllowed(app)
 
 		if createBackupEnabled {
-			_, err := app.bKProcessor.CreateFullBackupSync()
+			_, err := app.bKProcessor.CreateFullBackupSync(uploadTaskOperationId)
 			if err != nil {
 				app.logger.ErrorLog.Printf("Error when create backup sync %v", err)
 			} else {
@@ -579,40 +1589,78 @@ func UploadTask(app *Rest) {
 		} else {
 			app.logger.ErrorLog.Printf("Create backup disabled")
 		}
+	}
 
+	// Копирование в хранилища бэкапов выполняется до удаления старых локальных бэкапов
+	copyResult := copyToBackupLocations(app)
+
+	if app.isCreateBackupBeforeUpload() {
+		app.operationManager.ChangeStatusAndProgress(uploadTaskOperationId, "deleting old local files", 25)
+		app.operationManager.StartOperation(rotateLocalOperationId, "deleting old local files")
+		app.operationManager.SetOperationType(rotateLocalOperationId, om.OperationTypeRotate, uploadTaskOperationId)
 		err := app.bKProcessor.DeleteOldLocalFiles()
 		if err != nil {
 			app.logger.ErrorLog.Printf("Error when delete old backup files %v", err)
+			app.operationManager.ErrorDone(rotateLocalOperationId, fmt.Sprintf("Error when delete old local files %v", err))
 		} else {
 			app.logger.InfoLog.Printf("Delete old backup files completed")
+			app.operationManager.SuccessDone(rotateLocalOperationId)
 		}
 	}
+	app.operationManager.ChangeStatusAndProgress(uploadTaskOperationId, "uploading", 30)
 
 	app.yaDProcessor.RefreshTokenIsNeed()
 	filesInfo, err := app.bKProcessor.GetFilesInfo()
 	if err != nil {
+		// Без списка файлов нельзя понять, что загружать и что удалять на ЯндексДиске
 		app.logger.ErrorLog.Printf("Error get backup files %s", err)
+		failUploadTask(app, fmt.Sprintf("Error get backup files %v", err))
+		return
 	}
-	filesToUpload := app.bKProcessor.ChooseFilesToUpload(filesInfo)
-	app.logger.InfoLog.Printf("Need upload %d files", len(filesToUpload))
+	filesToUpload, excluded := app.bKProcessor.ChooseFilesToUploadFiltered(filesInfo)
+	app.logger.InfoLog.Printf("Need upload %d files, %d files excluded by upload filters", len(filesToUpload), len(excluded))
+
+	// Проверка свободного места на ЯндексДиске
+	spacePlan := app.bKProcessor.PlanRemoteSpace(filesInfo, filesToUpload)
+	filesInfo, freeSpaceResult, err := app.bKProcessor.FreeRemoteSpace(filesInfo, spacePlan)
+	if err != nil {
+		app.logger.ErrorLog.Printf("Error delete files to free space %s", err)
+	}
+	filesToUpload = spacePlan.ToUpload
 
 	uploadedFileAmount := len(filesToUpload)
 
 	uploadResult := bkoperate.ProcessedFilesResult{}
 	if len(filesToUpload) > 0 {
-		uploadResult, err = app.bKProcessor.UploadFiles(filesToUpload)
+		uploadResult, err = app.bKProcessor.UploadFiles(filesToUpload, uploadTaskOperationId)
 		if err != nil {
 			app.logger.ErrorLog.Printf("Error upload files %s", err)
 			uploadedFileAmount = 0
 		}
 	}
+	uploadResult.AddSkipped(spacePlan.Skipped)
 	filesToDelete := app.bKProcessor.ChooseFilesToDelete(filesInfo, uploadedFileAmount)
+	if app.applCtx.Err() != nil {
+		app.logger.InfoLog.Printf("Upload task interrupted by shutdown. Old remote files are not deleted")
+		filesToDelete = filesToDelete[:0]
+	}
 
 	app.logger.DebugLog.Printf("FilesToDelete %v", filesToDelete)
+	app.operationManager.ChangeStatusAndProgress(uploadTaskOperationId, "deleting old remote files", 90)
+	app.operationManager.StartOperation(rotateRemoteOperationId, "deleting old remote files")
+	app.operationManager.SetOperationType(rotateRemoteOperationId, om.OperationTypeRotate, uploadTaskOperationId)
 	deletedResult, err := app.bKProcessor.DeleteFiles(filesToDelete)
+	deletedResult.Ok += freeSpaceResult.Ok
+	deletedResult.Error += freeSpaceResult.Error
+	deletedResult.ProcessedSize += freeSpaceResult.ProcessedSize
+	deleteSummary := fmt.Sprintf("deleted %d, errors %d", deletedResult.Ok, deletedResult.Error)
 
 	if err != nil {
 		app.logger.ErrorLog.Printf("Error delete files %s", err)
+		app.operationManager.ErrorDone(rotateRemoteOperationId, deleteSummary)
+	} else {
+		app.operationManager.SetResult(rotateRemoteOperationId, deleteSummary)
+		app.operationManager.SuccessDone(rotateRemoteOperationId)
 	}
 
 	localFileSize := types.FileSize(0)
@@ -648,7 +1696,7 @@ func UploadTask(app *Rest) {
 
 	// Save entity
 	state := haoperate.OK
-	if uploadResult.Error > 0 || deletedResult.Error > 0 {
+	if uploadResult.Error > 0 || deletedResult.Error > 0 || copyResult.Error > 0 {
 		state = haoperate.ERROR
 	}
 
@@ -660,22 +1708,26 @@ func UploadTask(app *Rest) {
 
 	if entityState == nil {
 		entityState = &haoperate.EntityState{
-			State:            state,
-			OkUpload:         uploadResult.Ok,
-			ErrorUpload:      uploadResult.Error,
-			OkDelete:         deletedResult.Ok,
-			ErrorDelete:      deletedResult.Error,
-			LocalFiles:       localFiles,
-			RemoteFiles:      remoteFiles,
-			LocalSize:        localFileSize,
-			RemoteSize:       remoteFileSize,
-			RemoteFreeSpace:  diskInfo.TotalSpace - diskInfo.UsedSpace,
-			LastUploadedTime: haoperate.CustomTime{Time: time.Now()},
+			State:              state,
+			OkUpload:           uploadResult.Ok,
+			ErrorUpload:        uploadResult.Error,
+			ErrorUploadFiles:   uploadResult.ErrorFiles(),
+			UploadErrorMessage: spacePlan.SkippedReason(),
+			OkDelete:           deletedResult.Ok,
+			ErrorDelete:        deletedResult.Error,
+			LocalFiles:         localFiles,
+			RemoteFiles:        remoteFiles,
+			LocalSize:          localFileSize,
+			RemoteSize:         remoteFileSize,
+			RemoteFreeSpace:    diskInfo.TotalSpace - diskInfo.UsedSpace,
+			LastUploadedTime:   lastSuccessfulUpload(app),
 		}
 	} else {
 		entityState.State = state
 		entityState.OkUpload = uploadResult.Ok
 		entityState.ErrorUpload = uploadResult.Error
+		entityState.ErrorUploadFiles = uploadResult.ErrorFiles()
+		entityState.UploadErrorMessage = spacePlan.SkippedReason()
 		entityState.OkDelete = deletedResult.Ok
 		entityState.ErrorDelete = deletedResult.Error
 		entityState.LocalFiles = localFiles
@@ -683,8 +1735,10 @@ func UploadTask(app *Rest) {
 		entityState.LocalSize = localFileSize
 		entityState.RemoteSize = remoteFileSize
 		entityState.RemoteFreeSpace = diskInfo.TotalSpace - diskInfo.UsedSpace
+	}
+	// Время последней успешной загрузки. По нему определяются пропущенный запуск и свежесть бэкапов
+	if state == haoperate.OK {
 		entityState.LastUploadedTime = haoperate.CustomTime{Time: time.Now()}
-
 	}
 
 	err = app.haApi.SetEntityState(
@@ -693,10 +1747,46 @@ func UploadTask(app *Rest) {
 		app.logger.ErrorLog.Printf("Error save entity state %s", err)
 	}
 
+	taskSummary := fmt.Sprintf("uploaded %d, upload errors %d, deleted %d, delete errors %d",
+		uploadResult.Ok, uploadResult.Error, deletedResult.Ok, deletedResult.Error)
+	if state == haoperate.ERROR {
+		app.operationManager.ErrorDone(uploadTaskOperationId, taskSummary)
+	} else {
+		app.operationManager.SetResult(uploadTaskOperationId, taskSummary)
+		app.operationManager.SuccessDone(uploadTaskOperationId)
+	}
+
 	app.updateStatistic()
 
 }
 
+// lastSuccessfulUpload время последней успешной загрузки из локальной копии сущности,
+// чтобы оно не потерялось, если сущность в HA недоступна
+func lastSuccessfulUpload(app *Rest) haoperate.CustomTime {
+	lastUpload, err := app.haApi.GetLastUploadTime()
+	if err != nil {
+		app.logger.DebugLog.Printf("Last upload time unknown. %v", err)
+	}
+	return haoperate.CustomTime{Time: lastUpload}
+}
+
+// failUploadTask завершает задачу загрузки с ошибкой, не меняя время последней успешной загрузки
+func failUploadTask(app *Rest, message string) {
+	entityState, err := app.haApi.GetEntityState()
+	if err != nil {
+		app.logger.ErrorLog.Printf("Error read entity state %s", err)
+		entityState = &haoperate.EntityState{LastUploadedTime: lastSuccessfulUpload(app)}
+	}
+	entityState.State = haoperate.ERROR
+	entityState.UploadErrorMessage = message
+	if err := app.haApi.SetEntityState(*entityState); err != nil {
+		app.logger.ErrorLog.Printf("Error save entity state %s", err)
+	}
+
+	app.operationManager.ErrorDone(uploadTaskOperationId, message)
+	app.updateStatistic()
+}
+
 func (app *Rest) downloadFile(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	fileName, ok := vars["fileName"]
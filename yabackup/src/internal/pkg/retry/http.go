@@ -0,0 +1,61 @@
+package retry
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	dialTimeout           = 10 * time.Second
+	tlsHandshakeTimeout   = 10 * time.Second
+	responseHeaderTimeout = time.Minute
+	idleConnTimeout       = 90 * time.Second
+)
+
+// StatusError ответ сервера с неожиданным HTTP статусом
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected response status: %s", e.Status)
+}
+
+// NewStatusError создаёт ошибку по ответу сервера
+func NewStatusError(resp *http.Response) *StatusError {
+	return &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+}
+
+// IsRetryableStatus возвращает true для статусов, после которых запрос имеет смысл повторить
+func IsRetryableStatus(statusCode int) bool {
+	switch statusCode {
+	case http.StatusRequestTimeout, http.StatusTooEarly, http.StatusTooManyRequests:
+		return true
+	case http.StatusNotImplemented, http.StatusHTTPVersionNotSupported:
+		return false
+	}
+	return statusCode >= 500 && statusCode <= 599
+}
+
+// NewHTTPClient создаёт HTTP клиент с ограничениями на установку соединения и ожидание заголовков ответа.
+// Общего ограничения на время запроса нет, чтобы не прерывать передачу больших файлов -
+// время отдельных вызовов ограничивается через контекст.
+func NewHTTPClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   dialTimeout,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSHandshakeTimeout:   tlsHandshakeTimeout,
+			ResponseHeaderTimeout: responseHeaderTimeout,
+			IdleConnTimeout:       idleConnTimeout,
+			MaxIdleConnsPerHost:   4,
+			ForceAttemptHTTP2:     true,
+		},
+	}
+}
@@ -0,0 +1,131 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+	"ybg/internal/pkg/mylogger"
+)
+
+// Policy политика повторов для идемпотентных вызовов: экспоненциальная задержка с джиттером
+// и ограничение времени каждой попытки.
+type Policy struct {
+	MaxAttempts    int
+	BaseDelay      time.Duration
+	MaxDelay       time.Duration
+	AttemptTimeout time.Duration
+	// Retryable решает, стоит ли повторять вызов после ошибки. Если nil - используется IsRetryable
+	Retryable func(err error) bool
+}
+
+// DefaultPolicy политика по умолчанию: 4 попытки, задержка 1с, 2с, 4с (с джиттером), не более 30с на попытку
+func DefaultPolicy() Policy {
+	return Policy{
+		MaxAttempts:    4,
+		BaseDelay:      time.Second,
+		MaxDelay:       15 * time.Second,
+		AttemptTimeout: 30 * time.Second,
+	}
+}
+
+// Do выполняет fn, повторяя вызов при временных ошибках.
+// Каждой попытке передаётся контекст с ограничением AttemptTimeout.
+// Повторы прекращаются при отмене ctx, при постоянной ошибке и после MaxAttempts попыток.
+// Возвращается ошибка последней попытки.
+func (p Policy) Do(ctx context.Context, name string, logger *mylogger.Logger, fn func(ctx context.Context) error) error {
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = IsRetryable
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := p.attempt(ctx, fn)
+		if err == nil {
+			if attempt > 1 && logger != nil {
+				logger.InfoLog.Printf("%s succeeded on attempt %d", name, attempt)
+			}
+			return nil
+		}
+
+		if ctx.Err() != nil || attempt >= p.MaxAttempts || !retryable(err) {
+			return err
+		}
+
+		delay := p.backoff(attempt)
+		if logger != nil {
+			logger.WarnLog.Printf("%s failed on attempt %d/%d: %v. Retry in %v", name, attempt, p.MaxAttempts, err, delay)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+func (p Policy) attempt(ctx context.Context, fn func(ctx context.Context) error) error {
+	if p.AttemptTimeout <= 0 {
+		return fn(ctx)
+	}
+	attemptCtx, cancel := context.WithTimeout(ctx, p.AttemptTimeout)
+	defer cancel()
+	return fn(attemptCtx)
+}
+
+// backoff задержка перед следующей попыткой: половина экспоненциальной задержки плюс случайная добавка до второй половины
+func (p Policy) backoff(attempt int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempt && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+// IsRetryable возвращает true для временных ошибок: HTTP статусы 408, 425, 429, 5xx (кроме 501),
+// сетевые ошибки и ошибки DNS, обрыв соединения, истечение времени попытки.
+// Отмена контекста повторов не вызывает.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return IsRetryableStatus(statusErr.StatusCode)
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.EOF) {
+		return true
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
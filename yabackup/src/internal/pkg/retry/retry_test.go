@@ -0,0 +1,155 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testPolicy() Policy {
+	return Policy{MaxAttempts: 4, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond, AttemptTimeout: time.Second}
+}
+
+// flakyServer отвечает failStatus на первые failures запросов, затем 200 OK
+func flakyServer(failures int32, failStatus int) (*httptest.Server, *atomic.Int32) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= failures {
+			w.WriteHeader(failStatus)
+			return
+		}
+		_, _ = io.WriteString(w, "ok")
+	}))
+	return server, &calls
+}
+
+func get(ctx context.Context, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := NewHTTPClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return NewStatusError(resp)
+	}
+	return nil
+}
+
+func Test_DoRetriesTransientStatus(t *testing.T) {
+	server, calls := flakyServer(2, http.StatusServiceUnavailable)
+	defer server.Close()
+
+	err := testPolicy().Do(context.Background(), "get", nil, func(ctx context.Context) error {
+		return get(ctx, server.URL)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(3), calls.Load())
+}
+
+func Test_DoStopsOnPermanentStatus(t *testing.T) {
+	server, calls := flakyServer(10, http.StatusNotFound)
+	defer server.Close()
+
+	err := testPolicy().Do(context.Background(), "get", nil, func(ctx context.Context) error {
+		return get(ctx, server.URL)
+	})
+	var statusErr *StatusError
+	assert.True(t, errors.As(err, &statusErr))
+	assert.Equal(t, http.StatusNotFound, statusErr.StatusCode)
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func Test_DoGivesUpAfterMaxAttempts(t *testing.T) {
+	server, calls := flakyServer(10, http.StatusBadGateway)
+	defer server.Close()
+
+	err := testPolicy().Do(context.Background(), "get", nil, func(ctx context.Context) error {
+		return get(ctx, server.URL)
+	})
+	assert.Error(t, err)
+	assert.Equal(t, int32(4), calls.Load())
+}
+
+func Test_DoRetriesAttemptTimeout(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+			return
+		}
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer server.Close()
+
+	policy := testPolicy()
+	policy.AttemptTimeout = 50 * time.Millisecond
+	err := policy.Do(context.Background(), "get", nil, func(ctx context.Context) error {
+		return get(ctx, server.URL)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), calls.Load())
+}
+
+func Test_DoStopsOnContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+
+	policy := testPolicy()
+	policy.BaseDelay = time.Hour
+	policy.MaxDelay = time.Hour
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+
+	err := policy.Do(ctx, "call", nil, func(ctx context.Context) error {
+		attempts++
+		return &StatusError{StatusCode: http.StatusServiceUnavailable, Status: "503 Service Unavailable"}
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+}
+
+func Test_IsRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&StatusError{StatusCode: http.StatusTooManyRequests}, true},
+		{&StatusError{StatusCode: http.StatusInternalServerError}, true},
+		{&StatusError{StatusCode: http.StatusNotImplemented}, false},
+		{&StatusError{StatusCode: http.StatusUnauthorized}, false},
+		{fmt.Errorf("wrapped: %w", &StatusError{StatusCode: http.StatusGatewayTimeout}), true},
+		{fmt.Errorf("read: %w", io.ErrUnexpectedEOF), true},
+		{context.DeadlineExceeded, true},
+		{context.Canceled, false},
+		{errors.New("error when parse body"), false},
+	}
+	for _, tt := range tests {
+		assert.Equalf(t, tt.want, IsRetryable(tt.err), "IsRetryable(%v)", tt.err)
+	}
+}
+
+func Test_Backoff(t *testing.T) {
+	policy := Policy{BaseDelay: 100 * time.Millisecond, MaxDelay: 300 * time.Millisecond}
+	for i := 0; i < 20; i++ {
+		first := policy.backoff(1)
+		assert.True(t, first >= 50*time.Millisecond && first <= 100*time.Millisecond, "first delay %v", first)
+		third := policy.backoff(3)
+		assert.True(t, third >= 150*time.Millisecond && third <= 300*time.Millisecond, "third delay %v", third)
+	}
+}
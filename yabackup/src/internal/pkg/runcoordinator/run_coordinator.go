@@ -0,0 +1,230 @@
+package runcoordinator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"ybg/internal/pkg/mylogger"
+)
+
+// RunType тип запуска, которому нужен монопольный доступ к бэкапам
+type RunType string
+
+const (
+	RunCreate  RunType = "create backup"
+	RunUpload  RunType = "upload"
+	RunRotate  RunType = "rotate"
+	RunRestore RunType = "restore"
+	RunDelete  RunType = "delete"
+	RunVerify  RunType = "verify"
+	// RunShutdown занимает координатор при остановке аддона
+	RunShutdown RunType = "shutdown"
+)
+
+var ErrBusy = errors.New("another run is in progress")
+var ErrClosed = errors.New("addon is shutting down")
+
+type RunInfo struct {
+	Type      RunType
+	Initiator string
+	Started   time.Time
+}
+
+func (i RunInfo) String() string {
+	return fmt.Sprintf("%s (%s, started %s)", i.Type, i.Initiator, i.Started.Format(time.DateTime))
+}
+
+// BusyError запуск отклонён, так как выполняется другой запуск
+type BusyError struct {
+	Requested RunType
+	Current   *RunInfo
+}
+
+func (e *BusyError) Error() string {
+	if e.Current == nil {
+		return fmt.Sprintf("can not start %s: %v", e.Requested, ErrBusy)
+	}
+	return fmt.Sprintf("can not start %s: %s is running", e.Requested, e.Current)
+}
+
+func (e *BusyError) Is(target error) bool {
+	return target == ErrBusy
+}
+
+// Coordinator выполняет создание, загрузку, ротацию и восстановление бэкапов строго по одному.
+// Конфликтующий запуск либо отклоняется (TryAcquire), либо ждёт в очереди (Acquire).
+// После Shutdown новые запуски не принимаются.
+type Coordinator struct {
+	slot      chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+	drained   bool
+	mu        sync.Mutex
+	current   *RunInfo
+	queued    int
+	logger    *mylogger.Logger
+}
+
+func New(logger *mylogger.Logger) *Coordinator {
+	return &Coordinator{
+		slot:   make(chan struct{}, 1),
+		closed: make(chan struct{}),
+		logger: logger,
+	}
+}
+
+// Lease право на выполнение запуска. Должно быть освобождено через Release
+type Lease struct {
+	coordinator *Coordinator
+	info        RunInfo
+	once        sync.Once
+}
+
+// TryAcquire захватывает право на запуск. Если выполняется другой запуск, возвращает *BusyError
+func (c *Coordinator) TryAcquire(runType RunType, initiator string) (*Lease, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.isClosed() {
+		c.logger.InfoLog.Printf("Run %s rejected: %v", runType, ErrClosed)
+		return nil, ErrClosed
+	}
+
+	select {
+	case c.slot <- struct{}{}:
+		return c.start(runType, initiator), nil
+	default:
+		busyErr := &BusyError{Requested: runType}
+		if c.current != nil {
+			current := *c.current
+			busyErr.Current = &current
+		}
+		c.logger.InfoLog.Printf("Run rejected: %v", busyErr)
+		return nil, busyErr
+	}
+}
+
+// Acquire захватывает право на запуск, при необходимости дожидаясь завершения текущего запуска
+func (c *Coordinator) Acquire(ctx context.Context, runType RunType, initiator string) (*Lease, error) {
+	c.mu.Lock()
+	if c.isClosed() {
+		c.mu.Unlock()
+		return nil, ErrClosed
+	}
+	select {
+	case c.slot <- struct{}{}:
+		defer c.mu.Unlock()
+		return c.start(runType, initiator), nil
+	default:
+	}
+	c.queued++
+	if c.current != nil {
+		c.logger.InfoLog.Printf("Run %s (%s) queued. Waiting for %s", runType, initiator, c.current)
+	}
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		c.queued--
+		c.mu.Unlock()
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.closed:
+		return nil, ErrClosed
+	case c.slot <- struct{}{}:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.isClosed() {
+			// Слот освободился одновременно с остановкой - отдаём его Shutdown
+			<-c.slot
+			return nil, ErrClosed
+		}
+		return c.start(runType, initiator), nil
+	}
+}
+
+// Shutdown запрещает новые запуски (в том числе ожидающие в очереди) и ждёт завершения текущего.
+// Если ctx завершился раньше, возвращает ошибку ctx - Shutdown можно вызвать повторно.
+// После успешного завершения координатор остаётся занятым до конца работы аддона.
+func (c *Coordinator) Shutdown(ctx context.Context) error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+
+	c.mu.Lock()
+	if c.drained {
+		c.mu.Unlock()
+		return nil
+	}
+	if c.current != nil {
+		c.logger.InfoLog.Printf("Shutdown. Waiting for %s", c.current)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case c.slot <- struct{}{}:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.drained = true
+		c.start(RunShutdown, "addon")
+		return nil
+	}
+}
+
+// isClosed вызывается под c.mu
+func (c *Coordinator) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Current текущий запуск
+func (c *Coordinator) Current() (RunInfo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.current == nil {
+		return RunInfo{}, false
+	}
+	return *c.current, true
+}
+
+// Queued количество запусков, ожидающих в очереди
+func (c *Coordinator) Queued() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.queued
+}
+
+// start вызывается под c.mu после захвата slot
+func (c *Coordinator) start(runType RunType, initiator string) *Lease {
+	info := RunInfo{Type: runType, Initiator: initiator, Started: time.Now()}
+	c.current = &info
+	c.logger.DebugLog.Printf("Run started: %s", info)
+	return &Lease{coordinator: c, info: info}
+}
+
+func (l *Lease) Info() RunInfo {
+	return l.info
+}
+
+// Release освобождает право на запуск. Повторный вызов ничего не делает
+func (l *Lease) Release() {
+	l.once.Do(func() {
+		c := l.coordinator
+		c.mu.Lock()
+		c.current = nil
+		<-c.slot
+		c.mu.Unlock()
+		c.logger.DebugLog.Printf("Run finished: %s", l.info)
+	})
+}
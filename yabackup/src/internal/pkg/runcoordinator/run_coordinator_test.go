@@ -0,0 +1,165 @@
+package runcoordinator
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"ybg/internal/pkg/mylogger"
+)
+
+func newTestCoordinator() *Coordinator {
+	discardLog := log.New(io.Discard, "", 0)
+	return New(&mylogger.Logger{ErrorLog: discardLog, InfoLog: discardLog, DebugLog: discardLog})
+}
+
+func TestCoordinator_TryAcquire(t *testing.T) {
+	coordinator := newTestCoordinator()
+
+	lease, err := coordinator.TryAcquire(RunUpload, "schedule")
+	assert.NoError(t, err)
+
+	current, ok := coordinator.Current()
+	assert.True(t, ok)
+	assert.Equal(t, RunUpload, current.Type)
+
+	_, err = coordinator.TryAcquire(RunRestore, "user")
+	assert.ErrorIs(t, err, ErrBusy)
+	var busyErr *BusyError
+	assert.True(t, errors.As(err, &busyErr))
+	assert.Equal(t, RunRestore, busyErr.Requested)
+	assert.Equal(t, RunUpload, busyErr.Current.Type)
+	assert.Contains(t, err.Error(), "upload (schedule")
+
+	lease.Release()
+	lease.Release()
+	_, ok = coordinator.Current()
+	assert.False(t, ok)
+
+	lease, err = coordinator.TryAcquire(RunRestore, "user")
+	assert.NoError(t, err)
+	lease.Release()
+}
+
+func TestCoordinator_AcquireQueued(t *testing.T) {
+	coordinator := newTestCoordinator()
+	lease, err := coordinator.TryAcquire(RunCreate, "user")
+	assert.NoError(t, err)
+
+	acquired := make(chan *Lease)
+	go func() {
+		queuedLease, err := coordinator.Acquire(context.Background(), RunUpload, "schedule")
+		assert.NoError(t, err)
+		acquired <- queuedLease
+	}()
+
+	assert.Eventually(t, func() bool { return coordinator.Queued() == 1 }, time.Second, time.Millisecond)
+	select {
+	case <-acquired:
+		t.Fatal("queued run started before release")
+	default:
+	}
+
+	lease.Release()
+	queuedLease := <-acquired
+	assert.Equal(t, RunUpload, queuedLease.Info().Type)
+	assert.Equal(t, 0, coordinator.Queued())
+	queuedLease.Release()
+}
+
+func TestCoordinator_AcquireCanceled(t *testing.T) {
+	coordinator := newTestCoordinator()
+	lease, _ := coordinator.TryAcquire(RunCreate, "user")
+	defer lease.Release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := coordinator.Acquire(ctx, RunUpload, "schedule")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 0, coordinator.Queued())
+}
+
+// Запуски не должны выполняться одновременно. Запускать с -race
+func TestCoordinator_Concurrent(t *testing.T) {
+	coordinator := newTestCoordinator()
+	var running, maxRunning, completed, rejected int32
+	var wg sync.WaitGroup
+
+	run := func() {
+		now := atomic.AddInt32(&running, 1)
+		for {
+			old := atomic.LoadInt32(&maxRunning)
+			if now <= old || atomic.CompareAndSwapInt32(&maxRunning, old, now) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		atomic.AddInt32(&completed, 1)
+	}
+
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			lease, err := coordinator.Acquire(context.Background(), RunUpload, "schedule")
+			if assert.NoError(t, err) {
+				defer lease.Release()
+				run()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			lease, err := coordinator.TryAcquire(RunRestore, "user")
+			if err != nil {
+				assert.ErrorIs(t, err, ErrBusy)
+				atomic.AddInt32(&rejected, 1)
+				return
+			}
+			defer lease.Release()
+			run()
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), maxRunning)
+	assert.Equal(t, int32(40), completed+rejected)
+	_, ok := coordinator.Current()
+	assert.False(t, ok)
+}
+
+func TestCoordinator_Shutdown(t *testing.T) {
+	coordinator := newTestCoordinator()
+	lease, _ := coordinator.TryAcquire(RunUpload, "schedule")
+
+	queuedErr := make(chan error, 1)
+	go func() {
+		_, err := coordinator.Acquire(context.Background(), RunUpload, "schedule")
+		queuedErr <- err
+	}()
+	for coordinator.Queued() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Текущий запуск не успел завершиться
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, coordinator.Shutdown(ctx), context.DeadlineExceeded)
+
+	// Ожидающий в очереди запуск и новые запуски отклоняются
+	assert.ErrorIs(t, <-queuedErr, ErrClosed)
+	_, err := coordinator.TryAcquire(RunCreate, "user")
+	assert.ErrorIs(t, err, ErrClosed)
+
+	lease.Release()
+	assert.NoError(t, coordinator.Shutdown(context.Background()))
+	assert.NoError(t, coordinator.Shutdown(context.Background()))
+	current, ok := coordinator.Current()
+	assert.True(t, ok)
+	assert.Equal(t, RunShutdown, current.Type)
+}
@@ -0,0 +1,102 @@
+package throttle
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// Limiter ограничивает скорость передачи данных (байт в секунду).
+// Один Limiter может использоваться несколькими передачами одновременно - тогда ограничение общее.
+// Совместим с grab.RateLimiter.
+type Limiter struct {
+	mu          sync.Mutex
+	bytesPerSec int64
+	next        time.Time
+}
+
+// NewLimiter создаёт ограничитель. При bytesPerSec <= 0 возвращает nil (без ограничения).
+func NewLimiter(bytesPerSec int64) *Limiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return &Limiter{bytesPerSec: bytesPerSec}
+}
+
+func (l *Limiter) BytesPerSec() int64 {
+	if l == nil {
+		return 0
+	}
+	return l.bytesPerSec
+}
+
+// WaitN ждёт, пока передача n байт не будет укладываться в ограничение скорости
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(float64(n) / float64(l.bytesPerSec) * float64(time.Second)))
+	l.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Estimate оценивает время передачи size байт. Без ограничения возвращает 0.
+func (l *Limiter) Estimate(size int64) time.Duration {
+	if l == nil || size <= 0 {
+		return 0
+	}
+	return time.Duration(float64(size) / float64(l.bytesPerSec) * float64(time.Second))
+}
+
+type reader struct {
+	ctx         context.Context
+	reader      io.Reader
+	limiter     *Limiter
+	onRead      func(transferred int64)
+	transferred int64
+}
+
+// NewReader оборачивает reader ограничением скорости. onRead (может быть nil) вызывается
+// после каждого чтения с общим количеством прочитанных байт.
+func NewReader(ctx context.Context, r io.Reader, limiter *Limiter, onRead func(transferred int64)) io.Reader {
+	return &reader{ctx: ctx, reader: r, limiter: limiter, onRead: onRead}
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.transferred += int64(n)
+		if waitErr := r.limiter.WaitN(r.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+		if r.onRead != nil {
+			r.onRead(r.transferred)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,114 @@
+package throttle
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const day = 24 * time.Hour
+
+// Window разрешённый интервал времени суток, например "01:00-07:00".
+// Интервал может переходить через полночь ("22:00-06:00").
+type Window struct {
+	start time.Duration
+	end   time.Duration
+	value string
+}
+
+// ParseWindow разбирает интервал в формате "HH:MM-HH:MM". Пустая строка - ограничения нет (nil).
+func ParseWindow(value string) (*Window, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, nil
+	}
+
+	startValue, endValue, ok := strings.Cut(value, "-")
+	if !ok {
+		return nil, fmt.Errorf("incorrect time window %q. Expected format HH:MM-HH:MM", value)
+	}
+
+	start, err := parseTimeOfDay(startValue)
+	if err != nil {
+		return nil, fmt.Errorf("incorrect time window %q: %w", value, err)
+	}
+	end, err := parseTimeOfDay(endValue)
+	if err != nil {
+		return nil, fmt.Errorf("incorrect time window %q: %w", value, err)
+	}
+
+	return &Window{start: start, end: end, value: value}, nil
+}
+
+func parseTimeOfDay(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("incorrect time %q", value)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (w *Window) String() string {
+	return w.value
+}
+
+// Length длительность интервала
+func (w *Window) Length() time.Duration {
+	if w.end > w.start {
+		return w.end - w.start
+	}
+	return day - w.start + w.end
+}
+
+// Contains попадает ли момент t в интервал
+func (w *Window) Contains(t time.Time) bool {
+	if w == nil || w.start == w.end {
+		return true
+	}
+	tod := timeOfDay(t)
+	if w.start < w.end {
+		return tod >= w.start && tod < w.end
+	}
+	return tod >= w.start || tod < w.end
+}
+
+// NextStart ближайшее после t начало интервала
+func (w *Window) NextStart(t time.Time) time.Time {
+	start := midnight(t).Add(w.start)
+	if !start.After(t) {
+		start = start.Add(day)
+	}
+	return start
+}
+
+// End окончание интервала, в который попадает t
+func (w *Window) End(t time.Time) time.Time {
+	end := midnight(t).Add(w.end)
+	if !end.After(t) {
+		end = end.Add(day)
+	}
+	return end
+}
+
+// StartFor момент, когда можно начать передачу длительностью duration так, чтобы она уложилась в интервал.
+// Если передача не укладывается даже в целый интервал, она начинается сразу внутри интервала.
+func (w *Window) StartFor(t time.Time, duration time.Duration) time.Time {
+	if w == nil || w.start == w.end {
+		return t
+	}
+
+	if w.Contains(t) {
+		if duration > w.Length() || !t.Add(duration).After(w.End(t)) {
+			return t
+		}
+	}
+	return w.NextStart(t)
+}
+
+func timeOfDay(t time.Time) time.Duration {
+	return t.Sub(midnight(t))
+}
+
+func midnight(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
@@ -0,0 +1,81 @@
+package throttle
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func at(hour, minute int) time.Time {
+	return time.Date(2026, time.October, 19, hour, minute, 0, 0, time.UTC)
+}
+
+func Test_ParseWindow(t *testing.T) {
+	window, err := ParseWindow("")
+	assert.Nil(t, err, "Error must be nil")
+	assert.Nil(t, window, "Empty window must be nil")
+
+	for _, value := range []string{"01:00", "1-2", "25:00-01:00", "01:00-07:60"} {
+		_, err = ParseWindow(value)
+		assert.NotNilf(t, err, "Error expected for %s", value)
+	}
+
+	window, err = ParseWindow(" 22:00-06:00 ")
+	assert.Nil(t, err, "Error must be nil")
+	assert.Equal(t, 8*time.Hour, window.Length())
+}
+
+func Test_WindowContains(t *testing.T) {
+	day, _ := ParseWindow("01:00-07:00")
+	night, _ := ParseWindow("22:00-06:00")
+
+	tests := []struct {
+		name   string
+		window *Window
+		time   time.Time
+		want   bool
+	}{
+		{"day inside", day, at(3, 0), true},
+		{"day start", day, at(1, 0), true},
+		{"day end", day, at(7, 0), false},
+		{"day outside", day, at(12, 0), false},
+		{"night before midnight", night, at(23, 0), true},
+		{"night after midnight", night, at(2, 0), true},
+		{"night outside", night, at(12, 0), false},
+		{"nil window", nil, at(12, 0), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.window.Contains(tt.time))
+		})
+	}
+}
+
+func Test_WindowStartFor(t *testing.T) {
+	window, _ := ParseWindow("22:00-06:00")
+
+	tests := []struct {
+		name     string
+		time     time.Time
+		duration time.Duration
+		want     time.Time
+	}{
+		{"fits", at(23, 0), time.Hour, at(23, 0)},
+		{"fits after midnight", at(2, 0), 3 * time.Hour, at(2, 0)},
+		{"spills past window", at(5, 0), 2 * time.Hour, at(22, 0)},
+		{"outside window", at(12, 0), time.Hour, at(22, 0)},
+		{"longer than window", at(23, 0), 10 * time.Hour, at(23, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, window.StartFor(tt.time, tt.duration))
+		})
+	}
+}
+
+func Test_LimiterEstimate(t *testing.T) {
+	var unlimited *Limiter
+	assert.Nil(t, NewLimiter(0), "Limiter without limit must be nil")
+	assert.Equal(t, time.Duration(0), unlimited.Estimate(1024))
+	assert.Equal(t, 2*time.Second, NewLimiter(1024).Estimate(2048))
+}
@@ -2,20 +2,120 @@ package yadiskoperate
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	yadisk "github.com/nikitaksv/yandex-disk-sdk-go"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
+	om "ybg/internal/pkg/operationmanager"
+	"ybg/internal/pkg/retry"
 )
 
 const itemTypeFile string = "file"
+const itemTypeDir string = "dir"
+const remoteListPageSize = 1000
+const RemoteListMaxDepth = 3
+const folderExistsErrorId = "DiskPathPointsToExistentDirectoryError"
+const notFoundErrorId = "DiskNotFoundError"
+const progressReportInterval = time.Second
 
 var minTime = time.Date(1990, time.January, 01, 12, 00, 0, 0, time.UTC)
 
-func NewYandexDisk(accessToken string) (yadisk.YaDisk, error) {
-	return yadisk.NewYaDisk(context.Background(), http.DefaultClient, &yadisk.Token{AccessToken: accessToken})
+// retryableErrorIds идентификаторы ошибок ЯндексДиска, после которых вызов имеет смысл повторить
+var retryableErrorIds = map[string]bool{
+	"TooManyRequestsError":        true,
+	"ServiceUnavailableError":     true,
+	"DiskServiceUnavailableError": true,
+	"InternalServerError":         true,
+	"GatewayTimeoutError":         true,
+}
+
+// NewYandexDisk создаёт объект SDK ЯндексДиска. SDK выполняет все вызовы с контекстом ctx
+func NewYandexDisk(ctx context.Context, client *http.Client, accessToken string) (yadisk.YaDisk, error) {
+	return yadisk.NewYaDisk(ctx, client, &yadisk.Token{AccessToken: accessToken})
+}
 
+func yandexRetryPolicy() retry.Policy {
+	policy := retry.DefaultPolicy()
+	policy.Retryable = isRetryableYandexError
+	return policy
+}
+
+// isRetryableYandexError классифицирует ошибки вызовов SDK ЯндексДиска.
+// Кроме общих временных ошибок повторяются ошибки API с временным характером, ответы с кодом 5xx/429
+// и ответы не в формате JSON (страницы ошибок промежуточных прокси).
+func isRetryableYandexError(err error) bool {
+	if retry.IsRetryable(err) {
+		return true
+	}
+
+	var yaErr *yadisk.Error
+	if errors.As(err, &yaErr) {
+		if statusCode, convErr := strconv.Atoi(yaErr.ErrorID); convErr == nil {
+			return retry.IsRetryableStatus(statusCode)
+		}
+		return retryableErrorIds[yaErr.ErrorID]
+	}
+
+	var syntaxErr *json.SyntaxError
+	return errors.As(err, &syntaxErr)
 }
 
 func convertDateString(modified string) (time.Time, error) {
 	return time.Parse(time.RFC3339, modified)
 }
+
+func joinRemotePath(base string, name string) string {
+	base = strings.TrimSuffix(base, "/")
+	name = strings.Trim(name, "/")
+	if base == "" {
+		return name
+	}
+	if name == "" {
+		return base
+	}
+	return base + "/" + name
+}
+
+func isFolderExistsError(err error) bool {
+	var yaErr *yadisk.Error
+	return errors.As(err, &yaErr) && yaErr.ErrorID == folderExistsErrorId
+}
+
+func isNotFoundError(err error) bool {
+	var yaErr *yadisk.Error
+	return errors.As(err, &yaErr) && yaErr.ErrorID == notFoundErrorId
+}
+
+// progressReporter передаёт прогресс передачи в OperationManager не чаще progressReportInterval
+type progressReporter struct {
+	operationManager *om.OperationManager
+	operationId      string
+	status           string
+	size             int64
+	lastReport       time.Time
+}
+
+func newProgressReporter(operationManager *om.OperationManager, operationId string, status string, size int64) *progressReporter {
+	return &progressReporter{operationManager: operationManager, operationId: operationId, status: status, size: size}
+}
+
+func (p *progressReporter) report(transferred int64) {
+	if p.operationManager == nil || p.operationId == "" || p.size <= 0 {
+		return
+	}
+	if transferred < p.size && time.Since(p.lastReport) < progressReportInterval {
+		return
+	}
+	p.lastReport = time.Now()
+	p.operationManager.ChangeTransferred(p.operationId, p.status, transferred, p.size)
+}
+
+// limitedReadCloser поток скачивания с ограничением скорости, закрывающий исходное тело ответа
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
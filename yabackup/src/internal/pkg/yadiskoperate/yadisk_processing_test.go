@@ -1,9 +1,20 @@
 package yadiskoperate
 
 import (
+	"context"
 	"fmt"
+	yadisk "github.com/nikitaksv/yandex-disk-sdk-go"
 	"github.com/stretchr/testify/assert"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
 	"testing"
+	"time"
+	"ybg/internal/pkg/mylogger"
+	"ybg/internal/types"
 )
 
 func Test_convertDateString(t *testing.T) {
@@ -29,3 +40,131 @@ func Test_convertDateString(t *testing.T) {
 		})
 	}
 }
+
+func Test_joinRemotePath(t *testing.T) {
+	tests := []struct {
+		name string
+		base string
+		file string
+		want string
+	}{
+		{"simple", "/backup", "file1", "/backup/file1"},
+		{"trailing slash", "/backup/", "file1", "/backup/file1"},
+		{"sub folder", "/backup", "2026/10/file1", "/backup/2026/10/file1"},
+		{"empty base", "", "2026/10", "2026/10"},
+		{"empty name", "/backup", "", "/backup"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equalf(t, tt.want, joinRemotePath(tt.base, tt.file), "joinRemotePath(%v, %v)", tt.base, tt.file)
+		})
+	}
+}
+
+// redirectTransport направляет запросы SDK к тестовому серверу вместо cloud-api.yandex.net
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (r redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = r.target.Scheme
+	req.URL.Host = r.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func newTestProcessor(t *testing.T, handler http.HandlerFunc) *YaDProcessor {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	target, _ := url.Parse(server.URL)
+
+	client := &http.Client{Transport: redirectTransport{target: target}}
+	disk, err := yadisk.NewYaDisk(context.Background(), client, &yadisk.Token{AccessToken: "token"})
+	assert.NoError(t, err)
+
+	discardLog := log.New(io.Discard, "", 0)
+	processor := NewYaDProcessor(context.Background(), "", "", "/backup", nil, nil, nil, nil, mylogger.New(discardLog, discardLog, discardLog))
+	processor.yaDisk = &disk
+	processor.httpClient = client
+	processor.TokenInfo.AccessToken = "token"
+	processor.retryPolicy.BaseDelay = time.Millisecond
+	processor.retryPolicy.MaxDelay = time.Millisecond
+	return processor
+}
+
+func Test_GetRemoteFilesRetriesTransientErrors(t *testing.T) {
+	var calls atomic.Int32
+	processor := newTestProcessor(t, func(w http.ResponseWriter, r *http.Request) {
+		switch calls.Add(1) {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = io.WriteString(w, `{"error":"DiskServiceUnavailableError","message":"Сервис временно недоступен"}`)
+		case 2:
+			w.WriteHeader(http.StatusBadGateway)
+			_, _ = io.WriteString(w, "<html>502 Bad Gateway</html>")
+		default:
+			_, _ = io.WriteString(w, `{"_embedded":{"total":1,"items":[{"type":"file","name":"a.tar","size":10,"modified":"2026-10-19T03:00:00+00:00"}]}}`)
+		}
+	})
+
+	files, err := processor.GetRemoteFiles()
+	assert.NoError(t, err)
+	assert.Equal(t, int32(3), calls.Load())
+	if assert.Len(t, files, 1) {
+		assert.Equal(t, "a.tar", files[0].Name)
+	}
+}
+
+func Test_GetRemoteFilesDoesNotRetryPermanentErrors(t *testing.T) {
+	var calls atomic.Int32
+	processor := newTestProcessor(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = io.WriteString(w, `{"error":"UnauthorizedError","message":"Не авторизован"}`)
+	})
+
+	_, err := processor.GetRemoteFiles()
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func Test_callWithRetryLimitsAttemptTime(t *testing.T) {
+	var calls atomic.Int32
+	processor := newTestProcessor(t, func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			// Первый вызов зависает дольше времени попытки
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		_, _ = io.WriteString(w, `{"total_space":100,"used_space":40}`)
+	})
+	processor.retryPolicy.AttemptTimeout = 100 * time.Millisecond
+
+	diskInfo, err := processor.GetDiskInfo()
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), calls.Load())
+	assert.Equal(t, types.FileSize(60), diskInfo.TotalSpace-diskInfo.UsedSpace)
+}
+
+func Test_OpenRemoteFileUsesProcessorClient(t *testing.T) {
+	processor := newTestProcessor(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/file" {
+			_, _ = io.WriteString(w, "backup content")
+			return
+		}
+		// Ссылка на скачивание доступна только через клиент процессора (redirectTransport)
+		_, _ = io.WriteString(w, `{"href":"https://downloader.disk.yandex.ru/file","method":"GET"}`)
+	})
+
+	reader, err := processor.OpenRemoteFile(context.Background(), "a.tar")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer reader.Close()
+	content, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "backup content", string(content))
+}
@@ -1,43 +1,93 @@
 package yadiskoperate
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	uploadbig "github.com/maxifly/upload-big-file"
 	yadisk "github.com/nikitaksv/yandex-disk-sdk-go"
 	"io"
 	"net/http"
+	"os"
+	"path"
+	"strings"
 	"time"
 	"ybg/internal/pkg/downloader"
 	"ybg/internal/pkg/haoperate"
 	"ybg/internal/pkg/mylogger"
 	om "ybg/internal/pkg/operationmanager"
+	"ybg/internal/pkg/retry"
+	"ybg/internal/pkg/throttle"
 	"ybg/internal/types"
 )
 
 type YaDProcessor struct {
-	clientId     string
-	clientSecret string
-	remotePath   string
-	TokenInfo    types.TokenInfo
-	yaDisk       *yadisk.YaDisk
-	downloader   *downloader.Downloader
-	logger       *mylogger.Logger
+	applCtx          context.Context
+	clientId         string
+	clientSecret     string
+	remotePath       string
+	TokenInfo        types.TokenInfo
+	yaDisk           *yadisk.YaDisk
+	httpClient       *http.Client // Клиент вызовов API и скачивания файлов с таймаутами соединения
+	downloader       *downloader.Downloader
+	operationManager *om.OperationManager
+	uploadLimiter    *throttle.Limiter
+	downloadLimiter  *throttle.Limiter
+	uploadWindow     *throttle.Window
+	retryPolicy      retry.Policy
+	logger           *mylogger.Logger
 }
 
-func NewYaDProcessor(clientId string,
+func NewYaDProcessor(applCtx context.Context,
+	clientId string,
 	clientSecret string,
 	remotePath string,
+	uploadLimiter *throttle.Limiter,
+	downloadLimiter *throttle.Limiter,
+	uploadWindow *throttle.Window,
 	operationManager *om.OperationManager,
 	logger *mylogger.Logger) *YaDProcessor {
 	return &YaDProcessor{
-		clientId:     clientId,
-		clientSecret: clientSecret,
-		remotePath:   remotePath,
-		downloader:   downloader.New(operationManager, logger),
-		logger:       logger,
+		applCtx:          applCtx,
+		clientId:         clientId,
+		clientSecret:     clientSecret,
+		remotePath:       remotePath,
+		httpClient:       retry.NewHTTPClient(),
+		downloader:       downloader.New(operationManager, downloadLimiter, logger),
+		operationManager: operationManager,
+		uploadLimiter:    uploadLimiter,
+		downloadLimiter:  downloadLimiter,
+		uploadWindow:     uploadWindow,
+		retryPolicy:      yandexRetryPolicy(),
+		logger:           logger,
 	}
 }
 
+// callWithRetry выполняет идемпотентный вызов API ЯндексДиска, повторяя его при временных ошибках.
+// SDK привязывает контекст к объекту, поэтому для каждой попытки создаётся объект с контекстом попытки,
+// ограничивающим время вызова
+func (app *YaDProcessor) callWithRetry(name string, call func(disk yadisk.YaDisk) error) error {
+	return app.retryPolicy.Do(app.applCtx, name, app.logger, func(ctx context.Context) error {
+		disk, err := NewYandexDisk(ctx, app.httpClient, app.TokenInfo.AccessToken)
+		if err != nil {
+			return err
+		}
+		return call(disk)
+	})
+}
+
+// callOnce выполняет неидемпотентный вызов API ЯндексДиска без повторов, с тем же ограничением времени, что у попытки
+func (app *YaDProcessor) callOnce(call func(disk yadisk.YaDisk) error) error {
+	ctx, cancel := context.WithTimeout(app.applCtx, app.retryPolicy.AttemptTimeout)
+	defer cancel()
+	disk, err := NewYandexDisk(ctx, app.httpClient, app.TokenInfo.AccessToken)
+	if err != nil {
+		return err
+	}
+	return call(disk)
+}
+
 func (app *YaDProcessor) EnsureTokenInfo() {
 	if isTokenEmpty(app.TokenInfo) {
 		token, err := readToken()
@@ -45,10 +95,16 @@ func (app *YaDProcessor) EnsureTokenInfo() {
 			app.logger.ErrorLog.Printf("Error read token info %v", err)
 			return
 		}
-		app.TokenInfo = token
+		app.setTokenInfo(token)
 	}
 }
 
+// setTokenInfo запоминает токен. Значения токенов маскируются в логе
+func (app *YaDProcessor) setTokenInfo(tokenInfo types.TokenInfo) {
+	app.logger.AddSecret(tokenInfo.AccessToken, tokenInfo.RefreshToken)
+	app.TokenInfo = tokenInfo
+}
+
 func (app *YaDProcessor) RefreshTokenIsNeed() bool {
 	if app.TokenInfo.Expiry.After(time.Now().Add(time.Duration(240) * time.Hour)) {
 		app.logger.DebugLog.Printf("Not need refresh token")
@@ -60,7 +116,8 @@ func (app *YaDProcessor) RefreshTokenIsNeed() bool {
 		app.logger.ErrorLog.Printf("Error when refresh token %v", err)
 		return false
 	}
-	app.logger.InfoLog.Printf("%+v", tokenInfo)
+	app.logger.AddSecret(tokenInfo.AccessToken, tokenInfo.RefreshToken)
+	app.logger.InfoLog.Printf("Token refreshed. Expiry %v", tokenInfo.Expiry)
 
 	err = writeToken(*tokenInfo)
 	if err != nil {
@@ -68,7 +125,7 @@ func (app *YaDProcessor) RefreshTokenIsNeed() bool {
 		return false
 	}
 
-	app.TokenInfo = *tokenInfo
+	app.setTokenInfo(*tokenInfo)
 	app.logger.InfoLog.Printf("Refresh token done")
 	app.EnsureYandexDisk()
 	return true
@@ -80,11 +137,12 @@ func (app *YaDProcessor) CreateToken(checkCode string) (types.TokenInfo, error)
 		app.logger.ErrorLog.Printf("Get token error. %v", err.Error())
 		return tokenInfo, err
 	}
+	app.logger.AddSecret(tokenInfo.AccessToken, tokenInfo.RefreshToken)
 	app.logger.DebugLog.Printf("Create token success")
 	err = writeToken(tokenInfo)
 	if err == nil {
 		app.logger.DebugLog.Printf("Write token success.")
-		app.TokenInfo = tokenInfo
+		app.setTokenInfo(tokenInfo)
 	} else {
 		app.logger.ErrorLog.Printf("Save token error. %v", err)
 	}
@@ -94,7 +152,7 @@ func (app *YaDProcessor) CreateToken(checkCode string) (types.TokenInfo, error)
 
 func (app *YaDProcessor) EnsureYandexDisk() {
 	if !isTokenEmpty(app.TokenInfo) {
-		disk, err := NewYandexDisk(app.TokenInfo.AccessToken)
+		disk, err := NewYandexDisk(app.applCtx, app.httpClient, app.TokenInfo.AccessToken)
 		if err != nil {
 			app.logger.ErrorLog.Printf("Error when create YaDisk %v", err)
 			return
@@ -115,58 +173,127 @@ func (app *YaDProcessor) IsTokenValid() bool {
 }
 
 func (app *YaDProcessor) GetRemoteFiles() ([]types.RemoteFileInfo, error) {
-	app.logger.InfoLog.Printf("%v", app.remotePath)
+	app.logger.DebugLog.Printf("Get remote files from %v", app.remotePath)
 	if app.yaDisk == nil {
 		return nil, fmt.Errorf("YandexDisk object is nil")
 	}
 	result := make([]types.RemoteFileInfo, 0)
 
-	resource, err := (*app.yaDisk).GetResource(app.remotePath,
-		[]string{"_embedded.items.type", "_embedded.items.name", "_embedded.items.size", "_embedded.items.modified"},
-		10000, 0, false, "0", "name")
+	err := app.walkRemoteFolder("", 0,
+		[]string{"_embedded.total", "_embedded.items.type", "_embedded.items.name", "_embedded.items.size", "_embedded.items.modified"},
+		func(relativeName string, item yadisk.Resource) {
+			modifiedTime, err := convertDateString(item.Modified)
+			if err != nil {
+				app.logger.ErrorLog.Printf("Can not parse data %s %v", item.Modified, err)
+				modifiedTime = minTime
+			}
+
+			result = append(result, types.RemoteFileInfo{Name: relativeName,
+				Size:     types.FileSize(item.Size),
+				Created:  types.FileModified(modifiedTime),
+				Modified: types.FileModified(modifiedTime)})
+		})
 	if err != nil {
 		app.logger.ErrorLog.Printf("Error when get remote files from path %s. %v", app.remotePath, err)
 		return result, err
 	}
 
-	app.logger.DebugLog.Printf("Found %d remote items", len(resource.Embedded.Items))
+	app.logger.DebugLog.Printf("Processing %d remote files", len(result))
+	return result, nil
 
-	for _, item := range resource.Embedded.Items {
-		if item.Type != itemTypeFile {
-			continue
-		}
+}
 
-		modifiedTime, err := convertDateString(item.Modified)
+// walkRemoteFolder обходит каталог remotePath/relativeDir постранично и спускается во вложенные каталоги
+// (не глубже RemoteListMaxDepth). Для каждого файла вызывается visit с именем относительно remotePath.
+func (app *YaDProcessor) walkRemoteFolder(relativeDir string, depth int, fields []string,
+	visit func(relativeName string, item yadisk.Resource)) error {
+	folder := joinRemotePath(app.remotePath, relativeDir)
+	subFolders := make([]string, 0)
+
+	offset := 0
+	for {
+		var resource *yadisk.Resource
+		err := app.callWithRetry("Get remote folder "+folder, func(disk yadisk.YaDisk) error {
+			var err error
+			resource, err = disk.GetResource(folder, fields, remoteListPageSize, offset, false, "0", "name")
+			return err
+		})
 		if err != nil {
-			app.logger.ErrorLog.Printf("Can not parse data %s %v", item.Modified, err)
-			modifiedTime = minTime
+			return err
 		}
 
-		result = append(result, types.RemoteFileInfo{Name: item.Name,
-			Size:     types.FileSize(item.Size),
-			Created:  types.FileModified(modifiedTime),
-			Modified: types.FileModified(modifiedTime)})
+		items := resource.Embedded.Items
+		app.logger.DebugLog.Printf("Found %d remote items in %s [offset %d, total %d]",
+			len(items), folder, offset, resource.Embedded.Total)
+
+		for _, item := range items {
+			switch item.Type {
+			case itemTypeFile:
+				visit(joinRemotePath(relativeDir, item.Name), item)
+			case itemTypeDir:
+				subFolders = append(subFolders, joinRemotePath(relativeDir, item.Name))
+			}
+		}
 
+		offset += len(items)
+		if len(items) == 0 || offset >= resource.Embedded.Total {
+			break
+		}
 	}
 
-	app.logger.DebugLog.Printf("Processing %d remote files", len(result))
-	return result, nil
+	if depth >= RemoteListMaxDepth {
+		if len(subFolders) > 0 {
+			app.logger.DebugLog.Printf("Skip %d sub folders of %s. Maximum depth %d reached", len(subFolders), folder, RemoteListMaxDepth)
+		}
+		return nil
+	}
 
+	for _, subFolder := range subFolders {
+		err := app.walkRemoteFolder(subFolder, depth+1, fields, visit)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (app *YaDProcessor) DownloadFile(sourceFileName, destination, id string) error {
+// ensureRemoteFolder создаёт (при необходимости) все уровни каталога remotePath/relativeDir
+func (app *YaDProcessor) ensureRemoteFolder(relativeDir string) error {
+	current := app.remotePath
+	for _, part := range strings.Split(relativeDir, "/") {
+		if part == "" || part == "." {
+			continue
+		}
+		current = joinRemotePath(current, part)
+		err := app.callWithRetry("Create remote folder "+current, func(disk yadisk.YaDisk) error {
+			_, err := disk.CreateResource(current, nil)
+			return err
+		})
+		if err != nil && !isFolderExistsError(err) {
+			return fmt.Errorf("error when create remote folder %s: %w", current, err)
+		}
+	}
+	return nil
+}
+
+func (app *YaDProcessor) DownloadFile(ctx context.Context, sourceFileName, destination, id string) error {
 	source := app.remotePath + "/" + sourceFileName
 	app.logger.DebugLog.Printf("Download file: %s to %s", source, destination)
 
-	link, err := (*app.yaDisk).GetResourceDownloadLink(source, nil)
+	var link *yadisk.Link
+	err := app.callWithRetry("Get download link "+source, func(disk yadisk.YaDisk) error {
+		var err error
+		link, err = disk.GetResourceDownloadLink(source, nil)
+		return err
+	})
 	if err != nil {
-		app.logger.ErrorLog.Printf("Error when get download link for file: %w", err)
+		app.logger.ErrorLog.Printf("Error when get download link for file: %v", err)
 		return fmt.Errorf("error when get download link for file: %w", err)
 	}
 
-	err = app.downloader.Download(link.Href, destination, id, "from YD")
+	err = app.downloader.Download(ctx, link.Href, destination, id, "from YD")
 	if err != nil {
-		app.logger.ErrorLog.Printf("Error when download file: %w", err)
+		app.logger.ErrorLog.Printf("Error when download file: %v", err)
 		return fmt.Errorf("error when download file: %w", err)
 	}
 	app.logger.DebugLog.Printf("File: %s downloaded to %s", source, destination)
@@ -174,39 +301,131 @@ func (app *YaDProcessor) DownloadFile(sourceFileName, destination, id string) er
 
 }
 
-func (app *YaDProcessor) UploadFile(source string, destinationFileName string) error {
-	return app.innerUpload(source, nil, 0, destinationFileName)
+// OpenRemoteFile открывает файл на ЯндексДиске для чтения потоком (с ограничением скорости скачивания).
+// Вызывающий должен закрыть поток
+func (app *YaDProcessor) OpenRemoteFile(ctx context.Context, remoteFileName string) (io.ReadCloser, error) {
+	if app.yaDisk == nil {
+		return nil, fmt.Errorf("YandexDisk object is nil")
+	}
+	source := app.remotePath + "/" + remoteFileName
+
+	var link *yadisk.Link
+	err := app.callWithRetry("Get download link "+source, func(disk yadisk.YaDisk) error {
+		var err error
+		link, err = disk.GetResourceDownloadLink(source, nil)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error when get download link for file: %w", err)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, link.Href, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := app.httpClient.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("error when download file %s: %w", source, err)
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, fmt.Errorf("error when download file %s: status %s", source, response.Status)
+	}
+
+	app.logger.DebugLog.Printf("Open remote file %s for reading", source)
+	return &limitedReadCloser{
+		Reader: throttle.NewReader(ctx, response.Body, app.downloadLimiter, nil),
+		Closer: response.Body,
+	}, nil
 }
-func (app *YaDProcessor) UploadDataFromSlug(haApi *haoperate.HaApiClient, slug string, destinationFileName string) error {
-	size, body, err := haApi.GetDownloadBackupBody(slug)
+
+// UploadFile загружает файл на ЯндексДиск. Возвращает sha256 загруженных данных
+func (app *YaDProcessor) UploadFile(ctx context.Context, source string, destinationFileName string, operationId string) (string, error) {
+	fileStat, err := os.Stat(source)
 	if err != nil {
-		app.logger.ErrorLog.Printf("Error when upload network file: %w", err)
-		return fmt.Errorf("error when upload network file: %w", err)
+		return "", fmt.Errorf("error when get file info %s: %w", source, err)
+	}
+	file, err := os.Open(source)
+	if err != nil {
+		return "", fmt.Errorf("error when open file %s: %w", source, err)
+	}
+	defer file.Close()
+
+	return app.innerUpload(ctx, file, fileStat.Size(), destinationFileName, operationId)
+}
+
+// UploadDataFromSlug загружает на ЯндексДиск бэкап HA. Возвращает sha256 загруженных данных
+func (app *YaDProcessor) UploadDataFromSlug(ctx context.Context, haApi *haoperate.HaApiClient, slug string, destinationFileName string, operationId string) (string, error) {
+	size, body, err := haApi.GetDownloadBackupBody(ctx, slug)
+	if err != nil {
+		app.logger.ErrorLog.Printf("Error when upload network file: %v", err)
+		return "", fmt.Errorf("error when upload network file: %w", err)
 	}
 	defer body.Close()
 
 	if size == 0 {
 		app.logger.ErrorLog.Printf("Can not upload network file with 0 size.")
-		return fmt.Errorf("ean not upload network file with 0 size")
+		return "", fmt.Errorf("ean not upload network file with 0 size")
 	}
 
-	var reader io.Reader = body
-
-	err = app.innerUpload("", &reader, size, destinationFileName)
+	sha256sum, err := app.innerUpload(ctx, body, size, destinationFileName, operationId)
 	if err != nil {
-		app.logger.ErrorLog.Printf("Error when upload network file %w", err)
-		return err
+		app.logger.ErrorLog.Printf("Error when upload network file %v", err)
+		return "", err
 	}
-	return nil
+	return sha256sum, nil
+
+}
+
+// WaitUploadWindow откладывает загрузку файла размером size до ближайшего разрешённого окна загрузки,
+// в которое загрузка успеет завершиться (с учётом ограничения скорости).
+func (app *YaDProcessor) WaitUploadWindow(ctx context.Context, size int64, operationId string) error {
+	if app.uploadWindow == nil {
+		return nil
+	}
+
+	now := time.Now()
+	estimate := app.uploadLimiter.Estimate(size)
+	startAt := app.uploadWindow.StartFor(now, estimate)
+	if !startAt.After(now) {
+		return nil
+	}
+
+	app.logger.InfoLog.Printf("Upload %s postponed until %s [upload window %s, estimated duration %v]",
+		operationId, startAt.Format(time.DateTime), app.uploadWindow, estimate)
+	app.operationManager.ChangeStatusAndProgress(operationId, "postponed until "+startAt.Format("15:04"), 0)
 
+	timer := time.NewTimer(time.Until(startAt))
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
 }
 
-func (app *YaDProcessor) innerUpload(source string, reader *io.Reader, size int64, destinationFileName string) error {
+// innerUpload загружает данные на ЯндексДиск и попутно считает их sha256 (uploader читает source последовательно)
+func (app *YaDProcessor) innerUpload(ctx context.Context, source io.Reader, size int64, destinationFileName string, operationId string) (string, error) {
 	destination := app.remotePath + "/" + destinationFileName
-	app.logger.DebugLog.Printf("Try upload %s into %s", source, destination)
-	link, err := (*app.yaDisk).GetResourceUploadLink(destination, nil, true)
-	if err != nil {
+	app.logger.DebugLog.Printf("Try upload into %s", destination)
+
+	if dir := path.Dir(destinationFileName); dir != "." {
+		err := app.ensureRemoteFolder(dir)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	var link *yadisk.ResourceUploadLink
+	err := app.callWithRetry("Get upload link "+destination, func(disk yadisk.YaDisk) error {
+		var err error
+		link, err = disk.GetResourceUploadLink(destination, nil, true)
 		return err
+	})
+	if err != nil {
+		return "", err
 	}
 	app.logger.DebugLog.Printf("Get href %s", link.Href)
 
@@ -218,39 +437,67 @@ func (app *YaDProcessor) innerUpload(source string, reader *io.Reader, size int6
 		ErrorLog: app.logger.ErrorLog,
 	}
 
-	var uploader *uploadbig.UploadData = nil
+	progress := newProgressReporter(app.operationManager, operationId, "uploading to YD", size)
+	hasher := sha256.New()
+	reader := throttle.NewReader(ctx, io.TeeReader(source, hasher), app.uploadLimiter, progress.report)
 
-	switch {
-	case source != "":
-		uploader = uploadbig.NewUploaderFromFile(types.PUT, link.Href, source, nil, httpClient, int(types.MiB), &logger)
-	case reader != nil:
-		uploader = uploadbig.NewUploaderFromReader(types.PUT, link.Href, reader, size, nil, httpClient, int(types.MiB), &logger)
-	default:
-		return fmt.Errorf("unsupported upload source")
-	}
+	uploader := uploadbig.NewUploaderFromReader(types.PUT, link.Href, &reader, size, nil, httpClient, int(types.MiB), &logger)
 
 	err = uploader.Init()
+	if err == nil && uploader.Status.TransferredException {
+		err = fmt.Errorf("error when upload file %s. Transferred %d of %d bytes",
+			destination, uploader.Status.SizeTransferred, uploader.Status.Size)
+	}
 	if err != nil {
-		return err
+		if ctx.Err() != nil {
+			app.removePartialUpload(destination)
+			return "", fmt.Errorf("upload file %s canceled: %w", destination, ctx.Err())
+		}
+		return "", err
 	}
 
-	app.logger.DebugLog.Printf("Success load file %s", source)
+	app.logger.DebugLog.Printf("Success load file %s", destination)
 
-	status, err := (*app.yaDisk).GetOperationStatus(link.OperationID, nil)
-	if err != nil {
+	var status *yadisk.OperationStatus
+	err = app.callWithRetry("Get operation status "+link.OperationID, func(disk yadisk.YaDisk) error {
+		var err error
+		status, err = disk.GetOperationStatus(link.OperationID, nil)
 		return err
+	})
+	if err != nil {
+		return "", err
 	}
 
 	app.logger.DebugLog.Printf("Status %s", status.Status)
 
-	return nil
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// removePartialUpload удаляет файл, загрузка которого была прервана, если ЯндексДиск успел его создать
+func (app *YaDProcessor) removePartialUpload(destination string) {
+	err := app.callOnce(func(disk yadisk.YaDisk) error {
+		_, err := disk.DeleteResource(destination, nil, false, "", true)
+		return err
+	})
+	if err != nil {
+		if isNotFoundError(err) {
+			app.logger.DebugLog.Printf("Partial file %s not found on YD", destination)
+			return
+		}
+		app.logger.ErrorLog.Printf("Error when remove partial file %s: %v", destination, err)
+		return
+	}
+	app.logger.InfoLog.Printf("Partial file %s removed from YD", destination)
 }
 
 func (app *YaDProcessor) DeleteFile(remoteFileName string, md5 string, permanently bool) error {
 	remoteName := app.remotePath + "/" + remoteFileName
 	app.logger.DebugLog.Printf("Try delete %s", remoteName)
 
-	_, err := (*app.yaDisk).DeleteResource(remoteName, nil, false, md5, permanently)
+	err := app.callOnce(func(disk yadisk.YaDisk) error {
+		_, err := disk.DeleteResource(remoteName, nil, false, md5, permanently)
+		return err
+	})
 	if err != nil {
 		return err
 	}
@@ -263,12 +510,37 @@ func (app *YaDProcessor) DeleteFile(remoteFileName string, md5 string, permanent
 	return nil
 }
 
+// GetRemoteFileHash размер и контрольные суммы файла, посчитанные ЯндексДиском при загрузке
+func (app *YaDProcessor) GetRemoteFileHash(remoteFileName string) (types.RemoteFileHash, error) {
+	if app.yaDisk == nil {
+		return types.RemoteFileHash{}, fmt.Errorf("YandexDisk object is nil")
+	}
+	remoteName := app.remotePath + "/" + remoteFileName
+
+	var resource *yadisk.Resource
+	err := app.callWithRetry("Get remote file info "+remoteName, func(disk yadisk.YaDisk) error {
+		var err error
+		resource, err = disk.GetResource(remoteName, []string{"size", "md5", "sha256"}, 0, 0, false, "0", "")
+		return err
+	})
+	if err != nil {
+		return types.RemoteFileHash{}, fmt.Errorf("error when get remote file info %s: %w", remoteName, err)
+	}
+
+	return types.RemoteFileHash{Size: types.FileSize(resource.Size), Md5: resource.Md5, Sha256: resource.Sha256}, nil
+}
+
 func (app *YaDProcessor) GetDiskInfo() (types.DiskInfo, error) {
 	if app.yaDisk == nil {
 		return types.DiskInfo{UsedSpace: 0, TotalSpace: 0}, fmt.Errorf("YandexDisk object is nil")
 	}
 
-	diskInfo, err := (*app.yaDisk).GetDisk([]string{"total_space", "used_space"})
+	var diskInfo *yadisk.Disk
+	err := app.callWithRetry("Get remote disk info", func(disk yadisk.YaDisk) error {
+		var err error
+		diskInfo, err = disk.GetDisk([]string{"total_space", "used_space"})
+		return err
+	})
 	if err != nil {
 		app.logger.ErrorLog.Printf("Error when get remote disk info. %v", err)
 		return types.DiskInfo{UsedSpace: 0, TotalSpace: 0}, fmt.Errorf("error get YandexDisk info")
@@ -286,28 +558,22 @@ func (app *YaDProcessor) GetFilesStatistic() (int, types.FileSize, error) {
 		return 0, 0, fmt.Errorf("YandexDisk object is nil")
 	}
 
-	resource, err := (*app.yaDisk).GetResource(app.remotePath,
-		[]string{"_embedded.total", "_embedded.items.size", "_embedded.items.type"},
-		10000, 0, false, "0", "name")
+	amount := 0
+	resultSize := types.FileSize(0)
+	err := app.walkRemoteFolder("", 0,
+		[]string{"_embedded.total", "_embedded.items.name", "_embedded.items.size", "_embedded.items.type"},
+		func(relativeName string, item yadisk.Resource) {
+			amount++
+			resultSize += types.FileSize(item.Size)
+		})
 	if err != nil {
 		app.logger.ErrorLog.Printf("Error when get amount  remote files from path %s. %v", app.remotePath, err)
 		return 0, 0, err
 	}
 
-	app.logger.DebugLog.Printf("Found %d remote items", len(resource.Embedded.Items))
-
-	resultSize := types.FileSize(0)
-	for _, item := range resource.Embedded.Items {
-		if item.Type != itemTypeFile {
-			continue
-		}
-
-		resultSize += types.FileSize(item.Size)
-	}
-
-	app.logger.DebugLog.Printf("Amount remote files: %d", resource.Embedded.Total)
+	app.logger.DebugLog.Printf("Amount remote files: %d", amount)
 
-	return resource.Embedded.Total, resultSize, nil
+	return amount, resultSize, nil
 
 }
 
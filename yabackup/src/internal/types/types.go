@@ -11,10 +11,18 @@ type TokenInfo struct {
 }
 
 type StorageStatistic struct {
-	FreeSpace  FileSize
-	FilesSize  FileSize
-	FileAmount int
+	FreeSpace  FileSize `json:"free_space"`
+	FilesSize  FileSize `json:"files_size"`
+	FileAmount int      `json:"file_amount"`
 }
+
+// RemoteFileHash размер и контрольные суммы файла на ЯндексДиске
+type RemoteFileHash struct {
+	Size   FileSize
+	Md5    string
+	Sha256 string
+}
+
 type DiskInfo struct {
 	TotalSpace FileSize
 	UsedSpace  FileSize